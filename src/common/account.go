@@ -0,0 +1,130 @@
+package common
+
+import (
+    "fmt"
+    "sync"
+    "time"
+    "errors"
+    "strconv"
+    "strings"
+    "net/http"
+)
+
+// AccountConfig is what the config says about one account of a site,
+// read in one go instead of option by option.
+type AccountConfig struct {
+    Site string
+    Name string
+    // Enabled is false for accounts left in the config but not logged in.
+    Enabled bool
+    // Cookies is the cookies string, or COOKIE_FILE and the cookies_file
+    // with its modification time; empty when logging in by password.
+    Cookies string
+    Username string
+    Password string
+    Proxy string
+    UserAgent string
+    Headers http.Header
+    Pace time.Duration
+    PaceJitter time.Duration
+}
+
+// Account reads and checks the config of account name of site. An
+// enabled account needs cookies, a cookies_file or a username and
+// password its site can log in with.
+func (cf *configFile2) Account(site, name string) (*AccountConfig, error) {
+    ac := &AccountConfig{Site:site, Name:name}
+
+    enabled, err := accountOption(site, name, "enabled", "true")
+    if err != nil {
+        return nil, err
+    }
+    if ac.Enabled, err = strconv.ParseBool(strings.TrimSpace(enabled)); err != nil {
+        return nil, errors.New(fmt.Sprintf("invalid enabled '%s' for account '%s'", enabled, name))
+    }
+
+    if ac.Cookies, err = cookieSource(cf, name); err != nil {
+        return nil, errors.New(fmt.Sprintf("cookies of account '%s': %s", name, err.Error()))
+    }
+    if ac.Username, err = cf.String(name, "username", ""); err != nil {
+        return nil, err
+    }
+    if ac.Password, err = cf.raw(name, "password"); err != nil {
+        return nil, err
+    }
+    if ac.Proxy, err = cf.String(name, "proxy", ""); err != nil {
+        return nil, err
+    }
+    ac.Proxy = strings.TrimSpace(ac.Proxy)
+
+    if ac.Headers, err = loadHeaders(site, name); err != nil {
+        return nil, err
+    }
+    ac.UserAgent = ac.Headers.Get("User-Agent")
+    if ac.Pace, ac.PaceJitter, err = loadAccountPace(site, name); err != nil {
+        return nil, err
+    }
+
+    if err = ac.validate(); err != nil {
+        return nil, err
+    }
+    return ac, nil
+}
+
+func (ac *AccountConfig) validate() error {
+    if ac.Proxy != "" {
+        if _, err := newProxy(ac.Proxy); err != nil {
+            return errors.New(fmt.Sprintf("account '%s': %s", ac.Name, err.Error()))
+        }
+    }
+    if !ac.Enabled {
+        return nil
+    }
+
+    if ac.Cookies != "" {
+        if strings.HasPrefix(ac.Cookies, COOKIE_FILE) {
+            return nil
+        }
+        if _, err := parseCookies(ac.Cookies); err != nil {
+            return errors.New(fmt.Sprintf("account '%s': cookies must be name=value pairs separated by ;", ac.Name))
+        }
+        return nil
+    }
+    if ac.Username != "" {
+        if fn, err := siteLogin(ac.Site); err != nil {
+            return err
+        } else if fn != nil {
+            return nil
+        }
+    }
+    return errors.New(fmt.Sprintf("Cookies not found in config of account '%s'.", ac.Name))
+}
+
+// EachAccount calls fn for every one of accounts, at most workers at once,
+// and returns once all calls did.
+func EachAccount(accounts []string, workers int, fn func(account string)) {
+    if workers > len(accounts) {
+        workers = len(accounts)
+    }
+    if workers < 1 {
+        workers = 1
+    }
+
+    var wg sync.WaitGroup
+    jobs := make(chan string)
+    for i := 0; i < workers; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for account := range(jobs) {
+                fn(account)
+            }
+        }()
+    }
+
+    for _, account := range(accounts) {
+        jobs <- account
+    }
+    close(jobs)
+    wg.Wait()
+}
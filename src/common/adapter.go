@@ -0,0 +1,162 @@
+package common
+
+import (
+    "fmt"
+    "sort"
+    "sync"
+    "context"
+    "net/url"
+)
+
+// Rows is the report data an adapter fetched. It marshals to the json the
+// api serves, and Table lays it out for csv and xlsx.
+type Rows interface {
+    Len() int
+    Table() (header []string, rows [][]string)
+}
+
+// RowWarning is a row of a report that did not parse: it was skipped, or
+// kept with Column left empty. Page and Row count from 1, Range is set
+// when the report was fetched in several ranges.
+type RowWarning struct {
+    Range string `json:"range,omitempty"`
+    Page int `json:"page"`
+    Row int `json:"row"`
+    Column string `json:"column,omitempty"`
+    Reason string `json:"reason"`
+    Skipped bool `json:"skipped"`
+}
+
+// Warned Rows are all a report had that parsed, with warnings for the
+// rest.
+type Warned interface {
+    Warnings() []RowWarning
+}
+
+// Totaled Rows also have the totals the site reported for them, which the
+// api serves next to the data. Totals is nil when the site had none.
+type Totaled interface {
+    Totals() interface{}
+}
+
+// Deduplicated Rows tell how many repeated rows of the site they left
+// out.
+type Deduplicated interface {
+    Duplicates() int
+}
+
+// A SiteAdapter connects one CPS network: it logs its accounts in and
+// fetches their reports.
+type SiteAdapter interface {
+    Name() string
+    Login() error
+    Fetch(ctx context.Context, account, startTime, endTime string) (Rows, error)
+    HealthCheck(account string) (Health, error)
+}
+
+// A StreamAdapter can also hand out rows while the report is still being
+// fetched.
+type StreamAdapter interface {
+    SiteAdapter
+    Stream(ctx context.Context, account, startTime, endTime string, fn func(interface{}) error) error
+}
+
+// A SummaryStreamer is a StreamAdapter whose streams end with what goes
+// next to the rows in a response: Rows of no items that are Totaled,
+// Deduplicated or Warned.
+type SummaryStreamer interface {
+    StreamAdapter
+    StreamSummary(ctx context.Context, account, startTime, endTime string, fn func(interface{}) error) (Rows, error)
+}
+
+// AccountFetch fetches the report of one account as json, the way the
+// server does for a request.
+type AccountFetch func(ctx context.Context, account, startTime, endTime string) ([]byte, error)
+
+// A BatchAdapter fetches many accounts at once, at most workers at a
+// time, each with fetch. It returns the error of each account, nil for
+// those fetched. Sites without one are fetched by EachAccount.
+type BatchAdapter interface {
+    SiteAdapter
+    FetchAll(ctx context.Context, accounts []string, startTime, endTime string, workers int, fetch AccountFetch) map[string]error
+}
+
+// A FilterAdapter takes filters from the query of a request, eg.
+// /taoke?state=settled. keep tells the rows and streamed items to serve,
+// it is nil when the query has no filters.
+type FilterAdapter interface {
+    SiteAdapter
+    Filter(query url.Values) (keep func(interface{}) bool, err error)
+}
+
+// Filterable Rows can leave out the rows keep does not want; what goes
+// next to them stays that of the whole report.
+type Filterable interface {
+    Keep(keep func(interface{}) bool) Rows
+}
+
+// A SyncAdapter can fetch only the orders of an account that are newer
+// than those the last sync returned. It remembers them across restarts.
+type SyncAdapter interface {
+    SiteAdapter
+    Sync(ctx context.Context, account string) (Rows, error)
+}
+
+// A ReportAdapter has more reports than the one Fetch gets, each served
+// at /<site>/<report>.
+type ReportAdapter interface {
+    SiteAdapter
+    Reports() []string
+    Report(ctx context.Context, report, account, startTime, endTime string) (Rows, error)
+}
+
+var adapters map[string]SiteAdapter = make(map[string]SiteAdapter)
+var adapterLock sync.RWMutex
+
+// RegisterAdapter makes a available to main; adapters call it from init.
+func RegisterAdapter(a SiteAdapter) {
+    adapterLock.Lock()
+    defer adapterLock.Unlock()
+    if _, ok := adapters[a.Name()]; ok {
+        panic(fmt.Sprintf("site adapter '%s' registered twice", a.Name()))
+    }
+    adapters[a.Name()] = a
+}
+
+func Adapter(site string) (SiteAdapter, bool) {
+    adapterLock.RLock()
+    defer adapterLock.RUnlock()
+    a, ok := adapters[site]
+    return a, ok
+}
+
+// Adapters returns the registered adapters ordered by name.
+func Adapters() []SiteAdapter {
+    adapterLock.RLock()
+    defer adapterLock.RUnlock()
+    list := make([]SiteAdapter, 0, len(adapters))
+    for _, a := range(adapters) {
+        list = append(list, a)
+    }
+    sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+    return list
+}
+
+// SiteNames returns the names of the registered adapters, sorted.
+func SiteNames() []string {
+    names := []string{}
+    for _, a := range(Adapters()) {
+        names = append(names, a.Name())
+    }
+    return names
+}
+
+// SiteURL returns option of site's config section, an upstream address,
+// or def when it is not set.
+func SiteURL(site, option, def string) string {
+    u, err := Conf.String(site, option, def)
+    if err != nil || u == "" {
+        return def
+    }
+    return u
+}
@@ -0,0 +1,73 @@
+package common
+
+import (
+    "sync"
+    "time"
+    log "code.google.com/p/log4go"
+)
+
+// Alert is raised when something needs an operator, eg. a session died.
+// LastGood is when the account last worked, if ever.
+type Alert struct {
+    Kind string `json:"kind"`
+    Site string `json:"site"`
+    Account string `json:"account"`
+    Msg string `json:"msg"`
+    Time time.Time `json:"time"`
+    LastGood *time.Time `json:"last_good,omitempty"`
+}
+
+var alertHandlers []func(Alert)
+var alertLock sync.RWMutex
+
+// alerted is when each kind of alert was last sent per account.
+var alerted map[string]time.Time = make(map[string]time.Time)
+
+// AddAlertHandler makes fn receive every alert, in its own goroutine.
+func AddAlertHandler(fn func(Alert)) {
+    alertLock.Lock()
+    defer alertLock.Unlock()
+    alertHandlers = append(alertHandlers, fn)
+}
+
+// alert hands a to the handlers, unless the same kind of alert went out
+// for the account less than [alert] interval seconds ago.
+func alert(a Alert) {
+    interval, err := Conf.Duration("alert", "interval", time.Hour)
+    if err != nil {
+        log.Warn(err)
+    }
+    key := a.Kind + " " + a.Site + " " + a.Account
+
+    alertLock.Lock()
+    defer alertLock.Unlock()
+
+    if last, ok := alerted[key]; ok && a.Time.Sub(last) < interval {
+        log.Info("alert %s %s account %s suppressed, last sent %s", a.Kind, a.Site, a.Account, last.Format(time.RFC3339))
+        return
+    }
+    alerted[key] = a.Time
+
+    log.Warn("ALERT %s %s account %s: %s", a.Kind, a.Site, a.Account, a.Msg)
+    for _, fn := range(alertHandlers) {
+        go fn(a)
+    }
+}
+
+// loginChecks tell, per site, whether a page is the login page.
+var loginChecks map[string]func([]byte) bool = make(map[string]func([]byte) bool)
+
+// RegisterLoginCheck makes keepalive of site treat pages fn matches as an
+// expired session.
+func RegisterLoginCheck(site string, fn func([]byte) bool) {
+    clientLock.Lock()
+    defer clientLock.Unlock()
+    loginChecks[site] = fn
+}
+
+func isLoginPage(site string, body []byte) bool {
+    clientLock.RLock()
+    fn, ok := loginChecks[site]
+    clientLock.RUnlock()
+    return ok && fn(body)
+}
@@ -0,0 +1,434 @@
+package common
+
+import (
+    "os"
+    "fmt"
+    "time"
+    "bufio"
+    "errors"
+    "context"
+    "strings"
+    "os/exec"
+    "net/url"
+    "net/http"
+    "io/ioutil"
+    "encoding/json"
+    "github.com/cookiejar"
+    log "code.google.com/p/log4go"
+)
+
+// A LoginBackend logs a site in as username some other way than the
+// site's own PasswordLogin and returns the session cookies.
+type LoginBackend interface {
+    Login(ctx context.Context, site, username, password string) ([]cookiejar.Cookie, error)
+}
+
+var loginBackends map[string]LoginBackend = map[string]LoginBackend{"browser":&BrowserLogin{}}
+
+// RegisterLoginBackend makes b usable as login_backend=name.
+func RegisterLoginBackend(name string, b LoginBackend) {
+    clientLock.Lock()
+    defer clientLock.Unlock()
+    loginBackends[name] = b
+}
+
+// siteLogin returns how accounts of site log in with a password: through
+// the configured login_backend, or else the site's own PasswordLogin.
+func siteLogin(site string) (PasswordLogin, error) {
+    name, err := Conf.String(site, "login_backend", "")
+    if err != nil {
+        return nil, err
+    }
+
+    clientLock.RLock()
+    defer clientLock.RUnlock()
+    if name == "" {
+        return passwordLogins[site], nil
+    }
+
+    b, ok := loginBackends[name]
+    if !ok {
+        return nil, errors.New(fmt.Sprintf("unknown login_backend '%s' of site '%s'", name, site))
+    }
+    return func(ctx context.Context, client *http.Client, username, password string) error {
+        cookies, err := b.Login(ctx, site, username, password)
+        if err != nil {
+            return err
+        }
+        jar, ok := client.Jar.(*cookiejar.Jar)
+        if !ok {
+            return errors.New("client has no cookiejar")
+        }
+        jar.Add(cookies)
+        return nil
+    }, nil
+}
+
+// A BrowserForm tells the browser backend where a site's login form is.
+// Username, Password and Submit are CSS selectors; the login is done once
+// the page's URL starts with Done.
+type BrowserForm struct {
+    URL string
+    Username string
+    Password string
+    Submit string
+    Done string
+}
+
+var browserForms map[string]BrowserForm = make(map[string]BrowserForm)
+
+// RegisterBrowserForm sets the login form of site, which the browser_*
+// options of the site can still override.
+func RegisterBrowserForm(site string, form BrowserForm) {
+    clientLock.Lock()
+    defer clientLock.Unlock()
+    browserForms[site] = form
+}
+
+func browserForm(site string) (BrowserForm, error) {
+    clientLock.RLock()
+    form := browserForms[site]
+    clientLock.RUnlock()
+
+    var err error
+    options := []struct{ name string; value *string }{
+        {"browser_login_url", &form.URL},
+        {"browser_username", &form.Username},
+        {"browser_password", &form.Password},
+        {"browser_submit", &form.Submit},
+        {"browser_done", &form.Done},
+    }
+    for _, o := range(options) {
+        if *o.value, err = Conf.String(site, o.name, *o.value); err != nil {
+            return form, err
+        }
+        if *o.value == "" {
+            return form, errors.New(fmt.Sprintf("site '%s' has no %s", site, o.name))
+        }
+    }
+    return form, nil
+}
+
+// BrowserLogin drives a headless Chrome through the DevTools protocol: it
+// fills in the site's login form like a person would and takes the
+// cookies the browser ends up with. [browser] chrome is the binary to
+// start; devtools, when set, is the http address of a Chrome that is
+// already running with --remote-debugging-port.
+type BrowserLogin struct {
+}
+
+func (b *BrowserLogin) Login(ctx context.Context, site, username, password string) ([]cookiejar.Cookie, error) {
+    form, err := browserForm(site)
+    if err != nil {
+        return nil, err
+    }
+
+    base, err := Conf.String("browser", "devtools", "")
+    if err != nil {
+        return nil, err
+    }
+    if base == "" {
+        var stop func()
+        if base, stop, err = startChrome(ctx); err != nil {
+            return nil, err
+        }
+        defer stop()
+    }
+
+    page, closePage, err := newPage(ctx, base)
+    if err != nil {
+        return nil, err
+    }
+    defer closePage()
+
+    dt, err := dialDevtools(ctx, page)
+    if err != nil {
+        return nil, err
+    }
+    defer dt.close()
+
+    if err = dt.call("Page.navigate", map[string]string{"url":form.URL}, nil); err != nil {
+        return nil, err
+    }
+
+    /* the form may be built by scripts after the page loads */
+    if err = dt.waitFor(ctx, fmt.Sprintf("!!document.querySelector(%s) && !!document.querySelector(%s)", jsString(form.Username), jsString(form.Password))); err != nil {
+        return nil, errors.New(fmt.Sprintf("login form of %s not found: %s", site, err.Error()))
+    }
+
+    fill := `(function(sel, value) {
+        var e = document.querySelector(sel);
+        e.focus();
+        e.value = value;
+        e.dispatchEvent(new Event("input", {bubbles: true}));
+        e.dispatchEvent(new Event("change", {bubbles: true}));
+    })`
+    script := fmt.Sprintf("%s(%s, %s); %s(%s, %s); document.querySelector(%s).click(); true",
+        fill, jsString(form.Username), jsString(username),
+        fill, jsString(form.Password), jsString(password),
+        jsString(form.Submit))
+    if _, err = dt.evaluate(script); err != nil {
+        return nil, err
+    }
+
+    if err = dt.waitFor(ctx, fmt.Sprintf("location.href.indexOf(%s) == 0", jsString(form.Done))); err != nil {
+        return nil, errors.New(fmt.Sprintf("browser login of %s did not reach %s: %s", site, form.Done, err.Error()))
+    }
+
+    var result struct {
+        Cookies []devtoolsCookie `json:"cookies"`
+    }
+    if err = dt.call("Network.getAllCookies", nil, &result); err != nil {
+        return nil, err
+    }
+
+    cookies := make([]cookiejar.Cookie, 0, len(result.Cookies))
+    for _, c := range(result.Cookies) {
+        cookies = append(cookies, c.jarCookie())
+    }
+    log.Info("Browser login of %s as %s got %d cookies.", site, username, len(cookies))
+
+    return cookies, nil
+}
+
+type devtoolsCookie struct {
+    Name string `json:"name"`
+    Value string `json:"value"`
+    Domain string `json:"domain"`
+    Path string `json:"path"`
+    Expires float64 `json:"expires"`
+    HttpOnly bool `json:"httpOnly"`
+    Secure bool `json:"secure"`
+    Session bool `json:"session"`
+}
+
+func (c devtoolsCookie) jarCookie() cookiejar.Cookie {
+    jc := cookiejar.Cookie{
+        Name:c.Name,
+        Value:c.Value,
+        Domain:strings.ToLower(strings.TrimPrefix(c.Domain, ".")),
+        Path:c.Path,
+        Secure:c.Secure,
+        HostOnly:!strings.HasPrefix(c.Domain, "."),
+        HttpOnly:c.HttpOnly,
+    }
+    if jc.Path == "" {
+        jc.Path = "/"
+    }
+    if !c.Session && c.Expires > 0 {
+        jc.Expires = time.Unix(int64(c.Expires), 0)
+    }
+    return jc
+}
+
+func jsString(s string) string {
+    b, _ := json.Marshal(s)
+    return string(b)
+}
+
+// startChrome starts a headless Chrome with a throwaway profile and
+// returns the http address of its DevTools.
+func startChrome(ctx context.Context) (string, func(), error) {
+    chrome, err := Conf.String("browser", "chrome", "google-chrome")
+    if err != nil {
+        return "", nil, err
+    }
+
+    profile, err := ioutil.TempDir("", "taoke-chrome")
+    if err != nil {
+        return "", nil, err
+    }
+
+    cmd := exec.Command(chrome, "--headless", "--disable-gpu", "--no-first-run", "--no-default-browser-check",
+        "--remote-debugging-port=0", "--user-data-dir=" + profile, "--user-agent=" + USER_AGENT, "about:blank")
+    stderr, err := cmd.StderrPipe()
+    if err != nil {
+        os.RemoveAll(profile)
+        return "", nil, err
+    }
+    if err = cmd.Start(); err != nil {
+        os.RemoveAll(profile)
+        return "", nil, err
+    }
+    stop := func() {
+        cmd.Process.Kill()
+        cmd.Wait()
+        os.RemoveAll(profile)
+    }
+
+    /* chrome prints "DevTools listening on ws://127.0.0.1:port/devtools/browser/id" */
+    found := make(chan string, 1)
+    go func() {
+        scanner := bufio.NewScanner(stderr)
+        for scanner.Scan() {
+            line := scanner.Text()
+            if i := strings.Index(line, "DevTools listening on "); i >= 0 {
+                found <- strings.TrimSpace(line[i + len("DevTools listening on "):])
+                break
+            }
+        }
+        close(found)
+        ioutil.ReadAll(stderr)
+    }()
+
+    select {
+    case ws, ok := <-found:
+        if !ok {
+            stop()
+            return "", nil, errors.New(fmt.Sprintf("%s exited without starting DevTools", chrome))
+        }
+        u, err := url.Parse(ws)
+        if err != nil {
+            stop()
+            return "", nil, err
+        }
+        return "http://" + u.Host, stop, nil
+    case <-ctx.Done():
+        stop()
+        return "", nil, ctx.Err()
+    }
+}
+
+// newPage opens a blank tab and returns its DevTools websocket url.
+func newPage(ctx context.Context, base string) (string, func(), error) {
+    var target struct {
+        Id string `json:"id"`
+        WebSocketDebuggerUrl string `json:"webSocketDebuggerUrl"`
+    }
+    if err := devtoolsHTTP(ctx, "PUT", base + "/json/new?about:blank", &target); err != nil {
+        return "", nil, err
+    }
+    if target.WebSocketDebuggerUrl == "" {
+        return "", nil, errors.New(fmt.Sprintf("%s did not open a page", base))
+    }
+
+    closePage := func() {
+        c, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+        defer cancel()
+        devtoolsHTTP(c, "GET", base + "/json/close/" + target.Id, nil)
+    }
+    return target.WebSocketDebuggerUrl, closePage, nil
+}
+
+func devtoolsHTTP(ctx context.Context, method, u string, v interface{}) error {
+    req, err := http.NewRequestWithContext(ctx, method, u, nil)
+    if err != nil {
+        return err
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return err
+    }
+    if resp.StatusCode != http.StatusOK {
+        return errors.New(fmt.Sprintf("devtools %s: %s", u, resp.Status))
+    }
+    if v == nil {
+        return nil
+    }
+    return json.Unmarshal(body, v)
+}
+
+// devtools is a DevTools protocol session with one page. Calls are made
+// one at a time; events that arrive in between are dropped.
+type devtools struct {
+    ws *wsConn
+    id int
+}
+
+func dialDevtools(ctx context.Context, page string) (*devtools, error) {
+    ws, err := dialWebsocket(ctx, page)
+    if err != nil {
+        return nil, err
+    }
+    return &devtools{ws, 0}, nil
+}
+
+func (d *devtools) call(method string, params interface{}, result interface{}) error {
+    d.id++
+    msg := map[string]interface{}{"id":d.id, "method":method}
+    if params != nil {
+        msg["params"] = params
+    }
+    b, err := json.Marshal(msg)
+    if err != nil {
+        return err
+    }
+    if err = d.ws.WriteText(b); err != nil {
+        return err
+    }
+
+    for {
+        b, err = d.ws.ReadMessage()
+        if err != nil {
+            return err
+        }
+
+        var resp struct {
+            Id int `json:"id"`
+            Result json.RawMessage `json:"result"`
+            Error *struct {
+                Message string `json:"message"`
+            } `json:"error"`
+        }
+        if err = json.Unmarshal(b, &resp); err != nil {
+            return err
+        }
+        if resp.Id != d.id {
+            continue
+        }
+
+        if resp.Error != nil {
+            return errors.New(fmt.Sprintf("%s: %s", method, resp.Error.Message))
+        }
+        if result == nil {
+            return nil
+        }
+        return json.Unmarshal(resp.Result, result)
+    }
+}
+
+// evaluate runs expression in the page and returns its value.
+func (d *devtools) evaluate(expression string) (interface{}, error) {
+    var result struct {
+        Result struct {
+            Value interface{} `json:"value"`
+        } `json:"result"`
+        ExceptionDetails *struct {
+            Text string `json:"text"`
+        } `json:"exceptionDetails"`
+    }
+    params := map[string]interface{}{"expression":expression, "returnByValue":true}
+    if err := d.call("Runtime.evaluate", params, &result); err != nil {
+        return nil, err
+    }
+    if result.ExceptionDetails != nil {
+        return nil, errors.New(result.ExceptionDetails.Text)
+    }
+    return result.Result.Value, nil
+}
+
+// waitFor evaluates expression every half second until it is true.
+func (d *devtools) waitFor(ctx context.Context, expression string) error {
+    for {
+        /* errors while the page is navigating are expected */
+        if v, err := d.evaluate(expression); err == nil && v == true {
+            return nil
+        }
+
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-time.After(500 * time.Millisecond):
+        }
+    }
+}
+
+func (d *devtools) close() {
+    d.ws.Close()
+}
@@ -0,0 +1,141 @@
+package common
+
+import (
+    "strings"
+    "testing"
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "encoding/json"
+)
+
+// fakeDevtools answers the DevTools calls of BrowserLogin for one page.
+// The page is on the done url once the form was submitted.
+type fakeDevtools struct {
+    srv *httptest.Server
+    methods []string
+    script string
+    closed bool
+}
+
+func newFakeDevtools() *fakeDevtools {
+    f := &fakeDevtools{}
+    mux := http.NewServeMux()
+    mux.HandleFunc("/json/new", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != "PUT" {
+            http.Error(w, "use PUT", http.StatusMethodNotAllowed)
+            return
+        }
+        json.NewEncoder(w).Encode(map[string]string{"id":"p1", "webSocketDebuggerUrl":"ws" + strings.TrimPrefix(f.srv.URL, "http") + "/devtools/page/p1"})
+    })
+    mux.HandleFunc("/json/close/p1", func(w http.ResponseWriter, r *http.Request) {
+        f.closed = true
+    })
+    mux.HandleFunc("/devtools/page/p1", func(w http.ResponseWriter, r *http.Request) {
+        c, err := upgrade(w, r, false)
+        if err != nil {
+            return
+        }
+        defer c.conn.Close()
+        f.serve(c)
+    })
+    f.srv = httptest.NewServer(mux)
+    return f
+}
+
+func (f *fakeDevtools) serve(c *wsConn) {
+    submitted := false
+    for {
+        b, err := c.ReadMessage()
+        if err != nil {
+            return
+        }
+        var call struct {
+            Id int `json:"id"`
+            Method string `json:"method"`
+            Params struct {
+                Expression string `json:"expression"`
+            } `json:"params"`
+        }
+        json.Unmarshal(b, &call)
+        f.methods = append(f.methods, call.Method)
+
+        var result interface{} = map[string]interface{}{}
+        switch call.Method {
+        case "Runtime.evaluate":
+            e := call.Params.Expression
+            value := true
+            if strings.Contains(e, ".click()") {
+                f.script = e
+                submitted = true
+            } else if strings.HasPrefix(e, "location.href") {
+                value = submitted
+            }
+            result = map[string]interface{}{"result":map[string]interface{}{"value":value}}
+        case "Network.getAllCookies":
+            result = map[string]interface{}{"cookies":[]devtoolsCookie{
+                {Name:"t", Value:"1", Domain:".taobao.com", Path:"/", Expires:2000000000},
+                {Name:"s", Value:"2", Domain:"login.taobao.com", Session:true, HttpOnly:true, Secure:true},
+            }}
+        }
+        // an event first, which call skips.
+        c.WriteText([]byte(`{"method":"Page.loadEventFired","params":{}}`))
+        b, _ = json.Marshal(map[string]interface{}{"id":call.Id, "result":result})
+        c.WriteText(b)
+    }
+}
+
+func TestBrowserLogin(t *testing.T) {
+    f := newFakeDevtools()
+    defer f.srv.Close()
+
+    RegisterBrowserForm("testsite", BrowserForm{
+        URL:"https://login.example.com/",
+        Username:"#user",
+        Password:"#pass",
+        Submit:"#submit",
+        Done:"https://www.example.com/",
+    })
+    conf := "[browser]\ndevtools=" + f.srv.URL + "\n[testsite]\nbrowser_submit=button[type=\"submit\"]\n"
+    if err := LoadFromString(conf); err != nil {
+        t.Fatal(err)
+    }
+
+    cookies, err := (&BrowserLogin{}).Login(context.Background(), "testsite", "alice", `pa"ss`)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if want := "Page.navigate,Runtime.evaluate,Runtime.evaluate,Runtime.evaluate,Network.getAllCookies"; strings.Join(f.methods, ",") != want {
+        t.Errorf("calls %v, want %s", f.methods, want)
+    }
+    for _, s := range([]string{`"#user", "alice"`, `"#pass", "pa\"ss"`, `document.querySelector("button[type=\"submit\"]").click()`}) {
+        if !strings.Contains(f.script, s) {
+            t.Errorf("login script has no %s: %s", s, f.script)
+        }
+    }
+    if !f.closed {
+        t.Errorf("page not closed")
+    }
+
+    if len(cookies) != 2 {
+        t.Fatalf("%d cookies, want 2", len(cookies))
+    }
+    c := cookies[0]
+    if c.Name != "t" || c.Domain != "taobao.com" || c.HostOnly || c.Expires.Unix() != 2000000000 {
+        t.Errorf("domain cookie %+v", c)
+    }
+    c = cookies[1]
+    if c.Name != "s" || c.Domain != "login.taobao.com" || !c.HostOnly || !c.Expires.IsZero() || c.Path != "/" || !c.HttpOnly || !c.Secure {
+        t.Errorf("session cookie %+v", c)
+    }
+}
+
+func TestBrowserForm(t *testing.T) {
+    if err := LoadFromString("[other]\nbrowser_login_url=https://a/\n"); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := browserForm("other"); err == nil || !strings.Contains(err.Error(), "browser_username") {
+        t.Errorf("incomplete form gave %v", err)
+    }
+}
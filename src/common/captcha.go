@@ -0,0 +1,166 @@
+package common
+
+import (
+    "os"
+    "fmt"
+    "time"
+    "bytes"
+    "context"
+    "errors"
+    "strings"
+    "io/ioutil"
+    "net/http"
+    "path/filepath"
+    "encoding/json"
+    log "code.google.com/p/log4go"
+)
+
+var ErrCaptcha = errors.New("captcha not solved.")
+
+// A CaptchaSolver reads the text of a captcha image.
+type CaptchaSolver interface {
+    Solve(ctx context.Context, image []byte) (string, error)
+}
+
+// ManualSolver writes the image to Dir as <id>.img and waits for somebody
+// to write the answer to <id>.txt.
+type ManualSolver struct {
+    Dir string
+    Poll time.Duration
+}
+
+func (s *ManualSolver) Solve(ctx context.Context, image []byte) (string, error) {
+    if err := os.MkdirAll(s.Dir, 0700); err != nil {
+        return "", err
+    }
+
+    id := fmt.Sprintf("%d", time.Now().UnixNano())
+    file := filepath.Join(s.Dir, id + ".img")
+    answer := filepath.Join(s.Dir, id + ".txt")
+    if err := ioutil.WriteFile(file, image, 0600); err != nil {
+        return "", err
+    }
+    defer os.Remove(file)
+    defer os.Remove(answer)
+
+    log.Warn("Captcha waiting for answer, see %s, write the text to %s.", file, answer)
+
+    for {
+        b, err := ioutil.ReadFile(answer)
+        if err == nil && len(bytes.TrimSpace(b)) > 0 {
+            return strings.TrimSpace(string(b)), nil
+        }
+
+        select {
+        case <-ctx.Done():
+            return "", ctx.Err()
+        case <-time.After(s.Poll):
+        }
+    }
+}
+
+// HTTPSolver posts the image to an external solver service, which answers
+// {"text":"..."} or {"error":"..."}.
+type HTTPSolver struct {
+    URL string
+    Key string
+}
+
+func (s *HTTPSolver) Solve(ctx context.Context, image []byte) (string, error) {
+    req, err := http.NewRequestWithContext(ctx, "POST", s.URL, bytes.NewReader(image))
+    if err != nil {
+        return "", err
+    }
+    req.Header.Set("Content-Type", "application/octet-stream")
+    if s.Key != "" {
+        req.Header.Set("Authorization", "Bearer " + s.Key)
+    }
+
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        return "", err
+    }
+    defer resp.Body.Close()
+
+    var res struct {
+        Text string `json:"text"`
+        Error string `json:"error"`
+    }
+    if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+        return "", errors.New(fmt.Sprintf("captcha solver status %d: %s", resp.StatusCode, err.Error()))
+    }
+    if res.Error != "" || res.Text == "" {
+        return "", errors.New(fmt.Sprintf("captcha solver failed: %s", res.Error))
+    }
+    return res.Text, nil
+}
+
+// Captcha returns the solver configured in [captcha], or nil when none is.
+func Captcha() (CaptchaSolver, error) {
+    kind, err := Conf.String("captcha", "solver", "")
+    if err != nil {
+        return nil, err
+    }
+
+    switch kind {
+    case "":
+        return nil, nil
+    case "manual":
+        dir, err := Conf.String("captcha", "dir", "captcha")
+        if err != nil {
+            return nil, err
+        }
+        return &ManualSolver{dir, time.Second}, nil
+    case "http":
+        u, err := Conf.String("captcha", "url", "")
+        if err != nil {
+            return nil, err
+        }
+        if u == "" {
+            return nil, errors.New("captcha url not found in config.")
+        }
+        key, err := Conf.raw("captcha", "key")
+        if err != nil {
+            return nil, err
+        }
+        return &HTTPSolver{u, key}, nil
+    }
+
+    return nil, errors.New(fmt.Sprintf("unknown captcha solver '%s'", kind))
+}
+
+// SolveCaptcha downloads the captcha at imageURL with client, so that it
+// belongs to client's session, and solves it with the configured solver.
+func SolveCaptcha(ctx context.Context, client *http.Client, imageURL string) (string, error) {
+    solver, err := Captcha()
+    if err != nil {
+        return "", err
+    }
+    if solver == nil {
+        return "", ErrCaptcha
+    }
+
+    timeout, err := Conf.Duration("captcha", "timeout", 300 * time.Second)
+    if err != nil {
+        return "", err
+    }
+    ctx, cancel := context.WithTimeout(ctx, timeout)
+    defer cancel()
+
+    req, err := http.NewRequestWithContext(ctx, "GET", imageURL, nil)
+    if err != nil {
+        return "", err
+    }
+    req.Header.Set("User-Agent", USER_AGENT)
+    resp, err := client.Do(req)
+    if err != nil {
+        return "", err
+    }
+    image, err := ioutil.ReadAll(resp.Body)
+    resp.Body.Close()
+    if err != nil {
+        return "", err
+    }
+
+    return solver.Solve(ctx, image)
+}
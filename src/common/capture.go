@@ -0,0 +1,99 @@
+package common
+
+import (
+    "os"
+    "fmt"
+    "sync"
+    "time"
+    "context"
+    "io/ioutil"
+    "path/filepath"
+    log "code.google.com/p/log4go"
+)
+
+// CAPTURE_PAGES is how many pages a capture keeps by default, the last
+// ones, the page that failed is the last.
+const CAPTURE_PAGES = 5
+
+// CapturedPage is an upstream answer as it came, before decoding. Body
+// marshals as base64.
+type CapturedPage struct {
+    Site string `json:"site"`
+    Account string `json:"account"`
+    URL string `json:"url"`
+    Status int `json:"status"`
+    Body []byte `json:"body"`
+}
+
+// Capture collects the pages fetched with its context.
+type Capture struct {
+    lock sync.Mutex
+    max int
+    pages []CapturedPage
+}
+
+type captureKey struct{}
+
+// WithCapture returns a context whose fetches are kept by the returned
+// Capture, up to debug_pages of [debug].
+func WithCapture(ctx context.Context) (context.Context, *Capture) {
+    max, err := Conf.Int("debug", "debug_pages", CAPTURE_PAGES)
+    if err != nil || max <= 0 {
+        max = CAPTURE_PAGES
+    }
+    c := &Capture{max:max}
+    return context.WithValue(ctx, captureKey{}, c), c
+}
+
+// Capturing tells whether the fetches of ctx are captured, they should
+// not be served from a cache then.
+func Capturing(ctx context.Context) bool {
+    _, ok := ctx.Value(captureKey{}).(*Capture)
+    return ok
+}
+
+func capturePage(ctx context.Context, site, account string, req Request, resp *Response) {
+    c, ok := ctx.Value(captureKey{}).(*Capture)
+    if !ok {
+        return
+    }
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if len(c.pages) == c.max {
+        c.pages = c.pages[1:]
+    }
+    c.pages = append(c.pages, CapturedPage{site, account, req.URL, resp.Status, resp.Body})
+}
+
+// Pages returns the captured pages, oldest first.
+func (c *Capture) Pages() []CapturedPage {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return append([]CapturedPage(nil), c.pages...)
+}
+
+// Dump writes the captured pages to dump_dir of [debug], one file each,
+// and returns their paths. It does nothing without a dump_dir.
+func (c *Capture) Dump() ([]string, error) {
+    dir, err := Conf.String("debug", "dump_dir", "")
+    if err != nil || dir == "" {
+        return nil, err
+    }
+    if err = os.MkdirAll(dir, 0700); err != nil {
+        return nil, err
+    }
+    stamp := time.Now().Format("20060102-150405")
+    var files []string
+    for i, p := range(c.Pages()) {
+        file := filepath.Join(dir, fmt.Sprintf("%s-%s-%s-%d.html", stamp, p.Site, p.Account, i + 1))
+        // the pages hold what the account sees, keep them to the owner.
+        if err = ioutil.WriteFile(file, p.Body, 0600); err != nil {
+            return files, err
+        }
+        files = append(files, file)
+    }
+    if len(files) > 0 {
+        log.Info("dumped %d pages to %s", len(files), dir)
+    }
+    return files, nil
+}
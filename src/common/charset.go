@@ -0,0 +1,134 @@
+package common
+
+import (
+    "io"
+    "bytes"
+    "bufio"
+    "strings"
+    "io/ioutil"
+    "unicode/utf8"
+    "github.com/mahonia"
+)
+
+// charsetAliases maps the names sites use to the mahonia decoder names.
+// GB18030 is a superset of GBK and GB2312, and sites labelled with either
+// send its four byte characters in shop names, so all of them decode as
+// GB18030, as browsers do.
+var charsetAliases = map[string]string{
+    "gbk": "gb18030",
+    "x-gbk": "gb18030",
+    "cp936": "gb18030",
+    "windows-936": "gb18030",
+    "gb2312": "gb18030",
+    "gb_2312": "gb18030",
+    "gb_2312-80": "gb18030",
+    "csgb2312": "gb18030",
+    "euc-cn": "gb18030",
+    "x-euc-cn": "gb18030",
+    "gb18030": "gb18030",
+    "utf-8": "utf-8",
+    "utf8": "utf-8",
+}
+
+// charsetParam returns the value after charset= in s, if any.
+func charsetParam(s string) string {
+    i := strings.Index(strings.ToLower(s), "charset=")
+    if i == -1 {
+        return ""
+    }
+    s = strings.TrimLeft(s[i+len("charset="):], "\"' ")
+    if j := strings.IndexAny(s, "\"'; />"); j != -1 {
+        s = s[:j]
+    }
+    return strings.ToLower(s)
+}
+
+// metaCharset finds the charset of the first meta tag in head that has
+// one, <meta charset="gbk"> or the http-equiv Content-Type. Other tags,
+// eg. <script charset="utf-8">, do not tell the charset of the page.
+func metaCharset(head []byte) string {
+    lower := bytes.ToLower(head)
+    for {
+        i := bytes.Index(lower, []byte("<meta"))
+        if i == -1 {
+            return ""
+        }
+        lower = lower[i:]
+        end := bytes.IndexByte(lower, '>')
+        if end == -1 {
+            end = len(lower)
+        }
+        if cs := charsetParam(string(lower[:end])); cs != "" {
+            return cs
+        }
+        lower = lower[end:]
+    }
+}
+
+// DetectCharset finds the charset of body from its Content-Type header or
+// a meta tag near the top of the page. Without either, bytes that are not
+// UTF-8 are taken as GB18030, which is what the sites send.
+func DetectCharset(body []byte, contentType string) string {
+    if cs, ok := charsetAliases[charsetParam(contentType)]; ok {
+        return cs
+    }
+
+    head := body
+    if len(head) > 4096 {
+        head = head[:4096]
+    }
+    if cs, ok := charsetAliases[metaCharset(head)]; ok {
+        return cs
+    }
+
+    if utf8.Valid(body) {
+        return "utf-8"
+    }
+    return "gb18030"
+}
+
+// DecodeBody returns body as UTF-8, see DetectCharset.
+func DecodeBody(body []byte, contentType string) []byte {
+    cs := DetectCharset(body, contentType)
+    if cs == "utf-8" {
+        return body
+    }
+
+    d := mahonia.NewDecoder(cs)
+    if d == nil && cs == "gb18030" {
+        // its two byte characters are gbk.
+        d = mahonia.NewDecoder("gbk")
+    }
+    if d == nil {
+        return body
+    }
+    b, err := ioutil.ReadAll(d.NewReader(bytes.NewReader(body)))
+    if err != nil {
+        return body
+    }
+    return b
+}
+
+// DecodeReader is DecodeBody for a stream too long to hold, its charset
+// is found from the first 4096 bytes.
+func DecodeReader(r io.Reader, contentType string) io.Reader {
+    br := bufio.NewReaderSize(r, 4096)
+    head, _ := br.Peek(4096)
+    // a character cut at the end of head does not make it gb18030.
+    for i := 0; i < utf8.UTFMax - 1 && len(head) > 0 && !utf8.Valid(head); i++ {
+        head = head[:len(head) - 1]
+    }
+    cs := DetectCharset(head, contentType)
+    if cs == "utf-8" {
+        return br
+    }
+
+    d := mahonia.NewDecoder(cs)
+    if d == nil && cs == "gb18030" {
+        d = mahonia.NewDecoder("gbk")
+    }
+    if d == nil {
+        return br
+    }
+    return d.NewReader(br)
+}
@@ -0,0 +1,98 @@
+package common
+
+import (
+    "time"
+    "context"
+    "net/http"
+)
+
+// Health is the outcome of CheckAccount.
+type Health string
+
+const (
+    HEALTH_OK Health = "ok"
+    HEALTH_NEED_LOGIN Health = "need_login"
+    HEALTH_BLOCKED Health = "blocked"
+    HEALTH_NETWORK_ERROR Health = "network_error"
+)
+
+// CheckAccount requests the keepalive page of site as account and tells
+// whether the session works. The result is recorded in the account state.
+// While a scrape of the account runs it is not checked, the last health
+// is returned instead, ok when there is none.
+func CheckAccount(site, account string) (Health, error) {
+    tc, ok := HttpClient.Get(account)
+    if !ok || tc.site != site {
+        return "", notFound(account)
+    }
+
+    timeout, err := Conf.Duration(site, "check_timeout", 10 * time.Second)
+    if err != nil {
+        return "", err
+    }
+    clientLock.RLock()
+    info := sites[site]
+    clientLock.RUnlock()
+
+    release := accountIdle(site, account)
+    if release == nil {
+        stateLock.RLock()
+        health := HEALTH_OK
+        if st, found := states[account]; found && st.health != "" {
+            health = st.health
+        }
+        stateLock.RUnlock()
+        return health, nil
+    }
+    defer release()
+
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+
+    health := HEALTH_OK
+    if err = tc.pace.wait(ctx); err == nil {
+        if err = info.pace.wait(ctx); err == nil {
+            var resp *Response
+            resp, err = tc.send(ctx, Request{Method:"GET", URL:info.sitek})
+            switch {
+            case err != nil:
+                health = HEALTH_NETWORK_ERROR
+            case resp.Status == http.StatusForbidden || resp.Status == http.StatusTooManyRequests:
+                health = HEALTH_BLOCKED
+                err = &ErrUpstreamStatus{resp.Status}
+            case resp.Status >= 400:
+                health = HEALTH_NETWORK_ERROR
+                err = &ErrUpstreamStatus{resp.Status}
+            case isLoginPage(site, resp.Body):
+                health = HEALTH_NEED_LOGIN
+                err = ErrNeedLogin
+            }
+        }
+    }
+    if err != nil && health == HEALTH_OK {
+        health = HEALTH_NETWORK_ERROR
+    }
+
+    reportCheck(account, health, err)
+    return health, nil
+}
+
+// checkCached returns the last check of account when it is younger than
+// maxAge, checking again otherwise.
+func checkCached(site, account string, maxAge time.Duration) Health {
+    stateLock.RLock()
+    st, found := states[account]
+    var health Health
+    var at time.Time
+    if found {
+        health, at = st.health, st.checkedAt
+    }
+    stateLock.RUnlock()
+
+    if found && !at.IsZero() && time.Since(at) < maxAge {
+        return health
+    }
+
+    health, _ = CheckAccount(site, account)
+    return health
+}
@@ -0,0 +1,55 @@
+package common
+
+import (
+    "fmt"
+    "time"
+    "errors"
+)
+
+// CHUNK_LAYOUT is the layout of the dates of a request.
+const CHUNK_LAYOUT = "2006-01-02"
+
+// ChunkDays reads chunk_days of [site], the longest range of days asked
+// from its report at once, 0 for no limit.
+func ChunkDays(site string, def int) (int, error) {
+    n, err := Conf.Int(site, "chunk_days", def)
+    if err != nil {
+        return 0, err
+    }
+    if n < 0 {
+        return 0, errors.New(fmt.Sprintf("invalid chunk_days %d of [%s], expect 0 or more", n, site))
+    }
+    return n, nil
+}
+
+type DateChunk struct {
+    Start, End string
+}
+
+// DateChunks splits the days from startTime to endTime, both included,
+// into ranges of at most days. Missing or unparsable dates are left to the
+// report as one range.
+func DateChunks(startTime, endTime string, days int) []DateChunk {
+    whole := []DateChunk{{startTime, endTime}}
+    if days == 0 || startTime == "" || endTime == "" {
+        return whole
+    }
+    start, err := time.Parse(CHUNK_LAYOUT, startTime)
+    if err != nil {
+        return whole
+    }
+    end, err := time.Parse(CHUNK_LAYOUT, endTime)
+    if err != nil || end.Before(start) {
+        return whole
+    }
+
+    var list []DateChunk
+    for from := start; !from.After(end); from = from.AddDate(0, 0, days) {
+        to := from.AddDate(0, 0, days - 1)
+        if to.After(end) {
+            to = end
+        }
+        list = append(list, DateChunk{from.Format(CHUNK_LAYOUT), to.Format(CHUNK_LAYOUT)})
+    }
+    return list
+}
@@ -1,6 +1,15 @@
 package common
 
 import (
+    "os"
+    "fmt"
+    "errors"
+    "sort"
+    "sync"
+    "strconv"
+    "strings"
+    "time"
+    "context"
     config "github.com/goconf"
     log "code.google.com/p/log4go"
 )
@@ -13,54 +22,494 @@ const (
 )
 
 type configFile2 struct {
+	lock sync.RWMutex
 	conf *config.ConfigFile
+	file string
+	// origins is the file each section.option was read from.
+	origins map[string]string
+	// remote, if set, is read over the file.
+	remote *remoteSource
+	// profile selects the [profile.section] sections, see SetProfile.
+	profile string
+	// overrides are set from the command line and win over everything.
+	overrides map[string]string
 }
 
-func init() {
-	if err := Conf.LoadConfigFile("conf/taoke.conf"); err != nil {
-		panic(err)
+// ENV_PREFIX starts the environment variables that override options, eg.
+// TAOKE_COMMON_PORT for port of [common]. TAOKE_CONFIG is the config file.
+const ENV_PREFIX = "TAOKE_"
+
+// Override sets option of section above both the environment and the
+// file, and keeps it across reloads.
+func (cf *configFile2) Override(section, option, value string) {
+	cf.lock.Lock()
+	defer cf.lock.Unlock()
+	if cf.overrides == nil {
+		cf.overrides = make(map[string]string)
 	}
+	cf.overrides[section + "." + option] = value
 }
 
-func (cf *configFile2) LoadConfigFile(file string) (err error) {
-	cf.conf, err = config.ReadConfigFile(file)
-	return
+func (cf *configFile2) override(section, option string) (string, bool) {
+	cf.lock.RLock()
+	defer cf.lock.RUnlock()
+	value, ok := cf.overrides[section + "." + option]
+	return value, ok
 }
 
-func (cf *configFile2) Int(section, option string, def int) (int, error) {
-	value, err := cf.conf.GetInt(section, option)
+// overridden tells whether some option of section is set on the command
+// line or in the environment.
+func (cf *configFile2) overridden(section string) bool {
+	cf.lock.RLock()
+	for key := range(cf.overrides) {
+		if strings.HasPrefix(key, section + ".") {
+			cf.lock.RUnlock()
+			return true
+		}
+	}
+	cf.lock.RUnlock()
+
+	prefix := envName(section, "")
+	for _, kv := range(os.Environ()) {
+		if strings.HasPrefix(kv, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// envName is the variable overriding option of section. Characters other
+// than letters and digits become _.
+func envName(section, option string) string {
+	return ENV_PREFIX + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, section + "_" + option)
+}
+
+// env returns the environment override of option in section, which takes
+// precedence over the file.
+func env(section, option string) (string, bool) {
+	return os.LookupEnv(envName(section, option))
+}
+
+// ErrNotLoaded is returned by reads of Conf before LoadConfig.
+var ErrNotLoaded = errors.New("config not loaded")
+
+// STRING_CONFIG stands for the file of a config given by LoadFromString.
+const STRING_CONFIG = "<string>"
+
+// LoadConfig loads Conf from file. Nothing is read at import, so main
+// calls this first, before anything reads the config.
+func LoadConfig(file string) error {
+	return Conf.LoadConfigFile(file)
+}
+
+// LoadFromString loads Conf from text in the .conf format, eg. in tests.
+// Includes are read from the working directory; such a config cannot be
+// reloaded.
+func LoadFromString(text string) error {
+	c := config.NewConfigFile()
+	origins := make(map[string]string)
+	one, includes, err := parseIni(STRING_CONFIG, []byte(text))
+	if err == nil {
+		err = mergeAll(c, origins, one, includes, STRING_CONFIG, nil)
+	}
+	if err == nil {
+		err = applyProfile(c, origins, Conf.Profile())
+	}
+	if err != nil {
+		return err
+	}
+	Conf.set(c, origins, STRING_CONFIG)
+	return nil
+}
+
+// LoadConfigFile loads file in place of the current config, which is
+// kept when file does not load. With a remote set, the remote options
+// go over the file's; when the remote cannot be read the file alone is
+// used, and a missing file is fine as long as the remote can be read.
+func (cf *configFile2) LoadConfigFile(file string) error {
+	return cf.load(file, true)
+}
+
+// load is LoadConfigFile; without fallback a remote that cannot be read
+// is an error, so a reload keeps the live config.
+func (cf *configFile2) load(file string, fallback bool) error {
+	cf.lock.RLock()
+	rs, profile := cf.remote, cf.profile
+	cf.lock.RUnlock()
+
+	c, origins, err := readConfig(file)
+	if err != nil && !(rs != nil && os.IsNotExist(err)) {
+		return err
+	}
+
+	if rs != nil {
+		values, _, rerr := rs.fetch(context.Background())
+		switch {
+		case rerr == nil:
+			if c == nil {
+				log.Warn("%s not found, using remote config %s only.", file, rs)
+				c, origins = config.NewConfigFile(), make(map[string]string)
+			}
+			rs.overlay(c, origins, values)
+		case c != nil && fallback:
+			log.Warn("remote config %s: %s, using %s.", rs, rerr.Error(), file)
+		case c == nil:
+			return errors.New(fmt.Sprintf("%s, and remote config %s: %s", err.Error(), rs, rerr.Error()))
+		default:
+			return errors.New(fmt.Sprintf("remote config %s: %s", rs, rerr.Error()))
+		}
+	}
+
+	if err = applyProfile(c, origins, profile); err != nil {
+		return errors.New(fmt.Sprintf("%s: %s", file, err.Error()))
+	}
+
+	cf.set(c, origins, file)
+	return nil
+}
+
+func (cf *configFile2) set(c *config.ConfigFile, origins map[string]string, file string) {
+	cf.lock.Lock()
+	cf.conf = c
+	cf.origins = origins
+	cf.file = file
+	cf.lock.Unlock()
+}
+
+// Reload re-reads the config file, keeping the old values on error. It
+// returns the options that changed, without the values of secrets.
+func (cf *configFile2) Reload() ([]string, error) {
+	fresh, err := cf.reread()
 	if err != nil {
-		if e, ok := err.(config.GetError); !ok || e.Reason != config.OptionNotFound {
-			return 0, err
-		}
-		// option not found, find common.
-		value, err = cf.conf.GetInt("common", option)
-		if err != nil {
-			if e, ok := err.(config.GetError); !ok || e.Reason != config.OptionNotFound {
-				return 0, err
+		return nil, err
+	}
+	cf.lock.Lock()
+	old := cf.conf
+	cf.conf = fresh.conf
+	cf.origins = fresh.origins
+	cf.lock.Unlock()
+	return diffConfig(old, fresh.conf), nil
+}
+
+// secret tells whether option holds credentials that should not be logged.
+func secret(option string) bool {
+	for _, s := range([]string{"password", "cookies", "secret", "key", "token"}) {
+		if strings.Contains(option, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func configValues(c *config.ConfigFile) map[string]string {
+	values := make(map[string]string)
+	if c == nil {
+		return values
+	}
+	for _, section := range(c.GetSections()) {
+		options, _ := c.GetOptions(section)
+		for _, option := range(options) {
+			if v, err := c.GetRawString(section, option); err == nil {
+				values[section + "." + option] = v
 			}
-			value = def
 		}
 	}
+	return values
+}
+
+// diffConfig lists, sorted, the options added, removed or changed from old
+// to fresh.
+func diffConfig(old, fresh *config.ConfigFile) []string {
+	before := configValues(old)
+	after := configValues(fresh)
+
+	var changes []string
+	for name, v := range(after) {
+		was, ok := before[name]
+		option := name[strings.LastIndex(name, ".") + 1:]
+		switch {
+		case !ok && secret(option):
+			changes = append(changes, "config " + name + " added")
+		case !ok:
+			changes = append(changes, fmt.Sprintf("config %s added: %s", name, v))
+		case was == v:
+		case secret(option):
+			changes = append(changes, "config " + name + " changed")
+		default:
+			changes = append(changes, fmt.Sprintf("config %s: %s -> %s", name, was, v))
+		}
+	}
+	for name := range(before) {
+		if _, ok := after[name]; !ok {
+			changes = append(changes, "config " + name + " removed")
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// File returns the path the config was loaded from.
+func (cf *configFile2) File() string {
+	cf.lock.RLock()
+	defer cf.lock.RUnlock()
+	return cf.file
+}
+
+// Files returns the config file and every file it included.
+func (cf *configFile2) Files() []string {
+	cf.lock.RLock()
+	defer cf.lock.RUnlock()
+	files := []string{cf.file}
+	seen := map[string]bool{cf.file:true}
+	for _, f := range(cf.origins) {
+		// remote options are not files.
+		if !seen[f] && !strings.Contains(f, "://") {
+			seen[f] = true
+			files = append(files, f)
+		}
+	}
+	sort.Strings(files[1:])
+	return files
+}
+
+// origin tells where find got option of section from: a file, the
+// environment or the command line.
+func (cf *configFile2) origin(section, option string) string {
+	for _, s := range([]string{section, "common"}) {
+		if _, ok := cf.override(s, option); ok {
+			return "command line"
+		}
+		if _, ok := env(s, option); ok {
+			return "environment " + envName(s, option)
+		}
+		cf.lock.RLock()
+		f, ok := cf.origins[strings.ToLower(s) + "." + strings.ToLower(option)]
+		cf.lock.RUnlock()
+		if ok {
+			return f
+		}
+	}
+	return cf.File()
+}
+
+// badValue is the error for an option that does not parse as valueType,
+// naming where the value came from.
+func (cf *configFile2) badValue(valueType, value, section, option string) error {
+	err := config.GetError{Reason:config.CouldNotParse, ValueType:valueType, Value:value, Section:section, Option:option}
+	return errors.New(fmt.Sprintf("%s: option '%s' of [%s]: %s", cf.origin(section, option), option, section, err.Error()))
+}
+
+func (cf *configFile2) get() *config.ConfigFile {
+	cf.lock.RLock()
+	defer cf.lock.RUnlock()
+	return cf.conf
+}
+
+// reread reads the config file again without replacing cf.
+func (cf *configFile2) reread() (*configFile2, error) {
+	cf.lock.RLock()
+	file := cf.file
+	cf.lock.RUnlock()
+	if file == STRING_CONFIG {
+		return nil, errors.New("a config loaded from a string cannot be reloaded")
+	}
+
+	cf.lock.RLock()
+	fresh := &configFile2{remote:cf.remote, profile:cf.profile}
+	cf.lock.RUnlock()
+	if err := fresh.load(file, false); err != nil {
+		return nil, err
+	}
+	return fresh, nil
+}
+
+func (cf *configFile2) Loaded() bool {
+	return cf.get() != nil
+}
+
+func (cf *configFile2) Int(section, option string, def int) (int, error) {
+	value := def
+	sv, err := cf.find(section, option)
+	if err == nil {
+		if value, err = strconv.Atoi(sv); err != nil {
+			return 0, cf.badValue("int", sv, section, option)
+		}
+	} else if e, ok := err.(config.GetError); !ok || !missing(e) {
+		return 0, err
+	}
 	log.Info("CONF INFO, SECTION: %s, %s = %d", section, option, value)
 	return value, nil
 }
 
 func (cf *configFile2) String(section, option string, def string) (string, error) {
-	value, err := cf.conf.GetString(section, option)
+	value, err := cf.find(section, option)
 	if err != nil {
-		if e, ok := err.(config.GetError); !ok || e.Reason != config.OptionNotFound {
+		if e, ok := err.(config.GetError); !ok || !missing(e) {
 			return "", err
 		}
-		// option not found, find common.
-		value, err = cf.conf.GetString("common", option)
-		if err != nil {
-			if e, ok := err.(config.GetError); !ok || e.Reason != config.OptionNotFound {
-				return "", err
-			}
-			value = def
+		value = def
+	}
+	log.Info("CONF INFO, SECTION: %s, %s = %s", section, option, value)
+	return value, nil
+}
+
+// lookup is find with a missing option reported as not found rather than
+// as an error.
+func (cf *configFile2) lookup(section, option string) (string, bool, error) {
+	value, err := cf.find(section, option)
+	if err == nil {
+		return value, true, nil
+	}
+	if e, ok := err.(config.GetError); ok && missing(e) {
+		return "", false, nil
+	}
+	return "", false, err
+}
+
+func (cf *configFile2) Bool(section, option string, def bool) (bool, error) {
+	value := def
+	sv, found, err := cf.lookup(section, option)
+	if err != nil {
+		return false, err
+	}
+	if found {
+		if value, err = strconv.ParseBool(strings.TrimSpace(sv)); err != nil {
+			return false, cf.badValue("bool", sv, section, option)
+		}
+	}
+	log.Info("CONF INFO, SECTION: %s, %s = %t", section, option, value)
+	return value, nil
+}
+
+func (cf *configFile2) Float64(section, option string, def float64) (float64, error) {
+	value := def
+	sv, found, err := cf.lookup(section, option)
+	if err != nil {
+		return 0, err
+	}
+	if found {
+		if value, err = strconv.ParseFloat(strings.TrimSpace(sv), 64); err != nil {
+			return 0, cf.badValue("float", sv, section, option)
+		}
+	}
+	log.Info("CONF INFO, SECTION: %s, %s = %g", section, option, value)
+	return value, nil
+}
+
+// Duration reads eg. "30s" or "5m". A bare number is seconds, which is
+// what the options taking a duration have always been given in.
+func (cf *configFile2) Duration(section, option string, def time.Duration) (time.Duration, error) {
+	value := def
+	sv, found, err := cf.lookup(section, option)
+	if err != nil {
+		return 0, err
+	}
+	if found {
+		sv = strings.TrimSpace(sv)
+		if n, e := strconv.Atoi(sv); e == nil {
+			value = time.Duration(n) * time.Second
+		} else if value, err = time.ParseDuration(sv); err != nil {
+			return 0, cf.badValue("duration", sv, section, option)
 		}
 	}
 	log.Info("CONF INFO, SECTION: %s, %s = %s", section, option, value)
 	return value, nil
 }
+
+// StringSlice reads a comma separated list, leaving out blank entries.
+func (cf *configFile2) StringSlice(section, option string, def []string) ([]string, error) {
+	value := def
+	sv, found, err := cf.lookup(section, option)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		value = nil
+		for _, v := range(strings.Split(sv, ",")) {
+			if v = strings.TrimSpace(v); v != "" {
+				value = append(value, v)
+			}
+		}
+	}
+	log.Info("CONF INFO, SECTION: %s, %s = %s", section, option, strings.Join(value, ","))
+	return value, nil
+}
+
+// find reads option of section, falling back to the common section. The
+// command line, then the environment, override the file at each step.
+func (cf *configFile2) find(section, option string) (string, error) {
+	if value, ok := cf.override(section, option); ok {
+		return value, nil
+	}
+	if value, ok := env(section, option); ok {
+		return value, nil
+	}
+	c := cf.get()
+	if c == nil {
+		return "", ErrNotLoaded
+	}
+	value, err := c.GetString(section, option)
+	if err == nil {
+		return value, nil
+	}
+	if e, ok := err.(config.GetError); !ok || !missing(e) {
+		return "", err
+	}
+	// option not found, find common.
+	if value, ok := cf.override("common", option); ok {
+		return value, nil
+	}
+	if value, ok := env("common", option); ok {
+		return value, nil
+	}
+	return c.GetString("common", option)
+}
+
+// raw reads an option of section only, without falling back to the common
+// section and without logging it, eg. for passwords.
+func (cf *configFile2) raw(section, option string) (string, error) {
+	if value, ok := cf.override(section, option); ok {
+		return value, nil
+	}
+	if value, ok := env(section, option); ok {
+		return value, nil
+	}
+	c := cf.get()
+	if c == nil {
+		return "", ErrNotLoaded
+	}
+	value, err := c.GetString(section, option)
+	if err != nil {
+		if e, ok := err.(config.GetError); ok && missing(e) {
+			return "", nil
+		}
+		return "", err
+	}
+	return value, nil
+}
+
+// Secret reads option like String, without logging its value.
+func (cf *configFile2) Secret(section, option string) (string, error) {
+	value, err := cf.find(section, option)
+	if err != nil {
+		if e, ok := err.(config.GetError); ok && missing(e) {
+			return "", nil
+		}
+		return "", err
+	}
+	return value, nil
+}
+
+// missing tells whether e is only about an absent section or option, which
+// fall back to defaults.
+func missing(e config.GetError) bool {
+	return e.Reason == config.OptionNotFound || e.Reason == config.SectionNotFound
+}
@@ -0,0 +1,541 @@
+package common
+
+import (
+    "io"
+    "fmt"
+    "bytes"
+    "errors"
+    "strconv"
+    "strings"
+    "io/ioutil"
+    "encoding/json"
+    "path/filepath"
+    config "github.com/goconf"
+)
+
+// A config in YAML or JSON is a map of sections, each a map of options.
+// Lists become comma separated values, lists of lists are separated by |.
+// A site's accounts may be a map of account sections instead of a list:
+//
+//   taoke:
+//     accounts:
+//       account1:
+//         cookies: >
+//           cna=...; t=...
+//
+// is the same as accounts=account1 in [taoke] plus an [account1] section.
+
+// omap is a map that keeps the order its keys were read in.
+type omap struct {
+    keys []string
+    values map[string]interface{}
+}
+
+func newOmap() *omap {
+    return &omap{values:make(map[string]interface{})}
+}
+
+func (m *omap) set(key string, v interface{}) {
+    if _, ok := m.values[key]; !ok {
+        m.keys = append(m.keys, key)
+    }
+    m.values[key] = v
+}
+
+// readFile reads one file in the format its extension tells: .json,
+// .yaml or .yml, else the goconf ini format. It returns the patterns the
+// file includes without reading them.
+func readFile(file string) (*config.ConfigFile, []string, error) {
+    var read func([]byte) (*omap, error)
+    switch strings.ToLower(filepath.Ext(file)) {
+    case ".json":
+        read = readJSON
+    case ".yaml", ".yml":
+        read = readYAML
+    default:
+        return readIni(file)
+    }
+
+    b, err := ioutil.ReadFile(file)
+    if err != nil {
+        return nil, nil, err
+    }
+    tree, err := read(b)
+    if err != nil {
+        return nil, nil, errors.New(fmt.Sprintf("%s: %s", file, err.Error()))
+    }
+
+    var includes []string
+    if v, ok := tree.values[INCLUDE]; ok {
+        value, err := optionValue(v)
+        if err != nil {
+            return nil, nil, errors.New(fmt.Sprintf("%s: %s must be a file or a list of files", file, INCLUDE))
+        }
+        includes = splitIncludes(value)
+        delete(tree.values, INCLUDE)
+        for i, key := range(tree.keys) {
+            if key == INCLUDE {
+                tree.keys = append(tree.keys[:i], tree.keys[i+1:]...)
+                break
+            }
+        }
+    }
+
+    c, err := flatten(tree)
+    if err != nil {
+        return nil, nil, errors.New(fmt.Sprintf("%s: %s", file, err.Error()))
+    }
+    return c, includes, nil
+}
+
+// flatten lays tree out as goconf sections and options.
+func flatten(tree *omap) (*config.ConfigFile, error) {
+    c := config.NewConfigFile()
+    for _, section := range(tree.keys) {
+        options, ok := tree.values[section].(*omap)
+        if !ok {
+            return nil, errors.New(fmt.Sprintf("section '%s' must be a map of options", section))
+        }
+        if err := addOptions(c, section, options); err != nil {
+            return nil, err
+        }
+    }
+    return c, nil
+}
+
+func addOptions(c *config.ConfigFile, section string, options *omap) error {
+    c.AddSection(section)
+    for _, option := range(options.keys) {
+        v := options.values[option]
+
+        if accounts, ok := v.(*omap); ok && option == "accounts" {
+            for _, account := range(accounts.keys) {
+                sub, ok := accounts.values[account].(*omap)
+                if !ok {
+                    if accounts.values[account] != "" {
+                        return errors.New(fmt.Sprintf("account '%s' of '%s' must be a map of options", account, section))
+                    }
+                    sub = newOmap()
+                }
+                if err := addOptions(c, account, sub); err != nil {
+                    return err
+                }
+            }
+            c.AddOption(section, option, strings.Join(accounts.keys, ","))
+            continue
+        }
+
+        value, err := optionValue(v)
+        if err != nil {
+            return errors.New(fmt.Sprintf("option '%s' of '%s': %s", option, section, err.Error()))
+        }
+        c.AddOption(section, option, value)
+    }
+    return nil
+}
+
+func optionValue(v interface{}) (string, error) {
+    switch v := v.(type) {
+    case string:
+        return v, nil
+    case []interface{}:
+        sep := ","
+        parts := make([]string, len(v))
+        for i, item := range(v) {
+            if inner, ok := item.([]interface{}); ok {
+                sep = "|"
+                s, err := optionValue(inner)
+                if err != nil {
+                    return "", err
+                }
+                parts[i] = s
+                continue
+            }
+            s, ok := item.(string)
+            if !ok {
+                return "", errors.New("lists hold values or lists of values")
+            }
+            parts[i] = s
+        }
+        return strings.Join(parts, sep), nil
+    }
+    return "", errors.New("maps are only allowed for sections and accounts")
+}
+
+// readJSON decodes b keeping the order of keys. Numbers, booleans and
+// nulls become the strings goconf would hold.
+func readJSON(b []byte) (*omap, error) {
+    dec := json.NewDecoder(bytes.NewReader(b))
+    dec.UseNumber()
+    v, err := jsonValue(dec)
+    if err != nil {
+        return nil, err
+    }
+    if _, err = dec.Token(); err != io.EOF {
+        return nil, errors.New("data after the top level object")
+    }
+    m, ok := v.(*omap)
+    if !ok {
+        return nil, errors.New("top level must be an object of sections")
+    }
+    return m, nil
+}
+
+func jsonValue(dec *json.Decoder) (interface{}, error) {
+    t, err := dec.Token()
+    if err != nil {
+        return nil, err
+    }
+
+    switch t := t.(type) {
+    case json.Delim:
+        if t == '{' {
+            m := newOmap()
+            for dec.More() {
+                k, err := dec.Token()
+                if err != nil {
+                    return nil, err
+                }
+                v, err := jsonValue(dec)
+                if err != nil {
+                    return nil, err
+                }
+                m.set(k.(string), v)
+            }
+            _, err = dec.Token()
+            return m, err
+        }
+        var list []interface{}
+        for dec.More() {
+            v, err := jsonValue(dec)
+            if err != nil {
+                return nil, err
+            }
+            list = append(list, v)
+        }
+        _, err = dec.Token()
+        return list, err
+    case string:
+        return t, nil
+    case json.Number:
+        return t.String(), nil
+    case bool:
+        return strconv.FormatBool(t), nil
+    }
+    return "", nil
+}
+
+// yamlLine is a line of a YAML document with its indentation.
+type yamlLine struct {
+    n int
+    indent int
+    raw string
+    text string
+}
+
+// yamlParser reads the block style subset of YAML a config needs: maps,
+// lists, plain and quoted scalars, [flow, lists] and | or > block
+// scalars. Anchors, tags and multiple documents are not supported.
+type yamlParser struct {
+    lines []yamlLine
+    pos int
+}
+
+func readYAML(b []byte) (*omap, error) {
+    p := &yamlParser{}
+    for i, raw := range(strings.Split(strings.Replace(string(b), "\r\n", "\n", -1), "\n")) {
+        trimmed := strings.TrimLeft(raw, " ")
+        if strings.HasPrefix(trimmed, "\t") {
+            return nil, errors.New(fmt.Sprintf("line %d: tabs are not allowed for indentation", i + 1))
+        }
+        p.lines = append(p.lines, yamlLine{i + 1, len(raw) - len(trimmed), raw, strings.TrimSpace(stripYAMLComment(trimmed))})
+    }
+
+    p.skip()
+    if p.pos < len(p.lines) && p.lines[p.pos].text == "---" {
+        p.pos++
+        p.skip()
+    }
+    if p.pos >= len(p.lines) {
+        return newOmap(), nil
+    }
+
+    v, err := p.block(p.lines[p.pos].indent)
+    if err != nil {
+        return nil, err
+    }
+    p.skip()
+    if p.pos < len(p.lines) {
+        return nil, p.errorf("unexpected indentation")
+    }
+    m, ok := v.(*omap)
+    if !ok {
+        return nil, errors.New("top level must be a map of sections")
+    }
+    return m, nil
+}
+
+func (p *yamlParser) errorf(format string, args ...interface{}) error {
+    return errors.New(fmt.Sprintf("line %d: %s", p.lines[p.pos].n, fmt.Sprintf(format, args...)))
+}
+
+// skip moves past blank and comment lines.
+func (p *yamlParser) skip() {
+    for p.pos < len(p.lines) && p.lines[p.pos].text == "" {
+        p.pos++
+    }
+}
+
+// block reads the map or list whose lines are indented by indent.
+func (p *yamlParser) block(indent int) (interface{}, error) {
+    if isListItem(p.lines[p.pos].text) {
+        return p.list(indent)
+    }
+    return p.mapping(indent)
+}
+
+func isListItem(text string) bool {
+    return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+func (p *yamlParser) mapping(indent int) (*omap, error) {
+    m := newOmap()
+    for p.skip(); p.pos < len(p.lines) && p.lines[p.pos].indent == indent; p.skip() {
+        line := p.lines[p.pos]
+        if isListItem(line.text) {
+            return nil, p.errorf("list item in a map")
+        }
+
+        key, rest, ok := splitYAMLKey(line.text)
+        if !ok {
+            return nil, p.errorf("expect key: value")
+        }
+        key, err := yamlScalar(key)
+        if err != nil {
+            return nil, p.errorf("%s", err.Error())
+        }
+        p.pos++
+
+        v, err := p.value(indent, rest)
+        if err != nil {
+            return nil, err
+        }
+        m.set(key, v)
+    }
+    return m, nil
+}
+
+func (p *yamlParser) list(indent int) ([]interface{}, error) {
+    var list []interface{}
+    for p.skip(); p.pos < len(p.lines) && p.lines[p.pos].indent == indent; p.skip() {
+        line := p.lines[p.pos]
+        if !isListItem(line.text) {
+            return nil, p.errorf("map key in a list")
+        }
+        rest := strings.TrimSpace(line.text[1:])
+        if _, _, ok := splitYAMLKey(rest); ok && !strings.HasPrefix(rest, "[") && !strings.HasPrefix(rest, "\"") && !strings.HasPrefix(rest, "'") {
+            return nil, p.errorf("maps in lists are not supported")
+        }
+        p.pos++
+
+        v, err := p.value(indent, rest)
+        if err != nil {
+            return nil, err
+        }
+        list = append(list, v)
+    }
+    return list, nil
+}
+
+// value reads what follows a key or list dash at indent: rest of the line,
+// a block scalar or a nested block.
+func (p *yamlParser) value(indent int, rest string) (interface{}, error) {
+    switch {
+    case rest == "":
+        p.skip()
+        if p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+            return p.block(p.lines[p.pos].indent)
+        }
+        return "", nil
+    case rest[0] == '|' || rest[0] == '>':
+        return p.blockScalar(indent, rest), nil
+    case rest[0] == '[':
+        return yamlFlowList(rest)
+    case rest[0] == '{':
+        p.pos--
+        return nil, p.errorf("flow maps are not supported")
+    }
+    return yamlScalar(rest)
+}
+
+// blockScalar reads the lines indented deeper than indent as a | literal
+// or > folded scalar.
+func (p *yamlParser) blockScalar(indent int, header string) string {
+    var lines []string
+    base := -1
+    for ; p.pos < len(p.lines); p.pos++ {
+        line := p.lines[p.pos]
+        if strings.TrimSpace(line.raw) == "" {
+            lines = append(lines, "")
+            continue
+        }
+        if line.indent <= indent {
+            break
+        }
+        if base < 0 {
+            base = line.indent
+        }
+        lines = append(lines, line.raw[min(base, line.indent):])
+    }
+    for len(lines) > 0 && lines[len(lines) - 1] == "" {
+        lines = lines[:len(lines) - 1]
+    }
+
+    if header[0] == '>' {
+        var b strings.Builder
+        for i, l := range(lines) {
+            // a break between lines folds into a space, a blank
+            // line is a newline.
+            if i > 0 {
+                if l == "" {
+                    b.WriteString("\n")
+                } else if lines[i - 1] != "" {
+                    b.WriteString(" ")
+                }
+            }
+            b.WriteString(l)
+        }
+        return b.String()
+    }
+    return strings.Join(lines, "\n")
+}
+
+func splitYAMLKey(text string) (key, rest string, ok bool) {
+    quote := byte(0)
+    for i := 0; i < len(text); i++ {
+        c := text[i]
+        switch {
+        case quote != 0:
+            if c == quote {
+                quote = 0
+            }
+        case c == '"' || c == '\'':
+            if i == 0 {
+                quote = c
+            }
+        case c == ':' && (i == len(text) - 1 || text[i + 1] == ' '):
+            return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i + 1:]), true
+        }
+    }
+    return "", "", false
+}
+
+// stripYAMLComment cuts a # comment that starts the line or follows a
+// space, outside quotes.
+func stripYAMLComment(text string) string {
+    quote := byte(0)
+    for i := 0; i < len(text); i++ {
+        c := text[i]
+        switch {
+        case quote != 0:
+            if c == quote {
+                quote = 0
+            }
+        case c == '"' || c == '\'':
+            if i == 0 || text[i - 1] == ' ' || text[i - 1] == '[' || text[i - 1] == ',' {
+                quote = c
+            }
+        case c == '#' && (i == 0 || text[i - 1] == ' '):
+            return text[:i]
+        }
+    }
+    return text
+}
+
+func yamlScalar(s string) (string, error) {
+    s = strings.TrimSpace(s)
+    switch {
+    case s == "~" || s == "null":
+        return "", nil
+    case strings.HasPrefix(s, "\""):
+        v, err := strconv.Unquote(s)
+        if err != nil {
+            return "", errors.New(fmt.Sprintf("invalid quoted value %s", s))
+        }
+        return v, nil
+    case strings.HasPrefix(s, "'"):
+        if len(s) < 2 || !strings.HasSuffix(s, "'") {
+            return "", errors.New(fmt.Sprintf("invalid quoted value %s", s))
+        }
+        return strings.Replace(s[1:len(s) - 1], "''", "'", -1), nil
+    }
+    return s, nil
+}
+
+// yamlFlowList reads [a, b] and [[a, b], [c]].
+func yamlFlowList(s string) ([]interface{}, error) {
+    list, rest, err := flowList(s)
+    if err != nil {
+        return nil, err
+    }
+    if strings.TrimSpace(rest) != "" {
+        return nil, errors.New(fmt.Sprintf("data after list: %s", rest))
+    }
+    return list, nil
+}
+
+func flowList(s string) ([]interface{}, string, error) {
+    s = strings.TrimSpace(s)[1:]
+    var list []interface{}
+    for {
+        s = strings.TrimSpace(s)
+        if s == "" {
+            return nil, "", errors.New("unterminated list")
+        }
+        if s[0] == ']' {
+            return list, s[1:], nil
+        }
+
+        if s[0] == '[' {
+            inner, rest, err := flowList(s)
+            if err != nil {
+                return nil, "", err
+            }
+            list = append(list, inner)
+            s = rest
+        } else {
+            end := flowItemEnd(s)
+            v, err := yamlScalar(s[:end])
+            if err != nil {
+                return nil, "", err
+            }
+            list = append(list, v)
+            s = s[end:]
+        }
+
+        s = strings.TrimSpace(s)
+        if strings.HasPrefix(s, ",") {
+            s = s[1:]
+        } else if !strings.HasPrefix(s, "]") {
+            return nil, "", errors.New("expect , or ] in list")
+        }
+    }
+}
+
+func flowItemEnd(s string) int {
+    quote := byte(0)
+    for i := 0; i < len(s); i++ {
+        c := s[i]
+        switch {
+        case quote != 0:
+            if c == quote {
+                quote = 0
+            }
+        case i == 0 && (c == '"' || c == '\''):
+            quote = c
+        case c == ',' || c == ']':
+            return i
+        }
+    }
+    return len(s)
+}
@@ -0,0 +1,116 @@
+package common
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestConfigFormats(t *testing.T) {
+    cases := []struct {
+        name string
+        read func([]byte) (*omap, error)
+        text string
+        want map[string]string
+        err bool
+    }{
+        {
+            name:"json",
+            read:readJSON,
+            text:`{"common": {"port": 9000, "debug": true, "none": null},
+                   "taoke": {"accounts": ["a1", "a2"], "windows": [["0", "6"], ["22", "23"]]}}`,
+            want:map[string]string{"common.port":"9000", "common.debug":"true", "common.none":"",
+                "taoke.accounts":"a1,a2", "taoke.windows":"0,6|22,23"},
+        },
+        {
+            name:"json accounts map",
+            read:readJSON,
+            text:`{"taoke": {"accounts": {"b": {"cookies": "x=1"}, "a": {}}}}`,
+            want:map[string]string{"taoke.accounts":"b,a", "b.cookies":"x=1"},
+        },
+        {name:"json not an object", read:readJSON, text:`["a"]`, err:true},
+        {name:"json trailing data", read:readJSON, text:`{} {}`, err:true},
+        {name:"json option map", read:readJSON, text:`{"a": {"b": {"c": "d"}}}`, err:true},
+        {name:"json section value", read:readJSON, text:`{"a": "b"}`, err:true},
+        {
+            name:"yaml",
+            read:readYAML,
+            text:"---\n" +
+                "# a comment\n" +
+                "common:\n" +
+                "  port: 9000 # the port\n" +
+                "  name: \"a # b\"\n" +
+                "  quote: 'it''s'\n" +
+                "  empty: ~\n" +
+                "taoke:\n" +
+                "  accounts: [a1, \"a2\"]\n" +
+                "  windows: [[0, 6], [22, 23]]\n" +
+                "  urls:\n" +
+                "    - http://a\n" +
+                "    - http://b\n",
+            want:map[string]string{"common.port":"9000", "common.name":"a # b", "common.quote":"it's", "common.empty":"",
+                "taoke.accounts":"a1,a2", "taoke.windows":"0,6|22,23", "taoke.urls":"http://a,http://b"},
+        },
+        {
+            name:"yaml block scalars",
+            read:readYAML,
+            text:"a:\n" +
+                "  literal: |\n" +
+                "    one\n" +
+                "    two\n" +
+                "  folded: >\n" +
+                "    one\n" +
+                "    two\n" +
+                "\n" +
+                "    three\n" +
+                "\n" +
+                "\n" +
+                "    four\n" +
+                "  after: x\n",
+            want:map[string]string{"a.literal":"one\ntwo", "a.folded":"one two\nthree\n\nfour", "a.after":"x"},
+        },
+        {
+            name:"yaml accounts map",
+            read:readYAML,
+            text:"taoke:\n" +
+                "  accounts:\n" +
+                "    account2:\n" +
+                "      cookies: >\n" +
+                "        cna=1; t=2\n" +
+                "    account1:\n",
+            want:map[string]string{"taoke.accounts":"account2,account1", "account2.cookies":"cna=1; t=2"},
+        },
+        {name:"yaml empty", read:readYAML, text:"# nothing\n", want:map[string]string{}},
+        {name:"yaml tab", read:readYAML, text:"a:\n\tb: c\n", err:true},
+        {name:"yaml flow map", read:readYAML, text:"a:\n  b: {c: d}\n", err:true},
+        {name:"yaml map in list", read:readYAML, text:"a:\n  b:\n    - c: d\n", err:true},
+        {name:"yaml bad indent", read:readYAML, text:"a:\n    b: c\n  d: e\n", err:true},
+        {name:"yaml no key", read:readYAML, text:"a:\n  b\n", err:true},
+        {name:"yaml unterminated list", read:readYAML, text:"a:\n  b: [c, d\n", err:true},
+        {name:"yaml top list", read:readYAML, text:"- a\n", err:true},
+    }
+    for _, c := range(cases) {
+        tree, err := c.read([]byte(c.text))
+        if err == nil {
+            _, err = flatten(tree)
+        }
+        if c.err {
+            if err == nil {
+                t.Errorf("%s: no error", c.name)
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("%s: %v", c.name, err)
+            continue
+        }
+
+        conf, _ := flatten(tree)
+        for key, want := range(c.want) {
+            i := strings.Index(key, ".")
+            got, err := conf.GetRawString(key[:i], key[i+1:])
+            if err != nil || got != want {
+                t.Errorf("%s: %s = %q, %v, want %q", c.name, key, got, err, want)
+            }
+        }
+    }
+}
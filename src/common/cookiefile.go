@@ -0,0 +1,164 @@
+package common
+
+import (
+    "os"
+    "fmt"
+    "time"
+    "bytes"
+    "errors"
+    "strconv"
+    "strings"
+    "io/ioutil"
+    "encoding/json"
+    "github.com/cookiejar"
+)
+
+// COOKIE_FILE marks a cookie source that is a browser export file rather
+// than a cookies string.
+const COOKIE_FILE = "file:"
+
+// cookieSource returns what the session of account is built from in cf:
+// its cookies string, or its cookies_file with the file's modification
+// time, so that editing the file counts as a change.
+func cookieSource(cf *configFile2, account string) (string, error) {
+    cookiestr, err := cf.String(account, "cookies", "")
+    if err != nil || cookiestr != "" {
+        return cookiestr, err
+    }
+
+    file, err := cf.raw(account, "cookies_file")
+    if err != nil || file == "" {
+        return "", err
+    }
+    fi, err := os.Stat(file)
+    if err != nil {
+        return "", err
+    }
+    return COOKIE_FILE + file + "#" + strconv.FormatInt(fi.ModTime().UnixNano(), 10), nil
+}
+
+// cookieFilePath strips the COOKIE_FILE mark and modification time.
+func cookieFilePath(src string) string {
+    path := strings.TrimPrefix(src, COOKIE_FILE)
+    if i := strings.LastIndex(path, "#"); i != -1 {
+        if _, err := strconv.ParseInt(path[i+1:], 10, 64); err == nil {
+            path = path[:i]
+        }
+    }
+    return path
+}
+
+// readCookieFile reads a Netscape cookies.txt or the JSON export of a
+// browser extension. Expired cookies are left out.
+func readCookieFile(path string) ([]cookiejar.Cookie, error) {
+    b, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+
+    var cookies []cookiejar.Cookie
+    if trimmed := bytes.TrimSpace(b); len(trimmed) > 0 && trimmed[0] == '[' {
+        cookies, err = parseCookieJSON(trimmed)
+    } else {
+        cookies, err = parseCookiesTxt(b)
+    }
+    if err != nil {
+        return nil, errors.New(fmt.Sprintf("cookies file '%s': %s", path, err.Error()))
+    }
+
+    now := time.Now()
+    live := cookies[:0]
+    for _, c := range(cookies) {
+        c.Created, c.LastAccess = now, now
+        if !c.Expired() {
+            live = append(live, c)
+        }
+    }
+    if len(live) == 0 {
+        return nil, errors.New(fmt.Sprintf("no valid cookies in '%s'", path))
+    }
+    return live, nil
+}
+
+// parseCookiesTxt reads the Netscape format: domain, include subdomains,
+// path, secure, expiry, name and value separated by tabs.
+func parseCookiesTxt(b []byte) ([]cookiejar.Cookie, error) {
+    var cookies []cookiejar.Cookie
+    for n, line := range(strings.Split(string(b), "\n")) {
+        line = strings.TrimRight(line, "\r")
+        httpOnly := false
+        if strings.HasPrefix(line, "#HttpOnly_") {
+            line = strings.TrimPrefix(line, "#HttpOnly_")
+            httpOnly = true
+        }
+        if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+
+        f := strings.Split(line, "\t")
+        if len(f) != 7 {
+            return nil, errors.New(fmt.Sprintf("line %d: want 7 fields, got %d", n + 1, len(f)))
+        }
+        expiry, err := strconv.ParseInt(f[4], 10, 64)
+        if err != nil {
+            return nil, errors.New(fmt.Sprintf("line %d: invalid expiry '%s'", n + 1, f[4]))
+        }
+
+        c := cookiejar.Cookie{
+            Name:f[5],
+            Value:f[6],
+            Domain:strings.ToLower(strings.TrimPrefix(f[0], ".")),
+            Path:f[2],
+            Secure:strings.EqualFold(f[3], "TRUE"),
+            HostOnly:!strings.EqualFold(f[1], "TRUE"),
+            HttpOnly:httpOnly,
+        }
+        if expiry > 0 {
+            c.Expires = time.Unix(expiry, 0)
+        }
+        cookies = append(cookies, c)
+    }
+    return cookies, nil
+}
+
+type exportedCookie struct {
+    Domain string `json:"domain"`
+    HostOnly bool `json:"hostOnly"`
+    HttpOnly bool `json:"httpOnly"`
+    Name string `json:"name"`
+    Path string `json:"path"`
+    Secure bool `json:"secure"`
+    Session bool `json:"session"`
+    ExpirationDate float64 `json:"expirationDate"`
+    Value string `json:"value"`
+}
+
+// parseCookieJSON reads the array that browser extensions such as
+// EditThisCookie export.
+func parseCookieJSON(b []byte) ([]cookiejar.Cookie, error) {
+    var exported []exportedCookie
+    if err := json.Unmarshal(b, &exported); err != nil {
+        return nil, err
+    }
+
+    cookies := make([]cookiejar.Cookie, 0, len(exported))
+    for _, e := range(exported) {
+        c := cookiejar.Cookie{
+            Name:e.Name,
+            Value:e.Value,
+            Domain:strings.ToLower(strings.TrimPrefix(e.Domain, ".")),
+            Path:e.Path,
+            Secure:e.Secure,
+            HostOnly:e.HostOnly,
+            HttpOnly:e.HttpOnly,
+        }
+        if c.Path == "" {
+            c.Path = "/"
+        }
+        if !e.Session && e.ExpirationDate > 0 {
+            c.Expires = time.Unix(int64(e.ExpirationDate), 0)
+        }
+        cookies = append(cookies, c)
+    }
+    return cookies, nil
+}
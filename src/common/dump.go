@@ -0,0 +1,92 @@
+package common
+
+import (
+    "os"
+    "strings"
+    config "github.com/goconf"
+)
+
+// MASK replaces the values of secret options in Dump.
+const MASK = "******"
+
+// OptionValue is an option in effect and where it was set.
+type OptionValue struct {
+    Value string `json:"value"`
+    From string `json:"from"`
+}
+
+// ConfigDump is the config in effect: the files, then the environment
+// and the command line over them.
+type ConfigDump struct {
+    Files []string `json:"files"`
+    Profile string `json:"profile,omitempty"`
+    Sections map[string]map[string]OptionValue `json:"sections"`
+    // Environment holds TAOKE_ variables that name no known option.
+    Environment map[string]string `json:"environment,omitempty"`
+}
+
+func mask(option, value string) string {
+    if value != "" && secret(option) {
+        return MASK
+    }
+    return value
+}
+
+// Dump returns every option in effect by section, with the values of
+// passwords, cookies, keys and tokens masked.
+func (cf *configFile2) Dump() *ConfigDump {
+    d := &ConfigDump{Files:cf.Files(), Profile:cf.Profile(), Sections:make(map[string]map[string]OptionValue)}
+    c := cf.get()
+    if c == nil {
+        return d
+    }
+
+    names := make(map[string]map[string]bool)
+    add := func(section, option string) {
+        if names[section] == nil {
+            names[section] = make(map[string]bool)
+        }
+        names[section][option] = true
+    }
+    for _, section := range(c.GetSections()) {
+        options, _ := c.GetOptions(section)
+        for _, option := range(options) {
+            add(section, option)
+        }
+    }
+    cf.lock.RLock()
+    for key := range(cf.overrides) {
+        i := strings.Index(key, ".")
+        add(strings.ToLower(key[:i]), strings.ToLower(key[i+1:]))
+    }
+    cf.lock.RUnlock()
+
+    known := map[string]bool{ENV_PREFIX + "CONFIG":true, ENV_PREFIX + "REMOTE":true, ENV_PREFIX + "PROFILE":true}
+    for section, options := range(names) {
+        if section == config.DefaultSection {
+            continue
+        }
+        values := make(map[string]OptionValue)
+        for option := range(options) {
+            known[envName(section, option)] = true
+            value, err := cf.raw(section, option)
+            if err != nil {
+                continue
+            }
+            values[option] = OptionValue{mask(option, value), cf.origin(section, option)}
+        }
+        d.Sections[section] = values
+    }
+
+    for _, kv := range(os.Environ()) {
+        i := strings.Index(kv, "=")
+        if i == -1 || !strings.HasPrefix(kv, ENV_PREFIX) || known[kv[:i]] {
+            continue
+        }
+        if d.Environment == nil {
+            d.Environment = make(map[string]string)
+        }
+        d.Environment[kv[:i]] = mask(strings.ToLower(kv[:i]), kv[i+1:])
+    }
+    return d
+}
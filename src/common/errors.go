@@ -0,0 +1,110 @@
+package common
+
+import (
+    "fmt"
+    "errors"
+)
+
+// ErrNeedLogin means the upstream answered with its login page: the
+// session of the account is gone.
+var ErrNeedLogin = errors.New("account need login.")
+
+// The answers a site gives in place of its data, see ErrSitePage: it is
+// down for maintenance, the account asks too often, or it may not see the
+// data.
+var ErrMaintenance = errors.New("site under maintenance.")
+var ErrRateLimited = errors.New("account rate limited.")
+var ErrDenied = errors.New("account permission denied.")
+
+// ErrSitePage is a page of the site that says why it has no data. Err is
+// ErrMaintenance, ErrRateLimited or ErrDenied, Excerpt the text of the
+// page.
+type ErrSitePage struct {
+    Page string
+    Err error
+    Excerpt string
+}
+
+func (e *ErrSitePage) Error() string {
+    return fmt.Sprintf("%s page: %s near: %s", e.Page, e.Err.Error(), e.Excerpt)
+}
+
+func (e *ErrSitePage) Unwrap() error {
+    return e.Err
+}
+
+// ErrAccountNotFound means no logged in client has the account name.
+var ErrAccountNotFound = errors.New("account notfound.")
+
+// accountNotFound is ErrAccountNotFound naming the account.
+type accountNotFound string
+
+func (a accountNotFound) Error() string {
+    return fmt.Sprintf("account '%s' notfound", string(a))
+}
+
+func (a accountNotFound) Is(target error) bool {
+    return target == ErrAccountNotFound
+}
+
+func notFound(account string) error {
+    return accountNotFound(account)
+}
+
+// ErrParse is a page the parser could not read. Number, Row and Column
+// say where, counted from 1 and 0 when they do not apply; Expected is
+// what the parser looked for there and Excerpt what it found instead.
+type ErrParse struct {
+    Page string `json:"page"`
+    Number int `json:"number,omitempty"`
+    Row int `json:"row,omitempty"`
+    Column int `json:"column,omitempty"`
+    Expected string `json:"expected,omitempty"`
+    Excerpt string `json:"excerpt,omitempty"`
+}
+
+func (e *ErrParse) Error() string {
+    s := "parse " + e.Page + " failed"
+    if e.Number > 0 {
+        s += fmt.Sprintf(", page %d", e.Number)
+    }
+    if e.Row > 0 {
+        s += fmt.Sprintf(", row %d", e.Row)
+    }
+    if e.Column > 0 {
+        s += fmt.Sprintf(", column %d", e.Column)
+    }
+    if e.Expected != "" {
+        s += ", expected " + e.Expected
+    }
+    if e.Excerpt != "" {
+        s += ", near: " + e.Excerpt
+    }
+    return s
+}
+
+// ErrLayout is a page whose markup is no layout version the parser
+// knows: the site changed it. Snippet is the markup where the parser
+// looked for its data.
+type ErrLayout struct {
+    Page string
+    Snippet string
+}
+
+func (e *ErrLayout) Error() string {
+    return fmt.Sprintf("unsupported %s page layout version, near: %s", e.Page, e.Snippet)
+}
+
+// ErrUpstreamStatus is a response from the site with a failing status.
+type ErrUpstreamStatus struct {
+    Code int
+}
+
+func (e *ErrUpstreamStatus) Error() string {
+    return fmt.Sprintf("fetch failed, status %d", e.Code)
+}
+
+// Temporary tells whether trying again later may succeed.
+func (e *ErrUpstreamStatus) Temporary() bool {
+    return e.Code >= 500 || e.Code == 429
+}
@@ -0,0 +1,105 @@
+package common
+
+import (
+    "fmt"
+    "time"
+    "errors"
+    "strings"
+    "net/http"
+)
+
+// loadGroups reads the failover groups of site: accounts within a group
+// serve the same data, eg. "account1,account2|account3,account4".
+func loadGroups(site string) ([][]string, error) {
+    value, err := Conf.String(site, "groups", "")
+    if err != nil {
+        return nil, err
+    }
+
+    var groups [][]string
+    seen := make(map[string]bool)
+    for _, g := range(strings.Split(value, "|")) {
+        var group []string
+        for _, account := range(strings.Split(g, ",")) {
+            account = strings.TrimSpace(account)
+            if account == "" {
+                continue
+            }
+            if seen[account] {
+                return nil, errors.New(fmt.Sprintf("account '%s' is in more than one group of site '%s'", account, site))
+            }
+            seen[account] = true
+            group = append(group, account)
+        }
+        if len(group) > 1 {
+            groups = append(groups, group)
+        }
+    }
+    return groups, nil
+}
+
+// Failover returns the accounts to try, in order, for a fetch of site
+// asked of account: account itself, then the healthy members of its
+// group from the one after it on. An unhealthy account goes last when
+// there is somebody else to try.
+func Failover(site, account string) []string {
+    clientLock.RLock()
+    var group []string
+    if info, ok := sites[site]; ok {
+        for _, g := range(info.groups) {
+            for _, a := range(g) {
+                if a == account {
+                    group = g
+                }
+            }
+        }
+    }
+    clientLock.RUnlock()
+
+    if group == nil {
+        return []string{account}
+    }
+
+    var others []string
+    for i := range(group) {
+        if group[i] == account {
+            for j := 1; j < len(group); j++ {
+                a := group[(i + j) % len(group)]
+                if healthy(a) {
+                    others = append(others, a)
+                }
+            }
+        }
+    }
+
+    if len(others) > 0 && !healthy(account) {
+        return append(others, account)
+    }
+    return append([]string{account}, others...)
+}
+
+// FailoverError tells whether a fetch failing with err may succeed with
+// another account: the session is gone, or the account is rate limited
+// or denied.
+func FailoverError(err error) bool {
+    return errors.Is(err, ErrNeedLogin) || errors.Is(err, ErrAccountNotFound) || blockedError(err)
+}
+
+// blockedError tells whether err keeps the account out of failover for a
+// while.
+func blockedError(err error) bool {
+    var status *ErrUpstreamStatus
+    return errors.Is(err, ErrRateLimited) || errors.Is(err, ErrDenied) || (errors.As(err, &status) && blockedStatus(status.Code))
+}
+
+func blockedStatus(code int) bool {
+    return code == http.StatusForbidden || code == http.StatusTooManyRequests
+}
+
+// healthy tells whether account is logged in and not rate limited lately.
+func healthy(account string) bool {
+    stateLock.RLock()
+    defer stateLock.RUnlock()
+    st, found := states[account]
+    return found && st.loggedIn && time.Now().After(st.blockedUntil)
+}
@@ -0,0 +1,163 @@
+package common
+
+import (
+    "bytes"
+    "time"
+    "context"
+    "io/ioutil"
+    "net/http"
+)
+
+// Request is an upstream request made as an account. Header is sent on
+// top of the account's configured headers.
+type Request struct {
+    Method string
+    URL string
+    Header http.Header
+    Body []byte
+}
+
+// Response is the upstream answer with its body read. Body may be shared
+// with the validator cache and must not be modified.
+type Response struct {
+    Status int
+    Header http.Header
+    Body []byte
+}
+
+// Fetch is FetchCtx without a deadline.
+func Fetch(account string, req Request) (*Response, error) {
+    return FetchCtx(context.Background(), account, req)
+}
+
+// FetchCtx sends req with account's session, paced and retried like
+// GetPage. A retryable status left after the last try is an error. Every
+// answer is kept when ctx is captured, see WithCapture. Outside a scrape
+// the request takes a slot of the account, see AcquireAccount.
+func FetchCtx(ctx context.Context, account string, req Request) (*Response, error) {
+    client, ok := HttpClient.Get(account)
+
+    clientLock.RLock()
+    var policy *retryPolicy
+    var sitePace *pacer
+    if ok {
+        policy = sites[client.site].retry
+        sitePace = sites[client.site].pace
+    }
+    clientLock.RUnlock()
+    if !ok {
+        return nil, notFound(account)
+    }
+
+    if req.Method == "" {
+        req.Method = "GET"
+    }
+
+    ctx, release, err := AcquireAccount(ctx, client.site, account)
+    if err != nil {
+        return nil, err
+    }
+    defer release()
+
+    tries := 0
+    return policy.do(ctx, req, func() (*Response, error) {
+        if tries++; tries > 1 {
+            recordRetry(client.site, account)
+        }
+        if err := client.pace.wait(ctx); err != nil {
+            return nil, err
+        }
+        if err := sitePace.wait(ctx); err != nil {
+            return nil, err
+        }
+        resp, err := client.send(ctx, req)
+        if err == nil {
+            capturePage(ctx, client.site, account, req, resp)
+        }
+        return resp, err
+    })
+}
+
+// send makes one try of req, without pacing or retries.
+func (tc *TaokeClient) send(ctx context.Context, req Request) (*Response, error) {
+    mode, dir := recordMode()
+    if mode == REPLAY {
+        return replay(dir, tc.site, req)
+    }
+
+    var body *bytes.Reader
+    if req.Body != nil {
+        body = bytes.NewReader(req.Body)
+    }
+
+    var hr *http.Request
+    var err error
+    if body != nil {
+        hr, err = http.NewRequestWithContext(ctx, req.Method, req.URL, body)
+    } else {
+        hr, err = http.NewRequestWithContext(ctx, req.Method, req.URL, nil)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    clientLock.RLock()
+    for name, values := range(tc.headers) {
+        hr.Header[name] = values
+    }
+    clientLock.RUnlock()
+    for name, values := range(req.Header) {
+        hr.Header[http.CanonicalHeaderKey(name)] = values
+    }
+    if hr.Header.Get("Accept-Encoding") == "" && wantGzip(tc.site) {
+        hr.Header.Set("Accept-Encoding", "gzip")
+    }
+
+    // revalidate what we have, unless the caller asks on its own.
+    key := tc.account + " " + req.URL
+    var cached *validated
+    if req.Method == "GET" && hr.Header.Get("If-None-Match") == "" && hr.Header.Get("If-Modified-Since") == "" {
+        if cached = validators.get(key); cached != nil {
+            if cached.etag != "" {
+                hr.Header.Set("If-None-Match", cached.etag)
+            }
+            if cached.lastModified != "" {
+                hr.Header.Set("If-Modified-Since", cached.lastModified)
+            }
+        }
+    }
+
+    start := time.Now()
+    resp, err := tc.Do(hr)
+    if err != nil {
+        recordAttempt(tc.site, tc.account, 0, 0, time.Since(start))
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    b, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        recordAttempt(tc.site, tc.account, 0, len(b), time.Since(start))
+        return nil, err
+    }
+    recordAttempt(tc.site, tc.account, resp.StatusCode, len(b), time.Since(start))
+
+    if cached != nil && resp.StatusCode == http.StatusNotModified {
+        return cached.resp, nil
+    }
+
+    if resp.Header.Get("Content-Encoding") == "gzip" {
+        b = gunzip(b)
+        resp.Header.Del("Content-Encoding")
+        resp.Header.Del("Content-Length")
+    }
+
+    ret := &Response{resp.StatusCode, resp.Header, b}
+    if mode == RECORD {
+        record(dir, tc.site, req, ret)
+    }
+    if req.Method == "GET" {
+        validators.put(key, ret)
+    }
+    return ret, nil
+}
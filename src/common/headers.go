@@ -0,0 +1,76 @@
+package common
+
+import (
+    "fmt"
+    "errors"
+    "reflect"
+    "strings"
+    "net/http"
+)
+
+// accountOption reads option of account, then of site, then of common.
+func accountOption(site, account, option, def string) (string, error) {
+    value, err := Conf.raw(account, option)
+    if err != nil || value != "" {
+        return value, err
+    }
+    return Conf.String(site, option, def)
+}
+
+// loadHeaders builds the headers GetPage sends for account: user_agent,
+// accept_language and referer, plus headers as "Name: value|Name: value".
+func loadHeaders(site, account string) (http.Header, error) {
+    h := http.Header{}
+
+    for _, o := range([]struct{ option, name, def string }{
+        {"user_agent", "User-Agent", USER_AGENT},
+        {"accept_language", "Accept-Language", ""},
+        {"referer", "Referer", ""},
+    }) {
+        value, err := accountOption(site, account, o.option, o.def)
+        if err != nil {
+            return h, err
+        }
+        if value != "" {
+            h.Set(o.name, value)
+        }
+    }
+
+    extra, err := accountOption(site, account, "headers", "")
+    if err != nil {
+        return h, err
+    }
+    for _, line := range(strings.Split(extra, "|")) {
+        if strings.TrimSpace(line) == "" {
+            continue
+        }
+        i := strings.Index(line, ":")
+        if i <= 0 {
+            return h, errors.New(fmt.Sprintf("invalid header '%s' of account '%s'", line, account))
+        }
+        h.Add(strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:]))
+    }
+
+    return h, nil
+}
+
+// reloadHeaders applies changed header options to a running client.
+func reloadHeaders(site, account string) (bool, error) {
+    h, err := loadHeaders(site, account)
+    if err != nil {
+        return false, err
+    }
+
+    tc, ok := HttpClient.Get(account)
+    if !ok {
+        return false, nil
+    }
+
+    clientLock.Lock()
+    defer clientLock.Unlock()
+    if reflect.DeepEqual(tc.headers, h) {
+        return false, nil
+    }
+    tc.headers = h
+    return true, nil
+}
@@ -0,0 +1,364 @@
+package common
+
+import (
+    "html"
+    "bytes"
+    "strings"
+)
+
+// Node is an element or a text of a parsed page. Parsing is forgiving the
+// way browsers are: unclosed cells and rows end where the next one starts,
+// stray end tags are dropped, so small markup changes keep the tree shape.
+type Node struct {
+    // Tag is the lower case element name, empty for text.
+    Tag string
+    Attrs map[string]string
+    // Data is the unescaped text of a text node.
+    Data string
+    Parent *Node
+    Children []*Node
+}
+
+var voidElements = map[string]bool{
+    "area":true, "base":true, "br":true, "col":true, "embed":true, "hr":true, "img":true,
+    "input":true, "link":true, "meta":true, "param":true, "source":true, "track":true, "wbr":true,
+}
+
+// rawElements hold text up to their end tag, markup included.
+var rawElements = map[string]bool{"script":true, "style":true, "textarea":true, "title":true}
+
+// impliedEnd lists, for the elements that may be left open, the open
+// elements a new one closes, and where closing stops.
+var impliedEnd = map[string]struct{ closes, stops []string }{
+    "tr":{[]string{"tr", "td", "th"}, []string{"table", "thead", "tbody", "tfoot"}},
+    "td":{[]string{"td", "th"}, []string{"tr", "table"}},
+    "th":{[]string{"td", "th"}, []string{"tr", "table"}},
+    "thead":{[]string{"thead", "tbody", "tfoot", "tr", "td", "th"}, []string{"table"}},
+    "tbody":{[]string{"thead", "tbody", "tfoot", "tr", "td", "th"}, []string{"table"}},
+    "tfoot":{[]string{"thead", "tbody", "tfoot", "tr", "td", "th"}, []string{"table"}},
+    "li":{[]string{"li"}, []string{"ul", "ol"}},
+    "option":{[]string{"option"}, []string{"select"}},
+    "p":{[]string{"p"}, []string{"div", "td", "th", "li", "body"}},
+}
+
+func contains(list []string, s string) bool {
+    for _, v := range(list) {
+        if v == s {
+            return true
+        }
+    }
+    return false
+}
+
+// ParseHTML builds the tree of b, which should already be UTF-8. The root
+// returned has no tag and holds the top level nodes.
+func ParseHTML(b []byte) *Node {
+    root := &Node{}
+    cur := root
+
+    appendChild := func(n *Node) {
+        n.Parent = cur
+        cur.Children = append(cur.Children, n)
+    }
+    text := func(s []byte) {
+        if len(s) > 0 {
+            appendChild(&Node{Data:html.UnescapeString(string(s))})
+        }
+    }
+
+    for len(b) > 0 {
+        i := bytes.IndexByte(b, '<')
+        if i == -1 {
+            text(b)
+            break
+        }
+        text(b[:i])
+        b = b[i:]
+
+        switch {
+        case bytes.HasPrefix(b, []byte("<!--")):
+            end := bytes.Index(b[4:], []byte("-->"))
+            if end == -1 {
+                return root
+            }
+            b = b[4+end+3:]
+            continue
+        case bytes.HasPrefix(b, []byte("<!")), bytes.HasPrefix(b, []byte("<?")):
+            end := bytes.IndexByte(b, '>')
+            if end == -1 {
+                return root
+            }
+            b = b[end+1:]
+            continue
+        }
+
+        closing := len(b) > 1 && b[1] == '/'
+        start := 1
+        if closing {
+            start = 2
+        }
+        name, rest := tagName(b[start:])
+        if name == "" {
+            // a lone < in text.
+            text(b[:1])
+            b = b[1:]
+            continue
+        }
+
+        attrs, selfClosing, rest := tagAttrs(rest)
+        b = rest
+
+        if closing {
+            for n := cur; n != root; n = n.Parent {
+                if n.Tag == name {
+                    cur = n.Parent
+                    break
+                }
+            }
+            continue
+        }
+
+        if rule, ok := impliedEnd[name]; ok {
+            for n := cur; n != root && !contains(rule.stops, n.Tag); n = n.Parent {
+                if contains(rule.closes, n.Tag) {
+                    cur = n.Parent
+                }
+            }
+        }
+
+        n := &Node{Tag:name, Attrs:attrs}
+        appendChild(n)
+        if voidElements[name] || selfClosing {
+            continue
+        }
+        if rawElements[name] {
+            end := bytes.Index(bytes.ToLower(b), []byte("</" + name))
+            if end == -1 {
+                end = len(b)
+            }
+            if end > 0 {
+                raw := string(b[:end])
+                if name == "textarea" || name == "title" {
+                    raw = html.UnescapeString(raw)
+                }
+                n.Children = []*Node{{Data:raw, Parent:n}}
+            }
+            b = b[end:]
+            if gt := bytes.IndexByte(b, '>'); gt != -1 {
+                b = b[gt+1:]
+            }
+            continue
+        }
+        cur = n
+    }
+    return root
+}
+
+func isSpace(c byte) bool {
+    return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+// tagName reads the element name at the start of b.
+func tagName(b []byte) (string, []byte) {
+    i := 0
+    for i < len(b) && (b[i] >= 'a' && b[i] <= 'z' || b[i] >= 'A' && b[i] <= 'Z' || b[i] >= '0' && b[i] <= '9' || b[i] == '-' || b[i] == ':') {
+        i++
+    }
+    if i == 0 || !(b[0] >= 'a' && b[0] <= 'z' || b[0] >= 'A' && b[0] <= 'Z') {
+        return "", b
+    }
+    return strings.ToLower(string(b[:i])), b[i:]
+}
+
+// tagAttrs reads attributes up to the end of the tag.
+func tagAttrs(b []byte) (attrs map[string]string, selfClosing bool, rest []byte) {
+    attrs = make(map[string]string)
+    for {
+        for len(b) > 0 && isSpace(b[0]) {
+            b = b[1:]
+        }
+        if len(b) == 0 {
+            return attrs, false, b
+        }
+        if b[0] == '>' {
+            return attrs, false, b[1:]
+        }
+        if b[0] == '/' {
+            if len(b) > 1 && b[1] == '>' {
+                return attrs, true, b[2:]
+            }
+            b = b[1:]
+            continue
+        }
+
+        i := 0
+        for i < len(b) && !isSpace(b[i]) && b[i] != '=' && b[i] != '>' && !(b[i] == '/' && i + 1 < len(b) && b[i+1] == '>') {
+            i++
+        }
+        key := strings.ToLower(string(b[:i]))
+        b = b[i:]
+        for len(b) > 0 && isSpace(b[0]) {
+            b = b[1:]
+        }
+
+        value := ""
+        if len(b) > 0 && b[0] == '=' {
+            b = b[1:]
+            for len(b) > 0 && isSpace(b[0]) {
+                b = b[1:]
+            }
+            if len(b) > 0 && (b[0] == '"' || b[0] == '\'') {
+                q := b[0]
+                end := bytes.IndexByte(b[1:], q)
+                if end == -1 {
+                    end = len(b) - 1
+                }
+                value = string(b[1:1+end])
+                b = b[min(len(b), 2+end):]
+            } else {
+                j := 0
+                for j < len(b) && !isSpace(b[j]) && b[j] != '>' {
+                    j++
+                }
+                value = string(b[:j])
+                b = b[j:]
+            }
+        }
+        if key != "" {
+            if _, ok := attrs[key]; !ok {
+                attrs[key] = html.UnescapeString(value)
+            }
+        }
+    }
+}
+
+// Attr returns the value of attribute name, empty if it is not set.
+func (n *Node) Attr(name string) string {
+    return n.Attrs[name]
+}
+
+// HasClass tells whether class is one of the classes of n.
+func (n *Node) HasClass(class string) bool {
+    for _, c := range(strings.Fields(n.Attrs["class"])) {
+        if c == class {
+            return true
+        }
+    }
+    return false
+}
+
+// Find returns the first node below n, depth first, that match accepts.
+func (n *Node) Find(match func(*Node) bool) *Node {
+    for _, c := range(n.Children) {
+        if match(c) {
+            return c
+        }
+        if found := c.Find(match); found != nil {
+            return found
+        }
+    }
+    return nil
+}
+
+// FindAll returns every node below n that match accepts, in page order.
+// It does not look inside the nodes it returns.
+func (n *Node) FindAll(match func(*Node) bool) []*Node {
+    var found []*Node
+    for _, c := range(n.Children) {
+        if match(c) {
+            found = append(found, c)
+            continue
+        }
+        found = append(found, c.FindAll(match)...)
+    }
+    return found
+}
+
+// Elements returns the element children of n named tag.
+func (n *Node) Elements(tag string) []*Node {
+    var list []*Node
+    for _, c := range(n.Children) {
+        if c.Tag == tag {
+            list = append(list, c)
+        }
+    }
+    return list
+}
+
+// Text returns the text below n with runs of white space made one space.
+func (n *Node) Text() string {
+    var b strings.Builder
+    n.text(&b, nil)
+    return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// TextWithout is Text leaving out the elements skip accepts, eg. the
+// currency sign in an <i> before a price.
+func (n *Node) TextWithout(skip func(*Node) bool) string {
+    var b strings.Builder
+    n.text(&b, skip)
+    return strings.Join(strings.Fields(b.String()), " ")
+}
+
+func (n *Node) text(b *strings.Builder, skip func(*Node) bool) {
+    if n.Tag == "" {
+        b.WriteString(n.Data)
+    }
+    if n.Tag == "script" || n.Tag == "style" {
+        return
+    }
+    for _, c := range(n.Children) {
+        if c.Tag != "" && skip != nil && skip(c) {
+            continue
+        }
+        if c.Tag == "br" || c.Tag == "td" || c.Tag == "th" {
+            b.WriteString(" ")
+        }
+        c.text(b, skip)
+    }
+}
+
+// ByTag matches elements named tag.
+func ByTag(tag string) func(*Node) bool {
+    return func(n *Node) bool {
+        return n.Tag == tag
+    }
+}
+
+// ByClass matches elements named tag, any element when tag is empty, that
+// have class.
+func ByClass(tag, class string) func(*Node) bool {
+    return func(n *Node) bool {
+        return n.Tag != "" && (tag == "" || n.Tag == tag) && n.HasClass(class)
+    }
+}
+
+// Snippet returns about n bytes of b from a little before the first of
+// marks found, from the start when none is, with white space made one
+// space. It is for errors and logs: the place a parser looked at, not
+// the whole page.
+func Snippet(b []byte, n int, marks ...string) string {
+    at := 0
+    for _, m := range(marks) {
+        if i := bytes.Index(b, []byte(m)); i != -1 {
+            at = i
+            break
+        }
+    }
+    start := at - n / 4
+    if start < 0 {
+        start = 0
+    }
+    end := start + n
+    if end > len(b) {
+        end = len(b)
+    }
+    // not in the middle of a utf-8 character.
+    for start > 0 && b[start] & 0xc0 == 0x80 {
+        start--
+    }
+    for end < len(b) && b[end] & 0xc0 == 0x80 {
+        end++
+    }
+    return strings.Join(strings.Fields(string(b[start:end])), " ")
+}
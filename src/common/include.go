@@ -0,0 +1,163 @@
+package common
+
+import (
+    "fmt"
+    "bytes"
+    "errors"
+    "strings"
+    "io/ioutil"
+    "path/filepath"
+    config "github.com/goconf"
+)
+
+// INCLUDE pulls more files into the config, in a .conf as a line of its
+// own and in YAML or JSON as a top level key:
+//
+//   include conf/accounts/*.conf
+//
+// Patterns are relative to the working directory, like -config, and the
+// files matched are read in name order after the file including them. An
+// option may only be set in one of the files.
+const INCLUDE = "include"
+
+// readConfig reads file and everything it includes. origins tells which
+// file each section.option was read from.
+func readConfig(file string) (c *config.ConfigFile, origins map[string]string, err error) {
+    c = config.NewConfigFile()
+    origins = make(map[string]string)
+    if err = includeFile(c, origins, file, nil); err != nil {
+        return nil, nil, err
+    }
+    return c, origins, nil
+}
+
+// includeFile merges file, then the files it includes, into c. stack is
+// the chain of files that led to file, to catch an include cycle.
+func includeFile(c *config.ConfigFile, origins map[string]string, file string, stack []string) error {
+    abs, err := filepath.Abs(file)
+    if err != nil {
+        return err
+    }
+    for i, f := range(stack) {
+        if f == abs {
+            return errors.New(fmt.Sprintf("include cycle: %s -> %s", strings.Join(stack[i:], " -> "), abs))
+        }
+    }
+
+    one, includes, err := readFile(file)
+    if err != nil {
+        return err
+    }
+    return mergeAll(c, origins, one, includes, file, append(stack, abs))
+}
+
+// mergeAll merges one, read from file, and then the files it includes.
+func mergeAll(c *config.ConfigFile, origins map[string]string, one *config.ConfigFile, includes []string, file string, stack []string) error {
+    if err := merge(c, origins, one, file); err != nil {
+        return err
+    }
+
+    for _, pattern := range(includes) {
+        files, err := filepath.Glob(pattern)
+        if err != nil {
+            return errors.New(fmt.Sprintf("%s: bad include '%s': %s", file, pattern, err.Error()))
+        }
+        if len(files) == 0 && !strings.ContainsAny(pattern, "*?[") {
+            return errors.New(fmt.Sprintf("%s: included file %s not found", file, pattern))
+        }
+        for _, f := range(files) {
+            if err = includeFile(c, origins, f, stack); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+// merge adds the options of one, read from file, to c.
+func merge(c *config.ConfigFile, origins map[string]string, one *config.ConfigFile, file string) error {
+    defaults, _ := one.GetOptions(config.DefaultSection)
+    isDefault := make(map[string]bool)
+    for _, option := range(defaults) {
+        isDefault[option] = true
+    }
+
+    for _, section := range(one.GetSections()) {
+        c.AddSection(section)
+        options, _ := one.GetOptions(section)
+        for _, option := range(options) {
+            value, err := one.GetRawString(section, option)
+            if err != nil {
+                continue
+            }
+            // GetOptions lists the default section's options in every section.
+            if section != config.DefaultSection && isDefault[option] {
+                if def, _ := one.GetRawString(config.DefaultSection, option); def == value {
+                    continue
+                }
+            }
+
+            key := section + "." + option
+            if where, ok := origins[key]; ok && where != file {
+                return errors.New(fmt.Sprintf("%s: option '%s' of [%s] is already set in %s", file, option, section, where))
+            }
+            origins[key] = file
+            c.AddOption(section, option, value)
+        }
+    }
+    return nil
+}
+
+// readIni reads the goconf format, taking include lines out first since
+// goconf would read them as the continuation of the option above.
+func readIni(file string) (*config.ConfigFile, []string, error) {
+    b, err := ioutil.ReadFile(file)
+    if err != nil {
+        return nil, nil, err
+    }
+    return parseIni(file, b)
+}
+
+// parseIni is readIni of b, with errors naming file.
+func parseIni(file string, b []byte) (*config.ConfigFile, []string, error) {
+    var includes []string
+    lines := strings.Split(strings.Replace(string(b), "\r\n", "\n", -1), "\n")
+    for i, line := range(lines) {
+        trimmed := strings.TrimSpace(line)
+        if strings.HasPrefix(trimmed, INCLUDE + " ") || strings.HasPrefix(trimmed, INCLUDE + "\t") {
+            includes = append(includes, splitIncludes(stripInlineComment(trimmed[len(INCLUDE):]))...)
+            lines[i] = ""
+        }
+    }
+
+    c := config.NewConfigFile()
+    if err := c.Read(bytes.NewBufferString(strings.Join(lines, "\n"))); err != nil {
+        if e, ok := err.(config.ReadError); ok {
+            for n, line := range(lines) {
+                if strings.TrimSpace(line) == e.Line {
+                    return nil, nil, errors.New(fmt.Sprintf("%s:%d: %s", file, n + 1, err.Error()))
+                }
+            }
+        }
+        return nil, nil, errors.New(fmt.Sprintf("%s: %s", file, err.Error()))
+    }
+    return c, includes, nil
+}
+
+// stripInlineComment cuts a " ;" or " #" comment, as goconf does.
+func stripInlineComment(s string) string {
+    for _, mark := range([]string{" ;", "\t;", " #", "\t#"}) {
+        if i := strings.Index(s, mark); i != -1 {
+            s = s[:i]
+        }
+    }
+    return s
+}
+
+// splitIncludes splits the patterns of one include, separated by commas
+// or spaces.
+func splitIncludes(s string) []string {
+    return strings.FieldsFunc(s, func(r rune) bool {
+        return r == ',' || r == ' ' || r == '\t'
+    })
+}
@@ -0,0 +1,114 @@
+package common
+
+import (
+    "sync"
+    "time"
+    "errors"
+    "context"
+)
+
+var ErrBusy = errors.New("too many upstream fetches in progress, try again later")
+
+// Semaphore is a counting semaphore; nil means unlimited.
+type Semaphore chan bool
+
+func NewSemaphore(n int) Semaphore {
+    if n <= 0 {
+        return nil
+    }
+    return make(Semaphore, n)
+}
+
+// Acquire waits for a free slot until timeout fires, returning ErrBusy,
+// or ctx is done.
+func (s Semaphore) Acquire(ctx context.Context, timeout <-chan time.Time) error {
+    if s == nil {
+        return nil
+    }
+
+    select {
+    case s <- true:
+        return nil
+    case <-timeout:
+        return ErrBusy
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+// TryAcquire takes a slot only if one is free right now.
+func (s Semaphore) TryAcquire() bool {
+    if s == nil {
+        return true
+    }
+
+    select {
+    case s <- true:
+        return true
+    default:
+        return false
+    }
+}
+
+func (s Semaphore) Release() {
+    if s != nil {
+        <-s
+    }
+}
+
+// accountFetches limit the scrapes of one account, upstream sites find
+// parallel sessions of an account suspicious. They are made on first use
+// with account_fetches of the site.
+var accountFetches map[string]Semaphore = make(map[string]Semaphore)
+var accountLock sync.Mutex
+
+func accountSemaphore(site, account string) Semaphore {
+    accountLock.Lock()
+    defer accountLock.Unlock()
+
+    key := site + "|" + account
+    s, ok := accountFetches[key]
+    if !ok {
+        n, err := Conf.Int(site, "account_fetches", 1)
+        if err != nil {
+            n = 1
+        }
+        s = NewSemaphore(n)
+        accountFetches[key] = s
+    }
+    return s
+}
+
+type accountSlot string
+
+// AcquireAccount takes a slot of account for a scrape, waiting for one at
+// most fetch_queue_timeout. Everything fetched with the returned context
+// runs in that slot; a ctx that already holds it is returned as is, so a
+// scrape may call others. FetchCtx takes a slot for each request made
+// outside a scrape.
+func AcquireAccount(ctx context.Context, site, account string) (context.Context, func(), error) {
+    key := accountSlot(site + "|" + account)
+    if ctx.Value(key) != nil {
+        return ctx, func() {}, nil
+    }
+
+    wait, err := Conf.Duration("common", "fetch_queue_timeout", 10 * time.Second)
+    if err != nil {
+        return nil, nil, err
+    }
+    s := accountSemaphore(site, account)
+    if err = s.Acquire(ctx, time.After(wait)); err != nil {
+        return nil, nil, err
+    }
+    return context.WithValue(ctx, key, true), s.Release, nil
+}
+
+// accountIdle takes a slot of account when a scrape leaves one free, for
+// a request that may as well be skipped. release is nil when it is busy.
+func accountIdle(site, account string) (release func()) {
+    s := accountSemaphore(site, account)
+    if !s.TryAcquire() {
+        return nil
+    }
+    return s.Release
+}
@@ -1,11 +1,68 @@
 package common
 
 import (
+    "strings"
+    "errors"
     log "code.google.com/p/log4go"
 )
 
-func init() {
-    log.LoadConfiguration("conf/log4go.xml")
+// LOG_CONFIG is the log4go config main loads at start.
+const LOG_CONFIG = "conf/log4go.xml"
+
+// LoadLogConfig sets log4go up from file. It is not done at import since
+// log4go exits when the file is missing, which would stop any test.
+func LoadLogConfig(file string) {
+    log.LoadConfiguration(file)
+}
+
+var logLevels = map[string]func(*log.Filter){
+    "FINEST":func(f *log.Filter) { f.Level = log.FINEST },
+    "FINE":func(f *log.Filter) { f.Level = log.FINE },
+    "DEBUG":func(f *log.Filter) { f.Level = log.DEBUG },
+    "TRACE":func(f *log.Filter) { f.Level = log.TRACE },
+    "INFO":func(f *log.Filter) { f.Level = log.INFO },
+    "WARNING":func(f *log.Filter) { f.Level = log.WARNING },
+    "ERROR":func(f *log.Filter) { f.Level = log.ERROR },
+    "CRITICAL":func(f *log.Filter) { f.Level = log.CRITICAL },
 }
 
+// xmlLevels put the filters back to the levels of log4go.xml.
+var xmlLevels []func()
+var logLevel string
 
+// LoadLogLevel applies log_level of [common] to every log filter; empty
+// keeps the levels of conf/log4go.xml. It returns what changed, if any.
+func LoadLogLevel() (string, error) {
+    level, err := Conf.String("common", "log_level", "")
+    if err != nil {
+        return "", err
+    }
+    level = strings.ToUpper(strings.TrimSpace(level))
+    set, ok := logLevels[level]
+    if level != "" && !ok {
+        return "", errors.New("invalid log_level '" + level + "', expect FINEST, FINE, DEBUG, TRACE, INFO, WARNING, ERROR or CRITICAL")
+    }
+    if level == logLevel {
+        return "", nil
+    }
+
+    if xmlLevels == nil {
+        for _, f := range(log.Global) {
+            f, orig := f, f.Level
+            xmlLevels = append(xmlLevels, func() { f.Level = orig })
+        }
+    }
+    if level == "" {
+        for _, restore := range(xmlLevels) {
+            restore()
+        }
+    } else {
+        for _, f := range(log.Global) {
+            set(f)
+        }
+    }
+
+    change := "log_level: " + logLevel + " -> " + level
+    logLevel = level
+    return change, nil
+}
@@ -2,10 +2,12 @@ package common
 
 import (
     "fmt"
+    "context"
+    "sync"
     "time"
     "errors"
+    "reflect"
     "strings"
-    "io/ioutil"
     "net/url"
     "net/http"
     "github.com/cookiejar"
@@ -13,104 +15,654 @@ import (
 )
 
 
+const USER_AGENT = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_8_3) AppleWebKit/537.17 (KHTML, like Gecko) Chrome/24.0.1312.57 Safari/537.17"
+
 type TaokeClient struct {
     http.Client
     url string
+    account string
+    site string
+    cookies string
+    stop chan bool
+    headers http.Header
+    pace pacer
 }
 
 
 func (tc *TaokeClient) keepalive(sitek string) {
+    // stopping the client aborts a keepalive in flight.
+    ctx, cancel := context.WithCancel(context.Background())
+    go func() {
+        <-tc.stop
+        cancel()
+    }()
+
     go func() {
         for {
-            time.Sleep(time.Second * 60)
-            _, _ = tc.Get("http://www.alimama.com/")
+            select {
+            case <-tc.stop:
+                return
+            case <-time.After(keepaliveInterval(tc.site)):
+            }
+
+            // a scrape of the account keeps the session alive itself.
+            release := accountIdle(tc.site, tc.account)
+            if release == nil {
+                continue
+            }
+            resp, err := tc.send(ctx, Request{Method:"GET", URL:sitek})
+            release()
+            if ctx.Err() != nil {
+                return
+            }
+            if err == nil && resp.Status >= 400 {
+                err = &ErrUpstreamStatus{resp.Status}
+            }
+            if err == nil && isLoginPage(tc.site, resp.Body) {
+                err = ErrNeedLogin
+            }
+            reportKeepalive(tc.account, err)
+
+            if errors.Is(err, ErrNeedLogin) && tc.expired() {
+                return
+            }
         }
     }()
 }
 
+// expired tries to log the account of tc in again once keepalive found
+// its session dead. It returns true when tc was replaced by a new client,
+// which runs its own keepalive.
+func (tc *TaokeClient) expired() bool {
+    if err := refresh(tc.site, tc.account, tc); err != nil {
+        log.Warn("relogin %s account %s failed: %s", tc.site, tc.account, err.Error())
+        return false
+    }
+
+    log.Info("Session of %s account %s recovered.", tc.site, tc.account)
+    return true
+}
+
+
+var HttpClient *ClientRegistry = NewClientRegistry()
+
+// clientLock guards the per site settings below and the headers of clients.
+var clientLock sync.RWMutex
+
+
+type siteInfo struct {
+    sitek string
+    ustr string
+    keepalive time.Duration
+    retry *retryPolicy
+    pace *pacer
+    tuning transportConfig
+    transport *http.Transport
+    groups [][]string
+}
+
+// sites remembers how each site was logged in, for Relogin and reloads.
+// It is guarded by clientLock.
+var sites map[string]*siteInfo = make(map[string]*siteInfo)
+
+
+func keepaliveInterval(site string) time.Duration {
+    clientLock.RLock()
+    defer clientLock.RUnlock()
+    return sites[site].keepalive
+}
+
+func loadKeepalive(site string) (time.Duration, error) {
+    d, err := Conf.Duration(site, "keepalive", 60 * time.Second)
+    if err != nil {
+        return 0, err
+    }
+    if d <= 0 {
+        return 0, errors.New(fmt.Sprintf("invalid keepalive %s for site '%s'", d, site))
+    }
+    return d, nil
+}
+
+
+// Accounts returns the account names configured for site.
+func Accounts(site string) ([]string, error) {
+    accountstr, err := Conf.String(site, "accounts", "")
+    if err != nil {
+        return nil, err
+    }
+
+    if accountstr == "" {
+        return nil, errors.New("accounts not found in config.")
+    }
+
+    return strings.Split(accountstr, ","), nil
+}
+
+func parseCookies(cookiestr string) ([]*http.Cookie, error) {
+    cos := strings.Split(cookiestr, ";")
+
+    cookies := []*http.Cookie{}
+
+    for _, co := range(cos) {
+
+        in := strings.Index(co, "=")
+        if in == -1 {
+            return nil, errors.New("Invalid cookies")
+        }
+
+        c := &http.Cookie{
+            Name:co[:in],
+            Value:co[in+1:],
+            Raw:co,
+        }
+        cookies = append(cookies, c)
+    }
+
+    return cookies, nil
+}
+
+// loginAccount builds a client for account from cookiestr, replacing and
+// stopping any previous client of that account.
+func loginAccount(site, account, cookiestr string) error {
+    clientLock.RLock()
+    info, ok := sites[site]
+    clientLock.RUnlock()
+    if !ok {
+        return errors.New(fmt.Sprintf("site '%s' not logged in", site))
+    }
+
+    u, err := url.Parse(info.ustr)
+    if err != nil {
+        return err
+    }
+
+    if cookiestr == "" {
+        return errors.New("Cookies not found in config.")
+    }
+
+    jar := cookiejar.NewJar(false)
+
+    if strings.HasPrefix(cookiestr, COOKIE_FILE) {
+        cookies, err := readCookieFile(cookieFilePath(cookiestr))
+        if err != nil {
+            return err
+        }
+        jar.Add(cookies)
+    } else {
+        cookies, err := parseCookies(cookiestr)
+        if err != nil {
+            return err
+        }
+        jar.SetCookies(u, cookies)
+    }
+
+    installClient(info, &TaokeClient{http.Client{Jar:jar, Transport:&proxyTransport{site, account}}, info.ustr, account, site, cookiestr, make(chan bool), nil, pacer{}})
+
+    return nil
+}
+
+// installClient makes tc the client of its account, stopping the old one.
+func installClient(info *siteInfo, tc *TaokeClient) {
+    headers, err := loadHeaders(tc.site, tc.account)
+    if err != nil {
+        log.Warn("headers of account %s: %s", tc.account, err.Error())
+    }
+    tc.headers = headers
+
+    interval, jitter, err := loadAccountPace(tc.site, tc.account)
+    if err != nil {
+        log.Warn("pace of account %s: %s", tc.account, err.Error())
+    }
+    tc.pace.set(interval, jitter)
+
+    old, found := HttpClient.Put(tc)
 
-var HttpClient map[string]*TaokeClient = make(map[string]*TaokeClient)
+    if found {
+        close(old.stop)
+    }
 
+    setLoggedIn(tc.site, tc.account, true)
+    tc.keepalive(info.sitek)
+}
+
+// A PasswordLogin logs a site in as username with client, leaving the
+// session cookies in the client's jar.
+type PasswordLogin func(ctx context.Context, client *http.Client, username, password string) error
+
+var passwordLogins map[string]PasswordLogin = make(map[string]PasswordLogin)
+
+// RegisterPasswordLogin makes accounts of site that have a username and
+// password in config, instead of cookies, log in with fn.
+func RegisterPasswordLogin(site string, fn PasswordLogin) {
+    clientLock.Lock()
+    defer clientLock.Unlock()
+    passwordLogins[site] = fn
+}
+
+func credentials(site, account string) (fn PasswordLogin, username, password string, err error) {
+    if fn, err = siteLogin(site); err != nil || fn == nil {
+        return nil, "", "", err
+    }
+
+    if username, err = Conf.String(account, "username", ""); err != nil || username == "" {
+        return nil, "", "", err
+    }
+    if password, err = Conf.raw(account, "password"); err != nil {
+        return nil, "", "", err
+    }
+    return fn, username, password, nil
+}
+
+// passwordLogin logs account in with its configured username and password.
+func passwordLogin(site, account string) error {
+    fn, username, password, err := credentials(site, account)
+    if err != nil {
+        return err
+    }
+    if fn == nil {
+        return errors.New(fmt.Sprintf("no username and password for account '%s'", account))
+    }
+
+    clientLock.RLock()
+    info, ok := sites[site]
+    clientLock.RUnlock()
+    if !ok {
+        return errors.New(fmt.Sprintf("site '%s' not logged in", site))
+    }
+
+    timeout, err := Conf.Duration(site, "login_timeout", 60 * time.Second)
+    if err != nil {
+        return err
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+
+    tc := &TaokeClient{http.Client{Jar:cookiejar.NewJar(false), Transport:&proxyTransport{site, account}}, info.ustr, account, site, "", make(chan bool), nil, pacer{}}
+    if err = fn(ctx, &tc.Client, username, password); err != nil {
+        return errors.New(fmt.Sprintf("login account '%s' failed: %s", account, err.Error()))
+    }
+
+    installClient(info, tc)
+    log.Info("Logged in %s account %s as %s.", site, account, username)
+
+    return nil
+}
+
+// startSession logs account in from cookiestr, or with its password when
+// there are no cookies and the site supports it.
+func startSession(site, account, cookiestr string) error {
+    if cookiestr == "" {
+        if fn, _, _, err := credentials(site, account); err == nil && fn != nil {
+            return passwordLogin(site, account)
+        }
+    }
+    return loginAccount(site, account, cookiestr)
+}
 
 func Login(site, sitek, ustr string) error {
 
-    u, err := url.Parse(ustr)
+    if _, err := url.Parse(ustr); err != nil {
+        return err
+    }
+
+    keepalive, err := loadKeepalive(site)
     if err != nil {
         return err
     }
 
-    accountstr, err := Conf.String(site, "accounts", "")
+    retry, err := loadRetry(site)
     if err != nil {
         return err
     }
 
-    if accountstr == "" {
-        return errors.New("accounts not found in config.")
+    if err = loadValidatorCache(); err != nil {
+        return err
+    }
+
+    if err = loadRecorder(); err != nil {
+        return err
+    }
+
+    interval, jitter, err := loadSitePace(site)
+    if err != nil {
+        return err
+    }
+    pace := &pacer{}
+    pace.set(interval, jitter)
+
+    tuning, err := loadTransportConfig(site)
+    if err != nil {
+        return err
+    }
+    transport, err := newTransport(tuning)
+    if err != nil {
+        return err
     }
 
-    accounts := strings.Split(accountstr, ",")
+    groups, err := loadGroups(site)
+    if err != nil {
+        return err
+    }
+
+    clientLock.Lock()
+    sites[site] = &siteInfo{sitek, ustr, keepalive, retry, pace, tuning, transport, groups}
+    clientLock.Unlock()
+
+    accounts, err := Accounts(site)
+    if err != nil {
+        return err
+    }
 
     for _, account := range(accounts) {
-        cookiestr, err := Conf.String(account, "cookies", "")
+        ac, err := Conf.Account(site, account)
         if err != nil {
             return err
         }
-
-        if cookiestr == "" {
-            return errors.New("Cookies not found in config.")
+        if !ac.Enabled {
+            log.Info("Account %s of %s is disabled.", account, site)
+            continue
         }
 
         log.Info("Read url and cookie from config of %s.", site)
 
-        cos := strings.Split(cookiestr, ";")
+        if err = startSession(site, account, ac.Cookies); err != nil {
+            return err
+        }
 
-        cookies := []*http.Cookie{}
+        if err = restoreCookies(site, account); err != nil {
+            log.Warn("restore cookies of account %s: %s", account, err.Error())
+        }
+    }
 
-        for _, co := range(cos) {
+    startCookieSaver()
 
-            in := strings.Index(co, "=")
-            if in == -1 {
-                return errors.New("Invalid cookies")
-            }
+    log.Info("Parse cookie and url successed.")
 
-            c := &http.Cookie{
-                Name:co[:in],
-                Value:co[in+1:],
-                Raw:co,
-            }
-            cookies = append(cookies, c)
+    return nil
+}
+
+// Relogin rebuilds the client of account with cookiestr, or with the
+// cookies from a freshly read config file when cookiestr is empty. An
+// account of another site is not found.
+func Relogin(site, account, cookiestr string) error {
+    if tc, found := HttpClient.Get(account); !found || tc.site != site {
+        return notFound(account)
+    }
+
+    if cookiestr == "" {
+        fresh, err := Conf.reread()
+        if err != nil {
+            return err
         }
 
-        jar := cookiejar.NewJar(false)
+        if cookiestr, err = cookieSource(fresh, account); err != nil {
+            return err
+        }
+    }
 
-        jar.SetCookies(u, cookies)
+    if err := startSession(site, account, cookiestr); err != nil {
+        return err
+    }
 
-        tc := &TaokeClient{http.Client{Jar:jar}, ustr}
-        HttpClient[account] = tc
-        tc.keepalive(sitek)
+    log.Info("Relogin %s account %s.", site, account)
+
+    return nil
+}
+
+
+func removeAccount(account string) {
+    tc, found := HttpClient.Delete(account)
+
+    if found {
+        close(tc.stop)
     }
 
-    log.Info("Parse cookie and url successed.")
+    stateLock.Lock()
+    delete(states, account)
+    stateLock.Unlock()
+
+    clientLock.Lock()
+    delete(hotAccounts, account)
+    clientLock.Unlock()
+}
+
+// hotAccounts were added by AddAccount, not by config, so SyncAccounts
+// leaves them alone. It is guarded by clientLock.
+var hotAccounts map[string]bool = make(map[string]bool)
+
+// AddAccount logs a new account of site in with cookiestr at runtime. It
+// lasts until RemoveAccount or a restart.
+func AddAccount(site, account, cookiestr string) error {
+    if account == "" || strings.ContainsAny(account, "[]|") {
+        return errors.New(fmt.Sprintf("invalid account name '%s'", account))
+    }
+
+    if _, found := HttpClient.Get(account); found {
+        return errors.New(fmt.Sprintf("account '%s' already exists", account))
+    }
+
+    if err := loginAccount(site, account, cookiestr); err != nil {
+        return err
+    }
+
+    clientLock.Lock()
+    hotAccounts[account] = true
+    clientLock.Unlock()
 
+    log.Info("Added %s account %s.", site, account)
     return nil
 }
 
+// RemoveAccount stops the keepalive of an account of site and drops its
+// client and state.
+func RemoveAccount(site, account string) error {
+    tc, found := HttpClient.Get(account)
+    if !found || tc.site != site {
+        return notFound(account)
+    }
 
-func GetPage(account, u string) (body []byte, err error) {
+    removeAccount(account)
+    log.Info("Removed %s account %s.", site, account)
+    return nil
+}
+
+// SiteAccounts returns the accounts of site that have a client, those from
+// config and those added at runtime, sorted.
+func SiteAccounts(site string) ([]string, error) {
+    accounts := []string{}
+    HttpClient.Range(func(account string, tc *TaokeClient) bool {
+        if tc.site == site {
+            accounts = append(accounts, account)
+        }
+        return true
+    })
+
+    if len(accounts) == 0 {
+        return nil, errors.New(fmt.Sprintf("no accounts for site '%s'", site))
+    }
+    return accounts, nil
+}
+
+// SyncAccounts applies the current config of site to its clients: new
+// accounts are logged in, dropped ones removed, and accounts whose cookies
+// changed are rebuilt. It returns a description of each change.
+func SyncAccounts(site string) (changes []string, err error) {
+    keepalive, err := loadKeepalive(site)
+    if err != nil {
+        return nil, err
+    }
+
+    retry, err := loadRetry(site)
+    if err != nil {
+        return nil, err
+    }
+
+    if err = loadValidatorCache(); err != nil {
+        return nil, err
+    }
+
+    if err = loadRecorder(); err != nil {
+        return nil, err
+    }
 
-    client, ok := HttpClient[account]
+    interval, jitter, err := loadSitePace(site)
+    if err != nil {
+        return nil, err
+    }
+
+    tuning, err := loadTransportConfig(site)
+    if err != nil {
+        return nil, err
+    }
+    transport, err := newTransport(tuning)
+    if err != nil {
+        return nil, err
+    }
+
+    groups, err := loadGroups(site)
+    if err != nil {
+        return nil, err
+    }
+
+    accounts, err := Accounts(site)
+    if err != nil {
+        return nil, err
+    }
+
+    want := make(map[string]string)
+    for _, account := range(accounts) {
+        ac, err := Conf.Account(site, account)
+        if err != nil {
+            return nil, err
+        }
+        // disabled accounts are removed like ones left out of accounts.
+        if ac.Enabled {
+            want[account] = ac.Cookies
+        }
+    }
+
+    clientLock.Lock()
+    info, ok := sites[site]
     if !ok {
-        return nil, errors.New(fmt.Sprintf("account '%s' notfound", account))
+        clientLock.Unlock()
+        return nil, errors.New(fmt.Sprintf("site '%s' not logged in", site))
     }
+    if info.keepalive != keepalive {
+        changes = append(changes, fmt.Sprintf("%s: keepalive %s -> %s", site, info.keepalive, keepalive))
+        info.keepalive = keepalive
+    }
+    if !reflect.DeepEqual(info.retry, retry) {
+        changes = append(changes, fmt.Sprintf("%s: retry policy changed", site))
+        info.retry = retry
+    }
+    if info.pace.set(interval, jitter) {
+        changes = append(changes, fmt.Sprintf("%s: pace changed to %s", site, interval))
+    }
+    if info.tuning != tuning {
+        changes = append(changes, fmt.Sprintf("%s: transport settings changed", site))
+        info.tuning = tuning
+        info.transport.CloseIdleConnections()
+        info.transport = transport
+    }
+    if !reflect.DeepEqual(info.groups, groups) {
+        changes = append(changes, fmt.Sprintf("%s: failover groups changed", site))
+        info.groups = groups
+    }
+    hot := make(map[string]bool)
+    for account := range(hotAccounts) {
+        hot[account] = true
+    }
+    clientLock.Unlock()
+
+    have := make(map[string]string)
+    HttpClient.Range(func(account string, tc *TaokeClient) bool {
+        if tc.site == site && !hot[account] {
+            have[account] = tc.cookies
+        }
+        return true
+    })
 
-    req, err := http.NewRequest("GET", u, nil)
-    req.Header.Add("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_8_3) AppleWebKit/537.17 (KHTML, like Gecko) Chrome/24.0.1312.57 Safari/537.17")
-    resp, e := client.Do(req)
-    if e != nil {
-        return nil, e
+    for account := range(have) {
+        if _, ok := want[account]; !ok {
+            continue
+        }
+        changed, err := reloadHeaders(site, account)
+        if err != nil {
+            return changes, err
+        }
+        if changed {
+            changes = append(changes, fmt.Sprintf("%s: headers changed for account %s", site, account))
+        }
+        if changed, err = reloadAccountPace(site, account); err != nil {
+            return changes, err
+        }
+        if changed {
+            changes = append(changes, fmt.Sprintf("%s: pace changed for account %s", site, account))
+        }
+    }
+
+    for account := range(have) {
+        if _, ok := want[account]; !ok {
+            removeAccount(account)
+            changes = append(changes, fmt.Sprintf("%s: removed account %s", site, account))
+        }
+    }
+
+    for _, account := range(accounts) {
+        cookiestr, enabled := want[account]
+        if !enabled {
+            continue
+        }
+        old, ok := have[account]
+        if ok && old == cookiestr {
+            continue
+        }
+
+        if err = startSession(site, account, cookiestr); err != nil {
+            return changes, err
+        }
+
+        // a config account of the same name takes over a runtime one.
+        clientLock.Lock()
+        delete(hotAccounts, account)
+        clientLock.Unlock()
+
+        if ok {
+            changes = append(changes, fmt.Sprintf("%s: cookies changed for account %s", site, account))
+        } else {
+            changes = append(changes, fmt.Sprintf("%s: added account %s", site, account))
+        }
+    }
+
+    return changes, nil
+}
+
+// Cookies returns the cookies the client of account sends to u.
+func Cookies(account, u string) ([]*http.Cookie, error) {
+    client, ok := HttpClient.Get(account)
+    if !ok {
+        return nil, notFound(account)
     }
+    pu, err := url.Parse(u)
+    if err != nil {
+        return nil, err
+    }
+    return client.Jar.Cookies(pu), nil
+}
+
+// GetPage is GetPageCtx without a deadline; callers that serve a request
+// should use GetPageCtx with the request's context.
+func GetPage(account, u string) (body []byte, err error) {
+    return GetPageCtx(context.Background(), account, u)
+}
 
-    body, err = ioutil.ReadAll(resp.Body)
 
-    return
+// GetPageCtx is GetPage bounded by ctx; cancelling ctx aborts the request.
+// Failed requests are retried by the retry policy of the account's site.
+func GetPageCtx(ctx context.Context, account, u string) (body []byte, err error) {
+    resp, err := FetchCtx(ctx, account, Request{Method:"GET", URL:u})
+    if err != nil {
+        return nil, err
+    }
+    return resp.Body, nil
 }
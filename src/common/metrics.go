@@ -0,0 +1,168 @@
+package common
+
+import (
+    "sort"
+    "sync"
+    "time"
+)
+
+// LATENCY_BUCKETS are the upper bounds, in seconds, of the latency
+// histogram of upstream requests.
+var LATENCY_BUCKETS = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Histogram counts observations into buckets. Counts has one more entry
+// than Bounds, for what is above the last bound.
+type Histogram struct {
+    Bounds []float64 `json:"bounds"`
+    Counts []int64 `json:"counts"`
+    Sum float64 `json:"sum"`
+    Count int64 `json:"count"`
+}
+
+func (h *Histogram) observe(v float64) {
+    i := sort.SearchFloat64s(h.Bounds, v)
+    h.Counts[i]++
+    h.Sum += v
+    h.Count++
+}
+
+// UpstreamMetrics counts the upstream requests of one account. Attempts
+// include retries; Errors are attempts that got no response at all.
+type UpstreamMetrics struct {
+    Site string `json:"site"`
+    Account string `json:"account"`
+    Attempts int64 `json:"attempts"`
+    Retries int64 `json:"retries"`
+    Errors int64 `json:"errors"`
+    Status map[int]int64 `json:"status"`
+    Bytes int64 `json:"bytes"`
+    Latency Histogram `json:"latency"`
+}
+
+var upstream map[string]*UpstreamMetrics = make(map[string]*UpstreamMetrics)
+var metricsLock sync.Mutex
+
+func accountMetrics(site, account string) *UpstreamMetrics {
+    m, ok := upstream[account]
+    if !ok || m.Site != site {
+        m = &UpstreamMetrics{Site:site, Account:account, Status:make(map[int]int64)}
+        m.Latency.Bounds = LATENCY_BUCKETS
+        m.Latency.Counts = make([]int64, len(LATENCY_BUCKETS) + 1)
+        upstream[account] = m
+    }
+    return m
+}
+
+// recordAttempt counts one try of an upstream request: status 0 means it
+// failed before a response, n is the size of the body as downloaded.
+func recordAttempt(site, account string, status int, n int, took time.Duration) {
+    metricsLock.Lock()
+    defer metricsLock.Unlock()
+
+    m := accountMetrics(site, account)
+    m.Attempts++
+    if status == 0 {
+        m.Errors++
+    } else {
+        m.Status[status]++
+    }
+    m.Bytes += int64(n)
+    m.Latency.observe(took.Seconds())
+}
+
+func recordRetry(site, account string) {
+    metricsLock.Lock()
+    defer metricsLock.Unlock()
+    accountMetrics(site, account).Retries++
+}
+
+func (m *UpstreamMetrics) copy() *UpstreamMetrics {
+    c := *m
+    c.Status = make(map[int]int64, len(m.Status))
+    for code, n := range(m.Status) {
+        c.Status[code] = n
+    }
+    c.Latency.Counts = append([]int64(nil), m.Latency.Counts...)
+    return &c
+}
+
+func upstreamOf(account string) *UpstreamMetrics {
+    metricsLock.Lock()
+    defer metricsLock.Unlock()
+    if m, ok := upstream[account]; ok {
+        return m.copy()
+    }
+    return nil
+}
+
+// Upstream returns a snapshot of the upstream metrics of every account,
+// sorted by site and account.
+func Upstream() []*UpstreamMetrics {
+    metricsLock.Lock()
+    list := make([]*UpstreamMetrics, 0, len(upstream))
+    for _, m := range(upstream) {
+        list = append(list, m.copy())
+    }
+    metricsLock.Unlock()
+
+    sort.Slice(list, func(i, j int) bool {
+        if list[i].Site != list[j].Site {
+            return list[i].Site < list[j].Site
+        }
+        return list[i].Account < list[j].Account
+    })
+    return list
+}
+
+// LAYOUT_UNKNOWN is the layout version of the pages no parser knows.
+const LAYOUT_UNKNOWN = "unknown"
+
+// LayoutMetrics counts the pages of one account parsed by layout version,
+// so a site changing its markup shows before anyone reads the logs.
+type LayoutMetrics struct {
+    Site string `json:"site"`
+    Account string `json:"account"`
+    Page string `json:"page"`
+    Version string `json:"version"`
+    Pages int64 `json:"pages"`
+}
+
+type layoutKey struct {
+    site, account, page, version string
+}
+
+var layouts map[layoutKey]int64 = make(map[layoutKey]int64)
+
+// RecordLayout counts a page of account that had layout version,
+// LAYOUT_UNKNOWN when it had none the parser knows.
+func RecordLayout(site, account, page, version string) {
+    metricsLock.Lock()
+    defer metricsLock.Unlock()
+    layouts[layoutKey{site, account, page, version}]++
+}
+
+// Layouts returns a snapshot of the layout counts, sorted by site,
+// account, page and version.
+func Layouts() []*LayoutMetrics {
+    metricsLock.Lock()
+    list := make([]*LayoutMetrics, 0, len(layouts))
+    for k, n := range(layouts) {
+        list = append(list, &LayoutMetrics{Site:k.site, Account:k.account, Page:k.page, Version:k.version, Pages:n})
+    }
+    metricsLock.Unlock()
+
+    sort.Slice(list, func(i, j int) bool {
+        a, b := list[i], list[j]
+        if a.Site != b.Site {
+            return a.Site < b.Site
+        }
+        if a.Account != b.Account {
+            return a.Account < b.Account
+        }
+        if a.Page != b.Page {
+            return a.Page < b.Page
+        }
+        return a.Version < b.Version
+    })
+    return list
+}
@@ -0,0 +1,111 @@
+package common
+
+import (
+    "fmt"
+    "sync"
+    "time"
+    "context"
+    "errors"
+    "strconv"
+    "math/rand"
+)
+
+// pacer spaces requests at least interval apart, plus random jitter.
+// Callers reserve their slot up front, so waiting callers keep order.
+type pacer struct {
+    lock sync.Mutex
+    interval time.Duration
+    jitter time.Duration
+    next time.Time
+}
+
+func (p *pacer) set(interval, jitter time.Duration) bool {
+    p.lock.Lock()
+    defer p.lock.Unlock()
+    changed := p.interval != interval || p.jitter != jitter
+    p.interval, p.jitter = interval, jitter
+    return changed
+}
+
+func (p *pacer) wait(ctx context.Context) error {
+    p.lock.Lock()
+    if p.interval <= 0 {
+        p.lock.Unlock()
+        return nil
+    }
+    now := time.Now()
+    at := p.next
+    if at.Before(now) {
+        at = now
+    }
+    p.next = at.Add(p.interval)
+    if p.jitter > 0 {
+        p.next = p.next.Add(time.Duration(rand.Int63n(int64(p.jitter))))
+    }
+    p.lock.Unlock()
+
+    if d := at.Sub(now); d > 0 {
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-time.After(d):
+        }
+    }
+    return nil
+}
+
+func paceOption(value, option, owner string) (time.Duration, error) {
+    ms, err := strconv.Atoi(value)
+    if err != nil || ms < 0 {
+        return 0, errors.New(fmt.Sprintf("invalid %s '%s' for '%s'", option, value, owner))
+    }
+    return time.Duration(ms) * time.Millisecond, nil
+}
+
+// loadSitePace reads pace and pace_jitter, in ms, shared by all accounts
+// of site.
+func loadSitePace(site string) (interval, jitter time.Duration, err error) {
+    ms, err := Conf.Int(site, "pace", 0)
+    if err != nil {
+        return 0, 0, err
+    }
+    if interval, err = paceOption(strconv.Itoa(ms), "pace", site); err != nil {
+        return 0, 0, err
+    }
+    if ms, err = Conf.Int(site, "pace_jitter", 0); err != nil {
+        return 0, 0, err
+    }
+    jitter, err = paceOption(strconv.Itoa(ms), "pace_jitter", site)
+    return
+}
+
+// loadAccountPace reads account_pace and account_pace_jitter, in ms, of
+// account or its site.
+func loadAccountPace(site, account string) (interval, jitter time.Duration, err error) {
+    value, err := accountOption(site, account, "account_pace", "0")
+    if err != nil {
+        return 0, 0, err
+    }
+    if interval, err = paceOption(value, "account_pace", account); err != nil {
+        return 0, 0, err
+    }
+    if value, err = accountOption(site, account, "account_pace_jitter", "0"); err != nil {
+        return 0, 0, err
+    }
+    jitter, err = paceOption(value, "account_pace_jitter", account)
+    return
+}
+
+// reloadAccountPace applies changed pace options to a running client.
+func reloadAccountPace(site, account string) (bool, error) {
+    interval, jitter, err := loadAccountPace(site, account)
+    if err != nil {
+        return false, err
+    }
+
+    tc, ok := HttpClient.Get(account)
+    if !ok {
+        return false, nil
+    }
+    return tc.pace.set(interval, jitter), nil
+}
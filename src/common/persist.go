@@ -0,0 +1,132 @@
+package common
+
+import (
+    "os"
+    "fmt"
+    "sync"
+    "time"
+    "errors"
+    "io/ioutil"
+    "path/filepath"
+    "encoding/json"
+    "github.com/cookiejar"
+    log "code.google.com/p/log4go"
+)
+
+// savedJar is the file a jar is persisted to, one per account.
+type savedJar struct {
+    Account string
+    Site string
+    Saved time.Time
+    Cookies []cookiejar.Cookie
+}
+
+var saverOnce sync.Once
+
+func cookieDir() (string, error) {
+    return Conf.String("common", "cookie_dir", "")
+}
+
+func jarFile(dir, account string) string {
+    return filepath.Join(dir, account + ".cookies")
+}
+
+func saveJar(dir string, tc *TaokeClient) error {
+    jar, ok := tc.Jar.(*cookiejar.Jar)
+    if !ok {
+        return nil
+    }
+
+    b, err := json.Marshal(savedJar{tc.account, tc.site, time.Now(), jar.All()})
+    if err != nil {
+        return err
+    }
+
+    // write aside and rename, so a crash never leaves half a file.
+    file := jarFile(dir, tc.account)
+    if err = ioutil.WriteFile(file + ".tmp", b, 0600); err != nil {
+        return err
+    }
+    return os.Rename(file + ".tmp", file)
+}
+
+// SaveCookies writes the cookie jar of every account to cookie_dir. It
+// does nothing when cookie_dir is not set.
+func SaveCookies() error {
+    dir, err := cookieDir()
+    if err != nil || dir == "" {
+        return err
+    }
+
+    if err = os.MkdirAll(dir, 0700); err != nil {
+        return err
+    }
+
+    HttpClient.Range(func(account string, tc *TaokeClient) bool {
+        if e := saveJar(dir, tc); e != nil {
+            err = errors.New(fmt.Sprintf("save cookies of account '%s': %s", account, e.Error()))
+            log.Warn(err)
+        }
+        return true
+    })
+
+    return err
+}
+
+// restoreCookies adds the persisted cookies of account to its jar, unless
+// the config file was changed after they were saved.
+func restoreCookies(site, account string) error {
+    dir, err := cookieDir()
+    if err != nil || dir == "" {
+        return err
+    }
+
+    b, err := ioutil.ReadFile(jarFile(dir, account))
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+
+    var saved savedJar
+    if err = json.Unmarshal(b, &saved); err != nil {
+        return err
+    }
+    if saved.Site != site {
+        return nil
+    }
+
+    if fi, err := os.Stat(Conf.File()); err == nil && fi.ModTime().After(saved.Saved) {
+        log.Info("Config is newer than saved cookies of account %s, ignored them.", account)
+        return nil
+    }
+
+    tc, ok := HttpClient.Get(account)
+    if !ok {
+        return nil
+    }
+
+    if jar, ok := tc.Jar.(*cookiejar.Jar); ok {
+        jar.Add(saved.Cookies)
+        log.Info("Restored %d saved cookies of account %s.", len(saved.Cookies), account)
+    }
+
+    return nil
+}
+
+// startCookieSaver saves all jars every cookie_save_interval seconds.
+func startCookieSaver() {
+    saverOnce.Do(func() {
+        go func() {
+            for {
+                interval, err := Conf.Duration("common", "cookie_save_interval", 300 * time.Second)
+                if err != nil || interval <= 0 {
+                    interval = 300 * time.Second
+                }
+                time.Sleep(interval)
+                SaveCookies()
+            }
+        }()
+    })
+}
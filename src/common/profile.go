@@ -0,0 +1,67 @@
+package common
+
+import (
+    "fmt"
+    "errors"
+    "strings"
+    config "github.com/goconf"
+)
+
+// A profile overrides sections for one environment from the same file:
+// with profile prod, the options of [prod.common] go over those of
+// [common], and [prod.account1] over [account1].
+
+// SetProfile selects the sections of profile, empty for none. Call it
+// before LoadConfig.
+func (cf *configFile2) SetProfile(profile string) error {
+    if strings.ContainsAny(profile, ".[] ") {
+        return errors.New(fmt.Sprintf("invalid profile '%s'", profile))
+    }
+    cf.lock.Lock()
+    cf.profile = profile
+    cf.lock.Unlock()
+    return nil
+}
+
+// Profile returns the selected profile.
+func (cf *configFile2) Profile() string {
+    cf.lock.RLock()
+    defer cf.lock.RUnlock()
+    return cf.profile
+}
+
+// applyProfile moves the options of the sections of profile over their
+// base sections.
+func applyProfile(c *config.ConfigFile, origins map[string]string, profile string) error {
+    if profile == "" {
+        return nil
+    }
+    prefix := strings.ToLower(profile) + "."
+
+    found := false
+    for _, section := range(c.GetSections()) {
+        if !strings.HasPrefix(section, prefix) || len(section) == len(prefix) {
+            continue
+        }
+        found = true
+        base := section[len(prefix):]
+
+        options, _ := c.GetOptions(section)
+        for _, option := range(options) {
+            // GetOptions lists the default section's options too.
+            if _, ok := origins[section + "." + option]; !ok {
+                continue
+            }
+            value, _ := c.GetRawString(section, option)
+            c.AddOption(base, option, value)
+            origins[base + "." + option] = origins[section + "." + option]
+            delete(origins, section + "." + option)
+        }
+        c.RemoveSection(section)
+    }
+
+    if !found {
+        return errors.New(fmt.Sprintf("profile '%s' has no [%s*] sections", profile, prefix))
+    }
+    return nil
+}
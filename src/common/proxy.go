@@ -0,0 +1,305 @@
+package common
+
+import (
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+    "errors"
+    "strings"
+    "net/url"
+    "net/http"
+    log "code.google.com/p/log4go"
+)
+
+type tunedTransport struct {
+    base *http.Transport
+    transport *http.Transport
+}
+
+type proxy struct {
+    url *url.URL
+    transport *http.Transport
+    // copies of the site transports going through this proxy, by site.
+    tuned map[string]tunedTransport
+    alive bool
+    requests int64
+    failures int64
+    errorsInRow int
+    lastUsed time.Time
+    lastError string
+}
+
+// ProxyStatus is what /admin/proxies reports of a proxy.
+type ProxyStatus struct {
+    URL string `json:"url"`
+    Alive bool `json:"alive"`
+    Requests int64 `json:"requests"`
+    Failures int64 `json:"failures"`
+    FailureRate float64 `json:"failure_rate"`
+    LastError string `json:"last_error,omitempty"`
+}
+
+// proxyPool is shared by every account without a proxy of its own.
+type proxyPool struct {
+    lock sync.Mutex
+    proxies []*proxy
+    byURL map[string]*proxy
+    accounts map[string]*proxy
+    next int
+    lru bool
+    maxErrors int
+    checkURL string
+}
+
+var pool *proxyPool = &proxyPool{byURL:make(map[string]*proxy), accounts:make(map[string]*proxy)}
+var checkerOnce sync.Once
+
+func newProxy(u string) (*proxy, error) {
+    pu, err := url.Parse(strings.TrimSpace(u))
+    if err != nil || pu.Host == "" {
+        return nil, errors.New(fmt.Sprintf("invalid proxy '%s'", u))
+    }
+    return &proxy{url:pu, transport:&http.Transport{Proxy:http.ProxyURL(pu)}, tuned:make(map[string]tunedTransport), alive:true}, nil
+}
+
+// LoadProxies reads the [proxy] pool and the proxy option of every account
+// of sites. Proxies that stay configured keep their state and counters.
+func LoadProxies(sites []string) error {
+    urls, err := Conf.StringSlice("proxy", "pool", nil)
+    if err != nil {
+        return err
+    }
+    rotation, err := Conf.String("proxy", "rotation", "roundrobin")
+    if err != nil {
+        return err
+    }
+    if rotation != "roundrobin" && rotation != "lru" {
+        return errors.New(fmt.Sprintf("invalid proxy rotation '%s'", rotation))
+    }
+    maxErrors, err := Conf.Int("proxy", "max_errors", 3)
+    if err != nil {
+        return err
+    }
+    checkURL, err := Conf.String("proxy", "check_url", "http://www.taobao.com/")
+    if err != nil {
+        return err
+    }
+
+    pool.lock.Lock()
+    old := pool.byURL
+    pool.lock.Unlock()
+
+    get := func(u string) (*proxy, error) {
+        if p, ok := old[u]; ok {
+            return p, nil
+        }
+        return newProxy(u)
+    }
+
+    byURL := make(map[string]*proxy)
+    proxies := []*proxy{}
+    for _, u := range(urls) {
+        if byURL[u] != nil {
+            continue
+        }
+        p, err := get(u)
+        if err != nil {
+            return err
+        }
+        byURL[u] = p
+        proxies = append(proxies, p)
+    }
+
+    accounts := make(map[string]*proxy)
+    for _, site := range(sites) {
+        names, err := Accounts(site)
+        if err != nil {
+            return err
+        }
+        for _, account := range(names) {
+            u, err := Conf.String(account, "proxy", "")
+            if err != nil {
+                return err
+            }
+            if u = strings.TrimSpace(u); u == "" {
+                continue
+            }
+            if byURL[u] == nil {
+                if byURL[u], err = get(u); err != nil {
+                    return err
+                }
+            }
+            accounts[account] = byURL[u]
+        }
+    }
+
+    pool.lock.Lock()
+    pool.proxies = proxies
+    pool.byURL = byURL
+    pool.accounts = accounts
+    pool.lru = rotation == "lru"
+    pool.maxErrors = maxErrors
+    pool.checkURL = checkURL
+    pool.lock.Unlock()
+
+    if len(byURL) > 0 {
+        checkerOnce.Do(pool.startChecker)
+    }
+
+    return nil
+}
+
+// pick returns the proxy for a request of account, nil to go direct.
+func (pp *proxyPool) pick(account string) (*proxy, error) {
+    pp.lock.Lock()
+    defer pp.lock.Unlock()
+
+    if p, ok := pp.accounts[account]; ok {
+        return p, nil
+    }
+    if len(pp.proxies) == 0 {
+        return nil, nil
+    }
+
+    var best *proxy
+    for n := 0; n < len(pp.proxies); n++ {
+        p := pp.proxies[(pp.next + n) % len(pp.proxies)]
+        if !p.alive {
+            continue
+        }
+        if !pp.lru {
+            pp.next = (pp.next + n + 1) % len(pp.proxies)
+            best = p
+            break
+        }
+        if best == nil || p.lastUsed.Before(best.lastUsed) {
+            best = p
+        }
+    }
+    if best == nil {
+        return nil, errors.New("no alive proxy in pool")
+    }
+
+    best.lastUsed = time.Now()
+    return best, nil
+}
+
+func (pp *proxyPool) record(p *proxy, err error) {
+    pp.lock.Lock()
+    defer pp.lock.Unlock()
+
+    p.requests++
+    if err == nil {
+        p.errorsInRow = 0
+        return
+    }
+
+    p.failures++
+    p.errorsInRow++
+    p.lastError = err.Error()
+    if p.alive && pp.maxErrors > 0 && p.errorsInRow >= pp.maxErrors {
+        p.alive = false
+        log.Warn("Proxy %s removed after %d errors: %s", p.url, p.errorsInRow, p.lastError)
+    }
+}
+
+// startChecker retries dead proxies and puts them back when they work.
+func (pp *proxyPool) startChecker() {
+    go func() {
+        for {
+            interval, err := Conf.Duration("proxy", "check_interval", 60 * time.Second)
+            if err != nil || interval <= 0 {
+                interval = 60 * time.Second
+            }
+            time.Sleep(interval)
+
+            pp.lock.Lock()
+            dead := []*proxy{}
+            for _, p := range(pp.byURL) {
+                if !p.alive {
+                    dead = append(dead, p)
+                }
+            }
+            checkURL := pp.checkURL
+            pp.lock.Unlock()
+
+            for _, p := range(dead) {
+                client := &http.Client{Transport:p.transport, Timeout:10 * time.Second}
+                resp, err := client.Get(checkURL)
+                if err != nil {
+                    continue
+                }
+                resp.Body.Close()
+
+                pp.lock.Lock()
+                p.alive = true
+                p.errorsInRow = 0
+                pp.lock.Unlock()
+                log.Info("Proxy %s is back.", p.url)
+            }
+        }
+    }()
+}
+
+// via returns the transport of site sending through p.
+func (pp *proxyPool) via(p *proxy, site string) *http.Transport {
+    base := siteTransport(site)
+
+    pp.lock.Lock()
+    defer pp.lock.Unlock()
+
+    tt, ok := p.tuned[site]
+    if !ok || tt.base != base {
+        // the site transport is new or was replaced by a reload.
+        if ok {
+            tt.transport.CloseIdleConnections()
+        }
+        tt = tunedTransport{base, base.Clone()}
+        tt.transport.Proxy = http.ProxyURL(p.url)
+        p.tuned[site] = tt
+    }
+    return tt.transport
+}
+
+// proxyTransport sends each request of account through the transport of
+// its site and a proxy picked from the pool, and records how it went.
+type proxyTransport struct {
+    site string
+    account string
+}
+
+func (t *proxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    p, err := pool.pick(t.account)
+    if err != nil {
+        return nil, err
+    }
+    if p == nil {
+        return siteTransport(t.site).RoundTrip(req)
+    }
+
+    resp, err := pool.via(p, t.site).RoundTrip(req)
+    if err == nil && resp.StatusCode == http.StatusProxyAuthRequired {
+        pool.record(p, errors.New(resp.Status))
+    } else {
+        pool.record(p, err)
+    }
+    return resp, err
+}
+
+// ProxyStates reports every configured proxy, sorted by url.
+func ProxyStates() []ProxyStatus {
+    pool.lock.Lock()
+    defer pool.lock.Unlock()
+
+    ret := make([]ProxyStatus, 0, len(pool.byURL))
+    for u, p := range(pool.byURL) {
+        st := ProxyStatus{URL:u, Alive:p.alive, Requests:p.requests, Failures:p.failures, LastError:p.lastError}
+        if p.requests > 0 {
+            st.FailureRate = float64(p.failures) / float64(p.requests)
+        }
+        ret = append(ret, st)
+    }
+    sort.Slice(ret, func(i, j int) bool { return ret[i].URL < ret[j].URL })
+    return ret
+}
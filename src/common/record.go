@@ -0,0 +1,115 @@
+package common
+
+import (
+    "os"
+    "fmt"
+    "sync"
+    "errors"
+    "io/ioutil"
+    "net/http"
+    "crypto/sha1"
+    "encoding/hex"
+    "encoding/json"
+    "path/filepath"
+    log "code.google.com/p/log4go"
+)
+
+const (
+    RECORD = "record"
+    REPLAY = "replay"
+)
+
+// fixture is one upstream exchange as saved by record mode.
+type fixture struct {
+    Method string `json:"method"`
+    URL string `json:"url"`
+    Status int `json:"status"`
+    Header http.Header `json:"header"`
+    Body []byte `json:"body"`
+}
+
+// recorder saves upstream responses to, or serves them from, dir/<site>.
+// An empty mode talks to the sites as usual.
+var recorder struct {
+    lock sync.RWMutex
+    mode string
+    dir string
+}
+
+func loadRecorder() error {
+    mode, err := Conf.String("common", "http_mode", "")
+    if err != nil {
+        return err
+    }
+    if mode != "" && mode != RECORD && mode != REPLAY {
+        return errors.New(fmt.Sprintf("invalid http_mode '%s', expect record or replay", mode))
+    }
+
+    dir, err := Conf.String("common", "fixture_dir", "fixtures")
+    if err != nil {
+        return err
+    }
+
+    recorder.lock.Lock()
+    defer recorder.lock.Unlock()
+    if mode != recorder.mode && mode != "" {
+        log.Warn("upstream requests are in %s mode, fixtures in %s", mode, dir)
+    }
+    recorder.mode = mode
+    recorder.dir = dir
+    return nil
+}
+
+func recordMode() (string, string) {
+    recorder.lock.RLock()
+    defer recorder.lock.RUnlock()
+    return recorder.mode, recorder.dir
+}
+
+// fixturePath names the fixture of req. The account is left out so any
+// account of the site can replay it.
+func fixturePath(dir, site string, req Request) string {
+    h := sha1.New()
+    fmt.Fprintf(h, "%s %s\n", req.Method, req.URL)
+    h.Write(req.Body)
+    return filepath.Join(dir, site, hex.EncodeToString(h.Sum(nil))[:16] + ".json")
+}
+
+func replay(dir, site string, req Request) (*Response, error) {
+    path := fixturePath(dir, site, req)
+    b, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, errors.New(fmt.Sprintf("no fixture for %s %s: %s", req.Method, req.URL, err.Error()))
+    }
+
+    var f fixture
+    if err = json.Unmarshal(b, &f); err != nil {
+        return nil, errors.New(fmt.Sprintf("fixture %s: %s", path, err.Error()))
+    }
+    return &Response{f.Status, f.Header, f.Body}, nil
+}
+
+// record saves resp as the fixture of req, leaving out the cookies the
+// site set.
+func record(dir, site string, req Request, resp *Response) {
+    header := http.Header{}
+    for name, values := range(resp.Header) {
+        if name != "Set-Cookie" {
+            header[name] = values
+        }
+    }
+
+    b, err := json.MarshalIndent(fixture{req.Method, req.URL, resp.Status, header, resp.Body}, "", "  ")
+    if err != nil {
+        log.Error(err)
+        return
+    }
+
+    path := fixturePath(dir, site, req)
+    if err = os.MkdirAll(filepath.Dir(path), 0700); err == nil {
+        err = ioutil.WriteFile(path, b, 0600)
+    }
+    if err != nil {
+        log.Error("record %s %s: %s", req.Method, req.URL, err.Error())
+    }
+}
@@ -0,0 +1,68 @@
+package common
+
+import (
+    "sort"
+    "sync"
+)
+
+// ClientRegistry holds the client of each account. It is safe for
+// concurrent use.
+type ClientRegistry struct {
+    lock sync.RWMutex
+    clients map[string]*TaokeClient
+}
+
+func NewClientRegistry() *ClientRegistry {
+    return &ClientRegistry{clients:make(map[string]*TaokeClient)}
+}
+
+func (r *ClientRegistry) Get(account string) (*TaokeClient, bool) {
+    r.lock.RLock()
+    defer r.lock.RUnlock()
+    tc, ok := r.clients[account]
+    return tc, ok
+}
+
+// Put makes tc the client of its account and returns the one it replaced.
+func (r *ClientRegistry) Put(tc *TaokeClient) (old *TaokeClient, found bool) {
+    r.lock.Lock()
+    defer r.lock.Unlock()
+    old, found = r.clients[tc.account]
+    r.clients[tc.account] = tc
+    return
+}
+
+// Delete removes the client of account and returns it.
+func (r *ClientRegistry) Delete(account string) (*TaokeClient, bool) {
+    r.lock.Lock()
+    defer r.lock.Unlock()
+    tc, ok := r.clients[account]
+    delete(r.clients, account)
+    return tc, ok
+}
+
+func (r *ClientRegistry) Len() int {
+    r.lock.RLock()
+    defer r.lock.RUnlock()
+    return len(r.clients)
+}
+
+// Range calls fn for each client, ordered by account, until fn returns
+// false. It works on a snapshot, so fn may change the registry.
+func (r *ClientRegistry) Range(fn func(account string, tc *TaokeClient) bool) {
+    r.lock.RLock()
+    accounts := make([]string, 0, len(r.clients))
+    clients := make(map[string]*TaokeClient, len(r.clients))
+    for account, tc := range(r.clients) {
+        accounts = append(accounts, account)
+        clients[account] = tc
+    }
+    r.lock.RUnlock()
+
+    sort.Strings(accounts)
+    for _, account := range(accounts) {
+        if !fn(account, clients[account]) {
+            return
+        }
+    }
+}
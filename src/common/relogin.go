@@ -0,0 +1,108 @@
+package common
+
+import (
+    "sync"
+    "errors"
+    log "code.google.com/p/log4go"
+)
+
+// A Refresher tries to get a new session for account, eg. by logging in
+// again. It returns an error when it could not.
+type Refresher func(site, account string) error
+
+var refreshers []Refresher
+
+func init() {
+    // set here, the refreshers lead back to refresh through keepalive.
+    refreshers = []Refresher{refreshFromConfig, refreshPassword}
+}
+
+// refreshLocks serializes refreshes per account.
+var refreshLocks map[string]*sync.Mutex = make(map[string]*sync.Mutex)
+var refreshLock sync.Mutex
+
+// AddRefresher registers r to be tried, after the ones before it, when an
+// account needs login.
+func AddRefresher(r Refresher) {
+    refreshLock.Lock()
+    defer refreshLock.Unlock()
+    refreshers = append(refreshers, r)
+}
+
+// refreshFromConfig rebuilds the client from the cookies in the config
+// file, if they were changed since the client was built.
+func refreshFromConfig(site, account string) error {
+    fresh, err := Conf.reread()
+    if err != nil {
+        return err
+    }
+
+    cookiestr, err := cookieSource(fresh, account)
+    if err != nil {
+        return err
+    }
+
+    tc, ok := HttpClient.Get(account)
+    if ok && tc.cookies == cookiestr {
+        return errors.New("cookies in config unchanged")
+    }
+
+    return loginAccount(site, account, cookiestr)
+}
+
+// refreshPassword logs in again with the configured username and password.
+func refreshPassword(site, account string) error {
+    return passwordLogin(site, account)
+}
+
+func currentClient(account string) *TaokeClient {
+    tc, _ := HttpClient.Get(account)
+    return tc
+}
+
+func refresh(site, account string, failed *TaokeClient) error {
+    refreshLock.Lock()
+    l, ok := refreshLocks[account]
+    if !ok {
+        l = &sync.Mutex{}
+        refreshLocks[account] = l
+    }
+    list := refreshers
+    refreshLock.Unlock()
+
+    l.Lock()
+    defer l.Unlock()
+
+    // another request already refreshed while we waited.
+    if currentClient(account) != failed {
+        return nil
+    }
+
+    for _, r := range(list) {
+        err := r(site, account)
+        if err == nil {
+            log.Info("Refreshed session of %s account %s.", site, account)
+            return nil
+        }
+        log.Warn("refresh %s account %s: %s", site, account, err.Error())
+    }
+
+    return ErrNeedLogin
+}
+
+// WithRelogin runs fn and, if it fails with ErrNeedLogin, refreshes the
+// session of account and runs fn once more.
+func WithRelogin(site, account string, fn func() error) error {
+    tc := currentClient(account)
+
+    err := fn()
+    if !errors.Is(err, ErrNeedLogin) || tc == nil {
+        return err
+    }
+
+    if refresh(site, account, tc) != nil {
+        return err
+    }
+
+    return fn()
+}
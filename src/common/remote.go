@@ -0,0 +1,301 @@
+package common
+
+import (
+    "io"
+    "os"
+    "fmt"
+    "time"
+    "bytes"
+    "errors"
+    "context"
+    "strings"
+    "net/url"
+    "net/http"
+    "io/ioutil"
+    "encoding/json"
+    "encoding/base64"
+    config "github.com/goconf"
+    log "code.google.com/p/log4go"
+)
+
+// remoteSource is an etcd or Consul KV prefix holding the same options
+// as the file, one key each: <prefix>/<section>/<option>, eg.
+// taoke/common/port. Given as etcd://host:2379/taoke or
+// consul://host:8500/taoke, with +https for TLS, eg. consul+https://.
+type remoteSource struct {
+    kind string
+    base string
+    prefix string
+    client *http.Client
+}
+
+func parseRemote(ustr string) (*remoteSource, error) {
+    u, err := url.Parse(ustr)
+    if err != nil || u.Host == "" {
+        return nil, errors.New(fmt.Sprintf("invalid remote config '%s'", ustr))
+    }
+    kind, scheme := u.Scheme, "http"
+    if i := strings.Index(kind, "+"); i != -1 {
+        kind, scheme = kind[:i], kind[i+1:]
+    }
+    if (kind != "etcd" && kind != "consul") || (scheme != "http" && scheme != "https") {
+        return nil, errors.New(fmt.Sprintf("remote config '%s' must be etcd:// or consul://", ustr))
+    }
+    prefix := strings.Trim(u.Path, "/")
+    if prefix == "" {
+        return nil, errors.New(fmt.Sprintf("remote config '%s' needs a key prefix, eg. %s://%s/taoke", ustr, u.Scheme, u.Host))
+    }
+    // no client timeout: watches block for minutes, requests carry their own.
+    return &remoteSource{kind:kind, base:scheme + "://" + u.Host, prefix:prefix, client:&http.Client{}}, nil
+}
+
+func (rs *remoteSource) String() string {
+    return rs.kind + "://" + strings.SplitN(rs.base, "://", 2)[1] + "/" + rs.prefix
+}
+
+// SetRemote makes the config read from the etcd or Consul prefix u on
+// top of the file, which is what is left when the remote is down at
+// start. An empty u turns the remote off. Call it before LoadConfig.
+func (cf *configFile2) SetRemote(u string) error {
+    var rs *remoteSource
+    if u != "" {
+        var err error
+        if rs, err = parseRemote(u); err != nil {
+            return err
+        }
+    }
+    cf.lock.Lock()
+    cf.remote = rs
+    cf.lock.Unlock()
+    return nil
+}
+
+// fetch reads every option under the prefix, keyed section.option, and
+// the index or revision to watch from.
+func (rs *remoteSource) fetch(ctx context.Context) (map[string]string, string, error) {
+    ctx, cancel := context.WithTimeout(ctx, 10 * time.Second)
+    defer cancel()
+    if rs.kind == "consul" {
+        return rs.consul(ctx, "")
+    }
+    return rs.etcdRange(ctx)
+}
+
+// option maps key to section.option, false for keys of another shape.
+func (rs *remoteSource) option(key string) (string, bool) {
+    parts := strings.Split(strings.TrimPrefix(key, rs.prefix + "/"), "/")
+    if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+        return "", false
+    }
+    return strings.ToLower(parts[0]) + "." + strings.ToLower(parts[1]), true
+}
+
+func (rs *remoteSource) do(req *http.Request) ([]byte, *http.Response, error) {
+    if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" && rs.kind == "consul" {
+        req.Header.Set("X-Consul-Token", token)
+    }
+    resp, err := rs.client.Do(req)
+    if err != nil {
+        return nil, nil, err
+    }
+    defer resp.Body.Close()
+    b, err := ioutil.ReadAll(resp.Body)
+    return b, resp, err
+}
+
+// consul reads the prefix recursively. With an index it is a blocking
+// query, returning once something under the prefix changed.
+func (rs *remoteSource) consul(ctx context.Context, index string) (map[string]string, string, error) {
+    u := rs.base + "/v1/kv/" + rs.prefix + "/?recurse=true"
+    if index != "" {
+        u += "&wait=5m&index=" + url.QueryEscape(index)
+    }
+    req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+    if err != nil {
+        return nil, "", err
+    }
+    b, resp, err := rs.do(req)
+    if err != nil {
+        return nil, "", err
+    }
+
+    values := make(map[string]string)
+    next := resp.Header.Get("X-Consul-Index")
+    if resp.StatusCode == http.StatusNotFound {
+        return values, next, nil
+    }
+    if resp.StatusCode != http.StatusOK {
+        return nil, "", &ErrUpstreamStatus{Code:resp.StatusCode}
+    }
+
+    var kvs []struct {
+        Key string
+        Value []byte
+    }
+    if err = json.Unmarshal(b, &kvs); err != nil {
+        return nil, "", err
+    }
+    for _, kv := range(kvs) {
+        if name, ok := rs.option(kv.Key); ok {
+            values[name] = string(kv.Value)
+        }
+    }
+    return values, next, nil
+}
+
+// etcdRange reads the prefix through the v3 JSON gateway.
+func (rs *remoteSource) etcdRange(ctx context.Context) (map[string]string, string, error) {
+    var out struct {
+        Header struct {
+            Revision string `json:"revision"`
+        } `json:"header"`
+        Kvs []struct {
+            Key []byte `json:"key"`
+            Value []byte `json:"value"`
+        } `json:"kvs"`
+    }
+    if err := rs.etcdPost(ctx, "/v3/kv/range", rs.etcdKeys(""), &out); err != nil {
+        return nil, "", err
+    }
+
+    values := make(map[string]string)
+    for _, kv := range(out.Kvs) {
+        if name, ok := rs.option(string(kv.Key)); ok {
+            values[name] = string(kv.Value)
+        }
+    }
+    return values, out.Header.Revision, nil
+}
+
+// etcdKeys is the key range of the prefix, from revision on if given.
+func (rs *remoteSource) etcdKeys(revision string) map[string]interface{} {
+    key := []byte(rs.prefix + "/")
+    end := append([]byte(nil), key...)
+    end[len(end) - 1]++
+    keys := map[string]interface{}{
+        "key":base64.StdEncoding.EncodeToString(key),
+        "range_end":base64.StdEncoding.EncodeToString(end),
+    }
+    if revision != "" {
+        keys["start_revision"] = revision
+    }
+    return keys
+}
+
+func (rs *remoteSource) etcdPost(ctx context.Context, path string, body interface{}, out interface{}) error {
+    b, _ := json.Marshal(body)
+    req, err := http.NewRequestWithContext(ctx, "POST", rs.base + path, bytes.NewReader(b))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    b, resp, err := rs.do(req)
+    if err != nil {
+        return err
+    }
+    if resp.StatusCode != http.StatusOK {
+        return &ErrUpstreamStatus{Code:resp.StatusCode}
+    }
+    return json.Unmarshal(b, out)
+}
+
+// etcdWatch blocks until a key under the prefix changes after revision.
+func (rs *remoteSource) etcdWatch(ctx context.Context, revision string) error {
+    if revision != "" {
+        var n int64
+        fmt.Sscan(revision, &n)
+        revision = fmt.Sprint(n + 1)
+    }
+    b, _ := json.Marshal(map[string]interface{}{"create_request":rs.etcdKeys(revision)})
+    req, err := http.NewRequestWithContext(ctx, "POST", rs.base + "/v3/watch", bytes.NewReader(b))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    resp, err := rs.client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return &ErrUpstreamStatus{Code:resp.StatusCode}
+    }
+
+    // the gateway streams one JSON message per watch response.
+    dec := json.NewDecoder(resp.Body)
+    for {
+        var msg struct {
+            Result struct {
+                Events []json.RawMessage `json:"events"`
+            } `json:"result"`
+        }
+        if err := dec.Decode(&msg); err != nil {
+            if err == io.EOF {
+                return errors.New("etcd watch closed")
+            }
+            return err
+        }
+        if len(msg.Result.Events) > 0 {
+            return nil
+        }
+    }
+}
+
+// wait blocks until something under the prefix may have changed since
+// index, as returned by fetch.
+func (rs *remoteSource) wait(ctx context.Context, index string) error {
+    if rs.kind == "etcd" {
+        return rs.etcdWatch(ctx, index)
+    }
+    for {
+        _, next, err := rs.consul(ctx, index)
+        if err != nil {
+            return err
+        }
+        // a blocking query also returns when its wait runs out.
+        if next != index {
+            return nil
+        }
+    }
+}
+
+// overlay sets the remote values over c, which was read from the file.
+func (rs *remoteSource) overlay(c *config.ConfigFile, origins map[string]string, values map[string]string) {
+    for name, value := range(values) {
+        i := strings.Index(name, ".")
+        section, option := name[:i], name[i+1:]
+        c.AddSection(section)
+        c.AddOption(section, option, value)
+        origins[name] = rs.String() + "/" + section + "/" + option
+    }
+}
+
+// WatchRemote calls changed whenever the keys of the remote config
+// change, until ctx is done. It does nothing without a remote.
+func (cf *configFile2) WatchRemote(ctx context.Context, changed func()) {
+    cf.lock.RLock()
+    rs := cf.remote
+    cf.lock.RUnlock()
+    if rs == nil {
+        return
+    }
+
+    go func() {
+        for ctx.Err() == nil {
+            _, index, err := rs.fetch(ctx)
+            if err == nil {
+                err = rs.wait(ctx, index)
+            }
+            if ctx.Err() != nil {
+                return
+            }
+            if err != nil {
+                log.Warn("watch of remote config %s: %s", rs, err.Error())
+                time.Sleep(5 * time.Second)
+                continue
+            }
+            changed()
+        }
+    }()
+    log.Info("Watching remote config %s for changes.", rs)
+}
@@ -0,0 +1,100 @@
+package common
+
+import (
+    "fmt"
+    "time"
+    "context"
+    "errors"
+    "strconv"
+    "math/rand"
+    log "code.google.com/p/log4go"
+)
+
+// retryPolicy says how GetPage retries failed requests of a site.
+type retryPolicy struct {
+    retries int
+    delay time.Duration
+    jitter time.Duration
+    status map[int]bool
+    maxTime time.Duration
+}
+
+func loadRetry(site string) (*retryPolicy, error) {
+    p := &retryPolicy{status:make(map[int]bool)}
+
+    var err error
+    if p.retries, err = Conf.Int(site, "retries", 2); err != nil {
+        return nil, err
+    }
+
+    ms, err := Conf.Int(site, "retry_delay", 500)
+    if err != nil {
+        return nil, err
+    }
+    p.delay = time.Duration(ms) * time.Millisecond
+
+    if ms, err = Conf.Int(site, "retry_jitter", 250); err != nil {
+        return nil, err
+    }
+    p.jitter = time.Duration(ms) * time.Millisecond
+
+    if p.maxTime, err = Conf.Duration(site, "retry_max_time", 30 * time.Second); err != nil {
+        return nil, err
+    }
+
+    codes, err := Conf.StringSlice(site, "retry_status", []string{"500", "502", "503", "504"})
+    if err != nil {
+        return nil, err
+    }
+    for _, c := range(codes) {
+        code, err := strconv.Atoi(c)
+        if err != nil {
+            return nil, errors.New(fmt.Sprintf("invalid retry_status '%s' for site '%s'", c, site))
+        }
+        p.status[code] = true
+    }
+
+    if p.retries < 0 || p.delay < 0 || p.jitter < 0 || p.maxTime <= 0 {
+        return nil, errors.New(fmt.Sprintf("invalid retry settings for site '%s'", site))
+    }
+
+    return p, nil
+}
+
+// do runs send until it succeeds, the retries are used up or the next try
+// would end after maxTime. A nil policy tries once, and only GET and HEAD
+// requests are retried.
+func (p *retryPolicy) do(ctx context.Context, req Request, send func() (*Response, error)) (*Response, error) {
+    start := time.Now()
+    idempotent := req.Method == "GET" || req.Method == "HEAD"
+
+    for attempt := 0; ; attempt++ {
+        resp, err := send()
+        if err == nil && (p == nil || !p.status[resp.Status]) {
+            return resp, nil
+        }
+        if err == nil {
+            err = &ErrUpstreamStatus{resp.Status}
+        }
+
+        if ctx.Err() != nil || p == nil || !idempotent || attempt >= p.retries {
+            return nil, err
+        }
+
+        delay := p.delay << uint(attempt)
+        if p.jitter > 0 {
+            delay += time.Duration(rand.Int63n(int64(p.jitter)))
+        }
+        if time.Since(start) + delay > p.maxTime {
+            return nil, err
+        }
+
+        log.Warn("%s %s attempt %d failed: %s, retry in %s", req.Method, req.URL, attempt + 1, err.Error(), delay)
+
+        select {
+        case <-ctx.Done():
+            return nil, err
+        case <-time.After(delay):
+        }
+    }
+}
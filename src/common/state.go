@@ -0,0 +1,237 @@
+package common
+
+import (
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+    "errors"
+)
+
+type accountState struct {
+    site string
+    loggedIn bool
+    lastFetch time.Time
+    lastError string
+    keepaliveAt time.Time
+    keepaliveError string
+    health Health
+    checkedAt time.Time
+    checkError string
+    // lastGood is when the session last worked, by any means.
+    lastGood time.Time
+    // blockedUntil keeps a rate limited account out of failover.
+    blockedUntil time.Time
+}
+
+// AccountStatus is a snapshot of an account's session state.
+type AccountStatus struct {
+    Site string `json:"site"`
+    Account string `json:"account"`
+    LoggedIn bool `json:"logged_in"`
+    LastFetch *time.Time `json:"last_fetch,omitempty"`
+    LastError string `json:"last_error,omitempty"`
+    KeepaliveAt *time.Time `json:"keepalive_at,omitempty"`
+    KeepaliveError string `json:"keepalive_error,omitempty"`
+    Health Health `json:"health,omitempty"`
+    CheckedAt *time.Time `json:"checked_at,omitempty"`
+    CheckError string `json:"check_error,omitempty"`
+    LastGood *time.Time `json:"last_good,omitempty"`
+    Upstream *UpstreamMetrics `json:"upstream,omitempty"`
+}
+
+var states map[string]*accountState = make(map[string]*accountState)
+var stateLock sync.RWMutex
+
+func setLoggedIn(site, account string, ok bool) {
+    stateLock.Lock()
+    defer stateLock.Unlock()
+
+    st, found := states[account]
+    if !found {
+        st = &accountState{site:site}
+        states[account] = st
+    }
+    st.loggedIn = ok
+}
+
+func loggedIn(account string) bool {
+    stateLock.RLock()
+    defer stateLock.RUnlock()
+    st, found := states[account]
+    return found && st.loggedIn
+}
+
+// ReportSession records the outcome of a fetch for account: nil marks the
+// session valid, ErrNeedLogin marks it expired, other errors are ignored.
+func ReportSession(account string, err error) {
+    stateLock.Lock()
+    defer stateLock.Unlock()
+
+    st, found := states[account]
+    if !found {
+        return
+    }
+
+    if err == nil {
+        st.loggedIn = true
+        st.lastFetch = time.Now()
+        st.lastGood = st.lastFetch
+        st.lastError = ""
+        st.blockedUntil = time.Time{}
+        return
+    }
+
+    st.lastError = err.Error()
+    if errors.Is(err, ErrNeedLogin) {
+        st.expire(account, "a fetch found the login page")
+    }
+
+    if blockedError(err) {
+        st.block()
+    }
+}
+
+// block keeps account out of failover for block_time seconds. Called
+// with stateLock held.
+func (st *accountState) block() {
+    d, err := Conf.Duration(st.site, "block_time", 300 * time.Second)
+    if err != nil {
+        d = 300 * time.Second
+    }
+    st.blockedUntil = time.Now().Add(d)
+}
+
+// expire marks the session of account dead and raises session_expired
+// when it was live until now. Called with stateLock held.
+func (st *accountState) expire(account, msg string) {
+    if !st.loggedIn {
+        return
+    }
+    st.loggedIn = false
+
+    a := Alert{Kind:"session_expired", Site:st.site, Account:account, Msg:msg, Time:time.Now()}
+    if !st.lastGood.IsZero() {
+        lastGood := st.lastGood
+        a.LastGood = &lastGood
+    }
+    alert(a)
+}
+
+func reportKeepalive(account string, err error) {
+    stateLock.Lock()
+    defer stateLock.Unlock()
+
+    st, found := states[account]
+    if !found {
+        return
+    }
+
+    st.keepaliveAt = time.Now()
+    st.keepaliveError = ""
+    if err != nil {
+        st.keepaliveError = err.Error()
+    } else {
+        st.lastGood = st.keepaliveAt
+    }
+    if errors.Is(err, ErrNeedLogin) {
+        st.expire(account, "keepalive found the login page")
+    }
+}
+
+func reportCheck(account string, health Health, err error) {
+    stateLock.Lock()
+    defer stateLock.Unlock()
+
+    st, found := states[account]
+    if !found {
+        return
+    }
+
+    st.health = health
+    st.checkedAt = time.Now()
+    st.checkError = ""
+    if err != nil {
+        st.checkError = err.Error()
+    }
+    if health == HEALTH_OK {
+        st.loggedIn = true
+        st.lastGood = st.checkedAt
+        st.blockedUntil = time.Time{}
+    } else if health == HEALTH_NEED_LOGIN {
+        st.expire(account, "health check found the login page")
+    } else if health == HEALTH_BLOCKED {
+        st.block()
+    }
+}
+
+func timePtr(t time.Time) *time.Time {
+    if t.IsZero() {
+        return nil
+    }
+    return &t
+}
+
+// AccountStates returns the state of every account set up by Login,
+// ordered by site and account.
+func AccountStates() []AccountStatus {
+    stateLock.RLock()
+    defer stateLock.RUnlock()
+
+    list := make([]AccountStatus, 0, len(states))
+    for account, st := range(states) {
+        list = append(list, AccountStatus{
+            Site:st.site,
+            Account:account,
+            LoggedIn:st.loggedIn,
+            LastFetch:timePtr(st.lastFetch),
+            LastError:st.lastError,
+            KeepaliveAt:timePtr(st.keepaliveAt),
+            KeepaliveError:st.keepaliveError,
+            Health:st.health,
+            CheckedAt:timePtr(st.checkedAt),
+            CheckError:st.checkError,
+            LastGood:timePtr(st.lastGood),
+            Upstream:upstreamOf(account),
+        })
+    }
+
+    sort.Slice(list, func(i, j int) bool {
+        if list[i].Site != list[j].Site {
+            return list[i].Site < list[j].Site
+        }
+        return list[i].Account < list[j].Account
+    })
+
+    return list
+}
+
+// Ready fails unless the config is loaded and every given site has at
+// least one account that passes CheckAccount. Checks younger than
+// check_max_age seconds are reused.
+func Ready(sites ...string) error {
+    if !Conf.Loaded() {
+        return ErrNotLoaded
+    }
+
+    maxAge, err := Conf.Duration("common", "check_max_age", 60 * time.Second)
+    if err != nil {
+        return err
+    }
+
+    for _, site := range(sites) {
+        accounts, _ := SiteAccounts(site)
+        ok := false
+        for _, account := range(accounts) {
+            if loggedIn(account) && checkCached(site, account, maxAge) == HEALTH_OK {
+                ok = true
+                break
+            }
+        }
+        if !ok {
+            return errors.New(fmt.Sprintf("no logged in account for site '%s'", site))
+        }
+    }
+
+    return nil
+}
@@ -0,0 +1,146 @@
+package common
+
+import (
+    "fmt"
+    "bytes"
+    "compress/gzip"
+    "net"
+    "time"
+    "context"
+    "errors"
+    "strings"
+    "io/ioutil"
+    "net/http"
+    "crypto/tls"
+    "crypto/x509"
+)
+
+// transportConfig is the tuning of the transport shared by the accounts of
+// a site.
+type transportConfig struct {
+    maxIdlePerHost int
+    idleTimeout time.Duration
+    disableCompression bool
+    gzip bool
+    insecureSkipVerify bool
+    rootCAs string
+    // hosts is "host=ip,host=ip": those hosts are dialed at the given ip
+    // whatever DNS says. It stays a string to keep the struct comparable.
+    hosts string
+}
+
+func loadTransportConfig(site string) (tc transportConfig, err error) {
+    if tc.maxIdlePerHost, err = Conf.Int(site, "max_idle_conns_per_host", 2); err != nil {
+        return
+    }
+    if tc.idleTimeout, err = Conf.Duration(site, "idle_conn_timeout", 90 * time.Second); err != nil {
+        return
+    }
+    if tc.disableCompression, err = Conf.Bool(site, "disable_compression", false); err != nil {
+        return
+    }
+    if tc.gzip, err = Conf.Bool(site, "gzip", true); err != nil {
+        return
+    }
+    if tc.insecureSkipVerify, err = Conf.Bool(site, "insecure_skip_verify", false); err != nil {
+        return
+    }
+    if tc.rootCAs, err = Conf.String(site, "root_cas", ""); err != nil {
+        return
+    }
+    if tc.hosts, err = Conf.String(site, "hosts", ""); err != nil {
+        return
+    }
+    _, err = parseHosts(site, tc.hosts)
+    return
+}
+
+func parseHosts(site, value string) (map[string]string, error) {
+    hosts := make(map[string]string)
+    for _, pair := range(strings.Split(value, ",")) {
+        pair = strings.TrimSpace(pair)
+        if pair == "" {
+            continue
+        }
+        i := strings.Index(pair, "=")
+        if i <= 0 || net.ParseIP(strings.TrimSpace(pair[i + 1:])) == nil {
+            return nil, errors.New(fmt.Sprintf("invalid hosts entry '%s' for '%s', expect host=ip", pair, site))
+        }
+        hosts[strings.ToLower(strings.TrimSpace(pair[:i]))] = strings.TrimSpace(pair[i + 1:])
+    }
+    return hosts, nil
+}
+
+// newTransport builds the transport of c, starting from the defaults of
+// http.DefaultTransport.
+func newTransport(c transportConfig) (*http.Transport, error) {
+    t := http.DefaultTransport.(*http.Transport).Clone()
+    t.MaxIdleConnsPerHost = c.maxIdlePerHost
+    t.IdleConnTimeout = c.idleTimeout
+    // send asks for gzip itself, so the transport never has to.
+    t.DisableCompression = true
+
+    hosts, err := parseHosts("transport", c.hosts)
+    if err != nil {
+        return nil, err
+    }
+    if len(hosts) > 0 {
+        dialer := &net.Dialer{Timeout:30 * time.Second, KeepAlive:30 * time.Second}
+        t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+            if host, port, err := net.SplitHostPort(addr); err == nil {
+                if ip, ok := hosts[strings.ToLower(host)]; ok {
+                    addr = net.JoinHostPort(ip, port)
+                }
+            }
+            return dialer.DialContext(ctx, network, addr)
+        }
+    }
+
+    if c.insecureSkipVerify || c.rootCAs != "" {
+        t.TLSClientConfig = &tls.Config{InsecureSkipVerify:c.insecureSkipVerify}
+    }
+    if c.rootCAs != "" {
+        pem, err := ioutil.ReadFile(c.rootCAs)
+        if err != nil {
+            return nil, err
+        }
+        pool := x509.NewCertPool()
+        if !pool.AppendCertsFromPEM(pem) {
+            return nil, errors.New(fmt.Sprintf("no certificates in root_cas '%s'", c.rootCAs))
+        }
+        t.TLSClientConfig.RootCAs = pool
+    }
+
+    return t, nil
+}
+
+// wantGzip tells whether requests of site ask for gzip.
+func wantGzip(site string) bool {
+    clientLock.RLock()
+    defer clientLock.RUnlock()
+    info, ok := sites[site]
+    return ok && info.tuning.gzip && !info.tuning.disableCompression
+}
+
+// gunzip decodes a gzip body, keeping it as it is when a site claims
+// gzip but sends something else.
+func gunzip(body []byte) []byte {
+    zr, err := gzip.NewReader(bytes.NewReader(body))
+    if err != nil {
+        return body
+    }
+    b, err := ioutil.ReadAll(zr)
+    if err != nil {
+        return body
+    }
+    return b
+}
+
+func siteTransport(site string) *http.Transport {
+    clientLock.RLock()
+    defer clientLock.RUnlock()
+    if info, ok := sites[site]; ok {
+        return info.transport
+    }
+    return http.DefaultTransport.(*http.Transport)
+}
@@ -0,0 +1,155 @@
+package common
+
+import (
+    "fmt"
+    "time"
+    "errors"
+    "reflect"
+    "strconv"
+    "strings"
+)
+
+// Unmarshal fills the fields of the struct v points to from options of
+// section, with the same fallback to common as the accessors. A field is
+// read from the option its conf tag names, and keeps the default tag when
+// the option is not set:
+//
+//   var mc struct {
+//       Addr string `conf:"smtp"`
+//       To []string `conf:"to"`
+//       Timeout time.Duration `conf:"timeout" default:"10s"`
+//   }
+//   err := Conf.Unmarshal("alert", &mc)
+//
+// Fields may be string, bool, int, float64, time.Duration or []string;
+// fields without a conf tag are left alone, and a string tagged
+// secret:"true" is read without logging it. Every option that does not
+// parse is reported, not only the first.
+func (cf *configFile2) Unmarshal(section string, v interface{}) error {
+    rv := reflect.ValueOf(v)
+    if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+        return errors.New(fmt.Sprintf("Unmarshal of [%s] needs a pointer to a struct, got %T", section, v))
+    }
+    rv = rv.Elem()
+    rt := rv.Type()
+
+    var bad []string
+    for i := 0; i < rt.NumField(); i++ {
+        f := rt.Field(i)
+        option := f.Tag.Get("conf")
+        if option == "" || option == "-" {
+            continue
+        }
+        if f.PkgPath != "" {
+            return errors.New(fmt.Sprintf("field %s of %s is not exported", f.Name, rt))
+        }
+        def, hasDef := f.Tag.Lookup("default")
+        if err := cf.setField(rv.Field(i), section, option, def, hasDef, f.Tag.Get("secret") == "true"); err != nil {
+            bad = append(bad, err.Error())
+        }
+    }
+
+    if len(bad) > 0 {
+        return errors.New(strings.Join(bad, "; "))
+    }
+    return nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func (cf *configFile2) setField(fv reflect.Value, section, option, def string, hasDef, secret bool) error {
+    // the default tag is parsed like a file value, so a bad one shows.
+    badDefault := func(err error) error {
+        return errors.New(fmt.Sprintf("default '%s' of option '%s' of [%s]: %s", def, option, section, err.Error()))
+    }
+
+    switch {
+    case fv.Type() == durationType:
+        var d time.Duration
+        if hasDef {
+            n, err := strconv.Atoi(def)
+            if err == nil {
+                d = time.Duration(n) * time.Second
+            } else if d, err = time.ParseDuration(def); err != nil {
+                return badDefault(err)
+            }
+        }
+        d, err := cf.Duration(section, option, d)
+        if err != nil {
+            return err
+        }
+        fv.SetInt(int64(d))
+
+    case fv.Kind() == reflect.String:
+        var s string
+        var err error
+        if secret {
+            if s, err = cf.Secret(section, option); err == nil && s == "" {
+                s = def
+            }
+        } else {
+            s, err = cf.String(section, option, def)
+        }
+        if err != nil {
+            return err
+        }
+        fv.SetString(s)
+
+    case fv.Kind() == reflect.Bool:
+        var b bool
+        if hasDef {
+            var err error
+            if b, err = strconv.ParseBool(def); err != nil {
+                return badDefault(err)
+            }
+        }
+        b, err := cf.Bool(section, option, b)
+        if err != nil {
+            return err
+        }
+        fv.SetBool(b)
+
+    case fv.Kind() == reflect.Int:
+        var n int
+        if hasDef {
+            var err error
+            if n, err = strconv.Atoi(def); err != nil {
+                return badDefault(err)
+            }
+        }
+        n, err := cf.Int(section, option, n)
+        if err != nil {
+            return err
+        }
+        fv.SetInt(int64(n))
+
+    case fv.Kind() == reflect.Float64:
+        var x float64
+        if hasDef {
+            var err error
+            if x, err = strconv.ParseFloat(def, 64); err != nil {
+                return badDefault(err)
+            }
+        }
+        x, err := cf.Float64(section, option, x)
+        if err != nil {
+            return err
+        }
+        fv.SetFloat(x)
+
+    case fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() == reflect.String:
+        var list []string
+        if hasDef {
+            list = strings.Split(def, ",")
+        }
+        list, err := cf.StringSlice(section, option, list)
+        if err != nil {
+            return err
+        }
+        fv.Set(reflect.ValueOf(list).Convert(fv.Type()))
+
+    default:
+        return errors.New(fmt.Sprintf("option '%s' of [%s]: unsupported field type %s", option, section, fv.Type()))
+    }
+    return nil
+}
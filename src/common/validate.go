@@ -0,0 +1,164 @@
+package common
+
+import (
+    "fmt"
+    "errors"
+    "time"
+    "strings"
+    "net/url"
+)
+
+// problems collects everything wrong with the config instead of stopping
+// at the first error.
+type problems []error
+
+func (p *problems) add(err error) {
+    if err != nil {
+        *p = append(*p, err)
+    }
+}
+
+func (p *problems) addf(format string, args ...interface{}) {
+    *p = append(*p, errors.New(fmt.Sprintf(format, args...)))
+}
+
+// Validate checks the config of sites before anything logs in: required
+// sections and options, that every listed account is configured, and
+// that urls, numbers and durations parse. It returns every problem found.
+func Validate(sites []string) []error {
+    var p problems
+
+    if !Conf.Loaded() {
+        p.add(ErrNotLoaded)
+        return p
+    }
+    c := Conf.get()
+
+    if !c.HasSection("common") {
+        p.addf("section [common] not found in %s", Conf.File())
+    }
+    port, err := Conf.Int("common", "port", 8080)
+    p.add(err)
+    if err == nil && (port <= 0 || port > 65535) {
+        p.addf("[common] port %d out of range 1-65535", port)
+    }
+
+    p.atLeast("common", "cookie_save_interval", time.Second)
+    p.atLeast("common", "check_max_age", 0)
+    p.add(loadValidatorCache())
+    p.add(loadRecorder())
+
+    for _, site := range(sites) {
+        p.site(site)
+    }
+
+    p.url("proxy", "check_url", true)
+    pool, err := Conf.StringSlice("proxy", "pool", nil)
+    p.add(err)
+    for _, u := range(pool) {
+        _, err := newProxy(u)
+        p.add(err)
+    }
+
+    _, err = Captcha()
+    p.add(err)
+    p.url("captcha", "url", true)
+    p.url("browser", "devtools", true)
+
+    return p
+}
+
+func (p *problems) site(site string) {
+    c := Conf.get()
+    if !c.HasSection(site) && !Conf.overridden(site) {
+        p.addf("section [%s] not found", site)
+        return
+    }
+
+    accountstr, err := Conf.String(site, "accounts", "")
+    p.add(err)
+    if strings.TrimSpace(accountstr) == "" {
+        p.addf("[%s] has no accounts option, eg. accounts=account1,account2", site)
+    }
+
+    seen := make(map[string]bool)
+    for _, account := range(strings.Split(accountstr, ",")) {
+        if strings.TrimSpace(accountstr) == "" {
+            break
+        }
+        if account != strings.TrimSpace(account) || account == "" {
+            p.addf("[%s] accounts has an empty or padded name '%s'", site, account)
+            continue
+        }
+        if seen[account] {
+            p.addf("[%s] lists account '%s' twice", site, account)
+        }
+        seen[account] = true
+        p.account(site, account)
+    }
+
+    _, err = loadKeepalive(site)
+    p.add(err)
+    _, err = loadRetry(site)
+    p.add(err)
+    _, _, err = loadSitePace(site)
+    p.add(err)
+    _, err = loadTransportConfig(site)
+    p.add(err)
+    groups, err := loadGroups(site)
+    p.add(err)
+    for _, g := range(groups) {
+        for _, account := range(g) {
+            if !seen[account] {
+                p.addf("[%s] groups has '%s', which is not in accounts", site, account)
+            }
+        }
+    }
+    _, err = siteLogin(site)
+    p.add(err)
+
+    for _, option := range([]string{"login_timeout", "check_timeout", "block_time"}) {
+        p.atLeast(site, option, time.Second)
+    }
+    p.url(site, "base_url", false)
+    p.url(site, "login_url", false)
+}
+
+func (p *problems) account(site, account string) {
+    if !Conf.get().HasSection(account) && !Conf.overridden(account) {
+        p.addf("account '%s' of [%s] has no [%s] section", account, site, account)
+        return
+    }
+    _, err := Conf.Account(site, account)
+    p.add(err)
+}
+
+// atLeast checks that the duration option of section, when set, is at
+// least min.
+func (p *problems) atLeast(section, option string, min time.Duration) {
+    d, err := Conf.Duration(section, option, min)
+    if err != nil {
+        p.add(err)
+    } else if d < min {
+        p.addf("[%s] %s must be at least %s, got %s", section, option, min, d)
+    }
+}
+
+// url checks that option of section, when set, is an absolute url.
+func (p *problems) url(section, option string, own bool) {
+    var value string
+    var err error
+    if own {
+        value, err = Conf.raw(section, option)
+    } else {
+        value, err = Conf.String(section, option, "")
+    }
+    if err != nil || value == "" {
+        p.add(err)
+        return
+    }
+    u, err := url.Parse(value)
+    if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+        p.addf("[%s] %s '%s' is not an http(s) url", section, option, value)
+    }
+}
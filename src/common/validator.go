@@ -0,0 +1,80 @@
+package common
+
+import (
+    "sync"
+    "net/http"
+    "container/list"
+)
+
+// validatorCache keeps the last response of GET requests that came with
+// an ETag or Last-Modified, so unchanged pages are asked for with
+// If-None-Match/If-Modified-Since and not downloaded again. Entries are
+// per account, sessions see different pages.
+type validatorCache struct {
+    lock sync.Mutex
+    max int
+    order *list.List
+    entries map[string]*list.Element
+}
+
+type validated struct {
+    key string
+    etag string
+    lastModified string
+    resp *Response
+}
+
+var validators *validatorCache = &validatorCache{order:list.New(), entries:make(map[string]*list.Element)}
+
+// loadValidatorCache reads validator_cache, the number of pages kept, 0
+// turns the cache off.
+func loadValidatorCache() error {
+    n, err := Conf.Int("common", "validator_cache", 1000)
+    if err != nil {
+        return err
+    }
+
+    validators.lock.Lock()
+    defer validators.lock.Unlock()
+    validators.max = n
+    validators.trim()
+    return nil
+}
+
+func (vc *validatorCache) trim() {
+    for vc.order.Len() > 0 && vc.order.Len() > vc.max {
+        e := vc.order.Back()
+        vc.order.Remove(e)
+        delete(vc.entries, e.Value.(*validated).key)
+    }
+}
+
+func (vc *validatorCache) get(key string) *validated {
+    vc.lock.Lock()
+    defer vc.lock.Unlock()
+    e, ok := vc.entries[key]
+    if !ok {
+        return nil
+    }
+    vc.order.MoveToFront(e)
+    return e.Value.(*validated)
+}
+
+func (vc *validatorCache) put(key string, resp *Response) {
+    etag := resp.Header.Get("ETag")
+    lastModified := resp.Header.Get("Last-Modified")
+
+    vc.lock.Lock()
+    defer vc.lock.Unlock()
+
+    if e, ok := vc.entries[key]; ok {
+        vc.order.Remove(e)
+        delete(vc.entries, key)
+    }
+    if vc.max <= 0 || resp.Status != http.StatusOK || (etag == "" && lastModified == "") {
+        return
+    }
+
+    vc.entries[key] = vc.order.PushFront(&validated{key, etag, lastModified, resp})
+    vc.trim()
+}
@@ -0,0 +1,177 @@
+package common
+
+import (
+    "io"
+    "fmt"
+    "net"
+    "time"
+    "bufio"
+    "errors"
+    "context"
+    "net/url"
+    "net/http"
+    "crypto/rand"
+    "crypto/sha1"
+    "encoding/base64"
+    "encoding/binary"
+)
+
+// wsConn is the small part of a websocket client the DevTools protocol
+// needs: masked text frames out, unfragmented or continued frames in.
+type wsConn struct {
+    conn net.Conn
+    r *bufio.Reader
+}
+
+const WS_GUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+func dialWebsocket(ctx context.Context, ustr string) (*wsConn, error) {
+    u, err := url.Parse(ustr)
+    if err != nil {
+        return nil, err
+    }
+    if u.Scheme != "ws" {
+        return nil, errors.New(fmt.Sprintf("unsupported websocket url '%s'", ustr))
+    }
+
+    var d net.Dialer
+    conn, err := d.DialContext(ctx, "tcp", u.Host)
+    if err != nil {
+        return nil, err
+    }
+    if deadline, ok := ctx.Deadline(); ok {
+        conn.SetDeadline(deadline)
+    }
+
+    nonce := make([]byte, 16)
+    rand.Read(nonce)
+    key := base64.StdEncoding.EncodeToString(nonce)
+
+    req := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", u.RequestURI(), u.Host, key)
+    if _, err = io.WriteString(conn, req); err != nil {
+        conn.Close()
+        return nil, err
+    }
+
+    r := bufio.NewReader(conn)
+    resp, err := http.ReadResponse(r, nil)
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+    resp.Body.Close()
+
+    sum := sha1.Sum([]byte(key + WS_GUID))
+    if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+        conn.Close()
+        return nil, errors.New(fmt.Sprintf("websocket handshake with %s failed: %s", u.Host, resp.Status))
+    }
+
+    return &wsConn{conn, r}, nil
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+    header := []byte{0x80 | opcode}
+    n := len(payload)
+    switch {
+    case n < 126:
+        header = append(header, 0x80 | byte(n))
+    case n < 65536:
+        header = append(header, 0x80 | 126, byte(n >> 8), byte(n))
+    default:
+        header = append(header, 0x80 | 127)
+        var size [8]byte
+        binary.BigEndian.PutUint64(size[:], uint64(n))
+        header = append(header, size[:]...)
+    }
+
+    mask := make([]byte, 4)
+    rand.Read(mask)
+    header = append(header, mask...)
+
+    masked := make([]byte, n)
+    for i := range(payload) {
+        masked[i] = payload[i] ^ mask[i % 4]
+    }
+
+    if _, err := c.conn.Write(append(header, masked...)); err != nil {
+        return err
+    }
+    return nil
+}
+
+// WriteText sends b as one text message.
+func (c *wsConn) WriteText(b []byte) error {
+    return c.writeFrame(0x1, b)
+}
+
+// ReadMessage returns the next text or binary message, answering pings
+// on the way.
+func (c *wsConn) ReadMessage() ([]byte, error) {
+    var message []byte
+    for {
+        var head [2]byte
+        if _, err := io.ReadFull(c.r, head[:]); err != nil {
+            return nil, err
+        }
+        fin := head[0] & 0x80 != 0
+        opcode := head[0] & 0x0f
+
+        n := uint64(head[1] & 0x7f)
+        switch n {
+        case 126:
+            var size [2]byte
+            if _, err := io.ReadFull(c.r, size[:]); err != nil {
+                return nil, err
+            }
+            n = uint64(binary.BigEndian.Uint16(size[:]))
+        case 127:
+            var size [8]byte
+            if _, err := io.ReadFull(c.r, size[:]); err != nil {
+                return nil, err
+            }
+            n = binary.BigEndian.Uint64(size[:])
+        }
+
+        var mask []byte
+        if head[1] & 0x80 != 0 {
+            mask = make([]byte, 4)
+            if _, err := io.ReadFull(c.r, mask); err != nil {
+                return nil, err
+            }
+        }
+
+        payload := make([]byte, n)
+        if _, err := io.ReadFull(c.r, payload); err != nil {
+            return nil, err
+        }
+        if mask != nil {
+            for i := range(payload) {
+                payload[i] ^= mask[i % 4]
+            }
+        }
+
+        switch opcode {
+        case 0x8:
+            return nil, io.EOF
+        case 0x9:
+            if err := c.writeFrame(0xa, payload); err != nil {
+                return nil, err
+            }
+            continue
+        case 0xa:
+            continue
+        }
+
+        message = append(message, payload...)
+        if fin {
+            return message, nil
+        }
+    }
+}
+
+func (c *wsConn) Close() error {
+    c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+    c.writeFrame(0x8, nil)
+    return c.conn.Close()
+}
@@ -0,0 +1,138 @@
+package common
+
+import (
+    "io"
+    "net"
+    "bytes"
+    "bufio"
+    "context"
+    "strings"
+    "testing"
+    "net/http"
+    "net/http/httptest"
+    "crypto/sha1"
+    "encoding/base64"
+)
+
+// upgrade answers the websocket handshake of r, with a wrong accept key
+// when bad, and returns the server side of the connection.
+func upgrade(w http.ResponseWriter, r *http.Request, bad bool) (*wsConn, error) {
+    conn, rw, err := w.(http.Hijacker).Hijack()
+    if err != nil {
+        return nil, err
+    }
+    key := r.Header.Get("Sec-WebSocket-Key")
+    if bad {
+        key += "x"
+    }
+    sum := sha1.Sum([]byte(key + WS_GUID))
+    io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+    return &wsConn{conn, rw.Reader}, nil
+}
+
+func TestDialWebsocket(t *testing.T) {
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        c, err := upgrade(w, r, r.URL.Path == "/bad")
+        if err != nil {
+            return
+        }
+        defer c.conn.Close()
+        if b, err := c.ReadMessage(); err == nil {
+            c.WriteText(bytes.ToUpper(b))
+        }
+    }))
+    defer srv.Close()
+    base := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+    c, err := dialWebsocket(context.Background(), base + "/ok")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err = c.WriteText([]byte("hello")); err != nil {
+        t.Fatal(err)
+    }
+    if b, err := c.ReadMessage(); err != nil || string(b) != "HELLO" {
+        t.Errorf("echo %q, %v, want HELLO", b, err)
+    }
+    c.Close()
+
+    if _, err = dialWebsocket(context.Background(), base + "/bad"); err == nil {
+        t.Errorf("no error for a wrong accept key")
+    }
+    if _, err = dialWebsocket(context.Background(), srv.URL); err == nil {
+        t.Errorf("no error for an http url")
+    }
+}
+
+// pipe returns the two ends of a websocket without the handshake.
+func pipe() (*wsConn, *wsConn) {
+    a, b := net.Pipe()
+    return &wsConn{a, bufio.NewReader(a)}, &wsConn{b, bufio.NewReader(b)}
+}
+
+func TestWebsocketFrames(t *testing.T) {
+    // the lengths around the 7 bit, 16 bit and 64 bit sizes.
+    for _, n := range([]int{0, 1, 125, 126, 127, 65535, 65536, 70000}) {
+        client, server := pipe()
+        payload := bytes.Repeat([]byte("abcdefg"), n / 7 + 1)[:n]
+        go client.WriteText(payload)
+        got, err := server.ReadMessage()
+        if err != nil || !bytes.Equal(got, payload) {
+            t.Errorf("%d bytes: read %d bytes, %v", n, len(got), err)
+        }
+        client.conn.Close()
+        server.conn.Close()
+    }
+}
+
+func TestWebsocketMessages(t *testing.T) {
+    client, server := pipe()
+    defer client.conn.Close()
+    defer server.conn.Close()
+
+    go func() {
+        // a fragmented message with a ping in the middle, then a close.
+        server.writeFrameFin(false, 0x1, []byte("hel"))
+        server.writeFrame(0x9, []byte("are you there"))
+        server.writeFrameFin(true, 0x0, []byte("lo"))
+        server.writeFrame(0xa, nil)
+        server.writeFrame(0x1, []byte("second"))
+        server.writeFrame(0x8, nil)
+    }()
+    // the client answers the ping with a masked pong of its payload.
+    pong := make(chan string, 1)
+    go func() {
+        frame := make([]byte, 2 + 4 + len("are you there"))
+        if _, err := io.ReadFull(server.r, frame); err != nil || frame[0] != 0x8a || frame[1] != 0x80 | byte(len(frame) - 6) {
+            pong <- ""
+            return
+        }
+        for i := range(frame[6:]) {
+            frame[6 + i] ^= frame[2 + i % 4]
+        }
+        pong <- string(frame[6:])
+    }()
+
+    if b, err := client.ReadMessage(); err != nil || string(b) != "hello" {
+        t.Errorf("fragmented message %q, %v, want hello", b, err)
+    }
+    if b, err := client.ReadMessage(); err != nil || string(b) != "second" {
+        t.Errorf("message %q, %v, want second", b, err)
+    }
+    if _, err := client.ReadMessage(); err != io.EOF {
+        t.Errorf("close frame gave %v, want EOF", err)
+    }
+    if b := <-pong; b != "are you there" {
+        t.Errorf("pong of %q, want the ping's payload", b)
+    }
+}
+
+// writeFrameFin is writeFrame with fin chosen, for fragments.
+func (c *wsConn) writeFrameFin(fin bool, opcode byte, payload []byte) error {
+    head := []byte{opcode, byte(len(payload))}
+    if fin {
+        head[0] |= 0x80
+    }
+    _, err := c.conn.Write(append(head, payload...))
+    return err
+}
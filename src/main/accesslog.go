@@ -0,0 +1,112 @@
+package main
+
+import (
+    "fmt"
+    "time"
+    "errors"
+    "net/http"
+    "encoding/json"
+    "common"
+    log "code.google.com/p/log4go"
+)
+
+type accessRecorder struct {
+    http.ResponseWriter
+    status int
+    size int
+}
+
+func (ar *accessRecorder) WriteHeader(status int) {
+    ar.status = status
+    ar.ResponseWriter.WriteHeader(status)
+}
+
+func (ar *accessRecorder) Write(b []byte) (int, error) {
+    if ar.status == 0 {
+        ar.status = http.StatusOK
+    }
+    n, err := ar.ResponseWriter.Write(b)
+    ar.size += n
+    return n, err
+}
+
+func (ar *accessRecorder) Flush() {
+    if f, ok := ar.ResponseWriter.(http.Flusher); ok {
+        f.Flush()
+    }
+}
+
+type accessEntry struct {
+    Method string `json:"method"`
+    Path string `json:"path"`
+    Account string `json:"account,omitempty"`
+    Status int `json:"status"`
+    Size int `json:"size"`
+    DurationMs float64 `json:"duration_ms"`
+    Cache string `json:"cache,omitempty"`
+}
+
+var accessLogJSON bool
+
+func loadAccessLog() error {
+    format, err := common.Conf.String("log", "access_format", "text")
+    if err != nil {
+        return err
+    }
+
+    settingsLock.Lock()
+    defer settingsLock.Unlock()
+
+    switch format {
+    case "text":
+        accessLogJSON = false
+    case "json":
+        accessLogJSON = true
+    default:
+        return errors.New(fmt.Sprintf("invalid access_format '%s', expect text or json", format))
+    }
+
+    return nil
+}
+
+// accessLog logs one line per request. Handlers report cache usage via
+// the X-Cache response header.
+func accessLog(h http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        start := time.Now()
+        ar := &accessRecorder{ResponseWriter:w}
+
+        h.ServeHTTP(ar, r)
+
+        if ar.status == 0 {
+            ar.status = http.StatusOK
+        }
+
+        entry := accessEntry{
+            Method:r.Method,
+            Path:r.URL.Path,
+            Account:r.FormValue("account"),
+            Status:ar.status,
+            Size:ar.size,
+            DurationMs:float64(time.Since(start)) / float64(time.Millisecond),
+            Cache:w.Header().Get("X-Cache"),
+        }
+
+        settingsLock.RLock()
+        useJSON := accessLogJSON
+        settingsLock.RUnlock()
+
+        if useJSON {
+            b, _ := json.Marshal(entry)
+            log.Info("ACCESS %s", string(b))
+            return
+        }
+
+        cache := entry.Cache
+        if cache == "" {
+            cache = "-"
+        }
+        log.Info("ACCESS %s %s account=%s status=%d size=%d time=%.1fms cache=%s",
+            entry.Method, entry.Path, entry.Account, entry.Status, entry.Size, entry.DurationMs, cache)
+    })
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+    "strings"
+    "io/ioutil"
+    "net/http"
+    "common"
+    log "code.google.com/p/log4go"
+)
+
+// reloginHandler rebuilds an account's client from the cookies posted in
+// the body, or from the config file when the body is empty.
+func reloginHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        writeError(w, http.StatusMethodNotAllowed, BAD_PARAMS, "error, use POST", false)
+        return
+    }
+
+    site := r.URL.Query().Get("site")
+    account := r.URL.Query().Get("account")
+    if site == "" || account == "" {
+        writeError(w, http.StatusBadRequest, BAD_PARAMS, "error, site or account is nil. eg.http://localhost/admin/relogin?site=taoke&account=account1", false)
+        return
+    }
+
+    var cookies string
+    if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+        cookies = r.PostFormValue("cookies")
+    } else {
+        b, e := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1 << 20))
+        if e != nil {
+            writeError(w, http.StatusBadRequest, BAD_PARAMS, e.Error(), false)
+            return
+        }
+        cookies = string(b)
+    }
+
+    if e := common.Relogin(site, account, strings.TrimSpace(cookies)); e != nil {
+        log.Error(e)
+        writeFetchError(w, e)
+        return
+    }
+
+    cleanAccount(site, account)
+
+    writeStatus(w, http.StatusOK, "relogin " + account)
+}
+
+// reloadHandler re-reads the config file and applies it to accounts,
+// cache, keepalive and middleware settings, listing what changed.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        writeError(w, http.StatusMethodNotAllowed, BAD_PARAMS, "error, use POST", false)
+        return
+    }
+
+    changes, e := reload()
+    if e != nil {
+        writeResponse(w, http.StatusInternalServerError, &Response{Error:1, Code:INTERNAL, Msg:e.Error(), Data:changes})
+        return
+    }
+
+    writeData(w, changes)
+}
+
+// proxiesHandler reports the proxy pool with per-proxy failure rates.
+func proxiesHandler(w http.ResponseWriter, r *http.Request) {
+    writeData(w, common.ProxyStates())
+}
+
+// configHandler shows the config the process runs with, after includes,
+// remote, environment and command line, with secrets masked.
+func configHandler(w http.ResponseWriter, r *http.Request) {
+    writeData(w, common.Conf.Dump())
+}
+
+// accountHandler adds an account at runtime on POST, with its cookies in
+// the body, and removes one on DELETE.
+func accountHandler(w http.ResponseWriter, r *http.Request) {
+    site := r.URL.Query().Get("site")
+    account := r.URL.Query().Get("account")
+    if site == "" || account == "" {
+        writeError(w, http.StatusBadRequest, BAD_PARAMS, "error, site or account is nil. eg.http://localhost/admin/account?site=taoke&account=account3", false)
+        return
+    }
+    if _, ok := common.Adapter(site); !ok {
+        writeError(w, http.StatusBadRequest, BAD_PARAMS, "error, unknown site " + site, false)
+        return
+    }
+
+    switch r.Method {
+    case "POST":
+        b, e := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1 << 20))
+        if e != nil {
+            writeError(w, http.StatusBadRequest, BAD_PARAMS, e.Error(), false)
+            return
+        }
+        if e = common.AddAccount(site, account, strings.TrimSpace(string(b))); e != nil {
+            log.Error(e)
+            writeError(w, http.StatusBadRequest, BAD_PARAMS, e.Error(), false)
+            return
+        }
+        writeStatus(w, http.StatusOK, "added " + account)
+
+    case "DELETE":
+        if e := common.RemoveAccount(site, account); e != nil {
+            writeFetchError(w, e)
+            return
+        }
+        cleanAccount(site, account)
+        writeStatus(w, http.StatusOK, "removed " + account)
+
+    default:
+        writeError(w, http.StatusMethodNotAllowed, BAD_PARAMS, "error, use POST or DELETE", false)
+    }
+}
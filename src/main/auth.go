@@ -0,0 +1,188 @@
+package main
+
+import (
+    "fmt"
+    "context"
+    "errors"
+    "strings"
+    "net/http"
+    "common"
+    log "code.google.com/p/log4go"
+)
+
+type apiKey struct {
+    name string
+    token string
+    endpoints map[string]bool
+    sites map[string]bool
+    accounts map[string]bool
+}
+
+type ctxKey int
+
+const apiKeyCtx ctxKey = 0
+
+func listSet(s string) map[string]bool {
+    set := make(map[string]bool)
+    for _, v := range(splitList(s)) {
+        set[v] = true
+    }
+    return set
+}
+
+// apiKeys maps tokens to keys; empty means auth is disabled.
+var apiKeys map[string]*apiKey = make(map[string]*apiKey)
+
+func loadAuth() error {
+    keystr, err := common.Conf.String("auth", "keys", "")
+    if err != nil {
+        return err
+    }
+
+    keys := make(map[string]*apiKey)
+
+    for _, name := range(strings.Split(keystr, ",")) {
+        name = strings.TrimSpace(name)
+        if name == "" {
+            continue
+        }
+
+        token, err := common.Conf.Secret(name, "token")
+        if err != nil {
+            return err
+        }
+
+        if token == "" {
+            return errors.New(fmt.Sprintf("token not found for api key '%s'", name))
+        }
+
+        endpointstr, err := common.Conf.String(name, "endpoints", "*")
+        if err != nil {
+            return err
+        }
+
+        sitestr, err := common.Conf.String(name, "sites", "*")
+        if err != nil {
+            return err
+        }
+
+        accountstr, err := common.Conf.String(name, "accounts", "*")
+        if err != nil {
+            return err
+        }
+
+        k := &apiKey{
+            name:name,
+            token:token,
+            endpoints:listSet(endpointstr),
+            sites:listSet(sitestr),
+            accounts:listSet(accountstr),
+        }
+
+        keys[token] = k
+    }
+
+    settingsLock.Lock()
+    apiKeys = keys
+    settingsLock.Unlock()
+    log.Info("Loaded %d api keys.", len(keys))
+
+    return nil
+}
+
+func requestToken(r *http.Request) string {
+    if t := r.Header.Get("X-Api-Token"); t != "" {
+        return t
+    }
+
+    if a := r.Header.Get("Authorization"); strings.HasPrefix(a, "Bearer ") {
+        return strings.TrimSpace(a[len("Bearer "):])
+    }
+
+    return r.FormValue("token")
+}
+
+func (k *apiKey) allowed(path string) bool {
+    return k.endpoints["*"] || k.endpoints[path]
+}
+
+func (k *apiKey) allowedAccount(site, account string) bool {
+    return (k.sites["*"] || k.sites[site]) && (k.accounts["*"] || k.accounts[account])
+}
+
+// requestKey returns the api key that authenticated r, nil when auth is
+// disabled.
+func requestKey(r *http.Request) *apiKey {
+    k, _ := r.Context().Value(apiKeyCtx).(*apiKey)
+    return k
+}
+
+// allowAccount reports whether r may read account of site.
+func allowAccount(r *http.Request, site, account string) bool {
+    k := requestKey(r)
+    return k == nil || k.allowedAccount(site, account)
+}
+
+// forbidAccount writes a 403 unless r may read account of site.
+func forbidAccount(w http.ResponseWriter, r *http.Request, site, account string) bool {
+    if allowAccount(r, site, account) {
+        return false
+    }
+    writeError(w, http.StatusForbidden, FORBIDDEN, fmt.Sprintf("api key '%s' not permitted for %s account %s", requestKey(r).name, site, account), false)
+    return true
+}
+
+func unauthorized(w http.ResponseWriter, msg string) {
+    writeError(w, http.StatusUnauthorized, UNAUTHORIZED, msg, false)
+}
+
+// requireAuth rejects requests without a configured token permitted for
+// the request path. It is a no-op when no api keys are configured.
+func requireAuth(h http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        settingsLock.RLock()
+        keys := apiKeys
+        settingsLock.RUnlock()
+
+        if len(keys) == 0 {
+            h(w, r)
+            return
+        }
+
+        token := requestToken(r)
+        if token == "" {
+            unauthorized(w, "api token required")
+            return
+        }
+
+        k, ok := keys[token]
+        if !ok {
+            unauthorized(w, "invalid api token")
+            return
+        }
+
+        if !k.allowed(r.URL.Path) {
+            unauthorized(w, fmt.Sprintf("api key '%s' not permitted for %s", k.name, r.URL.Path))
+            return
+        }
+
+        h(w, r.WithContext(context.WithValue(r.Context(), apiKeyCtx, k)))
+    }
+}
+
+// requireAdmin is requireAuth, except that admin endpoints stay closed
+// when no api keys are configured.
+func requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        settingsLock.RLock()
+        n := len(apiKeys)
+        settingsLock.RUnlock()
+
+        if n == 0 {
+            writeError(w, http.StatusForbidden, UNAUTHORIZED, "admin endpoints need api keys in config", false)
+            return
+        }
+
+        requireAuth(h)(w, r)
+    }
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+    "testing"
+    "net/http"
+    "net/http/httptest"
+    "common"
+)
+
+// loadTestAuth loads the api keys of conf, the returned func drops them.
+func loadTestAuth(t *testing.T, conf string) func() {
+    if err := common.LoadFromString(conf); err != nil {
+        t.Fatal(err)
+    }
+    if err := loadAuth(); err != nil {
+        t.Fatal(err)
+    }
+    return func() {
+        settingsLock.Lock()
+        apiKeys = make(map[string]*apiKey)
+        settingsLock.Unlock()
+    }
+}
+
+const testAuthConf = "[auth]\nkeys=admin,dash\n" +
+    "[admin]\ntoken=admtok\n" +
+    "[dash]\ntoken=dashtok\nendpoints=/taoke,/yiqifa\nsites=taoke\naccounts=a1,a2\n"
+
+func TestRequireAuth(t *testing.T) {
+    cases := []struct {
+        name string
+        conf string
+        path string
+        header string
+        value string
+        form string
+        code int
+        key string
+    }{
+        {name:"disabled", conf:"[auth]\nkeys=\n", path:"/taoke", code:200},
+        {name:"no token", conf:testAuthConf, path:"/taoke", code:401},
+        {name:"bad token", conf:testAuthConf, path:"/taoke", header:"X-Api-Token", value:"nope", code:401},
+        {name:"header", conf:testAuthConf, path:"/taoke", header:"X-Api-Token", value:"dashtok", code:200, key:"dash"},
+        {name:"bearer", conf:testAuthConf, path:"/taoke", header:"Authorization", value:"Bearer admtok", code:200, key:"admin"},
+        {name:"not bearer", conf:testAuthConf, path:"/taoke", header:"Authorization", value:"Basic admtok", code:401},
+        {name:"form", conf:testAuthConf, path:"/yiqifa", form:"token=dashtok", code:200, key:"dash"},
+        {name:"endpoint not permitted", conf:testAuthConf, path:"/admin/reload", header:"X-Api-Token", value:"dashtok", code:401},
+        {name:"any endpoint", conf:testAuthConf, path:"/admin/reload", header:"X-Api-Token", value:"admtok", code:200, key:"admin"},
+    }
+    for _, c := range(cases) {
+        defer loadTestAuth(t, c.conf)()
+
+        key := ""
+        h := requireAuth(func(w http.ResponseWriter, r *http.Request) {
+            if k := requestKey(r); k != nil {
+                key = k.name
+            }
+        })
+        target := c.path
+        if c.form != "" {
+            target += "?" + c.form
+        }
+        r := httptest.NewRequest("GET", target, nil)
+        if c.header != "" {
+            r.Header.Set(c.header, c.value)
+        }
+        w := httptest.NewRecorder()
+        h(w, r)
+
+        if w.Code != c.code || key != c.key {
+            t.Errorf("%s: code %d with key %q, want %d with %q", c.name, w.Code, key, c.code, c.key)
+        }
+    }
+}
+
+func TestRequireAdmin(t *testing.T) {
+    h := requireAdmin(func(w http.ResponseWriter, r *http.Request) {})
+    cases := []struct {
+        conf string
+        token string
+        code int
+    }{
+        {conf:"[auth]\nkeys=\n", code:403},
+        {conf:testAuthConf, code:401},
+        {conf:testAuthConf, token:"admtok", code:200},
+    }
+    for _, c := range(cases) {
+        defer loadTestAuth(t, c.conf)()
+        r := httptest.NewRequest("GET", "/admin/reload", nil)
+        r.Header.Set("X-Api-Token", c.token)
+        w := httptest.NewRecorder()
+        h(w, r)
+        if w.Code != c.code {
+            t.Errorf("token %q: code %d, want %d", c.token, w.Code, c.code)
+        }
+    }
+}
+
+func TestAllowAccount(t *testing.T) {
+    defer loadTestAuth(t, testAuthConf)()
+    cases := []struct {
+        token string
+        site string
+        account string
+        allowed bool
+    }{
+        {token:"admtok", site:"yiqifa", account:"b9", allowed:true},
+        {token:"dashtok", site:"taoke", account:"a1", allowed:true},
+        {token:"dashtok", site:"taoke", account:"a2", allowed:true},
+        {token:"dashtok", site:"taoke", account:"a3"},
+        {token:"dashtok", site:"yiqifa", account:"a1"},
+    }
+    for _, c := range(cases) {
+        allowed, forbidden := false, false
+        h := requireAuth(func(w http.ResponseWriter, r *http.Request) {
+            allowed = allowAccount(r, c.site, c.account)
+            forbidden = forbidAccount(w, r, c.site, c.account)
+        })
+        r := httptest.NewRequest("GET", "/taoke", nil)
+        r.Header.Set("X-Api-Token", c.token)
+        w := httptest.NewRecorder()
+        h(w, r)
+
+        if allowed != c.allowed || forbidden == c.allowed {
+            t.Errorf("%s for %s %s: allowed %v, forbidden %v, want allowed %v", c.token, c.site, c.account, allowed, forbidden, c.allowed)
+        }
+        if want := map[bool]int{true:200, false:403}[c.allowed]; w.Code != want {
+            t.Errorf("%s for %s %s: code %d, want %d", c.token, c.site, c.account, w.Code, want)
+        }
+    }
+
+    // without api keys every account is allowed.
+    r := httptest.NewRequest("GET", "/taoke", nil)
+    if !allowAccount(r, "taoke", "any") {
+        t.Errorf("account not allowed without an api key")
+    }
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+    "sync"
+    "context"
+    "strings"
+    "net/http"
+    "common"
+    log "code.google.com/p/log4go"
+)
+
+// fetchAll fetches site data for every account using at most workers
+// concurrent fetches, returning one Response per account. Each account is
+// fetched by fetch, so through the cache, failover and the limits; a
+// BatchAdapter runs them, EachAccount otherwise.
+func fetchAll(ctx context.Context, site string, accounts []string, startTime, endTime string, workers int) map[string]*Response {
+    entries := make(map[string]*cacheEntry, len(accounts))
+    var lock sync.Mutex
+    get := func(ctx context.Context, account, startTime, endTime string) ([]byte, error) {
+        entry, _, e := fetch(ctx, site, account, startTime, endTime)
+        if e != nil {
+            return nil, e
+        }
+        lock.Lock()
+        entries[account] = entry
+        lock.Unlock()
+        return entry.data, nil
+    }
+
+    var errs map[string]error
+    adapter, _ := common.Adapter(site)
+    if ba, ok := adapter.(common.BatchAdapter); ok {
+        errs = ba.FetchAll(ctx, accounts, startTime, endTime, workers, get)
+    } else {
+        errs = make(map[string]error, len(accounts))
+        common.EachAccount(accounts, workers, func(account string) {
+            _, e := get(ctx, account, startTime, endTime)
+            if e != nil {
+                log.Error(e)
+            }
+            lock.Lock()
+            errs[account] = e
+            lock.Unlock()
+        })
+    }
+
+    results := make(map[string]*Response, len(errs))
+    for account, e := range(errs) {
+        if e != nil {
+            _, results[account] = errorResponse(e)
+            continue
+        }
+        results[account] = rowsResponse(entries[account].data, entries[account].rows)
+    }
+    return results
+}
+
+// batchAccounts lists the accounts named by param; "all" means every
+// account of site the request may read.
+func batchAccounts(r *http.Request, site, param string) ([]string, error) {
+    if param == "all" {
+        all, err := common.SiteAccounts(site)
+        if err != nil {
+            return nil, err
+        }
+        var accounts []string
+        for _, account := range(all) {
+            if allowAccount(r, site, account) {
+                accounts = append(accounts, account)
+            }
+        }
+        return accounts, nil
+    }
+
+    seen := make(map[string]bool)
+    var accounts []string
+    for _, account := range(strings.Split(param, ",")) {
+        account = strings.TrimSpace(account)
+        if account != "" && !seen[account] {
+            seen[account] = true
+            accounts = append(accounts, account)
+        }
+    }
+    return accounts, nil
+}
+
+func batchHandler(site string) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        accounts, e := batchAccounts(r, site, r.FormValue("account"))
+        if e != nil {
+            writeError(w, http.StatusInternalServerError, INTERNAL, e.Error(), false)
+            return
+        }
+
+        if len(accounts) == 0 {
+            writeError(w, http.StatusBadRequest, BAD_PARAMS, "error, account is nil. eg.http://localhost/" + site + "/batch?account=a,b or account=all", false)
+            return
+        }
+
+        for _, account := range(accounts) {
+            if forbidAccount(w, r, site, account) {
+                return
+            }
+        }
+
+        startTime, endTime, e := dateRange(r)
+        if e != nil {
+            writeError(w, http.StatusBadRequest, BAD_PARAMS, e.Error(), false)
+            return
+        }
+
+        workers, e := common.Conf.Int("common", "batch_workers", 4)
+        if e != nil || workers <= 0 {
+            workers = 4
+        }
+
+        ctx, cancel := requestContext(r)
+        defer cancel()
+
+        writeData(w, fetchAll(ctx, site, accounts, startTime, endTime, workers))
+    }
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+    "time"
+    "strconv"
+    "strings"
+    "net/http"
+    "common"
+)
+
+type corsConfig struct {
+    origins map[string]bool
+    methods string
+    headers string
+    expose string
+    maxAge string
+}
+
+// cors is nil when no origins are configured.
+var cors *corsConfig
+
+func splitList(s string) []string {
+    var list []string
+    for _, v := range(strings.Split(s, ",")) {
+        v = strings.TrimSpace(v)
+        if v != "" {
+            list = append(list, v)
+        }
+    }
+    return list
+}
+
+func loadCORS() error {
+    origins, err := common.Conf.String("cors", "origins", "")
+    if err != nil {
+        return err
+    }
+
+    methods, err := common.Conf.String("cors", "methods", "GET,OPTIONS")
+    if err != nil {
+        return err
+    }
+
+    headers, err := common.Conf.String("cors", "headers", "X-Api-Token,Authorization")
+    if err != nil {
+        return err
+    }
+
+    // the headers of the api a browser may read.
+    expose, err := common.Conf.String("cors", "expose", "ETag,X-Cache,X-Served-By,Retry-After,Content-Disposition")
+    if err != nil {
+        return err
+    }
+
+    maxAge, err := common.Conf.Duration("cors", "max_age", 600 * time.Second)
+    if err != nil {
+        return err
+    }
+
+    list := splitList(origins)
+    if len(list) == 0 {
+        settingsLock.Lock()
+        cors = nil
+        settingsLock.Unlock()
+        return nil
+    }
+
+    c := &corsConfig{
+        origins:make(map[string]bool),
+        methods:strings.Join(splitList(methods), ", "),
+        headers:strings.Join(splitList(headers), ", "),
+        expose:strings.Join(splitList(expose), ", "),
+        maxAge:strconv.Itoa(int(maxAge.Seconds())),
+    }
+    for _, o := range(list) {
+        c.origins[o] = true
+    }
+    settingsLock.Lock()
+    cors = c
+    settingsLock.Unlock()
+
+    return nil
+}
+
+func (c *corsConfig) allowed(origin string) bool {
+    return c.origins["*"] || c.origins[origin]
+}
+
+// withCORS adds CORS headers for allowed origins and answers preflight
+// requests before they reach authentication. Every answer varies by
+// Origin then, so a cache does not hand one without the headers to an
+// allowed origin.
+func withCORS(h http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        settingsLock.RLock()
+        c := cors
+        settingsLock.RUnlock()
+        if c == nil {
+            h.ServeHTTP(w, r)
+            return
+        }
+
+        w.Header().Add("Vary", "Origin")
+        origin := r.Header.Get("Origin")
+        if origin == "" || !c.allowed(origin) {
+            h.ServeHTTP(w, r)
+            return
+        }
+
+        w.Header().Set("Access-Control-Allow-Origin", origin)
+        if c.expose != "" {
+            w.Header().Set("Access-Control-Expose-Headers", c.expose)
+        }
+
+        if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+            w.Header().Set("Access-Control-Allow-Methods", c.methods)
+            w.Header().Set("Access-Control-Allow-Headers", c.headers)
+            w.Header().Set("Access-Control-Max-Age", c.maxAge)
+            w.WriteHeader(http.StatusNoContent)
+            return
+        }
+
+        h.ServeHTTP(w, r)
+    })
+}
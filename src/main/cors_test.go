@@ -0,0 +1,71 @@
+package main
+
+import (
+    "testing"
+    "net/http"
+    "net/http/httptest"
+    "common"
+)
+
+func TestWithCORS(t *testing.T) {
+    cases := []struct {
+        name string
+        conf string
+        method string
+        origin string
+        preflight bool
+        code int
+        allow string
+        expose string
+        vary bool
+    }{
+        {name:"disabled", conf:"", method:"GET", origin:"http://a.example.com", code:200},
+        {name:"allowed", conf:"origins=http://a.example.com", method:"GET", origin:"http://a.example.com", code:200,
+            allow:"http://a.example.com", expose:"ETag, X-Cache, X-Served-By, Retry-After, Content-Disposition", vary:true},
+        {name:"not allowed", conf:"origins=http://a.example.com", method:"GET", origin:"http://b.example.com", code:200, vary:true},
+        {name:"no origin", conf:"origins=http://a.example.com", method:"GET", code:200, vary:true},
+        {name:"any", conf:"origins=*\nexpose=ETag", method:"GET", origin:"http://b.example.com", code:200,
+            allow:"http://b.example.com", expose:"ETag", vary:true},
+        {name:"preflight", conf:"origins=http://a.example.com", method:"OPTIONS", origin:"http://a.example.com", preflight:true, code:204,
+            allow:"http://a.example.com", expose:"ETag, X-Cache, X-Served-By, Retry-After, Content-Disposition", vary:true},
+        {name:"preflight not allowed", conf:"origins=http://a.example.com", method:"OPTIONS", origin:"http://b.example.com", preflight:true, code:200, vary:true},
+        {name:"options", conf:"origins=http://a.example.com", method:"OPTIONS", origin:"http://a.example.com", code:200,
+            allow:"http://a.example.com", expose:"ETag, X-Cache, X-Served-By, Retry-After, Content-Disposition", vary:true},
+    }
+    h := withCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+    for _, c := range(cases) {
+        if err := common.LoadFromString("[cors]\n" + c.conf + "\n"); err != nil {
+            t.Fatal(err)
+        }
+        if err := loadCORS(); err != nil {
+            t.Fatal(err)
+        }
+
+        r := httptest.NewRequest(c.method, "/taoke", nil)
+        if c.origin != "" {
+            r.Header.Set("Origin", c.origin)
+        }
+        if c.preflight {
+            r.Header.Set("Access-Control-Request-Method", "GET")
+        }
+        w := httptest.NewRecorder()
+        h.ServeHTTP(w, r)
+
+        if w.Code != c.code {
+            t.Errorf("%s: code %d, want %d", c.name, w.Code, c.code)
+        }
+        if got := w.Header().Get("Access-Control-Allow-Origin"); got != c.allow {
+            t.Errorf("%s: Allow-Origin %q, want %q", c.name, got, c.allow)
+        }
+        if got := w.Header().Get("Access-Control-Expose-Headers"); got != c.expose {
+            t.Errorf("%s: Expose-Headers %q, want %q", c.name, got, c.expose)
+        }
+        if got := w.Header().Get("Vary") == "Origin"; got != c.vary {
+            t.Errorf("%s: Vary of Origin %v, want %v", c.name, got, c.vary)
+        }
+        preflight := w.Header().Get("Access-Control-Allow-Methods") != ""
+        if want := c.preflight && c.allow != ""; preflight != want {
+            t.Errorf("%s: preflight headers %v, want %v", c.name, preflight, want)
+        }
+    }
+}
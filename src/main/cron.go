@@ -0,0 +1,125 @@
+package main
+
+import (
+    "fmt"
+    "time"
+    "errors"
+    "strings"
+    "strconv"
+)
+
+// schedule is a cron expression of five fields: minute, hour, day of
+// month, month and day of week. Fields take *, numbers, ranges a-b,
+// steps */n or a-b/n, and comma separated lists of those. As in cron, a
+// day matches either day field when both are restricted, "0 3 1 * 1" is
+// at 3:00 on the first of the month and on every monday.
+type schedule struct {
+    fields [5]map[int]bool
+    // anyDay and anyWeekday tell which day fields are *.
+    anyDay, anyWeekday bool
+}
+
+var cronBounds = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+
+func parseCronField(s string, min, max int) (map[int]bool, error) {
+    set := make(map[int]bool)
+
+    for _, part := range(strings.Split(s, ",")) {
+        step := 1
+        if i := strings.Index(part, "/"); i != -1 {
+            n, err := strconv.Atoi(part[i+1:])
+            if err != nil || n <= 0 {
+                return nil, errors.New(fmt.Sprintf("invalid step in '%s'", part))
+            }
+            step = n
+            part = part[:i]
+        }
+
+        lo, hi := min, max
+        if part != "*" {
+            bounds := strings.SplitN(part, "-", 2)
+            var err error
+            if lo, err = strconv.Atoi(bounds[0]); err != nil {
+                return nil, errors.New(fmt.Sprintf("invalid value '%s'", part))
+            }
+            hi = lo
+            if len(bounds) == 2 {
+                if hi, err = strconv.Atoi(bounds[1]); err != nil {
+                    return nil, errors.New(fmt.Sprintf("invalid value '%s'", part))
+                }
+            }
+        }
+
+        if lo < min || hi > max || lo > hi {
+            return nil, errors.New(fmt.Sprintf("'%s' out of range %d-%d", part, min, max))
+        }
+
+        for v := lo; v <= hi; v += step {
+            set[v] = true
+        }
+    }
+
+    return set, nil
+}
+
+func parseSchedule(spec string) (*schedule, error) {
+    parts := strings.Fields(spec)
+    if len(parts) != 5 {
+        return nil, errors.New(fmt.Sprintf("schedule '%s' needs 5 fields", spec))
+    }
+
+    sc := &schedule{}
+    for i, part := range(parts) {
+        set, err := parseCronField(part, cronBounds[i][0], cronBounds[i][1])
+        if err != nil {
+            return nil, errors.New(fmt.Sprintf("schedule '%s': %s", spec, err.Error()))
+        }
+        sc.fields[i] = set
+    }
+    sc.anyDay = strings.HasPrefix(parts[2], "*")
+    sc.anyWeekday = strings.HasPrefix(parts[4], "*")
+
+    return sc, nil
+}
+
+func (sc *schedule) matches(t time.Time) bool {
+    if !sc.fields[0][t.Minute()] || !sc.fields[1][t.Hour()] || !sc.fields[3][int(t.Month())] {
+        return false
+    }
+    day, weekday := sc.fields[2][t.Day()], sc.fields[4][int(t.Weekday())]
+    if !sc.anyDay && !sc.anyWeekday {
+        return day || weekday
+    }
+    return day && weekday
+}
+
+// interval is the shortest time between the next runs after t, zero when
+// it runs once or never.
+func (sc *schedule) interval(t time.Time) time.Duration {
+    var min time.Duration
+    t = sc.next(t)
+    for i := 0; i < 8 && !t.IsZero(); i++ {
+        n := sc.next(t)
+        if n.IsZero() {
+            break
+        }
+        if d := n.Sub(t); min == 0 || d < min {
+            min = d
+        }
+        t = n
+    }
+    return min
+}
+
+// next returns the first minute after t matching the schedule.
+func (sc *schedule) next(t time.Time) time.Time {
+    t = t.Truncate(time.Minute).Add(time.Minute)
+    // a year of minutes covers every satisfiable expression.
+    for i := 0; i < 366 * 24 * 60; i++ {
+        if sc.matches(t) {
+            return t
+        }
+        t = t.Add(time.Minute)
+    }
+    return time.Time{}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func cronTime(s string) time.Time {
+    t, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+    if err != nil {
+        panic(err)
+    }
+    return t
+}
+
+func TestParseSchedule(t *testing.T) {
+    cases := []struct {
+        spec string
+        err bool
+    }{
+        {spec:"* * * * *"},
+        {spec:"*/15 0-6,22-23 1-31/2 * 1-5"},
+        {spec:"0 3 1 * 1"},
+        {spec:"* * * *", err:true},
+        {spec:"60 * * * *", err:true},
+        {spec:"* 24 * * *", err:true},
+        {spec:"* * 0 * *", err:true},
+        {spec:"* * * 13 *", err:true},
+        {spec:"* * * * 7", err:true},
+        {spec:"5-1 * * * *", err:true},
+        {spec:"*/0 * * * *", err:true},
+        {spec:"a * * * *", err:true},
+    }
+    for _, c := range(cases) {
+        _, err := parseSchedule(c.spec)
+        if (err != nil) != c.err {
+            t.Errorf("parseSchedule(%q) error %v, want error %v", c.spec, err, c.err)
+        }
+    }
+}
+
+func TestScheduleMatches(t *testing.T) {
+    // 2013-07-01 is a monday.
+    cases := []struct {
+        spec string
+        at string
+        want bool
+    }{
+        {"* * * * *", "2013-07-03 12:34", true},
+        {"*/15 * * * *", "2013-07-03 12:45", true},
+        {"*/15 * * * *", "2013-07-03 12:46", false},
+        {"0 3 * * *", "2013-07-03 03:00", true},
+        {"0 3 * * *", "2013-07-03 04:00", false},
+        {"0 9 * * 1-5", "2013-07-05 09:00", true},
+        {"0 9 * * 1-5", "2013-07-06 09:00", false},
+        {"0 0 1 * *", "2013-08-01 00:00", true},
+        {"0 0 1 * *", "2013-08-02 00:00", false},
+        {"0 0 * 7 *", "2013-08-01 00:00", false},
+        // both day fields restricted: either matches.
+        {"0 3 1 * 1", "2013-07-01 03:00", true},
+        {"0 3 1 * 1", "2013-07-08 03:00", true},
+        {"0 3 1 * 1", "2013-08-01 03:00", true},
+        {"0 3 1 * 1", "2013-07-09 03:00", false},
+        // a day field of * leaves the other alone.
+        {"0 3 */2 * 1", "2013-07-08 03:00", false},
+        {"0 3 */2 * 1", "2013-07-09 03:00", false},
+        {"0 3 */2 * 1", "2013-07-15 03:00", true},
+        {"0 3 1 * *", "2013-07-08 03:00", false},
+    }
+    for _, c := range(cases) {
+        sc, err := parseSchedule(c.spec)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if got := sc.matches(cronTime(c.at)); got != c.want {
+            t.Errorf("%q at %s: %v, want %v", c.spec, c.at, got, c.want)
+        }
+    }
+}
+
+func TestScheduleNext(t *testing.T) {
+    cases := []struct {
+        spec string
+        after string
+        want string
+    }{
+        {"*/15 * * * *", "2013-07-03 12:45", "2013-07-03 13:00"},
+        {"0 3 * * *", "2013-07-03 03:00", "2013-07-04 03:00"},
+        {"0 3 1 * 1", "2013-07-01 03:00", "2013-07-08 03:00"},
+        {"0 3 1 * 1", "2013-07-29 03:00", "2013-08-01 03:00"},
+        // no february 29th within a year.
+        {"0 0 29 2 *", "2013-03-01 00:00", ""},
+    }
+    for _, c := range(cases) {
+        sc, err := parseSchedule(c.spec)
+        if err != nil {
+            t.Fatal(err)
+        }
+        got := sc.next(cronTime(c.after))
+        if c.want == "" {
+            if !got.IsZero() {
+                t.Errorf("%q after %s: %s, want none", c.spec, c.after, got)
+            }
+            continue
+        }
+        if !got.Equal(cronTime(c.want)) {
+            t.Errorf("%q after %s: %s, want %s", c.spec, c.after, got, c.want)
+        }
+    }
+}
+
+func TestScheduleInterval(t *testing.T) {
+    cases := []struct {
+        spec string
+        want time.Duration
+    }{
+        {"*/15 * * * *", 15 * time.Minute},
+        {"0 3 * * *", 24 * time.Hour},
+        {"0 3,4 * * *", time.Hour},
+    }
+    for _, c := range(cases) {
+        sc, _ := parseSchedule(c.spec)
+        if got := sc.interval(cronTime("2013-07-03 12:00")); got != c.want {
+            t.Errorf("%q: interval %s, want %s", c.spec, got, c.want)
+        }
+    }
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+    "net/http"
+    "net/http/pprof"
+    "common"
+    log "code.google.com/p/log4go"
+)
+
+// startPprof serves the pprof handlers on their own address, kept apart
+// from the api port so profiles are not exposed with the data.
+func startPprof() error {
+    addr, err := common.Conf.String("debug", "pprof_addr", "")
+    if err != nil {
+        return err
+    }
+
+    if addr == "" {
+        return nil
+    }
+
+    mux := http.NewServeMux()
+    mux.HandleFunc("/debug/pprof/", pprof.Index)
+    mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+    mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+    mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+    mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+    go func() {
+        log.Info("pprof listening on %s.", addr)
+        if e := http.ListenAndServe(addr, mux); e != nil {
+            log.Error(e)
+        }
+    }()
+
+    return nil
+}
+
+// DEBUG_ENDPOINT is what an api key needs in its endpoints to ask for
+// debug=1.
+const DEBUG_ENDPOINT = "/admin/debug"
+
+// allowDebug reports whether r may ask for debug=1. The raw pages hold
+// all that the account sees, so like the admin endpoints it needs api
+// keys in config, and one permitted for DEBUG_ENDPOINT.
+func allowDebug(r *http.Request) bool {
+    k := requestKey(r)
+    return k != nil && k.allowed(DEBUG_ENDPOINT)
+}
+
+// writeDebugError is writeFetchError with the pages captured for r, also
+// written to dump_dir when it is set.
+func writeDebugError(w http.ResponseWriter, e error, c *common.Capture) {
+    if _, err := c.Dump(); err != nil {
+        log.Error("dump debug pages failed: %s", err.Error())
+    }
+    status, resp := errorResponse(e)
+    resp.Debug = c.Pages()
+    writeResponse(w, status, resp)
+}
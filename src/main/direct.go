@@ -0,0 +1,93 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "common"
+    log "code.google.com/p/log4go"
+)
+
+// directHandler serves what get fetches for account, in json, csv or
+// xlsx. It is never cached: sync moves on with every call and the daily
+// reports are small. dated handlers read startTime and endTime.
+func directHandler(site, name, example string, dated bool, get func(ctx context.Context, account, startTime, endTime string) (common.Rows, error)) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        account := r.FormValue("account")
+        if account == "" {
+            writeError(w, http.StatusBadRequest, BAD_PARAMS, "error, account is nil. eg.http://localhost/" + site + "/" + name + example, false)
+            return
+        }
+
+        if forbidAccount(w, r, site, account) {
+            return
+        }
+
+        format, ok := requestFormat(r)
+        if !ok || format == FORMAT_NDJSON {
+            writeError(w, http.StatusBadRequest, BAD_PARAMS, "error, format must be json, csv or xlsx", false)
+            return
+        }
+
+        var startTime, endTime string
+        if dated {
+            var e error
+            if startTime, endTime, e = dateRange(r); e != nil {
+                writeError(w, http.StatusBadRequest, BAD_PARAMS, e.Error(), false)
+                return
+            }
+        }
+
+        ctx, cancel := requestContext(r)
+        defer cancel()
+
+        ctx, release, e := acquireFetch(ctx, site, account)
+        if e != nil {
+            writeFetchError(w, e)
+            return
+        }
+        defer release()
+
+        var rows common.Rows
+        e = common.WithRelogin(site, account, func() (err error) {
+            rows, err = get(ctx, account, startTime, endTime)
+            return
+        })
+        common.ReportSession(account, e)
+        if e != nil {
+            log.Error(e)
+            writeFetchError(w, e)
+            return
+        }
+
+        if format == FORMAT_CSV || format == FORMAT_XLSX {
+            header, table := rows.Table()
+            file := site + "-" + account + "-" + name
+            if format == FORMAT_CSV {
+                e = writeCSV(w, file, header, table)
+            } else {
+                e = writeXLSX(w, file, header, table, siteColumnTypes(site, header, table))
+            }
+            if e != nil {
+                log.Error(e)
+            }
+            return
+        }
+
+        writeData(w, rows)
+    }
+}
+
+// syncHandler answers the orders of account that are new since its last
+// sync.
+func syncHandler(site string, adapter common.SyncAdapter) http.HandlerFunc {
+    return directHandler(site, "sync", "?account=account1", false, func(ctx context.Context, account, startTime, endTime string) (common.Rows, error) {
+        return adapter.Sync(ctx, account)
+    })
+}
+
+// reportHandler answers report of account, one of the adapter's Reports.
+func reportHandler(site, report string, adapter common.ReportAdapter) http.HandlerFunc {
+    return directHandler(site, report, "?account=account1&startTime=2013-1-1&endTime=2013-3-1", true, func(ctx context.Context, account, startTime, endTime string) (common.Rows, error) {
+        return adapter.Report(ctx, report, account, startTime, endTime)
+    })
+}
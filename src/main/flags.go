@@ -0,0 +1,81 @@
+package main
+
+import (
+    "os"
+    "fmt"
+    "flag"
+    "errors"
+    "strconv"
+    "strings"
+    "common"
+)
+
+// DEFAULT_CONFIG is loaded when neither -config nor TAOKE_CONFIG is given.
+const DEFAULT_CONFIG = "conf/taoke.conf"
+
+// setFlags collects -set section.option=value, which may be repeated.
+type setFlags []string
+
+func (s *setFlags) String() string {
+    return strings.Join(*s, ",")
+}
+
+func (s *setFlags) Set(value string) error {
+    i := strings.Index(value, "=")
+    j := strings.Index(value, ".")
+    if i == -1 || j == -1 || j > i || j == 0 || j == i - 1 {
+        return errors.New(fmt.Sprintf("expect section.option=value, got '%s'", value))
+    }
+    *s = append(*s, value)
+    return nil
+}
+
+// parseFlags loads the config named on the command line and applies the
+// flags over it, so that they win over the file and the environment.
+func parseFlags(args []string) error {
+    fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+    file := os.Getenv(common.ENV_PREFIX + "CONFIG")
+    if file == "" {
+        file = DEFAULT_CONFIG
+    }
+    fs.StringVar(&file, "config", file, "config file, .conf, .yaml/.yml or .json")
+    profile := fs.String("profile", os.Getenv(common.ENV_PREFIX + "PROFILE"), "profile whose [profile.section] sections override the base ones, eg. prod")
+    remote := fs.String("remote", os.Getenv(common.ENV_PREFIX + "REMOTE"), "etcd://host:2379/prefix or consul://host:8500/prefix read over the config file")
+    port := fs.Int("port", 0, "port to listen on, overrides port of [common]")
+    level := fs.String("log-level", "", "FINEST .. CRITICAL, overrides log_level of [common]")
+    var sets setFlags
+    fs.Var(&sets, "set", "section.option=value, overrides any option; may be repeated")
+
+    if err := fs.Parse(args[1:]); err != nil {
+        return err
+    }
+    if fs.NArg() > 0 {
+        return errors.New(fmt.Sprintf("unexpected arguments: %s", strings.Join(fs.Args(), " ")))
+    }
+
+    if err := common.Conf.SetProfile(*profile); err != nil {
+        return err
+    }
+    if err := common.Conf.SetRemote(*remote); err != nil {
+        return err
+    }
+    if err := common.LoadConfig(file); err != nil {
+        return errors.New(fmt.Sprintf("load config %s failed: %s", file, err.Error()))
+    }
+
+    // only flags given count, so the file keeps its say otherwise.
+    fs.Visit(func(f *flag.Flag) {
+        switch f.Name {
+        case "port":
+            common.Conf.Override("common", "port", strconv.Itoa(*port))
+        case "log-level":
+            common.Conf.Override("common", "log_level", *level)
+        }
+    })
+    for _, s := range(sets) {
+        i := strings.Index(s, "=")
+        j := strings.Index(s, ".")
+        common.Conf.Override(s[:j], s[j+1:i], s[i+1:])
+    }
+    return nil
+}
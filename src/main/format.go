@@ -0,0 +1,44 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "encoding/csv"
+)
+
+const (
+    FORMAT_JSON = "json"
+    FORMAT_CSV = "csv"
+)
+
+func requestFormat(r *http.Request) (string, bool) {
+    switch f := r.FormValue("format"); f {
+    case "", FORMAT_JSON:
+        return FORMAT_JSON, true
+    case FORMAT_CSV, FORMAT_XLSX, FORMAT_NDJSON:
+        return f, true
+    }
+    return "", false
+}
+
+func writeCSV(w http.ResponseWriter, name string, header []string, rows [][]string) error {
+    w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+    w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.csv\"", name))
+
+    // BOM so spreadsheet programs detect UTF-8.
+    if _, err := w.Write([]byte("\xef\xbb\xbf")); err != nil {
+        return err
+    }
+
+    cw := csv.NewWriter(w)
+    if header != nil {
+        if err := cw.Write(header); err != nil {
+            return err
+        }
+    }
+    if err := cw.WriteAll(rows); err != nil {
+        return err
+    }
+
+    return cw.Error()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+    "time"
+    "context"
+    "common"
+    log "code.google.com/p/log4go"
+)
+
+var ErrBusy = common.ErrBusy
+
+// fetch limits are read once at startup; the limit of each account is in
+// common, see common.AcquireAccount.
+var globalFetches common.Semaphore
+var siteFetches map[string]common.Semaphore = make(map[string]common.Semaphore)
+var fetchQueueTimeout time.Duration
+
+func loadFetchLimits(sites []string) error {
+    max, err := common.Conf.Int("common", "max_fetches", 0)
+    if err != nil {
+        return err
+    }
+    globalFetches = common.NewSemaphore(max)
+
+    // a site without its own max_fetches inherits the global one.
+    for _, site := range(sites) {
+        n, err := common.Conf.Int(site, "max_fetches", max)
+        if err != nil {
+            return err
+        }
+        siteFetches[site] = common.NewSemaphore(n)
+
+        per, err := common.Conf.Int(site, "account_fetches", 1)
+        if err != nil {
+            return err
+        }
+        log.Info("Upstream fetch limit: %s %d, %d per account, overall %d.", site, n, per, max)
+    }
+
+    if fetchQueueTimeout, err = common.Conf.Duration("common", "fetch_queue_timeout", 10 * time.Second); err != nil {
+        return err
+    }
+
+    return nil
+}
+
+// acquireFetch waits for a free upstream fetch slot of account, its site
+// and overall for at most fetch_queue_timeout each, returning ErrBusy when
+// none frees up. The account slot stays held by the returned context, the
+// fetches made with it do not wait for it again.
+func acquireFetch(ctx context.Context, site, account string) (actx context.Context, release func(), err error) {
+    // the account first, so waiting on it holds no shared slot.
+    actx, releaseAccount, err := common.AcquireAccount(ctx, site, account)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    timeout := time.After(fetchQueueTimeout)
+    if err = globalFetches.Acquire(ctx, timeout); err != nil {
+        releaseAccount()
+        return nil, nil, err
+    }
+
+    s := siteFetches[site]
+    if err = s.Acquire(ctx, timeout); err != nil {
+        globalFetches.Release()
+        releaseAccount()
+        return nil, nil, err
+    }
+
+    return actx, func() {
+        s.Release()
+        globalFetches.Release()
+        releaseAccount()
+    }, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "time"
+    "bytes"
+    "errors"
+    "strings"
+    "net/smtp"
+    "common"
+    log "code.google.com/p/log4go"
+)
+
+type mailConfig struct {
+    addr string
+    from string
+    to []string
+    auth smtp.Auth
+}
+
+// mailer is nil when no smtp server is configured.
+var mailer *mailConfig
+
+func loadMail() error {
+    var opts struct {
+        Addr string `conf:"smtp"`
+        From string `conf:"from"`
+        To []string `conf:"to"`
+        Username string `conf:"username"`
+        Password string `conf:"password" secret:"true"`
+    }
+    if err := common.Conf.Unmarshal("alert", &opts); err != nil {
+        return err
+    }
+
+    var mc *mailConfig
+    if opts.Addr != "" {
+        host, _, err := net.SplitHostPort(opts.Addr)
+        if err != nil {
+            return err
+        }
+        mc = &mailConfig{addr:opts.Addr, from:opts.From, to:opts.To}
+        if mc.from == "" || len(mc.to) == 0 {
+            return errors.New(fmt.Sprintf("alert smtp '%s' needs from and to", opts.Addr))
+        }
+        if opts.Username != "" {
+            mc.auth = smtp.PlainAuth("", opts.Username, opts.Password, host)
+        }
+    }
+
+    settingsLock.Lock()
+    mailer = mc
+    settingsLock.Unlock()
+
+    return nil
+}
+
+// mailAlert sends an alert of common to the configured addresses.
+func mailAlert(a common.Alert) {
+    settingsLock.RLock()
+    mc := mailer
+    settingsLock.RUnlock()
+
+    if mc == nil {
+        return
+    }
+
+    lastGood := "never"
+    if a.LastGood != nil {
+        lastGood = a.LastGood.Format(time.RFC3339)
+    }
+
+    var b bytes.Buffer
+    fmt.Fprintf(&b, "From: %s\r\n", mc.from)
+    fmt.Fprintf(&b, "To: %s\r\n", strings.Join(mc.to, ", "))
+    fmt.Fprintf(&b, "Subject: [%s] %s account %s\r\n", a.Kind, a.Site, a.Account)
+    fmt.Fprintf(&b, "Date: %s\r\n", a.Time.Format(time.RFC1123Z))
+    fmt.Fprintf(&b, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+    fmt.Fprintf(&b, "%s\r\n\r\nsite: %s\r\naccount: %s\r\ntime: %s\r\nlast good: %s\r\n",
+        a.Msg, a.Site, a.Account, a.Time.Format(time.RFC3339), lastGood)
+
+    if err := smtp.SendMail(mc.addr, mc.auth, mc.from, mc.to, b.Bytes()); err != nil {
+        log.Error("alert mail to %s failed: %s", strings.Join(mc.to, ","), err.Error())
+    }
+}
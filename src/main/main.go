@@ -2,6 +2,10 @@ package main
 
 import (
     "os"
+    "flag"
+    "crypto/sha1"
+    "encoding/hex"
+    "context"
     "fmt"
     "runtime"
     "net/http"
@@ -9,9 +13,14 @@ import (
     "time"
     "common"
     "sync"
-    "taoke"
-    "yiqifa"
+    "errors"
+    "strings"
+    "encoding/json"
     log "code.google.com/p/log4go"
+
+    // site adapters register themselves.
+    _ "taoke"
+    _ "yiqifa"
 )
 
 func ErrorExit() {
@@ -21,128 +30,482 @@ func ErrorExit() {
     os.Exit(-1)
 }
 
-var Cache map[string][]byte = make(map[string][]byte)
+// cacheEntry is a fetched payload and the ETag computed once for it.
+// servedBy is the account it was fetched with, which failover may have
+// picked instead of the one asked for.
+type cacheEntry struct {
+    data []byte
+    rows common.Rows
+    etag string
+    created time.Time
+    servedBy string
+}
+
+var Cache map[string]*cacheEntry = make(map[string]*cacheEntry)
 var CacheLock sync.RWMutex
 
-func cacheGet(web, account, startTime, endTime string) (ret []byte, ok bool) {
+func cacheKey(web, account, startTime, endTime string) string {
+    return web + "|" + account + "|" + startTime + "|" + endTime
+}
+
+func cacheGet(web, account, startTime, endTime string) (ret *cacheEntry, ok bool) {
     CacheLock.RLock()
     defer CacheLock.RUnlock()
-    st := web + account + startTime + endTime
+    st := cacheKey(web, account, startTime, endTime)
     ret, ok = Cache[st]
+    if ok && time.Since(ret.created) > currentCacheTTL() {
+        return nil, false
+    }
     return
 }
 
-func cachePut(web, account, startTime, endTime string, data []byte) {
+func cachePut(web, account, startTime, endTime string, data []byte, rows common.Rows, servedBy string) *cacheEntry {
+    sum := sha1.Sum(data)
+    entry := &cacheEntry{data, rows, hex.EncodeToString(sum[:]), time.Now(), servedBy}
+
     CacheLock.Lock()
     defer CacheLock.Unlock()
-    st := web + account + startTime + endTime
-    Cache[st] = data
+    st := cacheKey(web, account, startTime, endTime)
+    Cache[st] = entry
+    return entry
 }
 
-func cleanAll() {
+// cleanAccount drops cached data fetched with an account's old session.
+func cleanAccount(web, account string) {
     CacheLock.Lock()
     defer CacheLock.Unlock()
-    Cache = make(map[string][]byte)
+    prefix := web + "|" + account + "|"
+    for st := range(Cache) {
+        if strings.HasPrefix(st, prefix) {
+            delete(Cache, st)
+        }
+    }
+}
+
+// cleanExpired drops entries older than the cache ttl.
+func cleanExpired() {
+    ttl := currentCacheTTL()
+
+    CacheLock.Lock()
+    defer CacheLock.Unlock()
+    for st, entry := range(Cache) {
+        if time.Since(entry.created) > ttl {
+            delete(Cache, st)
+        }
+    }
 
     runtime.GC()
 }
 
+// settingsLock guards the settings that /admin/reload can replace.
+var settingsLock sync.RWMutex
+var cacheTTL time.Duration
+
+func loadCacheTTL() error {
+    ttl, err := common.Conf.Duration("common", "cache_ttl", 5 * time.Second)
+    if err != nil {
+        return err
+    }
+    if ttl <= 0 {
+        return errors.New(fmt.Sprintf("invalid cache_ttl %s", ttl))
+    }
+
+    settingsLock.Lock()
+    cacheTTL = ttl
+    settingsLock.Unlock()
+
+    return nil
+}
+
+func currentCacheTTL() time.Duration {
+    settingsLock.RLock()
+    defer settingsLock.RUnlock()
+    return cacheTTL
+}
+
 func cleanCache() {
     go func() {
         for {
-            time.Sleep(time.Second * 5)
-            cleanAll()
+            time.Sleep(currentCacheTTL())
+            cleanExpired()
         }
     }()
 }
 
-func taokeHandler(w http.ResponseWriter, r *http.Request) {
+var ErrUnknownSite = errors.New("site notfound.")
 
-    account := r.FormValue("account")
-    if account == "" {
-        fmt.Fprintf(w, "{\"error\":1, \"msg\":\"error, account is nil. eg.http://localhost/taoke?account=account1&startTime=2013-1-1&endTime=2013-3-1\"}")
-        return
+// fetch serves site data for account from the cache, fetching and caching
+// it on a miss.
+func fetch(ctx context.Context, site, account, startTime, endTime string) (entry *cacheEntry, hit bool, e error) {
+    adapter, ok := common.Adapter(site)
+    if !ok {
+        return nil, false, ErrUnknownSite
     }
 
-    startTime := r.FormValue("startTime")
-    endTime := r.FormValue("endTime")
+    // a captured fetch is after the pages as they are now.
+    if !common.Capturing(ctx) {
+        entry, hit = cacheGet(site, account, startTime, endTime)
+        if hit {
+            return entry, true, nil
+        }
+    }
 
-    var b []byte
-    var e error
-    b, ok := cacheGet("taoke", account, startTime, endTime)
-    if !ok {
-        b, e = taoke.GetTaokeDetail(account, startTime, endTime)
-        if e != nil {
-            log.Error(e)
-            fmt.Fprintf(w, "{\"error\":1, \"msg\":\"%s\"}", e.Error())
-            return
+    var rows common.Rows
+    var servedBy string
+    for _, candidate := range(common.Failover(site, account)) {
+        if servedBy != "" {
+            log.Warn("%s account %s failed over to %s: %s", site, servedBy, candidate, e.Error())
         }
-        cachePut("taoke", account, startTime, endTime, b)
+        servedBy = candidate
+
+        rows, e = fetchAs(ctx, adapter, site, candidate, startTime, endTime)
+        if !common.FailoverError(e) {
+            break
+        }
+    }
+    if e != nil {
+        return nil, false, e
     }
 
-    fmt.Fprintf(w, "{\"error\":0, \"data\":%s}", string(b))
+    b, e := json.Marshal(rows)
+    if e != nil {
+        return nil, false, e
+    }
+
+    entry = cachePut(site, account, startTime, endTime, b, rows, servedBy)
+    notifyNewOrders(site, account, b)
+    return entry, false, nil
 }
 
-func yiqifaHandler(w http.ResponseWriter, r *http.Request) {
+// fetchAs fetches from upstream with account, logging it in again once
+// when its session died.
+func fetchAs(ctx context.Context, adapter common.SiteAdapter, site, account, startTime, endTime string) (rows common.Rows, e error) {
+    ctx, release, e := acquireFetch(ctx, site, account)
+    if e != nil {
+        return nil, e
+    }
+    defer release()
 
-    account := r.FormValue("account")
-    if account == "" {
-        fmt.Fprintf(w, "{\"error\":1, \"msg\":\"error, account is nil. eg.http://localhost/yiqifa?account=yiqifaaccount1&startTime=2013-1-1&endTime=2013-3-1\"}")
+    e = common.WithRelogin(site, account, func() (err error) {
+        rows, err = adapter.Fetch(ctx, account, startTime, endTime)
         return
+    })
+    common.ReportSession(account, e)
+    return rows, e
+}
+
+// notModified sets the ETag of entry rendered as format and answers 304
+// when the client already has it.
+func notModified(w http.ResponseWriter, r *http.Request, entry *cacheEntry, format string) bool {
+    etag := fmt.Sprintf("\"%s-%s\"", entry.etag, format)
+    w.Header().Set("ETag", etag)
+
+    for _, tag := range(strings.Split(r.Header.Get("If-None-Match"), ",")) {
+        tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+        if tag == etag || tag == "*" {
+            w.WriteHeader(http.StatusNotModified)
+            return true
+        }
     }
 
-    startTime := r.FormValue("startTime")
-    endTime := r.FormValue("endTime")
+    return false
+}
 
-    var b []byte
-    var e error
-    b, ok := cacheGet("yiqifa", account, startTime, endTime)
-    if !ok {
-        b, e = yiqifa.GetCPSDetail(account, startTime, endTime)
+func setCacheHeader(w http.ResponseWriter, hit bool) {
+    if hit {
+        w.Header().Set("X-Cache", "HIT")
+    } else {
+        w.Header().Set("X-Cache", "MISS")
+    }
+}
+
+// siteHandler serves the report of site for one account as json, csv,
+// xlsx or a stream.
+func siteHandler(site string) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        account := r.FormValue("account")
+        if account == "" {
+            writeError(w, http.StatusBadRequest, BAD_PARAMS, "error, account is nil. eg.http://localhost/" + site + "?account=account1&startTime=2013-1-1&endTime=2013-3-1", false)
+            return
+        }
+
+        if forbidAccount(w, r, site, account) {
+            return
+        }
+
+        format, ok := requestFormat(r)
+        if !ok {
+            writeError(w, http.StatusBadRequest, BAD_PARAMS, "error, format must be json, ndjson, csv or xlsx", false)
+            return
+        }
+
+        startTime, endTime, e := dateRange(r)
+        if e != nil {
+            writeError(w, http.StatusBadRequest, BAD_PARAMS, e.Error(), false)
+            return
+        }
+
+        keep, e := siteFilter(site, r)
+        if e != nil {
+            writeError(w, http.StatusBadRequest, BAD_PARAMS, e.Error(), false)
+            return
+        }
+
+        debug := r.FormValue("debug") == "1"
+        if debug && !allowDebug(r) {
+            writeError(w, http.StatusForbidden, FORBIDDEN, "debug=1 needs an api key permitted for " + DEBUG_ENDPOINT, false)
+            return
+        }
+
+        if wantStream(r, format) {
+            if debug {
+                writeError(w, http.StatusBadRequest, BAD_PARAMS, "error, debug=1 does not stream, drop stream=1 or format=ndjson", false)
+                return
+            }
+            streamItems(w, r, site, account, startTime, endTime, format == FORMAT_NDJSON, keep)
+            return
+        }
+
+        ctx, cancel := requestContext(r)
+        defer cancel()
+
+        var capture *common.Capture
+        if debug {
+            ctx, capture = common.WithCapture(ctx)
+        }
+
+        entry, hit, e := fetch(ctx, site, account, startTime, endTime)
+        setCacheHeader(w, hit)
         if e != nil {
             log.Error(e)
-            fmt.Fprintf(w, "{\"error\":1, \"msg\":\"%s\"}", e.Error())
+            if capture != nil {
+                writeDebugError(w, e, capture)
+                return
+            }
+            writeFetchError(w, e)
             return
         }
-        cachePut("yiqifa", account, startTime, endTime, b)
+        w.Header().Set("X-Served-By", entry.servedBy)
+
+        if notModified(w, r, entry, format) {
+            return
+        }
+
+        // the cache has the whole report, filters only pick from it.
+        data, rows := entry.data, entry.rows
+        if f, ok := rows.(common.Filterable); ok && keep != nil {
+            rows = f.Keep(keep)
+            if data, e = json.Marshal(rows); e != nil {
+                log.Error(e)
+                writeFetchError(w, e)
+                return
+            }
+        }
+
+        if format == FORMAT_CSV || format == FORMAT_XLSX {
+            header, table := rows.Table()
+            if format == FORMAT_CSV {
+                e = writeCSV(w, site + "-" + account, header, table)
+            } else {
+                e = writeXLSX(w, site + "-" + account, header, table, siteColumnTypes(site, header, table))
+            }
+            if e != nil {
+                log.Error(e)
+            }
+            return
+        }
+
+        writeRows(w, data, rows)
     }
+}
 
-    fmt.Fprintf(w, "{\"error\":0, \"data\":%s}", string(b))
+// siteColumnTypes returns the xlsx column types of a site's table, guessed
+// from the data for sites without known columns.
+func siteColumnTypes(site string, header []string, rows [][]string) []columnType {
+    if site == "taoke" {
+        return taokeColumnTypes(header)
+    }
+    return guessColumnTypes(rows)
 }
 
-func run() {
-    if err := common.Login("taoke", "http://u.alimama.com","http://u.alimama.com/union/newreport/taobaokeDetail.htm"); err != nil {
-        log.Error(err)
+func taokeColumnTypes(header []string) []columnType {
+    types := make([]columnType, len(header))
+    for i, name := range(header) {
+        switch name {
+        case "Count", "Clicks", "Orders":
+            types[i] = COL_INT
+        case "Price", "Transaction", "Commission", "Income", "CommissionRate", "EffectiveRate":
+            types[i] = COL_MONEY
+        }
+    }
+    return types
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+    writeStatus(w, http.StatusOK, "ok")
+}
+
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+    if e := common.Ready(common.SiteNames()...); e != nil {
+        writeError(w, http.StatusServiceUnavailable, NOT_READY, e.Error(), true)
+        return
+    }
+
+    writeStatus(w, http.StatusOK, "ready")
+}
+
+// requestContext bounds upstream work for r by request_timeout and by
+// the client staying connected.
+func requestContext(r *http.Request) (context.Context, context.CancelFunc) {
+    timeout, err := common.Conf.Duration("common", "request_timeout", 120 * time.Second)
+    if err != nil || timeout <= 0 {
+        timeout = 120 * time.Second
+    }
+    return context.WithTimeout(r.Context(), timeout)
+}
+
+// port is the port the server listens on; it only changes on restart.
+var port int
+
+func run() error {
+    if problems := common.Validate(common.SiteNames()); len(problems) > 0 {
+        for _, p := range(problems) {
+            log.Error("config: %s", p.Error())
+        }
+        log.Error("%d problems in %s, not starting.", len(problems), common.Conf.File())
         ErrorExit()
     }
 
-    if err := common.Login("yiqifa", "http://www.yiqifa.com/", "http://www.yiqifa.com/"); err != nil {
+    common.AddAlertHandler(notifyAlert)
+    common.AddAlertHandler(mailAlert)
+
+    if err := common.LoadProxies(common.SiteNames()); err != nil {
         log.Error(err)
         ErrorExit()
     }
 
-    port, e := common.Conf.Int("common", "port", 8080)
+    for _, adapter := range(common.Adapters()) {
+        if err := adapter.Login(); err != nil {
+            log.Error(err)
+            ErrorExit()
+        }
+    }
+
+    var e error
+    port, e = common.Conf.Int("common", "port", 8080)
     if e != nil {
         log.Error(e)
         ErrorExit()
     }
 
-    http.HandleFunc("/taoke", taokeHandler)
-    http.HandleFunc("/yiqifa", yiqifaHandler)
+    if _, e = common.LoadLogLevel(); e != nil {
+        log.Error(e)
+        ErrorExit()
+    }
 
-    cleanCache()
+    if e = loadCacheTTL(); e != nil {
+        log.Error(e)
+        ErrorExit()
+    }
 
-    for {
-        e = http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
-        if e != nil {
-            log.Error(e)
-        }
+    if e = loadFetchLimits(common.SiteNames()); e != nil {
+        log.Error(e)
+        ErrorExit()
+    }
+
+    if e = loadAuth(); e != nil {
+        log.Error(e)
+        ErrorExit()
+    }
 
-        time.Sleep(time.Second)
+    if e = loadAccessLog(); e != nil {
+        log.Error(e)
+        ErrorExit()
+    }
+
+    if e = loadCORS(); e != nil {
+        log.Error(e)
+        ErrorExit()
     }
+
+    if e = loadRateLimit(); e != nil {
+        log.Error(e)
+        ErrorExit()
+    }
+
+    rt, e := newRouter()
+    if e != nil {
+        log.Error(e)
+        ErrorExit()
+    }
+
+    rt.registerSites()
+    rt.handle("/stream", requireAuth(streamHandler))
+    rt.handle("/accounts", requireAuth(accountsHandler))
+    rt.handle("/metrics", requireAuth(metricsHandler))
+    rt.handle("/admin/relogin", requireAdmin(reloginHandler))
+    rt.handle("/admin/reload", requireAdmin(reloadHandler))
+    rt.handle("/admin/proxies", requireAdmin(proxiesHandler))
+    rt.handle("/admin/config", requireAdmin(configHandler))
+    rt.handle("/admin/account", requireAdmin(accountHandler))
+    rt.handle("/version", versionHandler)
+    rt.handle("/health", healthHandler)
+    rt.handle("/ready", readyHandler)
+
+    if e = loadWebhooks(); e != nil {
+        log.Error(e)
+        ErrorExit()
+    }
+
+    if e = loadMail(); e != nil {
+        log.Error(e)
+        ErrorExit()
+    }
+
+    if e = startPprof(); e != nil {
+        log.Error(e)
+        ErrorExit()
+    }
+
+    if e = startPrefetch(rt.sites()); e != nil {
+        log.Error(e)
+        ErrorExit()
+    }
+
+    cleanCache()
+    reloadOnSIGHUP()
+
+    if e = watchConfig(); e != nil {
+        log.Error(e)
+        ErrorExit()
+    }
+
+    common.Conf.WatchRemote(baseCtx, func() {
+        log.Info("Remote config changed, reloading.")
+        reload()
+    })
+
+    e = serve(accessLog(withCORS(rt.Handler())))
+    common.SaveCookies()
+    return e
 }
 
 func main() {
-    run()
-    ErrorExit()
+    common.LoadLogConfig(common.LOG_CONFIG)
+
+    if e := parseFlags(os.Args); e != nil {
+        if e == flag.ErrHelp {
+            os.Exit(0)
+        }
+        log.Error(e)
+        ErrorExit()
+    }
+
+    if e := run(); e != nil {
+        log.Error(e)
+        ErrorExit()
+    }
+
+    log.Info("Shutdown complete.")
+    log.Close()
 }
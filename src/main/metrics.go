@@ -0,0 +1,78 @@
+package main
+
+import (
+    "fmt"
+    "sort"
+    "bytes"
+    "strconv"
+    "net/http"
+    "common"
+)
+
+// metricsHandler writes the upstream and layout metrics of the accounts
+// the request may read in the Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+    var b bytes.Buffer
+
+    families := []struct{ name, kind, help string }{
+        {"upstream_requests_total", "counter", "Upstream requests tried, retries included."},
+        {"upstream_retries_total", "counter", "Upstream requests tried again after a failure."},
+        {"upstream_errors_total", "counter", "Upstream requests that got no response."},
+        {"upstream_responses_total", "counter", "Upstream responses by status code."},
+        {"upstream_bytes_total", "counter", "Bytes of upstream response bodies as downloaded."},
+        {"upstream_latency_seconds", "histogram", "Time until the upstream body was read."},
+    }
+
+    var list []*common.UpstreamMetrics
+    for _, m := range(common.Upstream()) {
+        if allowAccount(r, m.Site, m.Account) {
+            list = append(list, m)
+        }
+    }
+
+    for _, f := range(families) {
+        fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+        for _, m := range(list) {
+            labels := fmt.Sprintf("site=%q,account=%q", m.Site, m.Account)
+            switch f.name {
+            case "upstream_requests_total":
+                fmt.Fprintf(&b, "%s{%s} %d\n", f.name, labels, m.Attempts)
+            case "upstream_retries_total":
+                fmt.Fprintf(&b, "%s{%s} %d\n", f.name, labels, m.Retries)
+            case "upstream_errors_total":
+                fmt.Fprintf(&b, "%s{%s} %d\n", f.name, labels, m.Errors)
+            case "upstream_responses_total":
+                codes := make([]int, 0, len(m.Status))
+                for code := range(m.Status) {
+                    codes = append(codes, code)
+                }
+                sort.Ints(codes)
+                for _, code := range(codes) {
+                    fmt.Fprintf(&b, "%s{%s,code=\"%d\"} %d\n", f.name, labels, code, m.Status[code])
+                }
+            case "upstream_bytes_total":
+                fmt.Fprintf(&b, "%s{%s} %d\n", f.name, labels, m.Bytes)
+            case "upstream_latency_seconds":
+                var n int64
+                for i, bound := range(m.Latency.Bounds) {
+                    n += m.Latency.Counts[i]
+                    fmt.Fprintf(&b, "%s_bucket{%s,le=\"%s\"} %d\n", f.name, labels, strconv.FormatFloat(bound, 'g', -1, 64), n)
+                }
+                fmt.Fprintf(&b, "%s_bucket{%s,le=\"+Inf\"} %d\n", f.name, labels, m.Latency.Count)
+                fmt.Fprintf(&b, "%s_sum{%s} %g\n", f.name, labels, m.Latency.Sum)
+                fmt.Fprintf(&b, "%s_count{%s} %d\n", f.name, labels, m.Latency.Count)
+            }
+        }
+    }
+
+    name := "layout_pages_total"
+    fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n", name, "Pages parsed by layout version, unknown for those the parser does not know.", name)
+    for _, m := range(common.Layouts()) {
+        if allowAccount(r, m.Site, m.Account) {
+            fmt.Fprintf(&b, "%s{site=%q,account=%q,page=%q,version=%q} %d\n", name, m.Site, m.Account, m.Page, m.Version, m.Pages)
+        }
+    }
+
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+    w.Write(b.Bytes())
+}
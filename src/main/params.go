@@ -0,0 +1,61 @@
+package main
+
+import (
+    "fmt"
+    "time"
+    "errors"
+    "net/http"
+    "common"
+)
+
+const DATE_LAYOUT = "2006-01-02"
+
+// parseDate accepts yyyy-m-d, yyyy-mm-dd and yyyymmdd.
+func parseDate(s string) (time.Time, error) {
+    for _, layout := range([]string{"2006-1-2", "20060102"}) {
+        if t, err := time.Parse(layout, s); err == nil {
+            return t, nil
+        }
+    }
+    return time.Time{}, errors.New(fmt.Sprintf("invalid date '%s', expect yyyy-mm-dd or yyyymmdd", s))
+}
+
+// dateRange reads startTime and endTime from the request and normalizes
+// them to yyyy-mm-dd. Missing dates are passed through empty.
+func dateRange(r *http.Request) (startTime, endTime string, err error) {
+    var start, end time.Time
+
+    if s := r.FormValue("startTime"); s != "" {
+        if start, err = parseDate(s); err != nil {
+            return "", "", errors.New("startTime: " + err.Error())
+        }
+        startTime = start.Format(DATE_LAYOUT)
+    }
+
+    if s := r.FormValue("endTime"); s != "" {
+        if end, err = parseDate(s); err != nil {
+            return "", "", errors.New("endTime: " + err.Error())
+        }
+        endTime = end.Format(DATE_LAYOUT)
+    }
+
+    if startTime != "" && endTime != "" && end.Before(start) {
+        return "", "", errors.New(fmt.Sprintf("endTime %s is before startTime %s", endTime, startTime))
+    }
+
+    return startTime, endTime, nil
+}
+
+// siteFilter reads the filters of site from the request. keep is nil when
+// the site takes no filters or the request has none.
+func siteFilter(site string, r *http.Request) (keep func(interface{}) bool, err error) {
+    adapter, _ := common.Adapter(site)
+    f, ok := adapter.(common.FilterAdapter)
+    if !ok {
+        return nil, nil
+    }
+    if err = r.ParseForm(); err != nil {
+        return nil, err
+    }
+    return f.Filter(r.Form)
+}
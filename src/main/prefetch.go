@@ -0,0 +1,98 @@
+package main
+
+import (
+    "time"
+    "common"
+    log "code.google.com/p/log4go"
+)
+
+// startPrefetch warms the cache with the last days of every account on
+// the configured schedule. Clients asking for the same range then hit
+// the cache, as long as cache_ttl outlives the schedule interval.
+func startPrefetch(sites []string) error {
+    spec, err := common.Conf.String("prefetch", "schedule", "")
+    if err != nil {
+        return err
+    }
+
+    if spec == "" {
+        return nil
+    }
+
+    sc, err := parseSchedule(spec)
+    if err != nil {
+        return err
+    }
+
+    days, err := common.Conf.Int("prefetch", "days", 7)
+    if err != nil {
+        return err
+    }
+
+    workers, err := common.Conf.Int("prefetch", "workers", 2)
+    if err != nil {
+        return err
+    }
+
+    if days <= 0 || workers <= 0 {
+        return nil
+    }
+
+    go func() {
+        for {
+            next := sc.next(time.Now())
+            if next.IsZero() {
+                log.Error("prefetch schedule '%s' never fires", spec)
+                return
+            }
+            select {
+            case <-baseCtx.Done():
+                return
+            case <-time.After(time.Until(next)):
+            }
+            warnCacheTTL(sc, spec)
+            prefetch(sites, days, workers)
+        }
+    }()
+
+    log.Info("Prefetch last %d days on schedule '%s'.", days, spec)
+    warnCacheTTL(sc, spec)
+
+    return nil
+}
+
+// warnCacheTTL tells when the entries a run warms expire before the next
+// run, cache_ttl can be reloaded so it is checked each time.
+func warnCacheTTL(sc *schedule, spec string) {
+    ttl := currentCacheTTL()
+    if every := sc.interval(time.Now()); every > 0 && ttl < every {
+        log.Warn("prefetch schedule '%s' runs every %s but cache_ttl is %s, the warmed entries expire before they are asked for; raise cache_ttl", spec, every, ttl)
+    }
+}
+
+func prefetch(sites []string, days, workers int) {
+    now := time.Now()
+    startTime := now.AddDate(0, 0, 1 - days).Format(DATE_LAYOUT)
+    endTime := now.Format(DATE_LAYOUT)
+
+    for _, site := range(sites) {
+        if baseCtx.Err() != nil {
+            return
+        }
+        accounts, err := common.SiteAccounts(site)
+        if err != nil {
+            log.Error(err)
+            continue
+        }
+
+        start := time.Now()
+        failed := 0
+        for account, resp := range(fetchAll(baseCtx, site, accounts, startTime, endTime, workers)) {
+            if resp.Error != 0 {
+                failed++
+                log.Warn("prefetch %s %s failed: %s", site, account, resp.Msg)
+            }
+        }
+        log.Info("Prefetched %s %s~%s for %d accounts, %d failed, in %s.", site, startTime, endTime, len(accounts), failed, time.Since(start))
+    }
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "math"
+    "sync"
+    "time"
+    "net/http"
+    "common"
+    log "code.google.com/p/log4go"
+)
+
+type bucket struct {
+    tokens float64
+    last time.Time
+}
+
+type rateLimiter struct {
+    lock sync.Mutex
+    rate float64 // tokens per second
+    burst float64
+    buckets map[string]*bucket
+}
+
+// limiter is nil when rate limiting is disabled.
+var limiter *rateLimiter
+
+func loadRateLimit() error {
+    perMinute, err := common.Conf.Int("ratelimit", "rate", 0)
+    if err != nil {
+        return err
+    }
+
+    burst, err := common.Conf.Int("ratelimit", "burst", perMinute)
+    if err != nil {
+        return err
+    }
+
+    if perMinute <= 0 {
+        settingsLock.Lock()
+        limiter = nil
+        settingsLock.Unlock()
+        return nil
+    }
+
+    if burst <= 0 {
+        burst = 1
+    }
+
+    rl := &rateLimiter{
+        rate:float64(perMinute) / 60,
+        burst:float64(burst),
+        buckets:make(map[string]*bucket),
+    }
+
+    settingsLock.Lock()
+    limiter = rl
+    settingsLock.Unlock()
+    rl.cleanup()
+
+    log.Info("Rate limit: %d requests/minute, burst %d.", perMinute, burst)
+
+    return nil
+}
+
+// take consumes one token for key, returning how long to wait when the
+// bucket is empty.
+func (rl *rateLimiter) take(key string) (ok bool, wait time.Duration) {
+    rl.lock.Lock()
+    defer rl.lock.Unlock()
+
+    now := time.Now()
+    b, found := rl.buckets[key]
+    if !found {
+        b = &bucket{tokens:rl.burst, last:now}
+        rl.buckets[key] = b
+    }
+
+    b.tokens = math.Min(rl.burst, b.tokens + now.Sub(b.last).Seconds() * rl.rate)
+    b.last = now
+
+    if b.tokens < 1 {
+        return false, time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+    }
+
+    b.tokens--
+    return true, 0
+}
+
+// cleanup drops buckets that have been idle long enough to be full again.
+func (rl *rateLimiter) cleanup() {
+    go func() {
+        for {
+            time.Sleep(time.Minute)
+
+            settingsLock.RLock()
+            current := limiter
+            settingsLock.RUnlock()
+            if current != rl {
+                return
+            }
+
+            rl.lock.Lock()
+            idle := time.Duration(rl.burst / rl.rate * float64(time.Second))
+            for key, b := range(rl.buckets) {
+                if time.Since(b.last) > idle {
+                    delete(rl.buckets, key)
+                }
+            }
+            rl.lock.Unlock()
+        }
+    }()
+}
+
+// clientKey is the bucket of r: the api key requireAuth matched, else the
+// remote ip. A token no key has is not trusted, a client sending a new one
+// each request would get past the limit with as many buckets.
+func clientKey(r *http.Request) string {
+    if k := requestKey(r); k != nil {
+        return "key:" + k.name
+    }
+
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        host = r.RemoteAddr
+    }
+    return "ip:" + host
+}
+
+func rateLimit(h http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        settingsLock.RLock()
+        rl := limiter
+        settingsLock.RUnlock()
+        if rl == nil {
+            h(w, r)
+            return
+        }
+
+        ok, wait := rl.take(clientKey(r))
+        if !ok {
+            w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(wait.Seconds()))))
+            writeError(w, http.StatusTooManyRequests, RATE_LIMITED, "rate limit exceeded", true)
+            return
+        }
+
+        h(w, r)
+    }
+}
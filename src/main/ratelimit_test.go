@@ -0,0 +1,95 @@
+package main
+
+import (
+    "time"
+    "context"
+    "testing"
+    "net/http"
+    "net/http/httptest"
+)
+
+func TestRateLimiterTake(t *testing.T) {
+    // a token a second, two at once.
+    rl := &rateLimiter{rate:1, burst:2, buckets:make(map[string]*bucket)}
+    steps := []struct {
+        key string
+        ago time.Duration // moves the last take of key back
+        ok bool
+    }{
+        {key:"a", ok:true},
+        {key:"a", ok:true},
+        {key:"a", ok:false},
+        {key:"b", ok:true},
+        {key:"a", ago:500 * time.Millisecond, ok:false},
+        {key:"a", ago:time.Second, ok:true},
+        {key:"a", ok:false},
+        // refills no more than burst.
+        {key:"b", ago:time.Hour, ok:true},
+        {key:"b", ok:true},
+        {key:"b", ok:false},
+    }
+    for i, s := range(steps) {
+        if b := rl.buckets[s.key]; b != nil {
+            b.last = b.last.Add(-s.ago)
+        }
+        ok, wait := rl.take(s.key)
+        if ok != s.ok {
+            t.Errorf("step %d: take(%q) = %v, want %v", i, s.key, ok, s.ok)
+        }
+        if ok && wait != 0 || !ok && (wait <= 0 || wait > time.Second) {
+            t.Errorf("step %d: take(%q) waits %v", i, s.key, wait)
+        }
+    }
+}
+
+func TestClientKey(t *testing.T) {
+    cases := []struct {
+        remote string
+        key *apiKey
+        token string
+        want string
+    }{
+        {remote:"10.0.0.1:5000", want:"ip:10.0.0.1"},
+        {remote:"[::1]:5000", want:"ip:::1"},
+        {remote:"10.0.0.1", want:"ip:10.0.0.1"},
+        {remote:"10.0.0.1:5000", key:&apiKey{name:"dashboard"}, want:"key:dashboard"},
+        // a token requireAuth did not match is no bucket of its own.
+        {remote:"10.0.0.1:5000", token:"made-up", want:"ip:10.0.0.1"},
+    }
+    for _, c := range(cases) {
+        r := httptest.NewRequest("GET", "/taoke", nil)
+        r.RemoteAddr = c.remote
+        if c.token != "" {
+            r.Header.Set("X-Api-Token", c.token)
+        }
+        if c.key != nil {
+            r = r.WithContext(context.WithValue(r.Context(), apiKeyCtx, c.key))
+        }
+        if got := clientKey(r); got != c.want {
+            t.Errorf("clientKey(%s, %v) = %q, want %q", c.remote, c.key, got, c.want)
+        }
+    }
+}
+
+func TestRateLimit(t *testing.T) {
+    settingsLock.Lock()
+    limiter = &rateLimiter{rate:1.0 / 60, burst:1, buckets:make(map[string]*bucket)}
+    settingsLock.Unlock()
+    defer func() {
+        settingsLock.Lock()
+        limiter = nil
+        settingsLock.Unlock()
+    }()
+
+    h := rateLimit(func(w http.ResponseWriter, r *http.Request) {})
+    for i, want := range([]int{200, 429}) {
+        w := httptest.NewRecorder()
+        h(w, httptest.NewRequest("GET", "/taoke", nil))
+        if w.Code != want {
+            t.Errorf("request %d: code %d, want %d", i, w.Code, want)
+        }
+        if retry := w.Header().Get("Retry-After"); want == 429 && retry != "60" {
+            t.Errorf("request %d: Retry-After %q, want 60", i, retry)
+        }
+    }
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+    "os"
+    "fmt"
+    "sync"
+    "time"
+    "errors"
+    "strings"
+    "syscall"
+    "os/signal"
+    "common"
+    log "code.google.com/p/log4go"
+)
+
+// reloadLock keeps /admin/reload and SIGHUP from reloading at once.
+var reloadLock sync.Mutex
+
+// reload re-reads the config file and applies it, returning what changed,
+// which is also logged. On error the changes applied so far are returned.
+func reload() (changes []string, e error) {
+    reloadLock.Lock()
+    defer reloadLock.Unlock()
+
+    defer func() {
+        for _, c := range(changes) {
+            log.Info("RELOAD %s", c)
+        }
+        if e != nil {
+            log.Error("RELOAD failed: %s", e.Error())
+        }
+    }()
+
+    oldTTL := currentCacheTTL()
+
+    changes, e = common.Conf.Reload()
+    if e != nil {
+        return
+    }
+
+    for _, site := range(common.SiteNames()) {
+        c, e := common.SyncAccounts(site)
+        changes = append(changes, c...)
+        if e != nil {
+            return changes, e
+        }
+    }
+
+    newPort, e := common.Conf.Int("common", "port", 8080)
+    if e != nil {
+        return
+    }
+    if newPort != port {
+        changes = append(changes, fmt.Sprintf("port: %d -> %d needs restart", port, newPort))
+    }
+
+    if e = common.LoadProxies(common.SiteNames()); e != nil {
+        return
+    }
+
+    level, e := common.LoadLogLevel()
+    if e != nil {
+        return
+    }
+    if level != "" {
+        changes = append(changes, level)
+    }
+
+    if e = loadCacheTTL(); e != nil {
+        return
+    }
+    if ttl := currentCacheTTL(); ttl != oldTTL {
+        changes = append(changes, fmt.Sprintf("cache_ttl: %s -> %s", oldTTL, ttl))
+    }
+
+    for _, load := range([]func() error{loadAuth, loadAccessLog, loadCORS, loadRateLimit, loadWebhooks, loadMail}) {
+        if e = load(); e != nil {
+            return
+        }
+    }
+
+    return
+}
+
+// reloadOnSIGHUP runs reload whenever the process gets SIGHUP.
+func reloadOnSIGHUP() {
+    sig := make(chan os.Signal, 1)
+    signal.Notify(sig, syscall.SIGHUP)
+    go func() {
+        for range(sig) {
+            log.Info("Received SIGHUP, reloading %s.", common.Conf.File())
+            reload()
+        }
+    }()
+}
+
+// watchConfig reloads when the config file or a file it includes
+// changes, if watch_config is on. The files are polled every
+// watch_interval ms rather than watched with inotify, and a reload waits
+// until they stopped changing for as long, so a half written file is not
+// picked up.
+func watchConfig() error {
+    on, err := common.Conf.Bool("common", "watch_config", false)
+    if err != nil {
+        return err
+    }
+    if !on {
+        return nil
+    }
+
+    ms, err := common.Conf.Int("common", "watch_interval", 1000)
+    if err != nil {
+        return err
+    }
+    if ms <= 0 {
+        return errors.New(fmt.Sprintf("invalid watch_interval %d", ms))
+    }
+    interval := time.Duration(ms) * time.Millisecond
+
+    file := common.Conf.File()
+    stamp := func() string {
+        var b strings.Builder
+        for i, f := range(common.Conf.Files()) {
+            fi, err := os.Stat(f)
+            if err != nil && i == 0 {
+                return ""
+            } else if err != nil {
+                fmt.Fprintf(&b, "%s gone;", f)
+                continue
+            }
+            fmt.Fprintf(&b, "%s %d %d;", f, fi.ModTime().UnixNano(), fi.Size())
+        }
+        return b.String()
+    }
+
+    go func() {
+        last := stamp()
+        for {
+            time.Sleep(interval)
+            now := stamp()
+            if now == last || now == "" {
+                continue
+            }
+
+            // wait for the writes to settle.
+            for {
+                time.Sleep(interval)
+                settled := stamp()
+                if settled == now {
+                    break
+                }
+                now = settled
+            }
+            last = now
+
+            log.Info("%s or an included file changed, reloading.", file)
+            reload()
+        }
+    }()
+
+    log.Info("Watching %s for changes.", file)
+    return nil
+}
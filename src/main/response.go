@@ -0,0 +1,167 @@
+package main
+
+import (
+    "net"
+    "errors"
+    "context"
+    "net/url"
+    "net/http"
+    "encoding/json"
+    "common"
+    log "code.google.com/p/log4go"
+)
+
+type ErrorCode string
+
+const (
+    BAD_PARAMS ErrorCode = "BAD_PARAMS"
+    UNAUTHORIZED ErrorCode = "UNAUTHORIZED"
+    FORBIDDEN ErrorCode = "FORBIDDEN"
+    RATE_LIMITED ErrorCode = "RATE_LIMITED"
+    NOT_READY ErrorCode = "NOT_READY"
+    ACCOUNT_NOT_FOUND ErrorCode = "ACCOUNT_NOT_FOUND"
+    NEED_LOGIN ErrorCode = "NEED_LOGIN"
+    PARSE_FAILED ErrorCode = "PARSE_FAILED"
+    UNSUPPORTED_LAYOUT ErrorCode = "UNSUPPORTED_LAYOUT"
+    UPSTREAM_TIMEOUT ErrorCode = "UPSTREAM_TIMEOUT"
+    UPSTREAM_ERROR ErrorCode = "UPSTREAM_ERROR"
+    UPSTREAM_MAINTENANCE ErrorCode = "UPSTREAM_MAINTENANCE"
+    UPSTREAM_RATE_LIMITED ErrorCode = "UPSTREAM_RATE_LIMITED"
+    UPSTREAM_DENIED ErrorCode = "UPSTREAM_DENIED"
+    BUSY ErrorCode = "BUSY"
+    INTERNAL ErrorCode = "INTERNAL"
+)
+
+// Response is the envelope of every JSON reply.
+type Response struct {
+    Error int `json:"error"`
+    Code ErrorCode `json:"code,omitempty"`
+    Msg string `json:"msg,omitempty"`
+    Retryable *bool `json:"retryable,omitempty"`
+    Status string `json:"status,omitempty"`
+    Data interface{} `json:"data,omitempty"`
+    Totals interface{} `json:"totals,omitempty"`
+    Duplicates int `json:"duplicates,omitempty"`
+    Warnings []common.RowWarning `json:"warnings,omitempty"`
+    // Parse places a parse error in its page.
+    Parse *common.ErrParse `json:"parse,omitempty"`
+    // Debug has the upstream pages of a failed debug=1 request.
+    Debug []common.CapturedPage `json:"debug,omitempty"`
+}
+
+func writeResponse(w http.ResponseWriter, status int, resp *Response) {
+    b, err := json.Marshal(resp)
+    if err != nil {
+        log.Error(err)
+        status = http.StatusInternalServerError
+        b = []byte(`{"error":1,"code":"INTERNAL","msg":"marshal response failed"}`)
+    }
+
+    w.Header().Set("Content-Type", "application/json; charset=utf-8")
+    w.WriteHeader(status)
+    w.Write(b)
+}
+
+// rawJSON keeps pre-marshaled json bytes from being encoded as base64.
+func rawJSON(data interface{}) interface{} {
+    if b, ok := data.([]byte); ok {
+        return json.RawMessage(b)
+    }
+    return data
+}
+
+func writeData(w http.ResponseWriter, data interface{}) {
+    writeResponse(w, http.StatusOK, &Response{Data:rawJSON(data)})
+}
+
+// rowsResponse holds the data of rows with their totals, duplicates and
+// warnings, if they have any.
+func rowsResponse(data []byte, rows common.Rows) *Response {
+    resp := &Response{Data:rawJSON(data)}
+    resp.summary(rows)
+    return resp
+}
+
+// summary sets what goes next to the data of rows.
+func (resp *Response) summary(rows common.Rows) {
+    if t, ok := rows.(common.Totaled); ok {
+        resp.Totals = t.Totals()
+    }
+    if d, ok := rows.(common.Deduplicated); ok {
+        resp.Duplicates = d.Duplicates()
+    }
+    if wd, ok := rows.(common.Warned); ok {
+        resp.Warnings = wd.Warnings()
+    }
+}
+
+func writeRows(w http.ResponseWriter, data []byte, rows common.Rows) {
+    writeResponse(w, http.StatusOK, rowsResponse(data, rows))
+}
+
+func writeStatus(w http.ResponseWriter, status int, msg string) {
+    writeResponse(w, status, &Response{Status:msg})
+}
+
+func writeError(w http.ResponseWriter, status int, code ErrorCode, msg string, retryable bool) {
+    writeResponse(w, status, &Response{Error:1, Code:code, Msg:msg, Retryable:&retryable})
+}
+
+// classify maps an error from common, taoke or yiqifa onto a status, code
+// and retry hint.
+func classify(e error) (status int, code ErrorCode, retryable bool) {
+    var parse *common.ErrParse
+    var layout *common.ErrLayout
+    var upstream *common.ErrUpstreamStatus
+
+    switch {
+    case errors.Is(e, common.ErrNeedLogin):
+        return http.StatusBadGateway, NEED_LOGIN, false
+    case errors.Is(e, common.ErrAccountNotFound), errors.Is(e, ErrUnknownSite):
+        return http.StatusNotFound, ACCOUNT_NOT_FOUND, false
+    case errors.Is(e, ErrBusy):
+        return http.StatusServiceUnavailable, BUSY, true
+    case errors.Is(e, common.ErrMaintenance):
+        return http.StatusServiceUnavailable, UPSTREAM_MAINTENANCE, true
+    case errors.Is(e, common.ErrRateLimited):
+        return http.StatusServiceUnavailable, UPSTREAM_RATE_LIMITED, true
+    case errors.Is(e, common.ErrDenied):
+        return http.StatusBadGateway, UPSTREAM_DENIED, false
+    case errors.Is(e, context.DeadlineExceeded):
+        return http.StatusGatewayTimeout, UPSTREAM_TIMEOUT, true
+    case errors.Is(e, context.Canceled):
+        // the client went away, nobody reads this.
+        return 499, INTERNAL, true
+    case errors.As(e, &layout):
+        return http.StatusBadGateway, UNSUPPORTED_LAYOUT, false
+    case errors.As(e, &parse):
+        return http.StatusBadGateway, PARSE_FAILED, false
+    case errors.As(e, &upstream):
+        return http.StatusBadGateway, UPSTREAM_ERROR, upstream.Temporary()
+    }
+
+    var ne net.Error
+    if errors.As(e, &ne) && ne.Timeout() {
+        return http.StatusGatewayTimeout, UPSTREAM_TIMEOUT, true
+    }
+
+    var ue *url.Error
+    if errors.As(e, &ue) {
+        return http.StatusBadGateway, UPSTREAM_ERROR, true
+    }
+
+    return http.StatusInternalServerError, INTERNAL, false
+}
+
+// errorResponse is the envelope of a fetch error e, and its status.
+func errorResponse(e error) (int, *Response) {
+    status, code, retryable := classify(e)
+    resp := &Response{Error:1, Code:code, Msg:e.Error(), Retryable:&retryable}
+    errors.As(e, &resp.Parse)
+    return status, resp
+}
+
+func writeFetchError(w http.ResponseWriter, e error) {
+    status, resp := errorResponse(e)
+    writeResponse(w, status, resp)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+    "strings"
+    "net/http"
+    "common"
+    log "code.google.com/p/log4go"
+)
+
+type router struct {
+    prefix string
+    mux *http.ServeMux
+}
+
+// newRouter mounts routes below base_path, eg. /api/v1. Handlers see the
+// path with the prefix stripped, so auth endpoints stay prefix free.
+func newRouter() (*router, error) {
+    prefix, err := common.Conf.String("common", "base_path", "")
+    if err != nil {
+        return nil, err
+    }
+
+    prefix = strings.TrimRight(strings.TrimSpace(prefix), "/")
+    if prefix != "" && !strings.HasPrefix(prefix, "/") {
+        prefix = "/" + prefix
+    }
+
+    // not the DefaultServeMux, net/http/pprof registers itself there.
+    return &router{prefix, http.NewServeMux()}, nil
+}
+
+func (rt *router) handle(path string, h http.HandlerFunc) {
+    rt.mux.HandleFunc(path, h)
+    log.Info("Route %s%s", rt.prefix, path)
+}
+
+// sites returns the names of the site adapters in a stable order.
+func (rt *router) sites() []string {
+    return common.SiteNames()
+}
+
+// registerSites mounts the data, batch and, where main knows how to sum
+// them up, summary endpoints of every site adapter, and sync and the
+// other reports for those that have them.
+func (rt *router) registerSites() {
+    for _, site := range(rt.sites()) {
+        rt.handle("/" + site, requireAuth(rateLimit(siteHandler(site))))
+        rt.handle("/" + site + "/batch", requireAuth(rateLimit(batchHandler(site))))
+        if _, ok := summarizers[site]; ok {
+            rt.handle("/" + site + "/summary", requireAuth(rateLimit(summaryHandler(site))))
+        }
+        if a, ok := common.Adapter(site); ok {
+            if sa, ok := a.(common.SyncAdapter); ok {
+                rt.handle("/" + site + "/sync", requireAuth(rateLimit(syncHandler(site, sa))))
+            }
+            if ra, ok := a.(common.ReportAdapter); ok {
+                for _, report := range(ra.Reports()) {
+                    rt.handle("/" + site + "/" + report, requireAuth(rateLimit(reportHandler(site, report, ra))))
+                }
+            }
+        }
+    }
+}
+
+func (rt *router) Handler() http.Handler {
+    if rt.prefix == "" {
+        return rt.mux
+    }
+
+    root := http.NewServeMux()
+    root.Handle(rt.prefix + "/", http.StripPrefix(rt.prefix, rt.mux))
+    return root
+}
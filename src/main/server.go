@@ -0,0 +1,119 @@
+package main
+
+import (
+    "os"
+    "net"
+    "time"
+    "errors"
+    "syscall"
+    "context"
+    "strconv"
+    "net/http"
+    "os/signal"
+    "common"
+    log "code.google.com/p/log4go"
+)
+
+// baseCtx parents every request context; it is cancelled when graceful
+// shutdown runs out of time, aborting upstream fetches still in flight.
+var baseCtx, cancelBase = context.WithCancel(context.Background())
+
+// subscribeCtx ends the event streams as soon as shutdown starts, they
+// never finish on their own and would hold it for shutdown_timeout.
+var subscribeCtx, cancelSubscribers = context.WithCancel(context.Background())
+
+// systemdListener returns the socket passed by systemd socket activation,
+// or nil when the process was not started that way.
+func systemdListener() (net.Listener, error) {
+    if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+        return nil, nil
+    }
+
+    n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+    if err != nil || n < 1 {
+        return nil, nil
+    }
+
+    // passed descriptors start at 3.
+    f := os.NewFile(3, "systemd-socket")
+    defer f.Close()
+    return net.FileListener(f)
+}
+
+// listenError explains the bind failures an operator can fix.
+func listenError(addr string, err error) error {
+    switch {
+    case errors.Is(err, syscall.EADDRINUSE):
+        return errors.New("listen " + addr + ": address already in use, is another instance running?")
+    case errors.Is(err, syscall.EACCES):
+        return errors.New("listen " + addr + ": permission denied, ports below 1024 need privileges")
+    case errors.Is(err, syscall.EADDRNOTAVAIL):
+        return errors.New("listen " + addr + ": bind address is not configured on this host")
+    }
+    return err
+}
+
+func listen() (net.Listener, error) {
+    l, err := systemdListener()
+    if err != nil {
+        return nil, err
+    }
+    if l != nil {
+        log.Info("Using systemd socket %s.", l.Addr())
+        return l, nil
+    }
+
+    bind, err := common.Conf.String("common", "bind", "")
+    if err != nil {
+        return nil, err
+    }
+
+    addr := net.JoinHostPort(bind, strconv.Itoa(port))
+    l, err = net.Listen("tcp", addr)
+    if err != nil {
+        return nil, listenError(addr, err)
+    }
+
+    log.Info("Listening on %s.", l.Addr())
+    return l, nil
+}
+
+// serve runs the api server until SIGINT or SIGTERM, then drains
+// in-flight requests for up to shutdown_timeout seconds.
+func serve(h http.Handler) error {
+    l, err := listen()
+    if err != nil {
+        return err
+    }
+
+    timeout, err := common.Conf.Duration("common", "shutdown_timeout", 30 * time.Second)
+    if err != nil {
+        return err
+    }
+
+    srv := &http.Server{
+        Handler:h,
+        BaseContext:func(net.Listener) context.Context { return baseCtx },
+    }
+    srv.RegisterOnShutdown(cancelSubscribers)
+
+    done := make(chan error, 1)
+    go func() {
+        sig := make(chan os.Signal, 1)
+        signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+        log.Info("Received %s, shutting down.", <-sig)
+
+        ctx, cancel := context.WithTimeout(context.Background(), timeout)
+        defer cancel()
+
+        err := srv.Shutdown(ctx)
+        cancelBase()
+        done <- err
+    }()
+
+    if err = srv.Serve(l); err != http.ErrServerClosed {
+        return err
+    }
+
+    return <-done
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+    "fmt"
+    "sync"
+    "time"
+    "net/http"
+    "common"
+    log "code.google.com/p/log4go"
+)
+
+type subscriber struct {
+    site string
+    accounts map[string]bool // empty means every account
+    key *apiKey // nil when auth is disabled
+    ch chan []byte
+}
+
+var subscribers map[*subscriber]bool = make(map[*subscriber]bool)
+var subscriberLock sync.RWMutex
+
+func (s *subscriber) wants(site, account string) bool {
+    if s.site != "" && s.site != site {
+        return false
+    }
+    if s.key != nil && !s.key.allowedAccount(site, account) {
+        return false
+    }
+    return len(s.accounts) == 0 || s.accounts[account]
+}
+
+// publish hands payload to matching subscribers, dropping it for those
+// too slow to keep up.
+func publish(site, account string, payload []byte) {
+    subscriberLock.RLock()
+    defer subscriberLock.RUnlock()
+
+    for s := range(subscribers) {
+        if !s.wants(site, account) {
+            continue
+        }
+        select {
+        case s.ch <- payload:
+        default:
+            log.Warn("sse subscriber too slow, dropped %s %s update", site, account)
+        }
+    }
+}
+
+func haveSubscribers() bool {
+    subscriberLock.RLock()
+    defer subscriberLock.RUnlock()
+    return len(subscribers) > 0
+}
+
+// streamHandler pushes newly discovered orders as server-sent events.
+// eg. /stream?site=taoke&account=account1,account2
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+    flusher, ok := w.(http.Flusher)
+    if !ok {
+        writeError(w, http.StatusInternalServerError, INTERNAL, "streaming unsupported", false)
+        return
+    }
+
+    site := r.FormValue("site")
+    if site != "" {
+        if _, ok := common.Adapter(site); !ok {
+            writeError(w, http.StatusBadRequest, BAD_PARAMS, "error, unknown site " + site, false)
+            return
+        }
+    }
+
+    s := &subscriber{site:site, accounts:make(map[string]bool), key:requestKey(r), ch:make(chan []byte, 16)}
+    for _, account := range(splitList(r.FormValue("account"))) {
+        if site != "" && forbidAccount(w, r, site, account) {
+            return
+        }
+        s.accounts[account] = true
+    }
+
+    subscriberLock.Lock()
+    subscribers[s] = true
+    subscriberLock.Unlock()
+
+    defer func() {
+        subscriberLock.Lock()
+        delete(subscribers, s)
+        subscriberLock.Unlock()
+    }()
+
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Header().Set("Connection", "keep-alive")
+    w.WriteHeader(http.StatusOK)
+    fmt.Fprintf(w, ": subscribed\n\n")
+    flusher.Flush()
+
+    ping := time.NewTicker(30 * time.Second)
+    defer ping.Stop()
+
+    for {
+        select {
+        case <-r.Context().Done():
+            return
+        case <-subscribeCtx.Done():
+            return
+        case <-ping.C:
+            fmt.Fprintf(w, ": ping\n\n")
+        case payload := <-s.ch:
+            fmt.Fprintf(w, "event: orders\ndata: %s\n\n", payload)
+        }
+        flusher.Flush()
+    }
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+    "net/http"
+    "common"
+)
+
+// accountsHandler lists the state of the accounts the request may read.
+// check=1 runs CheckAccount on each of them first.
+func accountsHandler(w http.ResponseWriter, r *http.Request) {
+    if r.FormValue("check") == "1" {
+        for _, st := range(common.AccountStates()) {
+            if allowAccount(r, st.Site, st.Account) {
+                common.CheckAccount(st.Site, st.Account)
+            }
+        }
+    }
+
+    states := common.AccountStates()
+
+    sites := make(map[string][]common.AccountStatus)
+    for _, st := range(states) {
+        if !allowAccount(r, st.Site, st.Account) {
+            continue
+        }
+        sites[st.Site] = append(sites[st.Site], st)
+    }
+
+    writeData(w, sites)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+    "fmt"
+    "errors"
+    "net/http"
+    "encoding/json"
+    "common"
+    log "code.google.com/p/log4go"
+)
+
+const FORMAT_NDJSON = "ndjson"
+
+// streamFlushEvery is how many items are written between flushes.
+const streamFlushEvery = 50
+
+// streamWriter writes items as they arrive, either as the data array of
+// a json envelope or as one json document per line. Nothing is written
+// before the first item so early errors still get a proper status.
+type streamWriter struct {
+    w http.ResponseWriter
+    ndjson bool
+    started bool
+    count int
+}
+
+func (sw *streamWriter) start() error {
+    sw.started = true
+    if sw.ndjson {
+        sw.w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+        return nil
+    }
+    sw.w.Header().Set("Content-Type", "application/json; charset=utf-8")
+    _, err := sw.w.Write([]byte(`{"data":[`))
+    return err
+}
+
+func (sw *streamWriter) item(item interface{}) error {
+    if !sw.started {
+        if err := sw.start(); err != nil {
+            return err
+        }
+    }
+
+    b, err := json.Marshal(item)
+    if err != nil {
+        return err
+    }
+
+    if sw.ndjson {
+        b = append(b, '\n')
+    } else if sw.count > 0 {
+        b = append([]byte(","), b...)
+    }
+
+    if _, err = sw.w.Write(b); err != nil {
+        return err
+    }
+
+    sw.count++
+    if sw.count % streamFlushEvery == 0 {
+        sw.flush()
+    }
+    return nil
+}
+
+func (sw *streamWriter) flush() {
+    if f, ok := sw.w.(http.Flusher); ok {
+        f.Flush()
+    }
+}
+
+// finish closes the stream; a failure after the first item is reported
+// in the trailing envelope fields or as a final ndjson line. The fields
+// also have the summary of the stream when there is one, ndjson leaves
+// it out.
+func (sw *streamWriter) finish(e error, summary common.Rows) {
+    if !sw.started && e != nil {
+        writeFetchError(sw.w, e)
+        return
+    }
+
+    if !sw.started {
+        if err := sw.start(); err != nil {
+            return
+        }
+    }
+
+    resp := &Response{}
+    if e != nil {
+        _, resp = errorResponse(e)
+    } else if summary != nil {
+        resp.summary(summary)
+    }
+
+    b, _ := json.Marshal(resp)
+    if sw.ndjson {
+        if e != nil {
+            sw.w.Write(append(b, '\n'))
+        }
+    } else {
+        // splice the envelope fields after the data array.
+        sw.w.Write([]byte("],"))
+        sw.w.Write(b[1:])
+    }
+    sw.flush()
+}
+
+// streamItems streams the report of account, the items keep wants when it
+// is not nil.
+func streamItems(w http.ResponseWriter, r *http.Request, site, account, startTime, endTime string, ndjson bool, keep func(interface{}) bool) {
+    ctx, cancel := requestContext(r)
+    defer cancel()
+
+    w.Header().Set("X-Cache", "BYPASS")
+    sw := &streamWriter{w:w, ndjson:ndjson}
+
+    ctx, release, e := acquireFetch(ctx, site, account)
+    if e != nil {
+        sw.finish(e, nil)
+        return
+    }
+    defer release()
+
+    adapter, _ := common.Adapter(site)
+    streamer, ok := adapter.(common.StreamAdapter)
+    if !ok {
+        sw.finish(errors.New(fmt.Sprintf("site '%s' can not stream", site)), nil)
+        return
+    }
+
+    send := sw.item
+    if keep != nil {
+        send = func(item interface{}) error {
+            if !keep(item) {
+                return nil
+            }
+            return sw.item(item)
+        }
+    }
+
+    // only retry after a relogin while nothing was sent yet.
+    var summary common.Rows
+    e = common.WithRelogin(site, account, func() error {
+        var err error
+        if s, ok := streamer.(common.SummaryStreamer); ok {
+            summary, err = s.StreamSummary(ctx, account, startTime, endTime, send)
+        } else {
+            err = streamer.Stream(ctx, account, startTime, endTime, send)
+        }
+        if errors.Is(err, common.ErrNeedLogin) && sw.count > 0 {
+            return errors.New("account need login during stream.")
+        }
+        return err
+    })
+    common.ReportSession(account, e)
+    if e != nil {
+        log.Error(e)
+    }
+    sw.finish(e, summary)
+}
+
+// wantStream reports whether the request asked for a streamed response.
+func wantStream(r *http.Request, format string) bool {
+    return format == FORMAT_NDJSON || (format == FORMAT_JSON && r.FormValue("stream") == "1")
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+    "sort"
+    "math"
+    "strings"
+    "strconv"
+    "net/http"
+    "encoding/json"
+    "taoke"
+    "yiqifa"
+    log "code.google.com/p/log4go"
+)
+
+// DaySummary sums the orders of a day. A site that reports no commission
+// amount (taoke) or no separate income (yiqifa) leaves that field out
+// rather than giving a zero that reads like one.
+type DaySummary struct {
+    Date string `json:"date"`
+    Orders int `json:"orders"`
+    Transaction float64 `json:"transaction"`
+    Commission *float64 `json:"commission,omitempty"`
+    Income *float64 `json:"income,omitempty"`
+}
+
+func parseAmount(s string) float64 {
+    s = strings.Replace(strings.TrimSpace(s), ",", "", -1)
+    v, _ := strconv.ParseFloat(s, 64)
+    return v
+}
+
+func cents(v float64) float64 {
+    return math.Floor(v * 100 + 0.5) / 100
+}
+
+// dayOf strips the time part from a "yyyy-mm-dd hh:mm:ss" value.
+func dayOf(s string) string {
+    s = strings.TrimSpace(s)
+    if i := strings.IndexAny(s, " T"); i != -1 {
+        s = s[:i]
+    }
+    return s
+}
+
+// sum adds v to *total, nil has no value.
+func sum(total **float64, v *float64) {
+    if v == nil {
+        return
+    }
+    if *total == nil {
+        *total = new(float64)
+    }
+    **total += *v
+}
+
+func centsOf(v *float64) *float64 {
+    if v == nil {
+        return nil
+    }
+    c := cents(*v)
+    return &c
+}
+
+type summarizer map[string]*DaySummary
+
+func (sm summarizer) add(date string, transaction float64, commission, income *float64) {
+    day := dayOf(date)
+    ds, ok := sm[day]
+    if !ok {
+        ds = &DaySummary{Date:day}
+        sm[day] = ds
+    }
+    ds.Orders++
+    ds.Transaction += transaction
+    sum(&ds.Commission, commission)
+    sum(&ds.Income, income)
+}
+
+func (sm summarizer) days() []*DaySummary {
+    days := make([]*DaySummary, 0, len(sm))
+    for _, ds := range(sm) {
+        ds.Transaction = cents(ds.Transaction)
+        ds.Commission = centsOf(ds.Commission)
+        ds.Income = centsOf(ds.Income)
+        days = append(days, ds)
+    }
+    sort.Slice(days, func(i, j int) bool { return days[i].Date < days[j].Date })
+    return days
+}
+
+func summarizeTaoke(b []byte) ([]*DaySummary, error) {
+    var items []taoke.ItemInfo
+    if err := json.Unmarshal(b, &items); err != nil {
+        return nil, err
+    }
+
+    sm := make(summarizer)
+    for _, item := range(items) {
+        // taoke reports a commission rate, not an amount.
+        income := item.Income.Float64()
+        sm.add(item.DateString(), item.Transaction.Float64(), nil, &income)
+    }
+    return sm.days(), nil
+}
+
+// summarizeYiqifa sums the orders by effect date. yiqifa has no separate
+// income, so it is left out.
+func summarizeYiqifa(b []byte) ([]*DaySummary, error) {
+    var items []yiqifa.CPSItem
+    if err := json.Unmarshal(b, &items); err != nil {
+        return nil, err
+    }
+
+    sm := make(summarizer)
+    for _, item := range(items) {
+        commission := parseAmount(item.Commission.String())
+        sm.add(item.EffectDateString(), parseAmount(item.Amount.String()), &commission, nil)
+    }
+    return sm.days(), nil
+}
+
+var summarizers = map[string]func([]byte) ([]*DaySummary, error){
+    "taoke": summarizeTaoke,
+    "yiqifa": summarizeYiqifa,
+}
+
+func summaryHandler(site string) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        account := r.FormValue("account")
+        if account == "" {
+            writeError(w, http.StatusBadRequest, BAD_PARAMS, "error, account is nil. eg.http://localhost/" + site + "/summary?account=x&startTime=2013-1-1&endTime=2013-3-1", false)
+            return
+        }
+
+        if forbidAccount(w, r, site, account) {
+            return
+        }
+
+        startTime, endTime, e := dateRange(r)
+        if e != nil {
+            writeError(w, http.StatusBadRequest, BAD_PARAMS, e.Error(), false)
+            return
+        }
+
+        ctx, cancel := requestContext(r)
+        defer cancel()
+
+        entry, hit, e := fetch(ctx, site, account, startTime, endTime)
+        setCacheHeader(w, hit)
+        if e != nil {
+            log.Error(e)
+            writeFetchError(w, e)
+            return
+        }
+
+        if notModified(w, r, entry, "summary") {
+            return
+        }
+
+        days, e := summarizers[site](entry.data)
+        if e != nil {
+            log.Error(e)
+            writeError(w, http.StatusInternalServerError, INTERNAL, e.Error(), false)
+            return
+        }
+
+        writeData(w, days)
+    }
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+    "testing"
+    "encoding/json"
+)
+
+func TestSummarizers(t *testing.T) {
+    cases := []struct {
+        site string
+        in string
+        want string
+    }{
+        {
+            site:"taoke",
+            in:`[{"Date":"2013-01-05T12:00:00+08:00","Transaction":12.34,"Income":0.68},
+                {"Date":"2013-01-05T13:00:00+08:00","Transaction":"1,000.01","Income":0.1},
+                {"Date":"2013-01-04T12:00:00+08:00","Transaction":5,"Income":null}]`,
+            want:`[{"date":"2013-01-04","orders":1,"transaction":5,"income":0},` +
+                `{"date":"2013-01-05","orders":2,"transaction":1012.35,"income":0.78}]`,
+        },
+        {
+            site:"yiqifa",
+            in:`[{"EffectDate":"2013-01-05T12:00:00+08:00","Amount":"12.34","Commission":"0.68"},
+                {"EffectDate":"2013-01-05T13:00:00+08:00","Amount":"0.01","Commission":"0.01"}]`,
+            want:`[{"date":"2013-01-05","orders":2,"transaction":12.35,"commission":0.69}]`,
+        },
+        {site:"taoke", in:`[]`, want:`[]`},
+    }
+    for _, c := range(cases) {
+        days, err := summarizers[c.site]([]byte(c.in))
+        if err != nil {
+            t.Errorf("%s: %v", c.site, err)
+            continue
+        }
+        b, _ := json.Marshal(days)
+        if string(b) != c.want {
+            t.Errorf("%s: %s, want %s", c.site, b, c.want)
+        }
+    }
+
+    if _, err := summarizers["taoke"]([]byte(`{`)); err == nil {
+        t.Errorf("taoke: no error for bad json")
+    }
+}
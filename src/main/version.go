@@ -0,0 +1,25 @@
+package main
+
+import (
+    "runtime"
+    "net/http"
+    "common"
+)
+
+// set at build time, eg. go build -ldflags "-X main.buildCommit=abc123"
+var (
+    buildCommit = "unknown"
+    buildTime = "unknown"
+)
+
+type versionInfo struct {
+    Commit string `json:"commit"`
+    BuildTime string `json:"build_time"`
+    GoVersion string `json:"go_version"`
+    Sites []string `json:"sites"`
+    ConfigFile string `json:"config_file"`
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+    writeData(w, versionInfo{buildCommit, buildTime, runtime.Version(), common.SiteNames(), common.Conf.File()})
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+    "sync"
+    "time"
+    "bytes"
+    "net/http"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "common"
+    "taoke"
+    "yiqifa"
+    log "code.google.com/p/log4go"
+)
+
+type webhookConfig struct {
+    urls []string
+    secret string
+    retries int
+    client *http.Client
+}
+
+// webhooks is nil when no urls are configured.
+var webhooks *webhookConfig
+
+func loadWebhooks() error {
+    urls, err := common.Conf.StringSlice("webhook", "urls", nil)
+    if err != nil {
+        return err
+    }
+
+    secret, err := common.Conf.Secret("webhook", "secret")
+    if err != nil {
+        return err
+    }
+
+    retries, err := common.Conf.Int("webhook", "retries", 3)
+    if err != nil {
+        return err
+    }
+
+    timeout, err := common.Conf.Duration("webhook", "timeout", 10 * time.Second)
+    if err != nil {
+        return err
+    }
+
+    max, err := common.Conf.Int("webhook", "seen_orders", SEEN_ORDERS)
+    if err != nil {
+        return err
+    }
+    if max <= 0 {
+        max = SEEN_ORDERS
+    }
+
+    var wh *webhookConfig
+    if len(urls) > 0 {
+        wh = &webhookConfig{
+            urls:urls,
+            secret:secret,
+            retries:retries,
+            client:&http.Client{Timeout:timeout},
+        }
+    }
+
+    settingsLock.Lock()
+    webhooks = wh
+    seenMax = max
+    settingsLock.Unlock()
+
+    return nil
+}
+
+// orderKeys identify an order within fetched data. They leave out the
+// fields that change when an order settles.
+var orderKeys = map[string]func(json.RawMessage) string{
+    "taoke": func(raw json.RawMessage) string {
+        var item taoke.ItemInfo
+        json.Unmarshal(raw, &item)
+        item.State, item.Commission, item.Income, item.Settled, item.Raw = "", "", "", nil, nil
+        item.CommissionRate, item.EffectiveRate = "", ""
+        b, _ := json.Marshal(item)
+        return string(b)
+    },
+    "yiqifa": func(raw json.RawMessage) string {
+        var item yiqifa.CPSItem
+        json.Unmarshal(raw, &item)
+        item.Status, item.Commission, item.BalanceDate, item.Raw = "", "", nil, nil
+        b, _ := json.Marshal(item)
+        return string(b)
+    },
+}
+
+// SEEN_ORDERS is how many orders of an account are remembered by default,
+// the oldest are forgotten first.
+const SEEN_ORDERS = 10000
+
+// seenSet is the order keys of an account in the order they were seen,
+// the first head of order are forgotten.
+type seenSet struct {
+    keys map[string]bool
+    order []string
+    head int
+}
+
+func (s *seenSet) add(k string, max int) {
+    s.keys[k] = true
+    s.order = append(s.order, k)
+    if len(s.order) - s.head > max {
+        delete(s.keys, s.order[s.head])
+        s.head++
+    }
+    if s.head > max {
+        s.order = append([]string(nil), s.order[s.head:]...)
+        s.head = 0
+    }
+}
+
+// seenOrders remembers order keys per site and account, up to seen_orders
+// of [webhook] each. The first fetch of an account only records a baseline
+// so startup does not notify every existing order.
+var seenOrders map[string]*seenSet = make(map[string]*seenSet)
+var seenLock sync.Mutex
+var seenMax int = SEEN_ORDERS
+
+func newOrders(site, account string, data []byte) []json.RawMessage {
+    var items []json.RawMessage
+    if err := json.Unmarshal(data, &items); err != nil {
+        log.Error(err)
+        return nil
+    }
+
+    settingsLock.RLock()
+    max := seenMax
+    settingsLock.RUnlock()
+
+    seenLock.Lock()
+    defer seenLock.Unlock()
+
+    key := site + "|" + account
+    seen, baseline := seenOrders[key]
+    if !baseline {
+        seen = &seenSet{keys:make(map[string]bool)}
+        seenOrders[key] = seen
+    }
+
+    var fresh []json.RawMessage
+    for _, item := range(items) {
+        k := string(item)
+        if fn, ok := orderKeys[site]; ok {
+            k = fn(item)
+        }
+        if seen.keys[k] {
+            continue
+        }
+        seen.add(k, max)
+        if baseline {
+            fresh = append(fresh, item)
+        }
+    }
+
+    return fresh
+}
+
+type webhookPayload struct {
+    Site string `json:"site"`
+    Account string `json:"account"`
+    Time time.Time `json:"time"`
+    Items []json.RawMessage `json:"items"`
+}
+
+// notifyNewOrders sends orders of data that were not seen before to every
+// configured webhook, in the background, and to stream subscribers.
+func notifyNewOrders(site, account string, data []byte) {
+    settingsLock.RLock()
+    wh := webhooks
+    settingsLock.RUnlock()
+
+    if wh == nil && !haveSubscribers() {
+        return
+    }
+
+    fresh := newOrders(site, account, data)
+    if len(fresh) == 0 {
+        return
+    }
+
+    body, err := json.Marshal(webhookPayload{site, account, time.Now(), fresh})
+    if err != nil {
+        log.Error(err)
+        return
+    }
+
+    publish(site, account, body)
+
+    if wh == nil {
+        return
+    }
+
+    for _, u := range(wh.urls) {
+        go wh.deliver(u, body)
+    }
+}
+
+func (wh *webhookConfig) sign(body []byte) string {
+    mac := hmac.New(sha256.New, []byte(wh.secret))
+    mac.Write(body)
+    return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (wh *webhookConfig) deliver(u string, body []byte) {
+    delay := time.Second
+    for attempt := 0; ; attempt++ {
+        req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+        if err != nil {
+            log.Error(err)
+            return
+        }
+        req.Header.Set("Content-Type", "application/json")
+        if wh.secret != "" {
+            req.Header.Set("X-Signature", wh.sign(body))
+        }
+
+        resp, err := wh.client.Do(req)
+        if err == nil {
+            resp.Body.Close()
+            if resp.StatusCode < 300 {
+                return
+            }
+            log.Warn("webhook %s status %d, attempt %d", u, resp.StatusCode, attempt + 1)
+        } else {
+            log.Warn("webhook %s failed: %s, attempt %d", u, err.Error(), attempt + 1)
+        }
+
+        if attempt >= wh.retries {
+            log.Error("webhook %s given up after %d attempts", u, attempt + 1)
+            return
+        }
+
+        time.Sleep(delay)
+        delay *= 2
+    }
+}
+
+type alertPayload struct {
+    Event string `json:"event"`
+    common.Alert
+}
+
+// notifyAlert sends an alert of common, eg. an expired session, to every
+// configured webhook.
+func notifyAlert(a common.Alert) {
+    settingsLock.RLock()
+    wh := webhooks
+    settingsLock.RUnlock()
+
+    if wh == nil {
+        return
+    }
+
+    body, err := json.Marshal(alertPayload{"alert", a})
+    if err != nil {
+        log.Error(err)
+        return
+    }
+
+    for _, u := range(wh.urls) {
+        go wh.deliver(u, body)
+    }
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+    "fmt"
+    "bytes"
+    "strconv"
+    "strings"
+    "net/http"
+    "archive/zip"
+    "encoding/xml"
+)
+
+const FORMAT_XLSX = "xlsx"
+
+type columnType int
+
+const (
+    COL_TEXT columnType = iota
+    COL_INT
+    COL_MONEY
+)
+
+// cell style indexes into cellXfs of xlsxStyles.
+const (
+    styleText = 0
+    styleHeader = 1
+    styleMoney = 2
+    styleInt = 3
+)
+
+const xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+<Default Extension="xml" ContentType="application/xml"/>
+<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>
+<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>
+<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>
+</Types>`
+
+const xlsxRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>
+</Relationships>`
+
+const xlsxWorkbookRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>
+<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>
+</Relationships>`
+
+const xlsxWorkbook = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<sheets><sheet name="%s" sheetId="1" r:id="rId1"/></sheets>
+</workbook>`
+
+const xlsxStyles = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>
+<fills count="3"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill><fill><patternFill patternType="solid"><fgColor rgb="FFD9D9D9"/><bgColor indexed="64"/></patternFill></fill></fills>
+<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>
+<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>
+<cellXfs count="4">
+<xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>
+<xf numFmtId="0" fontId="1" fillId="2" borderId="0" xfId="0" applyFont="1" applyFill="1"/>
+<xf numFmtId="4" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>
+<xf numFmtId="1" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>
+</cellXfs>
+<cellStyles count="1"><cellStyle name="Normal" xfId="0" builtinId="0"/></cellStyles>
+</styleSheet>`
+
+// columnName returns the spreadsheet letter for a zero based column.
+func columnName(i int) string {
+    name := ""
+    for i++; i > 0; i = (i - 1) / 26 {
+        name = string(rune('A' + (i - 1) % 26)) + name
+    }
+    return name
+}
+
+func xlsxText(buf *bytes.Buffer, ref string, style int, s string) {
+    fmt.Fprintf(buf, `<c r="%s" s="%d" t="inlineStr"><is><t xml:space="preserve">`, ref, style)
+    xml.EscapeText(buf, []byte(s))
+    buf.WriteString(`</t></is></c>`)
+}
+
+func xlsxSheet(header []string, rows [][]string, types []columnType) []byte {
+    buf := &bytes.Buffer{}
+    buf.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+<sheetViews><sheetView workbookViewId="0"><pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/></sheetView></sheetViews>
+<sheetData>`)
+
+    all := rows
+    if header != nil {
+        all = append([][]string{header}, rows...)
+    }
+
+    for i, row := range(all) {
+        fmt.Fprintf(buf, `<row r="%d">`, i + 1)
+        for j, col := range(row) {
+            ref := fmt.Sprintf("%s%d", columnName(j), i + 1)
+            if i == 0 {
+                xlsxText(buf, ref, styleHeader, col)
+                continue
+            }
+
+            t := COL_TEXT
+            if j < len(types) {
+                t = types[j]
+            }
+
+            v := strings.Replace(strings.TrimSpace(col), ",", "", -1)
+            if _, err := strconv.ParseFloat(v, 64); t == COL_TEXT || err != nil {
+                xlsxText(buf, ref, styleText, col)
+                continue
+            }
+
+            style := styleMoney
+            if t == COL_INT {
+                style = styleInt
+            }
+            fmt.Fprintf(buf, `<c r="%s" s="%d"><v>%s</v></c>`, ref, style, v)
+        }
+        buf.WriteString(`</row>`)
+    }
+
+    buf.WriteString(`</sheetData></worksheet>`)
+    return buf.Bytes()
+}
+
+// guessColumnTypes marks a column as money when every value parses as a
+// decimal number with a fraction, which keeps order numbers as text.
+func guessColumnTypes(rows [][]string) []columnType {
+    var types []columnType
+    for _, row := range(rows) {
+        for len(types) < len(row) {
+            types = append(types, COL_MONEY)
+        }
+    }
+
+    for _, row := range(rows) {
+        for j, col := range(row) {
+            col = strings.TrimSpace(col)
+            if col == "" {
+                continue
+            }
+            if _, err := strconv.ParseFloat(col, 64); err != nil || !strings.Contains(col, ".") {
+                types[j] = COL_TEXT
+            }
+        }
+    }
+
+    return types
+}
+
+// writeXLSX renders header and rows into a single sheet workbook. The
+// first row, header or not, is styled as a header.
+func writeXLSX(w http.ResponseWriter, name string, header []string, rows [][]string, types []columnType) error {
+    buf := &bytes.Buffer{}
+    zw := zip.NewWriter(buf)
+
+    files := []struct {
+        name string
+        body []byte
+    }{
+        {"[Content_Types].xml", []byte(xlsxContentTypes)},
+        {"_rels/.rels", []byte(xlsxRels)},
+        {"xl/workbook.xml", []byte(fmt.Sprintf(xlsxWorkbook, "Sheet1"))},
+        {"xl/_rels/workbook.xml.rels", []byte(xlsxWorkbookRels)},
+        {"xl/styles.xml", []byte(xlsxStyles)},
+        {"xl/worksheets/sheet1.xml", xlsxSheet(header, rows, types)},
+    }
+
+    for _, f := range(files) {
+        fw, err := zw.Create(f.name)
+        if err != nil {
+            return err
+        }
+        if _, err = fw.Write(f.body); err != nil {
+            return err
+        }
+    }
+
+    if err := zw.Close(); err != nil {
+        return err
+    }
+
+    w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+    w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.xlsx\"", name))
+    _, err := w.Write(buf.Bytes())
+    return err
+}
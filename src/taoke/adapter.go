@@ -0,0 +1,189 @@
+package taoke
+
+import (
+    "context"
+    "strconv"
+    "strings"
+    "net/url"
+    "encoding/json"
+    "common"
+)
+
+// The upstream addresses of taoke. The base_url, report_path and
+// login_url options of [taoke] replace them, eg. for a mock server.
+const BASE_URL = "http://u.alimama.com"
+const REPORT_PATH = "/union/newreport/taobaokeDetail.htm"
+const LOGIN_URL = "https://login.taobao.com/member/login.jhtml?style=minisimple&from=alimama&redirectURL=http%3A%2F%2Fu.alimama.com%2F"
+
+func baseURL() string {
+    return strings.TrimSuffix(common.SiteURL("taoke", "base_url", BASE_URL), "/")
+}
+
+func reportURL() string {
+    return baseURL() + common.SiteURL("taoke", "report_path", REPORT_PATH)
+}
+
+func loginURL() string {
+    return common.SiteURL("taoke", "login_url", LOGIN_URL)
+}
+
+// Items are the rows of a taoke report.
+type Items []ItemInfo
+
+// Report is the items of a report with its summary row, how many
+// repeated rows were dropped and the warnings of the rows that did not
+// parse. It marshals to the items alone, the rest goes next to them in
+// the response.
+type Report struct {
+    Items
+    totals *Totals
+    duplicates int
+    warnings []common.RowWarning
+}
+
+func (r *Report) MarshalJSON() ([]byte, error) {
+    return json.Marshal(r.Items)
+}
+
+// Totals is nil, no typed nil, when the report had no summary row.
+func (r *Report) Totals() interface{} {
+    if r.totals == nil {
+        return nil
+    }
+    return r.totals
+}
+
+func (r *Report) Duplicates() int {
+    return r.duplicates
+}
+
+func (r *Report) Warnings() []common.RowWarning {
+    return r.warnings
+}
+
+// Keep is r with only the items keep wants. The totals, duplicates and
+// warnings stay those of the whole report.
+func (r *Report) Keep(keep func(interface{}) bool) common.Rows {
+    kept := &Report{Items:Items{}, totals:r.totals, duplicates:r.duplicates, warnings:r.warnings}
+    for _, item := range(r.Items) {
+        if keep(item) {
+            kept.Items = append(kept.Items, item)
+        }
+    }
+    return kept
+}
+
+// hooks fill the totals and warnings of r.
+func (r *Report) hooks() *hooks {
+    return &hooks{
+        totals:func(t *Totals) {
+            r.totals = t
+        },
+        warn:func(w common.RowWarning) {
+            r.warnings = append(r.warnings, w)
+        },
+    }
+}
+
+func (items Items) Len() int {
+    return len(items)
+}
+
+func (items Items) Table() (header []string, rows [][]string) {
+    header = []string{"Date", "Id", "Name", "ShopId", "ShopName", "Count", "Price", "State", "Transaction", "Commission", "Income", "CommissionRate", "EffectiveRate", "OrderId", "ParentId", "Settled"}
+    rows = make([][]string, len(items))
+    for i, it := range(items) {
+        rows[i] = []string{it.DateString(), it.Id, it.Name, it.ShopId, it.ShopName, strconv.Itoa(it.Count), it.Price.String(), it.State, it.Transaction.String(), it.Commission.String(), it.Income.String(), it.CommissionRate.String(), it.EffectiveRate.String(), it.OrderId, it.ParentId, it.SettledString()}
+    }
+    return
+}
+
+type adapter struct{}
+
+func init() {
+    common.RegisterAdapter(adapter{})
+}
+
+func (adapter) Name() string {
+    return "taoke"
+}
+
+func (adapter) Login() error {
+    return common.Login("taoke", baseURL(), reportURL())
+}
+
+func (adapter) Fetch(ctx context.Context, account, startTime, endTime string) (common.Rows, error) {
+    r := &Report{Items:Items{}}
+    err := getTaokeStream(ctx, account, startTime, endTime, func(item ItemInfo) error {
+        r.Items = append(r.Items, item)
+        return nil
+    }, r.hooks())
+    if err != nil {
+        return nil, err
+    }
+    r.Items, r.duplicates = dedupe(r.Items)
+    logDuplicates(account, r.duplicates)
+    return r, nil
+}
+
+func (a adapter) Stream(ctx context.Context, account, startTime, endTime string, fn func(interface{}) error) error {
+    _, err := a.StreamSummary(ctx, account, startTime, endTime, fn)
+    return err
+}
+
+// StreamSummary returns a Report of no items, with the totals, dropped
+// duplicates and warnings of the stream.
+func (adapter) StreamSummary(ctx context.Context, account, startTime, endTime string, fn func(interface{}) error) (common.Rows, error) {
+    r := &Report{Items:Items{}}
+    filtered, dropped := dedupeStream(func(item ItemInfo) error {
+        return fn(item)
+    })
+    err := getTaokeStream(ctx, account, startTime, endTime, filtered, r.hooks())
+    r.duplicates = dropped()
+    logDuplicates(account, r.duplicates)
+    if err != nil {
+        return nil, err
+    }
+    return r, nil
+}
+
+// FetchAll is GetAll with fetch.
+func (adapter) FetchAll(ctx context.Context, accounts []string, startTime, endTime string, workers int, fetch common.AccountFetch) map[string]error {
+    errs := make(map[string]error, len(accounts))
+    for account, r := range(GetAll(ctx, accounts, startTime, endTime, workers, fetch)) {
+        errs[account] = r.Err
+    }
+    return errs
+}
+
+func (adapter) Filter(query url.Values) (func(interface{}) bool, error) {
+    f, err := ParseFilter(query)
+    if f == nil || err != nil {
+        return nil, err
+    }
+    return f.keep, nil
+}
+
+func (adapter) Sync(ctx context.Context, account string) (common.Rows, error) {
+    items, err := SyncTaoke(ctx, account)
+    if err != nil {
+        return nil, err
+    }
+    return Items(items), nil
+}
+
+func (adapter) Reports() []string {
+    return []string{REPORT_EFFECT, REPORT_OVERVIEW}
+}
+
+func (adapter) Report(ctx context.Context, report, account, startTime, endTime string) (common.Rows, error) {
+    days, err := GetTaokeDays(ctx, report, account, startTime, endTime)
+    if err != nil {
+        return nil, err
+    }
+    return Days(days), nil
+}
+
+func (adapter) HealthCheck(account string) (common.Health, error) {
+    return common.CheckAccount("taoke", account)
+}
@@ -0,0 +1,413 @@
+package taoke
+
+import (
+    "fmt"
+    "sort"
+    "time"
+    "bytes"
+    "errors"
+    "context"
+    "strings"
+    "net/url"
+    "net/http"
+    "crypto/md5"
+    "encoding/hex"
+    "encoding/json"
+    "common"
+    log "code.google.com/p/log4go"
+)
+
+// The TOP gateway of the taobao open platform, whose order details are
+// the rows of the report. api_url of [taoke] replaces it.
+const API_URL = "https://eco.taobao.com/router/rest"
+const API_METHOD = "taobao.tbk.order.details.get"
+const API_PAGE_SIZE = 100
+
+// API_WINDOW is the longest time range the gateway answers in one query.
+const API_WINDOW = 3 * time.Hour
+
+const BACKEND_HTML = "html"
+const BACKEND_API = "api"
+const BACKEND_EXPORT = "export"
+
+const API_TIME_LAYOUT = "2006-01-02 15:04:05"
+
+type apiConfig struct {
+    account string
+    url string
+    appkey string
+    secret string
+    session string
+    timeout time.Duration
+}
+
+// errAPIUnavailable is an api error that fetching the html report may
+// get around: the gateway is down, busy or over the call limit.
+type errAPIUnavailable struct {
+    err error
+}
+
+func (e *errAPIUnavailable) Error() string {
+    return "taoke api unavailable: " + e.err.Error()
+}
+
+func (e *errAPIUnavailable) Unwrap() error {
+    return e.err
+}
+
+// apiError is the error_response of the gateway.
+type apiError struct {
+    Code int `json:"code"`
+    Msg string `json:"msg"`
+    SubCode string `json:"sub_code"`
+    SubMsg string `json:"sub_msg"`
+}
+
+func (e *apiError) Error() string {
+    if e.SubCode != "" {
+        return fmt.Sprintf("taoke api error %d %s: %s %s", e.Code, e.Msg, e.SubCode, e.SubMsg)
+    }
+    return fmt.Sprintf("taoke api error %d %s", e.Code, e.Msg)
+}
+
+// unavailable tells the errors of the platform from those of the call,
+// eg. a bad signature, which the html report would not fix.
+func (e *apiError) unavailable() bool {
+    return e.Code == 1 || e.Code == 7 || e.Code == 15 || strings.HasPrefix(e.SubCode, "isp.")
+}
+
+// backend reads which way account fetches its report: html, the default,
+// api, which needs api_appkey and api_secret, export, the download of the
+// report, or pub, the report of pub.alimama.com.
+func backend(account string) (string, error) {
+    b, err := common.Conf.String(account, "backend", "")
+    if err != nil {
+        return "", err
+    }
+    if b == "" {
+        if b, err = common.Conf.String("taoke", "backend", BACKEND_HTML); err != nil {
+            return "", err
+        }
+    }
+    b = strings.ToLower(strings.TrimSpace(b))
+    if b != BACKEND_HTML && b != BACKEND_API && b != BACKEND_EXPORT && b != BACKEND_PUB {
+        return "", errors.New(fmt.Sprintf("invalid backend '%s' for account '%s', expect html, api, export or pub", b, account))
+    }
+    return b, nil
+}
+
+func secretOption(account, option string) (string, error) {
+    value, err := common.Conf.Secret(account, option)
+    if err != nil || value != "" {
+        return value, err
+    }
+    return common.Conf.Secret("taoke", option)
+}
+
+func loadAPIConfig(account string) (*apiConfig, error) {
+    c := &apiConfig{account:account}
+    var err error
+    if c.url, err = common.Conf.String("taoke", "api_url", API_URL); err != nil {
+        return nil, err
+    }
+    if c.timeout, err = common.Conf.Duration("taoke", "api_timeout", 30 * time.Second); err != nil {
+        return nil, err
+    }
+    if c.appkey, err = secretOption(account, "api_appkey"); err != nil {
+        return nil, err
+    }
+    if c.secret, err = secretOption(account, "api_secret"); err != nil {
+        return nil, err
+    }
+    if c.session, err = secretOption(account, "api_session"); err != nil {
+        return nil, err
+    }
+    if c.appkey == "" || c.secret == "" {
+        return nil, errors.New(fmt.Sprintf("account '%s' has backend api but no api_appkey and api_secret", account))
+    }
+    return c, nil
+}
+
+// sign is the md5 signature of the gateway: the secret, then every
+// parameter name and value sorted by name, then the secret again.
+func sign(params url.Values, secret string) string {
+    keys := make([]string, 0, len(params))
+    for k := range(params) {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+
+    var b bytes.Buffer
+    b.WriteString(secret)
+    for _, k := range(keys) {
+        b.WriteString(k)
+        b.WriteString(params.Get(k))
+    }
+    b.WriteString(secret)
+
+    sum := md5.Sum(b.Bytes())
+    return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// call posts method with params to the gateway as the account and
+// returns the body of its answer. It is fetched like the report pages,
+// with the proxy, pace and retries of the account, in api_timeout.
+func (c *apiConfig) call(ctx context.Context, method string, params url.Values) ([]byte, error) {
+    params.Set("method", method)
+    params.Set("app_key", c.appkey)
+    params.Set("timestamp", time.Now().In(reportZone).Format(API_TIME_LAYOUT))
+    params.Set("format", "json")
+    params.Set("v", "2.0")
+    params.Set("sign_method", "md5")
+    if c.session != "" {
+        params.Set("session", c.session)
+    }
+    params.Set("sign", sign(params, c.secret))
+
+    tctx, cancel := context.WithTimeout(ctx, c.timeout)
+    defer cancel()
+    header := http.Header{}
+    header.Set("Content-Type", "application/x-www-form-urlencoded;charset=utf-8")
+    resp, err := common.FetchCtx(tctx, c.account, common.Request{Method:"POST", URL:c.url, Header:header, Body:[]byte(params.Encode())})
+    if err != nil {
+        if ctx.Err() != nil {
+            return nil, ctx.Err()
+        }
+        return nil, &errAPIUnavailable{err}
+    }
+    body := resp.Body
+    if resp.Status != http.StatusOK {
+        return nil, &errAPIUnavailable{&common.ErrUpstreamStatus{Code:resp.Status}}
+    }
+
+    var e struct {
+        Error *apiError `json:"error_response"`
+    }
+    if err = json.Unmarshal(body, &e); err != nil {
+        return nil, &common.ErrParse{Page:"taoke api", Expected:"a json answer", Excerpt:common.Snippet(body, SNIPPET_SIZE)}
+    }
+    if e.Error != nil {
+        if e.Error.unavailable() {
+            return nil, &errAPIUnavailable{e.Error}
+        }
+        return nil, e.Error
+    }
+    return body, nil
+}
+
+// apiOrder is one publisher_order_dto of the order details.
+type apiOrder struct {
+    CreateTime string `json:"tk_create_time"`
+    ItemId json.Number `json:"item_id"`
+    ItemTitle string `json:"item_title"`
+    SellerNick string `json:"seller_nick"`
+    ShopTitle string `json:"seller_shop_title"`
+    ItemNum json.Number `json:"item_num"`
+    ItemPrice string `json:"item_price"`
+    Status json.Number `json:"tk_status"`
+    AlipayTotalPrice string `json:"alipay_total_price"`
+    CommissionRate string `json:"total_commission_rate"`
+    PubSharePreFee string `json:"pub_share_pre_fee"`
+    TradeId json.Number `json:"trade_id"`
+    TradeParentId json.Number `json:"trade_parent_id"`
+    EarningTime string `json:"tk_earning_time"`
+}
+
+// apiStates are the report's names of the tk_status codes.
+var apiStates = map[string]string{
+    "3":"订单结算",
+    "12":"订单付款",
+    "13":"订单失效",
+    "14":"订单成功",
+}
+
+// item reads o as the report would show it, with the warnings of its
+// cells.
+func (o *apiOrder) item() (ItemInfo, []common.RowWarning) {
+    state, ok := apiStates[o.Status.String()]
+    if !ok {
+        state = o.Status.String()
+    }
+    raw := &RawItem{
+        Date:o.CreateTime,
+        Settled:o.EarningTime,
+        Id:o.ItemId.String(),
+        Name:o.ItemTitle,
+        ShopId:o.SellerNick,
+        ShopName:o.ShopTitle,
+        Count:o.ItemNum.String(),
+        Price:o.ItemPrice,
+        State:state,
+        Transaction:o.AlipayTotalPrice,
+        Commission:o.CommissionRate,
+        Income:o.PubSharePreFee,
+        OrderId:o.TradeId.String(),
+        ParentId:o.TradeParentId.String(),
+    }
+    return raw.item()
+}
+
+type apiPage struct {
+    Response struct {
+        Data struct {
+            HasNext bool `json:"has_next"`
+            PositionIndex string `json:"position_index"`
+            Results struct {
+                Orders []apiOrder `json:"publisher_order_dto"`
+            } `json:"results"`
+        } `json:"data"`
+    } `json:"tbk_order_details_get_response"`
+}
+
+// apiRange turns the yyyy-mm-dd dates of the report into times: from the
+// start of startTime to the end of endTime, today when it is missing, and
+// not past now.
+func apiRange(startTime, endTime string) (start, end time.Time, err error) {
+    now := time.Now().In(reportZone)
+    today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, reportZone)
+
+    end = today
+    if endTime != "" {
+        if end, err = time.ParseInLocation("2006-01-02", endTime, reportZone); err != nil {
+            return
+        }
+    }
+    start = end
+    if startTime != "" {
+        if start, err = time.ParseInLocation("2006-01-02", startTime, reportZone); err != nil {
+            return
+        }
+    }
+    end = end.AddDate(0, 0, 1)
+    if end.After(now) {
+        end = now
+    }
+    return
+}
+
+// GetTaokeAPIStream fetches the orders of account from the gateway, in
+// windows as long as it allows, handing each to fn like
+// GetTaokeDetailStream.
+func GetTaokeAPIStream(ctx context.Context, account, startTime, endTime string, fn func(ItemInfo) error) error {
+    ctx, release, err := common.AcquireAccount(ctx, "taoke", account)
+    if err != nil {
+        return err
+    }
+    defer release()
+    return apiStream(ctx, account, startTime, endTime, fn, nil)
+}
+
+// apiStream is GetTaokeAPIStream, handing the warnings of its rows to h,
+// with the window they came in as their range.
+func apiStream(ctx context.Context, account, startTime, endTime string, fn func(ItemInfo) error, h *hooks) error {
+    c, err := loadAPIConfig(account)
+    if err != nil {
+        return err
+    }
+    start, end, err := apiRange(startTime, endTime)
+    if err != nil {
+        return err
+    }
+
+    log.Info("api request: %s, %s, %s", account, startTime, endTime)
+
+    for from := start; from.Before(end); from = from.Add(API_WINDOW) {
+        to := from.Add(API_WINDOW)
+        if to.After(end) {
+            to = end
+        }
+
+        position := ""
+        for page := 1; ; page++ {
+            params := url.Values{}
+            params.Set("query_type", "1")
+            params.Set("start_time", from.Format(API_TIME_LAYOUT))
+            params.Set("end_time", to.Format(API_TIME_LAYOUT))
+            params.Set("page_no", fmt.Sprint(page))
+            params.Set("page_size", fmt.Sprint(API_PAGE_SIZE))
+            params.Set("jump_type", "1")
+            if position != "" {
+                params.Set("position_index", position)
+            }
+
+            body, err := c.call(ctx, API_METHOD, params)
+            if err != nil {
+                return err
+            }
+
+            var p apiPage
+            if err = json.Unmarshal(body, &p); err != nil {
+                return &common.ErrParse{Page:"taoke api", Number:page, Expected:"tbk_order_details_get_response, " + err.Error(), Excerpt:common.Snippet(body, SNIPPET_SIZE, "tbk_order_details_get_response")}
+            }
+
+            data := &p.Response.Data
+            for i := range(data.Results.Orders) {
+                item, warnings := data.Results.Orders[i].item()
+                for _, w := range(warnings) {
+                    w.Page = page
+                    w.Row = i + 1
+                    w.Range = from.Format(API_TIME_LAYOUT) + ".." + to.Format(API_TIME_LAYOUT)
+                    log.Warn("taoke api %s page %d row %d of %s: %s %s", w.Range, page, w.Row, account, w.Column, w.Reason)
+                    h.onWarn(w)
+                }
+                if err = fn(item); err != nil {
+                    return err
+                }
+            }
+            if !data.HasNext || len(data.Results.Orders) == 0 {
+                break
+            }
+            position = data.PositionIndex
+        }
+    }
+    return nil
+}
+
+// getTaokeStream fetches with the backend of account. When the api is
+// unavailable, or the export or pub report an answer the parser can not
+// read, before any item came, the html report is fetched instead. The api
+// has no summary row for totals.
+func getTaokeStream(ctx context.Context, account, startTime, endTime string, fn func(ItemInfo) error, h *hooks) error {
+    ctx, release, err := common.AcquireAccount(ctx, "taoke", account)
+    if err != nil {
+        return err
+    }
+    defer release()
+
+    b, err := backend(account)
+    if err != nil {
+        return err
+    }
+    if b == BACKEND_HTML {
+        return chunkedDetailStream(ctx, account, startTime, endTime, fn, h)
+    }
+
+    sent := false
+    sending := func(item ItemInfo) error {
+        sent = true
+        return fn(item)
+    }
+    if b == BACKEND_EXPORT || b == BACKEND_PUB {
+        stream := exportStream
+        if b == BACKEND_PUB {
+            stream = pubStream
+        }
+        err = chunkedStream(ctx, account, startTime, endTime, sending, h, stream)
+        var layout *common.ErrLayout
+        var parse *common.ErrParse
+        if !sent && (errors.As(err, &layout) || errors.As(err, &parse)) {
+            log.Warn("%s, account %s falls back to the html report", err.Error(), account)
+            return chunkedDetailStream(ctx, account, startTime, endTime, fn, h)
+        }
+        return err
+    }
+
+    err = apiStream(ctx, account, startTime, endTime, sending, h)
+
+    var unavailable *errAPIUnavailable
+    if !sent && errors.As(err, &unavailable) {
+        log.Warn("%s, account %s falls back to the html report", err.Error(), account)
+        return chunkedDetailStream(ctx, account, startTime, endTime, fn, h)
+    }
+    return err
+}
@@ -0,0 +1,88 @@
+package taoke
+
+import (
+    "fmt"
+    "context"
+    "common"
+    log "code.google.com/p/log4go"
+)
+
+const CHUNK_LAYOUT = common.CHUNK_LAYOUT
+
+// chunkDays is the longest range of days asked from the report at once,
+// 0 for no limit. alimama cuts long ranges short without saying so.
+func chunkDays() (int, error) {
+    return common.ChunkDays("taoke", 31)
+}
+
+// chunks is common.DateChunks.
+func chunks(startTime, endTime string, days int) []common.DateChunk {
+    return common.DateChunks(startTime, endTime, days)
+}
+
+// itemKey tells orders apart across chunks; the same order in two chunks
+// has the same key.
+func itemKey(item *ItemInfo) string {
+    return fmt.Sprintf("%s|%s|%s|%d|%s|%s", item.DateString(), item.Id, item.ShopId, item.Count, item.Price, item.Transaction)
+}
+
+// streamFunc fetches the orders of one range, like detailStream.
+type streamFunc func(ctx context.Context, account, startTime, endTime string, fn func(ItemInfo) error, h *hooks) error
+
+// chunkedDetailStream is GetTaokeDetailStream over ranges of chunk_days,
+// see chunkedStream.
+func chunkedDetailStream(ctx context.Context, account, startTime, endTime string, fn func(ItemInfo) error, h *hooks) error {
+    return chunkedStream(ctx, account, startTime, endTime, fn, h, detailStream)
+}
+
+// chunkedStream is stream over ranges of chunk_days. An order an earlier
+// chunk already had, eg. on the day where two chunks meet, is not handed
+// to fn again. h gets the sum of the summaries of the chunks, if every
+// one had its summary, and the warnings of each chunk with its range.
+func chunkedStream(ctx context.Context, account, startTime, endTime string, fn func(ItemInfo) error, h *hooks, stream streamFunc) error {
+    days, err := chunkDays()
+    if err != nil {
+        return err
+    }
+    list := chunks(startTime, endTime, days)
+    if len(list) == 1 {
+        return stream(ctx, account, startTime, endTime, fn, h)
+    }
+
+    log.Info("request: %s, %s, %s in %d chunks", account, startTime, endTime, len(list))
+
+    seen := make(map[string]bool)
+    var sum *Totals
+    summed := 0
+    for _, c := range(list) {
+        keys := make(map[string]bool)
+        err := stream(ctx, account, c.Start, c.End, func(item ItemInfo) error {
+            key := itemKey(&item)
+            if seen[key] {
+                return nil
+            }
+            keys[key] = true
+            return fn(item)
+        }, &hooks{
+            totals:func(t *Totals) {
+                sum = sum.add(t)
+                summed++
+            },
+            warn:func(w common.RowWarning) {
+                w.Range = c.Start + ".." + c.End
+                h.onWarn(w)
+            },
+        })
+        if err != nil {
+            return err
+        }
+        // identical orders within one chunk are all kept.
+        for key := range(keys) {
+            seen[key] = true
+        }
+    }
+    if summed == len(list) {
+        h.onTotals(sum)
+    }
+    return nil
+}
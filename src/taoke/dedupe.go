@@ -0,0 +1,63 @@
+package taoke
+
+import (
+    log "code.google.com/p/log4go"
+)
+
+// orderKey identifies the row of one item of one order, empty when the
+// report has no order ids.
+func orderKey(item *ItemInfo) string {
+    if item.OrderId == "" {
+        return ""
+    }
+    return item.OrderId + "|" + item.Id
+}
+
+// dedupe drops the rows of an order seen more than once, as when the
+// report shifts between two pages while they are fetched. The last row
+// wins, it has the latest state, in the place of the first. A stream can
+// not do that, its first row is written before the next comes. It returns
+// how many rows were dropped.
+func dedupe(items []ItemInfo) ([]ItemInfo, int) {
+    at := make(map[string]int)
+    list := items[:0]
+    for _, item := range(items) {
+        key := orderKey(&item)
+        if key == "" {
+            list = append(list, item)
+            continue
+        }
+        if i, ok := at[key]; ok {
+            list[i] = item
+            continue
+        }
+        at[key] = len(list)
+        list = append(list, item)
+    }
+    return list, len(items) - len(list)
+}
+
+// dedupeStream hands fn the first row of each order; see dedupe for why
+// it can't keep the last. dropped tells how many it left out.
+func dedupeStream(fn func(ItemInfo) error) (filtered func(ItemInfo) error, dropped func() int) {
+    seen := make(map[string]bool)
+    n := 0
+    filtered = func(item ItemInfo) error {
+        key := orderKey(&item)
+        if key != "" {
+            if seen[key] {
+                n++
+                return nil
+            }
+            seen[key] = true
+        }
+        return fn(item)
+    }
+    return filtered, func() int { return n }
+}
+
+func logDuplicates(account string, n int) {
+    if n > 0 {
+        log.Warn("taoke report of %s repeated %d rows, dropped", account, n)
+    }
+}
@@ -0,0 +1,77 @@
+package taoke
+
+import (
+    "testing"
+)
+
+func rowsOf(items []ItemInfo) string {
+    s := ""
+    for _, item := range(items) {
+        s += item.OrderId + item.Id + item.State + " "
+    }
+    return s
+}
+
+// want is the rows dedupe keeps, stream the ones dedupeStream passes on.
+var dedupeCases = []struct {
+    name string
+    items []ItemInfo
+    want string
+    stream string
+    dropped int
+}{
+    {
+        name:"no repeats",
+        items:[]ItemInfo{{OrderId:"1", Id:"a"}, {OrderId:"1", Id:"b"}, {OrderId:"2", Id:"a"}},
+        want:"1a 1b 2a ",
+        stream:"1a 1b 2a ",
+    },
+    {
+        name:"last row wins in first place",
+        items:[]ItemInfo{{OrderId:"1", Id:"a", State:"paid"}, {OrderId:"2", Id:"a"}, {OrderId:"1", Id:"a", State:"settled"}},
+        want:"1asettled 2a ",
+        stream:"1apaid 2a ",
+        dropped:1,
+    },
+    {
+        name:"last of many",
+        items:[]ItemInfo{{OrderId:"1", Id:"a", State:"x"}, {OrderId:"1", Id:"a", State:"y"}, {OrderId:"3", Id:"c"}, {OrderId:"1", Id:"a", State:"z"}},
+        want:"1az 3c ",
+        stream:"1ax 3c ",
+        dropped:2,
+    },
+    {
+        name:"rows without order ids are kept",
+        items:[]ItemInfo{{Id:"a"}, {Id:"a"}},
+        want:"a a ",
+        stream:"a a ",
+    },
+}
+
+func TestDedupe(t *testing.T) {
+    for _, c := range(dedupeCases) {
+        items := append([]ItemInfo(nil), c.items...)
+        list, dropped := dedupe(items)
+        if rowsOf(list) != c.want || dropped != c.dropped {
+            t.Errorf("%s: %q dropping %d, want %q dropping %d", c.name, rowsOf(list), dropped, c.want, c.dropped)
+        }
+    }
+}
+
+func TestDedupeStream(t *testing.T) {
+    for _, c := range(dedupeCases) {
+        var list []ItemInfo
+        fn, dropped := dedupeStream(func(item ItemInfo) error {
+            list = append(list, item)
+            return nil
+        })
+        for _, item := range(c.items) {
+            if err := fn(item); err != nil {
+                t.Fatal(err)
+            }
+        }
+        if rowsOf(list) != c.stream || dropped() != c.dropped {
+            t.Errorf("%s: %q dropping %d, want %q dropping %d", c.name, rowsOf(list), dropped(), c.stream, c.dropped)
+        }
+    }
+}
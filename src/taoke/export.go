@@ -0,0 +1,454 @@
+package taoke
+
+import (
+    "io"
+    "fmt"
+    "sort"
+    "time"
+    "bytes"
+    "errors"
+    "context"
+    "strconv"
+    "strings"
+    "io/ioutil"
+    "archive/zip"
+    "encoding/csv"
+    "encoding/xml"
+    "common"
+    log "code.google.com/p/log4go"
+)
+
+// The export of the order details, the file behind the download button
+// of the report. export_path of [taoke] replaces it.
+const EXPORT_PATH = "/union/newreport/taobaokeDetailExport.htm"
+
+// The kinds of export file, also their layout versions in the metrics.
+// The xls download is an html table; a binary xls is not read.
+const (
+    EXPORT_CSV = "csv"
+    EXPORT_XLSX = "xlsx"
+    EXPORT_HTML = "html"
+)
+
+func exportURL() string {
+    return baseURL() + common.SiteURL("taoke", "export_path", EXPORT_PATH)
+}
+
+// exportColumns are the fields the export has in columns of their own,
+// where the report has them in the links of the item cell. Their headers
+// are matched whole, "商品ID" is not the item name.
+var exportColumns = []struct {
+    field string
+    headers []string
+}{
+    {"item_id", []string{"商品ID", "商品Id", "宝贝ID"}},
+    {"shop_id", []string{"掌柜旺旺", "卖家旺旺"}},
+    {"shop_name", []string{"所属店铺", "店铺名称"}},
+}
+
+func mapExportColumns(headers []string) map[string]int {
+    rest := make([]string, len(headers))
+    claimed := make(map[string]int)
+    for i, h := range(headers) {
+        h = strings.Join(strings.Fields(h), "")
+        rest[i] = h
+        for _, c := range(exportColumns) {
+            if _, ok := claimed[c.field]; ok {
+                continue
+            }
+            for _, k := range(c.headers) {
+                if strings.EqualFold(h, k) {
+                    claimed[c.field] = i
+                    rest[i] = ""
+                    break
+                }
+            }
+            if rest[i] == "" {
+                break
+            }
+        }
+    }
+    cols := mapColumns(rest)
+    for field, i := range(claimed) {
+        cols[field] = i
+    }
+    return cols
+}
+
+// exportKind tells the kind of export file from its first bytes.
+func exportKind(body []byte) (string, error) {
+    if bytes.HasPrefix(body, []byte("PK\x03\x04")) {
+        return EXPORT_XLSX, nil
+    }
+    if bytes.HasPrefix(body, []byte{0xd0, 0xcf, 0x11, 0xe0}) {
+        return "", &common.ErrLayout{Page:"taoke export", Snippet:"binary xls file, only csv, xlsx and html tables are read"}
+    }
+    head := body
+    if len(head) > 1024 {
+        head = head[:1024]
+    }
+    head = bytes.ToLower(bytes.TrimSpace(head))
+    if bytes.HasPrefix(head, []byte("<")) || bytes.Contains(head, []byte("<table")) {
+        return EXPORT_HTML, nil
+    }
+    return EXPORT_CSV, nil
+}
+
+// exportRows reads the cells of an export file, as text.
+func exportRows(body []byte, contentType string) (kind string, rows [][]string, err error) {
+    if kind, err = exportKind(body); err != nil {
+        return
+    }
+    switch kind {
+    case EXPORT_XLSX:
+        rows, err = xlsxRows(body)
+    case EXPORT_HTML:
+        root := common.ParseHTML(common.DecodeBody(body, contentType))
+        for _, tr := range(root.FindAll(common.ByTag("tr"))) {
+            var row []string
+            for _, td := range(spread(cells(tr))) {
+                row = append(row, td.Text())
+            }
+            rows = append(rows, row)
+        }
+    default:
+        rows, err = csvRows(common.DecodeBody(body, contentType))
+    }
+    return
+}
+
+// csvRows reads comma or tab separated text, whichever the first line
+// has more of.
+func csvRows(body []byte) ([][]string, error) {
+    body = bytes.TrimPrefix(body, []byte("\xef\xbb\xbf"))
+    first := body
+    if i := bytes.IndexByte(first, '\n'); i != -1 {
+        first = first[:i]
+    }
+
+    r := csv.NewReader(bytes.NewReader(body))
+    if bytes.Count(first, []byte("\t")) > bytes.Count(first, []byte(",")) {
+        r.Comma = '\t'
+    }
+    r.FieldsPerRecord = -1
+    r.LazyQuotes = true
+    r.TrimLeadingSpace = true
+
+    rows, err := r.ReadAll()
+    var pe *csv.ParseError
+    if errors.As(err, &pe) {
+        line := ""
+        if lines := bytes.Split(body, []byte("\n")); pe.Line > 0 && pe.Line <= len(lines) {
+            line = common.Snippet(lines[pe.Line - 1], SNIPPET_SIZE)
+        }
+        return nil, &common.ErrParse{Page:"taoke export", Row:pe.Line, Column:pe.Column, Expected:"csv fields, " + pe.Err.Error(), Excerpt:line}
+    }
+    if err != nil {
+        return nil, err
+    }
+    return rows, nil
+}
+
+// xlsxText is a shared or inline string: plain, or in runs of rich text.
+type xlsxText struct {
+    T string `xml:"t"`
+    R []struct {
+        T string `xml:"t"`
+    } `xml:"r"`
+}
+
+func (t *xlsxText) String() string {
+    s := t.T
+    for _, r := range(t.R) {
+        s += r.T
+    }
+    return s
+}
+
+type xlsxSheet struct {
+    Rows []struct {
+        Cells []struct {
+            Ref string `xml:"r,attr"`
+            Type string `xml:"t,attr"`
+            V string `xml:"v"`
+            Is xlsxText `xml:"is"`
+        } `xml:"c"`
+    } `xml:"sheetData>row"`
+}
+
+func zipFile(r *zip.Reader, name string) ([]byte, error) {
+    for _, f := range(r.File) {
+        if f.Name == name {
+            rc, err := f.Open()
+            if err != nil {
+                return nil, err
+            }
+            defer rc.Close()
+            return ioutil.ReadAll(rc)
+        }
+    }
+    return nil, io.EOF
+}
+
+// refColumn is the column of a cell reference, 0 for A1.
+func refColumn(ref string) int {
+    n := 0
+    for _, c := range(ref) {
+        if c < 'A' || c > 'Z' {
+            break
+        }
+        n = n * 26 + int(c - 'A') + 1
+    }
+    return n - 1
+}
+
+// xlsxRows reads the first worksheet of an xlsx file.
+func xlsxRows(body []byte) ([][]string, error) {
+    bad := func(err error) error {
+        return &common.ErrLayout{Page:"taoke export", Snippet:"xlsx file: " + err.Error()}
+    }
+    r, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+    if err != nil {
+        return nil, bad(err)
+    }
+
+    var sheets []string
+    for _, f := range(r.File) {
+        if strings.HasPrefix(f.Name, "xl/worksheets/") && strings.HasSuffix(f.Name, ".xml") {
+            sheets = append(sheets, f.Name)
+        }
+    }
+    if len(sheets) == 0 {
+        return nil, bad(errors.New("no worksheet"))
+    }
+    sort.Strings(sheets)
+    name := sheets[0]
+    for _, s := range(sheets) {
+        if s == "xl/worksheets/sheet1.xml" {
+            name = s
+        }
+    }
+
+    var shared struct {
+        Items []xlsxText `xml:"si"`
+    }
+    // a sheet of numbers only has no shared strings.
+    if b, err := zipFile(r, "xl/sharedStrings.xml"); err == nil {
+        if err = xml.Unmarshal(b, &shared); err != nil {
+            return nil, bad(err)
+        }
+    }
+
+    b, err := zipFile(r, name)
+    if err != nil {
+        return nil, bad(err)
+    }
+    var sheet xlsxSheet
+    if err = xml.Unmarshal(b, &sheet); err != nil {
+        return nil, bad(err)
+    }
+
+    rows := make([][]string, 0, len(sheet.Rows))
+    for _, sr := range(sheet.Rows) {
+        var row []string
+        for i, c := range(sr.Cells) {
+            col := i
+            if c.Ref != "" {
+                col = refColumn(c.Ref)
+            }
+            for len(row) < col {
+                row = append(row, "")
+            }
+            v := c.V
+            switch c.Type {
+            case "s":
+                if n, err := strconv.Atoi(c.V); err == nil && n >= 0 && n < len(shared.Items) {
+                    v = shared.Items[n].String()
+                }
+            case "inlineStr":
+                v = c.Is.String()
+            }
+            if col < len(row) {
+                row[col] = v
+            } else {
+                row = append(row, v)
+            }
+        }
+        rows = append(rows, row)
+    }
+    return rows, nil
+}
+
+// cleanCell undoes what spreadsheets need to keep long ids text: a
+// leading quote or tab, or a ="123" formula.
+func cleanCell(s string) string {
+    s = strings.TrimSpace(s)
+    if strings.HasPrefix(s, "=\"") && strings.HasSuffix(s, "\"") && len(s) >= 3 {
+        s = s[2:len(s) - 1]
+    }
+    return strings.TrimSpace(strings.TrimPrefix(s, "'"))
+}
+
+// excelDate turns the serial day number of a spreadsheet date, days since
+// 1899-12-30 with the time as the fraction, into report time.
+func excelDate(s string) (string, bool) {
+    f, err := strconv.ParseFloat(s, 64)
+    if err != nil || f < 1 {
+        return "", false
+    }
+    base := time.Date(1899, 12, 30, 0, 0, 0, 0, reportZone)
+    t := base.Add(time.Duration(f * 24 * float64(time.Hour) + 0.5 * float64(time.Second)))
+    return t.Truncate(time.Second).Format(API_TIME_LAYOUT), true
+}
+
+// parseExport reads the orders from the rows of an export file, below
+// the first row whose headers name the date and the item. Rows are all
+// on page 1; like parseReport, a row without an item id is skipped with
+// a warning.
+func parseExport(kind string, rows [][]string) (*parsedPage, error) {
+    start := -1
+    var cols map[string]int
+    for i, row := range(rows) {
+        cols = mapExportColumns(row)
+        _, date := cols["date"]
+        _, item := cols["item"]
+        _, id := cols["item_id"]
+        if date && (item || id) {
+            start = i
+            break
+        }
+    }
+    if start == -1 {
+        var b bytes.Buffer
+        for i := 0; i < len(rows) && i < 3; i++ {
+            b.WriteString(strings.Join(rows[i], ","))
+            b.WriteString("\n")
+        }
+        return nil, &common.ErrLayout{Page:"taoke export", Snippet:common.Snippet(b.Bytes(), SNIPPET_SIZE)}
+    }
+
+    p := &parsedPage{layout:kind}
+    for _, row := range(rows[start + 1:]) {
+        cell := func(field string) string {
+            if i, ok := cols[field]; ok && i < len(row) {
+                return cleanCell(row[i])
+            }
+            return ""
+        }
+
+        filled := 0
+        for _, v := range(row) {
+            if cleanCell(v) != "" {
+                filled++
+            }
+        }
+        // notes and the blank lines around them.
+        if filled <= 1 {
+            continue
+        }
+        if len(row) > 0 {
+            first := cleanCell(row[0])
+            totals := false
+            for _, w := range(totalsWords) {
+                totals = totals || strings.Contains(first, w)
+            }
+            if totals {
+                raw := &RawItem{Count:cell("count"), Transaction:cell("transaction"), Income:cell("income")}
+                p.totals = raw.totals()
+                continue
+            }
+        }
+        p.rows++
+
+        raw := &RawItem{
+            Date:cell("date"),
+            Settled:cell("settled"),
+            Id:cell("item_id"),
+            Name:cell("item"),
+            ShopId:cell("shop_id"),
+            ShopName:cell("shop_name"),
+            Count:cell("count"),
+            Price:cell("price"),
+            State:cell("state"),
+            Transaction:cell("transaction"),
+            Commission:cell("commission"),
+            Income:cell("income"),
+            OrderId:cell("order"),
+            ParentId:cell("parent"),
+        }
+        if raw.Id == "" {
+            p.warnings = append(p.warnings, common.RowWarning{Row:p.rows, Column:"item", Reason:"no item id", Skipped:true})
+            continue
+        }
+        for _, date := range([]*string{&raw.Date, &raw.Settled}) {
+            if _, err := parseDate(*date); err != nil {
+                if d, ok := excelDate(*date); ok {
+                    *date = d
+                }
+            }
+        }
+
+        item, warnings := raw.item()
+        for _, w := range(warnings) {
+            w.Row = p.rows
+            p.warnings = append(p.warnings, w)
+        }
+        p.items = append(p.items, item)
+    }
+    return p, nil
+}
+
+// exportStream fetches the export of account from startTime to endTime
+// and hands its items to fn, its summary row and warnings to h. A file
+// the parser does not know is an ErrLayout.
+func exportStream(ctx context.Context, account, startTime, endTime string, fn func(ItemInfo) error, h *hooks) error {
+    log.Info("export request: %s, %s, %s", account, startTime, endTime)
+
+    searchurl := fmt.Sprintf("%s?startTime=%s&endTime=%s", exportURL(), startTime, endTime)
+    resp, err := common.FetchCtx(ctx, account, common.Request{Method:"GET", URL:searchurl})
+    if err != nil {
+        return err
+    }
+    contentType := resp.Header.Get("Content-Type")
+    if isLoginPage(common.DecodeBody(resp.Body, contentType)) {
+        return common.ErrNeedLogin
+    }
+
+    kind, rows, err := exportRows(resp.Body, contentType)
+    var p *parsedPage
+    if err == nil {
+        p, err = parseExport(kind, rows)
+    }
+    if err != nil {
+        common.RecordLayout("taoke", account, "export", common.LAYOUT_UNKNOWN)
+        log.Error("%s of %s", err.Error(), account)
+        return err
+    }
+    common.RecordLayout("taoke", account, "export", p.layout)
+
+    if p.totals != nil {
+        h.onTotals(p.totals)
+    }
+    for _, w := range(p.warnings) {
+        w.Page = 1
+        log.Warn("taoke export row %d of %s: %s %s", w.Row, account, w.Column, w.Reason)
+        h.onWarn(w)
+    }
+    for _, item := range(p.items) {
+        if err = fn(item); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// GetTaokeExportStream fetches the orders of account from the export
+// file, handing each to fn like GetTaokeDetailStream.
+func GetTaokeExportStream(ctx context.Context, account, startTime, endTime string, fn func(ItemInfo) error) error {
+    ctx, release, err := common.AcquireAccount(ctx, "taoke", account)
+    if err != nil {
+        return err
+    }
+    defer release()
+    return exportStream(ctx, account, startTime, endTime, fn, nil)
+}
@@ -0,0 +1,102 @@
+package taoke
+
+import (
+    "fmt"
+    "errors"
+    "strings"
+    "math/big"
+    "net/url"
+)
+
+// The order states a filter takes, by the words of the report's states
+// they match. pending is paid or confirmed but not settled yet.
+const (
+    STATE_SETTLED = "settled"
+    STATE_INVALID = "invalid"
+    STATE_PENDING = "pending"
+)
+
+var stateWords = map[string][]string{
+    STATE_SETTLED:{"结算"},
+    STATE_INVALID:{"失效"},
+    STATE_PENDING:{"付款", "成功"},
+}
+
+// Filter keeps the items that match all of its fields; the zero Filter
+// keeps every item.
+type Filter struct {
+    // States are settled, invalid or pending, an item in any of them
+    // matches.
+    States []string
+    // Shop is part of the shop name, in any case.
+    Shop string
+    // MinCommission is the least commission rate in percent. Items
+    // without one do not match.
+    MinCommission Decimal
+}
+
+// ParseFilter reads the filters of a query: state, one or more separated
+// by commas, shop and min_commission. It is nil when the query has none.
+func ParseFilter(q url.Values) (*Filter, error) {
+    f := &Filter{Shop:strings.TrimSpace(q.Get("shop"))}
+    if s := q.Get("state"); s != "" {
+        for _, state := range(strings.Split(s, ",")) {
+            state = strings.ToLower(strings.TrimSpace(state))
+            if _, ok := stateWords[state]; !ok {
+                return nil, errors.New(fmt.Sprintf("invalid state '%s', expect settled, invalid or pending", state))
+            }
+            f.States = append(f.States, state)
+        }
+    }
+    if s := q.Get("min_commission"); s != "" {
+        d, err := ParseDecimal(s)
+        if err != nil || d == "" {
+            return nil, errors.New(fmt.Sprintf("invalid min_commission '%s', expect a rate in percent", s))
+        }
+        f.MinCommission = d
+    }
+    if len(f.States) == 0 && f.Shop == "" && f.MinCommission == "" {
+        return nil, nil
+    }
+    return f, nil
+}
+
+// Match tells whether f keeps item; a nil f keeps all.
+func (f *Filter) Match(item *ItemInfo) bool {
+    if f == nil {
+        return true
+    }
+    if len(f.States) > 0 {
+        matched := false
+        for _, state := range(f.States) {
+            for _, w := range(stateWords[state]) {
+                matched = matched || strings.Contains(item.State, w)
+            }
+        }
+        if !matched {
+            return false
+        }
+    }
+    if f.Shop != "" && !strings.Contains(strings.ToLower(item.ShopName), strings.ToLower(f.Shop)) {
+        return false
+    }
+    if f.MinCommission != "" {
+        min, _ := new(big.Rat).SetString(string(f.MinCommission))
+        rate, ok := new(big.Rat).SetString(string(item.Commission))
+        if item.Commission == "" || !ok || rate.Cmp(min) < 0 {
+            return false
+        }
+    }
+    return true
+}
+
+// keep is Match for the items of a stream or Rows.
+func (f *Filter) keep(v interface{}) bool {
+    switch item := v.(type) {
+    case ItemInfo:
+        return f.Match(&item)
+    case *ItemInfo:
+        return f.Match(item)
+    }
+    return true
+}
@@ -0,0 +1,383 @@
+package taoke
+
+import (
+    "fmt"
+    "sync"
+    "time"
+    "errors"
+    "math/big"
+    "strconv"
+    "strings"
+    "encoding/json"
+    "common"
+)
+
+// ItemInfo is one order of the report. As JSON:
+//
+//  {
+//    "Date": "2013-01-05T12:34:56+08:00",  order time, RFC 3339
+//    "Settled": "2013-01-20T08:00:00+08:00",  settle time, left out until then
+//    "Id": "123",                          item id
+//    "Name": "...",                        item title
+//    "ShopId": "456",
+//    "ShopName": "...",
+//    "Count": 1,                           number of items
+//    "Price": 12.34,                       unit price in yuan
+//    "State": "订单结算",
+//    "Transaction": 12.34,                 amount paid in yuan
+//    "Commission": 5.5,                    commission rate in percent
+//    "Income": 0.68,                       estimated income in yuan
+//    "CommissionRate": 5.51,               income per amount paid in percent
+//    "EffectiveRate": 5.51,                income per price of the items in percent
+//    "OrderId": "2345",                    trade id, the child order of the item
+//    "ParentId": "2344",                   parent trade id of the whole cart
+//    "Raw": {"Date": "2013-01-05 12:34:56", ...}
+//  }
+//
+// Dates are in the timezone of [taoke], beijing time by default. The ids
+// are empty when the report has none. The two rates are computed here,
+// rounded to RATE_SCALE decimals, null when a value they need is.
+//
+// Amounts are JSON numbers written with the digits of the report, null
+// when the report has none. A value that does not parse is left zero or
+// null; Raw always has the text as the report shows it.
+type ItemInfo struct {
+    Date time.Time
+    Settled *time.Time `json:",omitempty"`
+    Id string
+    Name string
+    ShopId string
+    ShopName string
+    Count int
+    Price Decimal
+    State string
+    Transaction Decimal
+    Commission Decimal
+    Income Decimal
+    CommissionRate Decimal
+    EffectiveRate Decimal
+    OrderId string
+    ParentId string
+    Raw *RawItem `json:",omitempty"`
+}
+
+// RawItem holds the fields of an order as scraped, for debugging.
+type RawItem struct {
+    Date string
+    Settled string
+    Id string
+    Name string
+    ShopId string
+    ShopName string
+    Count string
+    Price string
+    State string
+    Transaction string
+    Commission string
+    Income string
+    OrderId string
+    ParentId string
+}
+
+// reportZone is the time zone of the dates of the report and the api.
+var reportZone = time.FixedZone("CST", 8 * 3600)
+
+var dateLayouts = []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+func parseDate(s string) (time.Time, error) {
+    s = strings.TrimSpace(s)
+    for _, layout := range(dateLayouts) {
+        if t, err := time.ParseInLocation(layout, s, reportZone); err == nil {
+            return t, nil
+        }
+    }
+    return time.Time{}, errors.New("invalid date '" + s + "'")
+}
+
+// Decimal is an exact decimal number such as an amount in yuan. It keeps
+// the digits it was parsed from, so it never picks up float rounding.
+type Decimal string
+
+// ParseDecimal reads s without currency signs, thousands separators, a
+// percent sign, spaces or leading zeros.
+func ParseDecimal(s string) (Decimal, error) {
+    v := strings.Map(func(r rune) rune {
+        switch r {
+        case ' ', '\t', '\n', '\r', '\u00a0', ',', '¥', '￥', '%':
+            return -1
+        }
+        return r
+    }, s)
+    v = strings.TrimPrefix(v, "+")
+
+    digits := strings.TrimPrefix(v, "-")
+    dot := false
+    for i, c := range(digits) {
+        if c == '.' && !dot && i > 0 && i < len(digits) - 1 {
+            dot = true
+            continue
+        }
+        if c < '0' || c > '9' {
+            return "", errors.New("invalid number '" + s + "'")
+        }
+    }
+    if digits == "" {
+        return "", errors.New("invalid number '" + s + "'")
+    }
+
+    // json has no leading zeros, "012.50" is 12.50.
+    sign := v[:len(v) - len(digits)]
+    whole, frac := digits, ""
+    if i := strings.IndexByte(digits, '.'); i != -1 {
+        whole, frac = digits[:i], digits[i:]
+    }
+    if whole = strings.TrimLeft(whole, "0"); whole == "" {
+        whole = "0"
+    }
+    return Decimal(sign + whole + frac), nil
+}
+
+func (d Decimal) String() string {
+    return string(d)
+}
+
+// Float64 is d as a float for arithmetic, 0 when d is empty.
+func (d Decimal) Float64() float64 {
+    f, _ := strconv.ParseFloat(string(d), 64)
+    return f
+}
+
+func (d Decimal) MarshalJSON() ([]byte, error) {
+    if d == "" {
+        return []byte("null"), nil
+    }
+    return []byte(d), nil
+}
+
+// UnmarshalJSON takes a number, a string of one or null.
+func (d *Decimal) UnmarshalJSON(b []byte) error {
+    s := string(b)
+    if s == "null" {
+        *d = ""
+        return nil
+    }
+    if unquoted, err := strconv.Unquote(s); err == nil {
+        s = unquoted
+        if s == "" {
+            *d = ""
+            return nil
+        }
+    }
+    v, err := ParseDecimal(s)
+    if err != nil {
+        return err
+    }
+    *d = v
+    return nil
+}
+
+// item types the fields of raw. Fields that do not parse keep their zero
+// value and get a warning, raw still has them. Empty fields and "-" are
+// no value rather than a bad one.
+func (raw *RawItem) item() (ItemInfo, []common.RowWarning) {
+    item := ItemInfo{
+        Id:strings.TrimSpace(raw.Id),
+        Name:strings.TrimSpace(raw.Name),
+        ShopId:strings.TrimSpace(raw.ShopId),
+        ShopName:strings.TrimSpace(raw.ShopName),
+        State:strings.TrimSpace(raw.State),
+        OrderId:strings.TrimSpace(raw.OrderId),
+        ParentId:strings.TrimSpace(raw.ParentId),
+        Raw:raw,
+    }
+
+    var warnings []common.RowWarning
+    check := func(column, value string, err error) {
+        if v := strings.TrimSpace(value); err != nil && v != "" && v != "-" {
+            warnings = append(warnings, common.RowWarning{Column:column, Reason:err.Error()})
+        }
+    }
+    var err error
+    item.Date, err = parseDate(raw.Date)
+    check("date", raw.Date, err)
+    if settled, err := parseDate(raw.Settled); err == nil {
+        item.Settled = &settled
+    } else {
+        check("settled", raw.Settled, err)
+    }
+    item.Count, err = strconv.Atoi(strings.TrimSpace(raw.Count))
+    if err != nil {
+        err = errors.New("invalid count '" + raw.Count + "'")
+    }
+    check("count", raw.Count, err)
+    item.Price, err = ParseDecimal(raw.Price)
+    check("price", raw.Price, err)
+    item.Transaction, err = ParseDecimal(raw.Transaction)
+    check("transaction", raw.Transaction, err)
+    item.Commission, err = ParseDecimal(raw.Commission)
+    check("commission", raw.Commission, err)
+    item.Income, err = ParseDecimal(raw.Income)
+    check("income", raw.Income, err)
+
+    item.CommissionRate = item.Income.Percent(item.Transaction)
+    if item.Count > 0 {
+        item.EffectiveRate = item.Income.Percent(item.Price.Mul(item.Count))
+    }
+    return item, warnings
+}
+
+// Totals is the summary row of the report, the sums over the whole
+// range it was asked for:
+//
+//  {"Count": 12, "Transaction": 1234.50, "Income": 61.72, "Raw": {...}}
+type Totals struct {
+    Count int
+    Transaction Decimal
+    Income Decimal
+    Raw *RawItem `json:",omitempty"`
+}
+
+func (raw *RawItem) totals() *Totals {
+    t := &Totals{Raw:raw}
+    t.Count, _ = strconv.Atoi(strings.TrimSpace(raw.Count))
+    t.Transaction, _ = ParseDecimal(raw.Transaction)
+    t.Income, _ = ParseDecimal(raw.Income)
+    return t
+}
+
+// add sums the totals of two ranges, eg. two chunks of one request. The
+// sum has no Raw, no page showed it.
+func (t *Totals) add(o *Totals) *Totals {
+    if t == nil {
+        return o
+    }
+    if o == nil {
+        return t
+    }
+    return &Totals{
+        Count:t.Count + o.Count,
+        Transaction:t.Transaction.Add(o.Transaction),
+        Income:t.Income.Add(o.Income),
+    }
+}
+
+// Add is the exact sum of d and o, with the decimals of the longer.
+// Empty counts as missing: the sum is the other one.
+func (d Decimal) Add(o Decimal) Decimal {
+    if d == "" {
+        return o
+    }
+    if o == "" {
+        return d
+    }
+    a, ok := new(big.Rat).SetString(string(d))
+    b, ok2 := new(big.Rat).SetString(string(o))
+    if !ok || !ok2 {
+        return ""
+    }
+    return Decimal(a.Add(a, b).FloatString(max(d.scale(), o.scale())))
+}
+
+// RATE_SCALE is the decimals of the computed rates.
+const RATE_SCALE = 2
+
+// Percent is d in percent of o, rounded half away from zero to
+// RATE_SCALE decimals. It is empty when either is, or o is zero.
+func (d Decimal) Percent(o Decimal) Decimal {
+    a, ok := new(big.Rat).SetString(string(d))
+    b, ok2 := new(big.Rat).SetString(string(o))
+    if d == "" || o == "" || !ok || !ok2 || b.Sign() == 0 {
+        return ""
+    }
+    a.Quo(a, b)
+    return Decimal(a.Mul(a, big.NewRat(100, 1)).FloatString(RATE_SCALE))
+}
+
+// Mul is d times n, exact, with the decimals of d.
+func (d Decimal) Mul(n int) Decimal {
+    a, ok := new(big.Rat).SetString(string(d))
+    if d == "" || !ok {
+        return ""
+    }
+    return Decimal(a.Mul(a, big.NewRat(int64(n), 1)).FloatString(d.scale()))
+}
+
+// scale is the number of digits after the point.
+func (d Decimal) scale() int {
+    if i := strings.IndexByte(string(d), '.'); i != -1 {
+        return len(d) - i - 1
+    }
+    return 0
+}
+
+// zones caches the locations of timezone, loading one reads a file.
+var zones map[string]*time.Location = make(map[string]*time.Location)
+var zonesLock sync.Mutex
+
+// outputZone is the timezone of [taoke]: an IANA name such as UTC or
+// Asia/Shanghai, or an offset such as +08:00. The zone of the report is
+// the default.
+func outputZone() (*time.Location, error) {
+    name, err := common.Conf.String("taoke", "timezone", "")
+    if err != nil || name == "" {
+        return reportZone, err
+    }
+    zonesLock.Lock()
+    defer zonesLock.Unlock()
+    if loc, ok := zones[name]; ok {
+        return loc, nil
+    }
+
+    loc, err := time.LoadLocation(name)
+    if err != nil {
+        t, e := time.Parse("-07:00", name)
+        if e != nil {
+            return nil, errors.New(fmt.Sprintf("invalid timezone '%s' of [taoke], expect a name like Asia/Shanghai or an offset like +08:00", name))
+        }
+        _, offset := t.Zone()
+        loc = time.FixedZone(name, offset)
+    }
+    zones[name] = loc
+    return loc, nil
+}
+
+// MarshalJSON writes the dates in the timezone of [taoke].
+func (item ItemInfo) MarshalJSON() ([]byte, error) {
+    zone, err := outputZone()
+    if err != nil {
+        return nil, err
+    }
+    type plain ItemInfo
+    p := plain(item)
+    if !p.Date.IsZero() {
+        p.Date = p.Date.In(zone)
+    }
+    if p.Settled != nil {
+        settled := p.Settled.In(zone)
+        p.Settled = &settled
+    }
+    return json.Marshal(p)
+}
+
+// DateString is the order time as the report writes it.
+func (item *ItemInfo) DateString() string {
+    if item.Date.IsZero() {
+        if item.Raw != nil {
+            return item.Raw.Date
+        }
+        return ""
+    }
+    return item.Date.In(reportZone).Format(dateLayouts[0])
+}
+
+// SettledString is the settle time as the report writes it, empty while
+// the order is not settled.
+func (item *ItemInfo) SettledString() string {
+    if item.Settled == nil {
+        if item.Raw != nil {
+            return item.Raw.Settled
+        }
+        return ""
+    }
+    return item.Settled.In(reportZone).Format(dateLayouts[0])
+}
@@ -0,0 +1,161 @@
+package taoke
+
+import (
+    "strings"
+    "testing"
+    "encoding/json"
+)
+
+func TestParseDecimal(t *testing.T) {
+    cases := []struct {
+        in string
+        want Decimal
+        err bool
+    }{
+        {in:"12.50", want:"12.50"},
+        {in:"¥1,234.5", want:"1234.5"},
+        {in:" 5.50% ", want:"5.50"},
+        {in:"+0.5", want:"0.5"},
+        {in:"-3", want:"-3"},
+        {in:"012.50", want:"12.50"},
+        {in:"00", want:"0"},
+        {in:"-007", want:"-7"},
+        {in:"000.25", want:"0.25"},
+        {in:".5", err:true},
+        {in:"5.", err:true},
+        {in:"1.2.3", err:true},
+        {in:"", err:true},
+        {in:"-", err:true},
+        {in:"abc", err:true},
+    }
+    for _, c := range(cases) {
+        got, err := ParseDecimal(c.in)
+        if c.err {
+            if err == nil {
+                t.Errorf("ParseDecimal(%q) = %q, want an error", c.in, got)
+            }
+            continue
+        }
+        if err != nil || got != c.want {
+            t.Errorf("ParseDecimal(%q) = %q, %v, want %q", c.in, got, err, c.want)
+        }
+    }
+}
+
+// every Decimal ParseDecimal makes must marshal, json.Marshal checks the
+// bytes of a Marshaler.
+func TestDecimalMarshal(t *testing.T) {
+    var list []Decimal
+    for _, s := range([]string{"012.50", "00", "-007", "1,234.56", ""}) {
+        d, _ := ParseDecimal(s)
+        list = append(list, d)
+    }
+    b, err := json.Marshal(list)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := "[12.50,0,-7,1234.56,null]"; string(b) != want {
+        t.Errorf("json.Marshal = %s, want %s", b, want)
+    }
+}
+
+func TestDecimalAdd(t *testing.T) {
+    cases := []struct {
+        a, b, want Decimal
+    }{
+        {"1.5", "2.25", "3.75"},
+        {"0.1", "0.2", "0.3"},
+        {"-1", "0.50", "-0.50"},
+        {"", "2", "2"},
+        {"1", "", "1"},
+        {"", "", ""},
+    }
+    for _, c := range(cases) {
+        if got := c.a.Add(c.b); got != c.want {
+            t.Errorf("%q.Add(%q) = %q, want %q", c.a, c.b, got, c.want)
+        }
+    }
+}
+
+func TestDecimalPercent(t *testing.T) {
+    cases := []struct {
+        a, b, want Decimal
+    }{
+        {"0.68", "12.34", "5.51"},
+        {"1", "8", "12.50"},
+        {"1", "3", "33.33"},
+        {"2", "3", "66.67"},
+        // halves away from zero.
+        {"0.00125", "1", "0.13"},
+        {"-0.00125", "1", "-0.13"},
+        {"1", "0", ""},
+        {"", "1", ""},
+        {"1", "", ""},
+    }
+    for _, c := range(cases) {
+        if got := c.a.Percent(c.b); got != c.want {
+            t.Errorf("%q.Percent(%q) = %q, want %q", c.a, c.b, got, c.want)
+        }
+    }
+}
+
+func TestDecimalMul(t *testing.T) {
+    cases := []struct {
+        d Decimal
+        n int
+        want Decimal
+    }{
+        {"12.34", 3, "37.02"},
+        {"0.10", 0, "0.00"},
+        {"5", 2, "10"},
+        {"", 2, ""},
+    }
+    for _, c := range(cases) {
+        if got := c.d.Mul(c.n); got != c.want {
+            t.Errorf("%q.Mul(%d) = %q, want %q", c.d, c.n, got, c.want)
+        }
+    }
+}
+
+func TestRawItemWarnings(t *testing.T) {
+    cases := []struct {
+        name string
+        raw RawItem
+        warnings []string
+        commissionRate, effectiveRate Decimal
+    }{
+        {
+            name:"valid",
+            raw:RawItem{Date:"2013-01-05 12:00:00", Count:"1", Price:"12.34", Transaction:"12.34", Commission:"5.50%", Income:"0.68"},
+            commissionRate:"5.51",
+            effectiveRate:"5.51",
+        },
+        {
+            name:"no values",
+            raw:RawItem{Date:"2013-01-05", Settled:"-", Count:"", Price:"-", Transaction:"", Income:""},
+        },
+        {
+            name:"bad cells",
+            raw:RawItem{Date:"yesterday", Settled:"soon", Count:"x", Price:"abc", Transaction:"12.34", Commission:"1..2", Income:"0.68"},
+            warnings:[]string{"date", "settled", "count", "price", "commission"},
+            commissionRate:"5.51",
+        },
+    }
+    for _, c := range(cases) {
+        raw := c.raw
+        item, warnings := raw.item()
+        var columns []string
+        for _, w := range(warnings) {
+            columns = append(columns, w.Column)
+        }
+        if strings.Join(columns, ",") != strings.Join(c.warnings, ",") {
+            t.Errorf("%s: warnings of %v, want %v", c.name, columns, c.warnings)
+        }
+        if item.CommissionRate != c.commissionRate || item.EffectiveRate != c.effectiveRate {
+            t.Errorf("%s: rates %q and %q, want %q and %q", c.name, item.CommissionRate, item.EffectiveRate, c.commissionRate, c.effectiveRate)
+        }
+        if item.Raw != &raw {
+            t.Errorf("%s: Raw is not the raw item", c.name)
+        }
+    }
+}
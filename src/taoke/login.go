@@ -0,0 +1,126 @@
+package taoke
+
+import (
+    "fmt"
+    "context"
+    "bytes"
+    "common"
+    "errors"
+    "regexp"
+    "strings"
+    "io/ioutil"
+    "net/url"
+    "net/http"
+)
+
+var hiddenInput = regexp.MustCompile(`<input type="hidden" name="([^"]+)"[^>]* value="([^"]*)"`)
+var captchaImage = regexp.MustCompile(`<img id="J_StandardCode_m"[^>]* (?:data-)?src="([^"]+)"`)
+var loginMessage = regexp.MustCompile(`(?s)<div id="J_Message"[^>]*>.*?<p class="error">(.*?)</p>`)
+
+func init() {
+    common.RegisterPasswordLogin("taoke", Login)
+    common.RegisterBrowserForm("taoke", common.BrowserForm{
+        URL:LOGIN_URL,
+        Username:"input[name=TPL_username]",
+        Password:"input[name=TPL_password]",
+        Submit:"button#J_SubmitStatic",
+        Done:BASE_URL + "/",
+    })
+    common.RegisterLoginCheck("taoke", func(body []byte) bool {
+        return isLoginPage(common.DecodeBody(body, ""))
+    })
+}
+
+func loginRequest(ctx context.Context, client *http.Client, method, u string, form url.Values) ([]byte, error) {
+    var req *http.Request
+    var err error
+    if form != nil {
+        req, err = http.NewRequestWithContext(ctx, method, u, strings.NewReader(form.Encode()))
+        if err == nil {
+            req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+        }
+    } else {
+        req, err = http.NewRequestWithContext(ctx, method, u, nil)
+    }
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("User-Agent", common.USER_AGENT)
+    req.Header.Set("Referer", loginURL())
+
+    resp, err := client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return nil, err
+    }
+    return common.DecodeBody(body, resp.Header.Get("Content-Type")), nil
+}
+
+// Login performs the taobao login of alimama as username, then checks the
+// report page is reachable. The session cookies are left in client's jar.
+func Login(ctx context.Context, client *http.Client, username, password string) error {
+
+    login := loginURL()
+    page, err := loginRequest(ctx, client, "GET", login, nil)
+    if err != nil {
+        return err
+    }
+
+    /* keep the tokens of the login form */
+    form := url.Values{}
+    for _, m := range(hiddenInput.FindAllSubmatch(page, -1)) {
+        form.Set(string(m[1]), string(m[2]))
+    }
+    form.Set("TPL_username", username)
+    form.Set("TPL_password", password)
+
+    body, err := loginRequest(ctx, client, "POST", login, form)
+    if err != nil {
+        return err
+    }
+
+    /* asked for a captcha, try a few answers */
+    for try := 0; bytes.Index(body, []byte("TPL_checkcode")) != -1; try++ {
+        if try == 3 {
+            return common.ErrCaptcha
+        }
+
+        m := captchaImage.FindSubmatch(body)
+        if m == nil {
+            return errors.New("captcha image not found in login page")
+        }
+        image := strings.Replace(string(m[1]), "&amp;", "&", -1)
+        if strings.HasPrefix(image, "//") {
+            image = "https:" + image
+        }
+
+        text, err := common.SolveCaptcha(ctx, client, image)
+        if err != nil {
+            return err
+        }
+        form.Set("TPL_checkcode", text)
+
+        if body, err = loginRequest(ctx, client, "POST", login, form); err != nil {
+            return err
+        }
+    }
+
+    if m := loginMessage.FindSubmatch(body); m != nil {
+        return errors.New(fmt.Sprintf("login refused: %s", strings.TrimSpace(string(m[1]))))
+    }
+
+    body, err = loginRequest(ctx, client, "GET", reportURL(), nil)
+    if err != nil {
+        return err
+    }
+    if isLoginPage(body) {
+        return errors.New("login did not reach alimama")
+    }
+
+    return nil
+}
@@ -0,0 +1,329 @@
+package taoke
+
+import (
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+    "net/url"
+    "common"
+    log "code.google.com/p/log4go"
+)
+
+// The fields of a report row, found by the text of the column headers.
+// Keywords are tried in order, so the specific ones come first: "商品数"
+// is the count, not the item, "结算时间" is no order time.
+var columns = []struct {
+    field string
+    headers []string
+}{
+    {"settled", []string{"结算时间", "结算日期"}},
+    {"date", []string{"创建时间", "下单时间", "时间", "日期"}},
+    {"count", []string{"商品数", "数量"}},
+    {"price", []string{"单价"}},
+    {"state", []string{"订单状态", "状态"}},
+    {"parent", []string{"父订单", "父交易"}},
+    {"order", []string{"子订单", "订单编号", "订单号", "交易编号", "交易号"}},
+    {"transaction", []string{"付款金额", "成交金额"}},
+    {"income", []string{"预估收入", "效果预估", "预估佣金", "结算收入"}},
+    {"commission", []string{"佣金比率", "佣金比例", "佣金"}},
+    {"item", []string{"商品信息", "商品名称", "宝贝", "商品"}},
+}
+
+// legacyColumns are the positions of the fields in the report as it has
+// long been, used for what the headers do not tell.
+var legacyColumns = map[string]int{
+    "date":0, "item":1, "count":2, "price":3, "state":4,
+    "transaction":6, "commission":7, "income":10,
+}
+
+const LEGACY_WIDTH = 11
+
+// mapColumns finds the column of each field from the header cells.
+func mapColumns(headers []string) map[string]int {
+    cols := make(map[string]int)
+    for i, h := range(headers) {
+        h = strings.Join(strings.Fields(h), "")
+        for _, c := range(columns) {
+            if _, ok := cols[c.field]; ok {
+                continue
+            }
+            matched := false
+            for _, k := range(c.headers) {
+                if strings.Contains(h, k) {
+                    matched = true
+                    break
+                }
+            }
+            if matched {
+                cols[c.field] = i
+                break
+            }
+        }
+    }
+    return cols
+}
+
+func cells(tr *common.Node) []*common.Node {
+    var list []*common.Node
+    for _, c := range(tr.Children) {
+        if c.Tag == "td" || c.Tag == "th" {
+            list = append(list, c)
+        }
+    }
+    return list
+}
+
+// reportTable finds the report: the table of class med-table, else the
+// first table whose headers name the date and item columns.
+func reportTable(root *common.Node) (*common.Node, []string) {
+    var found *common.Node
+    var headers []string
+    for _, table := range(root.FindAll(common.ByTag("table"))) {
+        var hs []string
+        if tr := table.Find(func(n *common.Node) bool {
+            return n.Tag == "tr" && n.Find(common.ByTag("th")) != nil
+        }); tr != nil {
+            for _, th := range(cells(tr)) {
+                hs = append(hs, th.Text())
+            }
+        }
+        if table.HasClass("med-table") {
+            return table, hs
+        }
+        cols := mapColumns(hs)
+        _, date := cols["date"]
+        _, item := cols["item"]
+        if found == nil && date && item {
+            found, headers = table, hs
+        }
+    }
+    return found, headers
+}
+
+// The layout versions of the report the parser knows.
+const (
+    // LAYOUT_LEGACY is the med-table without headers, cells by position.
+    LAYOUT_LEGACY = "legacy"
+    // LAYOUT_MED_TABLE is the med-table with column headers.
+    LAYOUT_MED_TABLE = "med-table"
+    // LAYOUT_HEADERS is any other table whose headers name the date and
+    // item columns.
+    LAYOUT_HEADERS = "headers"
+    // LAYOUT_JSON is the json of the pub report.
+    LAYOUT_JSON = "json"
+)
+
+// SNIPPET_SIZE is about how much markup an ErrLayout or ErrParse shows.
+const SNIPPET_SIZE = 400
+
+// layoutVersion fingerprints the report table found by reportTable,
+// common.LAYOUT_UNKNOWN when it is none of the known layouts.
+func layoutVersion(table *common.Node, headers []string) string {
+    if table == nil {
+        return common.LAYOUT_UNKNOWN
+    }
+    cols := mapColumns(headers)
+    _, date := cols["date"]
+    _, item := cols["item"]
+    switch {
+    case !table.HasClass("med-table"):
+        return LAYOUT_HEADERS
+    case len(headers) == 0:
+        return LAYOUT_LEGACY
+    case date && item:
+        return LAYOUT_MED_TABLE
+    case len(headers) == LEGACY_WIDTH:
+        return LAYOUT_LEGACY
+    }
+    return common.LAYOUT_UNKNOWN
+}
+
+// itemCell reads the links of the item column: the item by its id
+// parameter, the shop by its oid.
+func itemCell(td *common.Node, item *RawItem) bool {
+    for _, a := range(td.FindAll(common.ByTag("a"))) {
+        u, err := url.Parse(a.Attr("href"))
+        if err != nil {
+            continue
+        }
+        q := u.Query()
+        if oid := q.Get("oid"); oid != "" && item.ShopId == "" {
+            item.ShopId = oid
+            item.ShopName = a.Text()
+        } else if id := q.Get("id"); id != "" && item.Id == "" {
+            item.Id = id
+            item.Name = a.Text()
+        }
+    }
+    return item.Id != ""
+}
+
+// totalsWords mark the first cell of the summary row.
+var totalsWords = []string{"合计", "总计", "汇总"}
+
+// isTotals tells the summary row from the orders: it is in the tfoot or
+// starts with one of totalsWords.
+func isTotals(tr *common.Node, tds []*common.Node) bool {
+    if tr.Parent != nil && tr.Parent.Tag == "tfoot" {
+        return true
+    }
+    first := tds[0].Text()
+    for _, w := range(totalsWords) {
+        if strings.Contains(first, w) {
+            return true
+        }
+    }
+    return false
+}
+
+// spread repeats a cell spanning several columns, so the nth column is
+// at n also after a colspan.
+func spread(tds []*common.Node) []*common.Node {
+    var list []*common.Node
+    for _, td := range(tds) {
+        n, err := strconv.Atoi(strings.TrimSpace(td.Attr("colspan")))
+        if err != nil || n < 1 {
+            n = 1
+        }
+        for ; n > 0; n-- {
+            list = append(list, td)
+        }
+    }
+    return list
+}
+
+// parseTotals reads the summary row by the columns of the orders. It
+// holds sums only: the item, price and rate columns are left out.
+func parseTotals(tds []*common.Node, cols map[string]int) *Totals {
+    raw := &RawItem{}
+    cell := func(field string) string {
+        if i, ok := cols[field]; ok && i < len(tds) {
+            return tds[i].Text()
+        }
+        return ""
+    }
+    raw.Count = cell("count")
+    raw.Transaction = cell("transaction")
+    raw.Income = cell("income")
+    return raw.totals()
+}
+
+// parsedPage is a report page: its layout version, its items, its summary
+// row if it has one, and warnings for the rows that did not parse. rows
+// counts the order rows, also those skipped, a page of bad rows is not
+// past the last one.
+type parsedPage struct {
+    layout string
+    items []ItemInfo
+    totals *Totals
+    warnings []common.RowWarning
+    rows int
+}
+
+// parseReport parses a report page, with no rows past the last page. A
+// row shorter than the header or without an item link is skipped with a
+// warning, a field that does not parse is left empty with one. A page of
+// no known layout version is an ErrLayout.
+func parseReport(body []byte) (*parsedPage, error) {
+    root := common.ParseHTML(body)
+
+    table, headers := reportTable(root)
+    layout := layoutVersion(table, headers)
+    if layout == common.LAYOUT_UNKNOWN {
+        return nil, &common.ErrLayout{Page:"taoke detail", Snippet:common.Snippet(body, SNIPPET_SIZE, "med-table", "<table", "<body")}
+    }
+
+    cols := mapColumns(headers)
+    for field, i := range(legacyColumns) {
+        if _, ok := cols[field]; ok {
+            continue
+        }
+        if len(headers) == 0 || len(headers) == LEGACY_WIDTH {
+            cols[field] = i
+        } else {
+            log.Warn("taoke report has no %s column in %s", field, strings.Join(headers, "|"))
+        }
+    }
+    // in column order, so the first column a row misses is the one named.
+    fields := make([]string, 0, len(cols))
+    for field := range(cols) {
+        fields = append(fields, field)
+    }
+    sort.Slice(fields, func(i, j int) bool { return cols[fields[i]] < cols[fields[j]] })
+
+    p := &parsedPage{layout:layout}
+    for _, tr := range(table.FindAll(common.ByTag("tr"))) {
+        tds := cells(tr)
+        if len(tds) == 0 || tds[0].Tag == "th" {
+            continue
+        }
+        // the no data tip is a single cell across the table.
+        if len(tds) == 1 {
+            continue
+        }
+        if isTotals(tr, tds) {
+            p.totals = parseTotals(spread(tds), cols)
+            continue
+        }
+        p.rows++
+
+        item := &RawItem{}
+        var skip *common.RowWarning
+        for _, field := range(fields) {
+            i := cols[field]
+            if i >= len(tds) {
+                skip = &common.RowWarning{Column:field, Reason:fmt.Sprintf("row has %d cells, no column %d", len(tds), i + 1)}
+                break
+            }
+            td := tds[i]
+            switch field {
+            case "date":
+                item.Date = td.Text()
+            case "settled":
+                item.Settled = td.Text()
+            case "item":
+                if !itemCell(td, item) {
+                    skip = &common.RowWarning{Column:field, Reason:"no item link"}
+                }
+            case "count":
+                item.Count = td.Text()
+            case "price":
+                item.Price = td.Text()
+            case "state":
+                if span := td.Find(common.ByTag("span")); span != nil {
+                    item.State = span.Text()
+                } else {
+                    item.State = td.Text()
+                }
+            case "transaction":
+                item.Transaction = td.Text()
+            case "order":
+                item.OrderId = td.Text()
+            case "parent":
+                item.ParentId = td.Text()
+            case "commission":
+                item.Commission = td.Text()
+            case "income":
+                item.Income = td.Text()
+            }
+            if skip != nil {
+                break
+            }
+        }
+        if skip != nil {
+            skip.Row = p.rows
+            skip.Skipped = true
+            p.warnings = append(p.warnings, *skip)
+            continue
+        }
+
+        parsed, warnings := item.item()
+        for _, w := range(warnings) {
+            w.Row = p.rows
+            p.warnings = append(p.warnings, w)
+        }
+        p.items = append(p.items, parsed)
+    }
+    return p, nil
+}
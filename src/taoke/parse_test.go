@@ -0,0 +1,120 @@
+package taoke
+
+import (
+    "os"
+    "flag"
+    "bytes"
+    "testing"
+    "io/ioutil"
+    "path/filepath"
+    "encoding/json"
+    "common"
+)
+
+// go test taoke -update rewrites the golden files from the parser, check
+// their diff before committing them.
+var update = flag.Bool("update", false, "rewrite the golden files of testdata")
+
+func TestMain(m *testing.M) {
+    // the dates of the items marshal in the timezone of [taoke].
+    if err := common.LoadFromString("[common]\nport=9000\n[taoke]\naccounts=a\ntimezone=+08:00\n[a]\ncookies=a=b\n"); err != nil {
+        panic(err)
+    }
+    flag.Parse()
+    os.Exit(m.Run())
+}
+
+// golden is what the parser made of a fixture.
+type golden struct {
+    Login bool `json:",omitempty"`
+    Layout string `json:",omitempty"`
+    Rows int
+    Items []ItemInfo `json:",omitempty"`
+    Totals *Totals `json:",omitempty"`
+    Warnings []common.RowWarning `json:",omitempty"`
+    Days []DayReport `json:",omitempty"`
+    Error string `json:",omitempty"`
+}
+
+// The fixtures are captured report pages, saved as utf-8. A new layout
+// gets a fixture here before the parser learns it.
+var parseCases = []struct {
+    file string
+    days bool
+}{
+    {file:"detail_normal.html"},
+    {file:"detail_empty.html"},
+    {file:"detail_last_page.html"},
+    {file:"detail_malformed.html"},
+    {file:"login.html"},
+    {file:"captcha.html"},
+    {file:"layout_legacy.html"},
+    {file:"layout_headers.html"},
+    {file:"layout_unknown.html"},
+    {file:"effect.html", days:true},
+}
+
+func parseFixture(body []byte, days bool) *golden {
+    g := &golden{}
+    body = common.DecodeBody(body, "text/html")
+    if isLoginPage(body) {
+        g.Login = true
+        return g
+    }
+    if days {
+        d, err := parseDays(body, "taoke effect")
+        if err != nil {
+            g.Error = err.Error()
+        }
+        g.Days = d
+        g.Rows = len(d)
+        return g
+    }
+    p, err := parseReport(body)
+    if err != nil {
+        g.Error = err.Error()
+        return g
+    }
+    g.Layout = p.layout
+    g.Rows = p.rows
+    g.Items = p.items
+    g.Totals = p.totals
+    g.Warnings = p.warnings
+    return g
+}
+
+func TestParseGolden(t *testing.T) {
+    for _, c := range(parseCases) {
+        t.Run(c.file, func(t *testing.T) {
+            path := filepath.Join("testdata", c.file)
+            body, err := ioutil.ReadFile(path)
+            if err != nil {
+                t.Fatal(err)
+            }
+            // unescaped, the snippets of the errors read like the page.
+            var b bytes.Buffer
+            enc := json.NewEncoder(&b)
+            enc.SetEscapeHTML(false)
+            enc.SetIndent("", "  ")
+            if err = enc.Encode(parseFixture(body, c.days)); err != nil {
+                t.Fatal(err)
+            }
+            got := b.Bytes()
+
+            file := path[:len(path) - len(filepath.Ext(path))] + ".golden.json"
+            if *update {
+                if err = ioutil.WriteFile(file, got, 0644); err != nil {
+                    t.Fatal(err)
+                }
+                return
+            }
+            want, err := ioutil.ReadFile(file)
+            if err != nil {
+                t.Fatalf("%s, run go test taoke -update to write it", err.Error())
+            }
+            if !bytes.Equal(got, want) {
+                t.Errorf("%s differs from %s:\n%s", c.file, file, got)
+            }
+        })
+    }
+}
@@ -0,0 +1,208 @@
+package taoke
+
+import (
+    "fmt"
+    "time"
+    "errors"
+    "context"
+    "strings"
+    "net/url"
+    "net/http"
+    "encoding/json"
+    "common"
+    log "code.google.com/p/log4go"
+)
+
+// PUB_URL is the publisher center alimama moves the reports of
+// u.alimama.com to, whose report pages load their rows as json. pub_url
+// and pub_path of [taoke] replace them.
+const PUB_URL = "https://pub.alimama.com"
+const PUB_PATH = "/report/getTbkPaymentDetails.json"
+
+const BACKEND_PUB = "pub"
+
+func pubURL() string {
+    return strings.TrimSuffix(common.SiteURL("taoke", "pub_url", PUB_URL), "/") + common.SiteURL("taoke", "pub_path", PUB_PATH)
+}
+
+// pubOrder is one row of the paymentList of the pub report.
+type pubOrder struct {
+    CreateTime string `json:"createTime"`
+    EarningTime string `json:"earningTime"`
+    AuctionId json.Number `json:"auctionId"`
+    AuctionTitle string `json:"auctionTitle"`
+    ExNickName string `json:"exNickName"`
+    ExShopTitle string `json:"exShopTitle"`
+    AuctionNum json.Number `json:"auctionNum"`
+    PayPrice json.Number `json:"payPrice"`
+    PayStatus json.Number `json:"payStatus"`
+    TotalAlipayFee string `json:"totalAlipayFeeString"`
+    CommissionRate string `json:"discountAndSubsidyToString"`
+    Fee string `json:"feeString"`
+    TradeId json.Number `json:"taobaoTradeId"`
+    TradeParentId json.Number `json:"taobaoTradeParentId"`
+}
+
+// item reads o as the report would show it, its payStatus is a tk_status
+// of the api.
+func (o *pubOrder) item() (ItemInfo, []common.RowWarning) {
+    state, ok := apiStates[o.PayStatus.String()]
+    if !ok {
+        state = o.PayStatus.String()
+    }
+    raw := &RawItem{
+        Date:o.CreateTime,
+        Settled:o.EarningTime,
+        Id:o.AuctionId.String(),
+        Name:o.AuctionTitle,
+        ShopId:o.ExNickName,
+        ShopName:o.ExShopTitle,
+        Count:o.AuctionNum.String(),
+        Price:o.PayPrice.String(),
+        State:state,
+        Transaction:o.TotalAlipayFee,
+        Commission:o.CommissionRate,
+        Income:o.Fee,
+        OrderId:o.TradeId.String(),
+        ParentId:o.TradeParentId.String(),
+    }
+    return raw.item()
+}
+
+type pubPage struct {
+    Ok bool `json:"ok"`
+    InvalidKey string `json:"invalidKey"`
+    Info struct {
+        Ok bool `json:"ok"`
+        Message string `json:"message"`
+    } `json:"info"`
+    Data struct {
+        HasNext bool `json:"hasNext"`
+        PaymentList []pubOrder `json:"paymentList"`
+    } `json:"data"`
+}
+
+// pubHeader is the session of account for the pub report: its cookies of
+// the old report, which a pasted cookie string only sets for that host,
+// under those the pub host set itself. token is the _tb_token_ the report
+// wants in its query.
+func pubHeader(account, u string) (header http.Header, token string, err error) {
+    own, err := common.Cookies(account, u)
+    if err != nil {
+        return nil, "", err
+    }
+    old, err := common.Cookies(account, reportURL())
+    if err != nil {
+        return nil, "", err
+    }
+    have := make(map[string]bool)
+    for _, c := range(own) {
+        have[c.Name] = true
+        if c.Name == "_tb_token_" {
+            token = c.Value
+        }
+    }
+    var pairs []string
+    for _, c := range(old) {
+        if have[c.Name] {
+            continue
+        }
+        pairs = append(pairs, c.Name + "=" + c.Value)
+        if c.Name == "_tb_token_" && token == "" {
+            token = c.Value
+        }
+    }
+    header = http.Header{}
+    if len(pairs) > 0 {
+        header.Set("Cookie", strings.Join(pairs, "; "))
+    }
+    return header, token, nil
+}
+
+// pubStream fetches the pub report of account from startTime to endTime,
+// page by page, and hands its items to fn and the warnings of its rows to
+// h. It has no summary row.
+func pubStream(ctx context.Context, account, startTime, endTime string, fn func(ItemInfo) error, h *hooks) error {
+    size, maxPages, err := pageLimits()
+    if err != nil {
+        return err
+    }
+    u := pubURL()
+
+    log.Info("pub request: %s, %s, %s", account, startTime, endTime)
+
+    for page := 1; ; page++ {
+        if page > maxPages {
+            return errors.New(fmt.Sprintf("taoke pub report of %s from %s to %s goes on past max_pages %d, stopped; raise max_pages of [taoke]", account, startTime, endTime, maxPages))
+        }
+
+        // again each page, the pub host may have set cookies of its own.
+        header, token, err := pubHeader(account, u)
+        if err != nil {
+            return err
+        }
+
+        q := url.Values{}
+        q.Set("queryType", "1")
+        q.Set("payStatus", "")
+        q.Set("DownloadID", "DOWNLOAD_REPORT_INCOME_NEW")
+        q.Set("startTime", startTime)
+        q.Set("endTime", endTime)
+        q.Set("pageNo", fmt.Sprint(page))
+        q.Set("pageSize", fmt.Sprint(size))
+        q.Set("_tb_token_", token)
+        q.Set("t", fmt.Sprint(time.Now().UnixNano() / int64(time.Millisecond)))
+
+        resp, err := common.FetchCtx(ctx, account, common.Request{Method:"GET", URL:u + "?" + q.Encode(), Header:header})
+        if err != nil {
+            return err
+        }
+
+        var p pubPage
+        if err = json.Unmarshal(resp.Body, &p); err != nil {
+            body := common.DecodeBody(resp.Body, resp.Header.Get("Content-Type"))
+            if isLoginPage(body) {
+                return common.ErrNeedLogin
+            }
+            common.RecordLayout("taoke", account, "pub", common.LAYOUT_UNKNOWN)
+            err = &common.ErrParse{Page:"taoke pub", Number:page, Expected:"a json answer", Excerpt:common.Snippet(body, SNIPPET_SIZE)}
+            log.Error("%s of %s", err.Error(), account)
+            return err
+        }
+        // a dead session is answered with the key it missed.
+        if p.InvalidKey != "" || strings.Contains(p.Info.Message, "登录") {
+            return common.ErrNeedLogin
+        }
+        if !p.Ok || !p.Info.Ok {
+            return errors.New(fmt.Sprintf("taoke pub report of %s refused: %s", account, p.Info.Message))
+        }
+        common.RecordLayout("taoke", account, "pub", LAYOUT_JSON)
+
+        for i := range(p.Data.PaymentList) {
+            item, warnings := p.Data.PaymentList[i].item()
+            for _, w := range(warnings) {
+                w.Page = page
+                w.Row = i + 1
+                log.Warn("taoke pub page %d row %d of %s: %s %s", page, w.Row, account, w.Column, w.Reason)
+                h.onWarn(w)
+            }
+            if err = fn(item); err != nil {
+                return err
+            }
+        }
+        if !p.Data.HasNext || len(p.Data.PaymentList) == 0 {
+            return nil
+        }
+    }
+}
+
+// GetTaokePubStream fetches the orders of account from the pub report,
+// handing each to fn like GetTaokeDetailStream.
+func GetTaokePubStream(ctx context.Context, account, startTime, endTime string, fn func(ItemInfo) error) error {
+    ctx, release, err := common.AcquireAccount(ctx, "taoke", account)
+    if err != nil {
+        return err
+    }
+    defer release()
+    return chunkedStream(ctx, account, startTime, endTime, fn, nil, pubStream)
+}
@@ -0,0 +1,209 @@
+package taoke
+
+import (
+    "fmt"
+    "sort"
+    "errors"
+    "strconv"
+    "strings"
+    "context"
+    "common"
+    log "code.google.com/p/log4go"
+)
+
+// The pages of the daily reports besides the order details. Options
+// effect_path and overview_path of [taoke] replace them.
+const EFFECT_PATH = "/union/newreport/taobaokeEffect.htm"
+const OVERVIEW_PATH = "/union/newreport/overview.htm"
+
+const (
+    REPORT_EFFECT = "effect"
+    REPORT_OVERVIEW = "overview"
+)
+
+var reportPaths = map[string]struct{ option, path string }{
+    REPORT_EFFECT:{"effect_path", EFFECT_PATH},
+    REPORT_OVERVIEW:{"overview_path", OVERVIEW_PATH},
+}
+
+// DayReport is one day of the effect report or of the overview:
+//
+//  {"Date": "2013-01-05", "Clicks": 120, "Orders": 3,
+//   "Transaction": 123.40, "Income": 6.17, "Raw": {"日期": "2013-01-05", ...}}
+//
+// Raw has every column by its header, also those without a field.
+type DayReport struct {
+    Date string
+    Clicks int
+    Orders int
+    Transaction Decimal
+    Income Decimal
+    Raw map[string]string `json:",omitempty"`
+}
+
+// dayColumns find the fields of a day by header, like columns do for the
+// orders.
+var dayColumns = []struct {
+    field string
+    headers []string
+}{
+    {"date", []string{"日期", "时间"}},
+    {"clicks", []string{"点击数", "点击"}},
+    {"orders", []string{"付款笔数", "成交笔数", "笔数"}},
+    {"transaction", []string{"付款金额", "成交金额"}},
+    {"income", []string{"预估收入", "效果预估", "预估佣金", "结算收入", "收入"}},
+}
+
+func mapDayColumns(headers []string) map[string]int {
+    cols := make(map[string]int)
+    for i, h := range(headers) {
+        h = strings.Join(strings.Fields(h), "")
+        for _, c := range(dayColumns) {
+            if _, ok := cols[c.field]; ok {
+                continue
+            }
+            matched := false
+            for _, k := range(c.headers) {
+                if strings.Contains(h, k) {
+                    matched = true
+                    break
+                }
+            }
+            if matched {
+                cols[c.field] = i
+                break
+            }
+        }
+    }
+    return cols
+}
+
+// dayTable finds the first table whose headers name a date column.
+func dayTable(root *common.Node) (*common.Node, []string) {
+    for _, table := range(root.FindAll(common.ByTag("table"))) {
+        tr := table.Find(func(n *common.Node) bool {
+            return n.Tag == "tr" && n.Find(common.ByTag("th")) != nil
+        })
+        if tr == nil {
+            continue
+        }
+        var hs []string
+        for _, th := range(cells(tr)) {
+            hs = append(hs, th.Text())
+        }
+        if _, ok := mapDayColumns(hs)["date"]; ok {
+            return table, hs
+        }
+    }
+    return nil, nil
+}
+
+// parseDays reads the rows of a daily report. A page without a table
+// with a date column is an ErrLayout.
+func parseDays(body []byte, page string) ([]DayReport, error) {
+    root := common.ParseHTML(body)
+    table, headers := dayTable(root)
+    if table == nil {
+        return nil, &common.ErrLayout{Page:page, Snippet:common.Snippet(body, SNIPPET_SIZE, "<table", "<body")}
+    }
+    cols := mapDayColumns(headers)
+
+    days := make([]DayReport, 0)
+    for _, tr := range(table.FindAll(common.ByTag("tr"))) {
+        tds := cells(tr)
+        if len(tds) < 2 || tds[0].Tag == "th" || isTotals(tr, tds) {
+            continue
+        }
+        tds = spread(tds)
+
+        text := func(field string) string {
+            if i, ok := cols[field]; ok && i < len(tds) {
+                return tds[i].Text()
+            }
+            return ""
+        }
+
+        d := DayReport{Raw:make(map[string]string)}
+        for i, h := range(headers) {
+            if i < len(tds) && h != "" {
+                d.Raw[h] = tds[i].Text()
+            }
+        }
+        date, err := parseDate(text("date"))
+        if err != nil {
+            log.Warn("%s row without a date: %s", page, text("date"))
+            continue
+        }
+        d.Date = date.Format(CHUNK_LAYOUT)
+        d.Clicks, _ = strconv.Atoi(strings.Replace(text("clicks"), ",", "", -1))
+        d.Orders, _ = strconv.Atoi(strings.Replace(text("orders"), ",", "", -1))
+        d.Transaction, _ = ParseDecimal(text("transaction"))
+        d.Income, _ = ParseDecimal(text("income"))
+        days = append(days, d)
+    }
+    sort.SliceStable(days, func(i, j int) bool { return days[i].Date < days[j].Date })
+    return days, nil
+}
+
+func dailyReportURL(name string) (string, bool) {
+    p, ok := reportPaths[name]
+    if !ok {
+        return "", false
+    }
+    return baseURL() + common.SiteURL("taoke", p.option, p.path), true
+}
+
+// GetTaokeDays fetches report name, effect or overview, of account by
+// day from startTime to endTime.
+func GetTaokeDays(ctx context.Context, name, account, startTime, endTime string) ([]DayReport, error) {
+    report, ok := dailyReportURL(name)
+    if !ok {
+        return nil, errors.New(fmt.Sprintf("unknown taoke report '%s'", name))
+    }
+    log.Info("%s request: %s, %s, %s", name, account, startTime, endTime)
+
+    searchurl := fmt.Sprintf("%s?startTime=%s&endTime=%s", report, startTime, endTime)
+    resp, err := common.FetchCtx(ctx, account, common.Request{Method:"GET", URL:searchurl})
+    if err != nil {
+        return nil, err
+    }
+    body := common.DecodeBody(resp.Body, resp.Header.Get("Content-Type"))
+    if isLoginPage(body) {
+        return nil, common.ErrNeedLogin
+    }
+
+    days, err := parseDays(body, "taoke " + name)
+    if err != nil {
+        common.RecordLayout("taoke", account, name, common.LAYOUT_UNKNOWN)
+        log.Error("%s of %s", err.Error(), account)
+        return nil, err
+    }
+    common.RecordLayout("taoke", account, name, LAYOUT_HEADERS)
+    return days, nil
+}
+
+// GetTaokeEffect fetches the daily effect report of account.
+func GetTaokeEffect(ctx context.Context, account, startTime, endTime string) ([]DayReport, error) {
+    return GetTaokeDays(ctx, REPORT_EFFECT, account, startTime, endTime)
+}
+
+// GetTaokeOverview fetches the numbers of the overview of account by day.
+func GetTaokeOverview(ctx context.Context, account, startTime, endTime string) ([]DayReport, error) {
+    return GetTaokeDays(ctx, REPORT_OVERVIEW, account, startTime, endTime)
+}
+
+// Days are the rows of a daily report.
+type Days []DayReport
+
+func (days Days) Len() int {
+    return len(days)
+}
+
+func (days Days) Table() (header []string, rows [][]string) {
+    header = []string{"Date", "Clicks", "Orders", "Transaction", "Income"}
+    rows = make([][]string, len(days))
+    for i, d := range(days) {
+        rows[i] = []string{d.Date, strconv.Itoa(d.Clicks), strconv.Itoa(d.Orders), d.Transaction.String(), d.Income.String()}
+    }
+    return
+}
@@ -0,0 +1,210 @@
+package taoke
+
+import (
+    "os"
+    "fmt"
+    "sync"
+    "time"
+    "errors"
+    "context"
+    "io/ioutil"
+    "path/filepath"
+    "encoding/json"
+    "common"
+    log "code.google.com/p/log4go"
+)
+
+// syncState is what the last sync of an account saw: the time of its
+// newest order and the keys of the orders at that time, as several can
+// share one second.
+type syncState struct {
+    Account string
+    Newest time.Time
+    Keys []string
+    Synced time.Time
+}
+
+// errSynced stops a fetch once it reached orders the last sync had.
+var errSynced = errors.New("reached synced orders")
+
+var syncLocks map[string]*sync.Mutex = make(map[string]*sync.Mutex)
+var syncLocksLock sync.Mutex
+
+func syncLock(account string) *sync.Mutex {
+    syncLocksLock.Lock()
+    defer syncLocksLock.Unlock()
+    l, ok := syncLocks[account]
+    if !ok {
+        l = &sync.Mutex{}
+        syncLocks[account] = l
+    }
+    return l
+}
+
+func syncFile(account string) (string, error) {
+    dir, err := common.Conf.String("taoke", "sync_dir", "sync")
+    if err != nil {
+        return "", err
+    }
+    return filepath.Join(dir, account + ".json"), nil
+}
+
+// loadSync reads the state of account, empty before its first sync.
+func loadSync(account string) (*syncState, error) {
+    st := &syncState{Account:account}
+    file, err := syncFile(account)
+    if err != nil {
+        return nil, err
+    }
+    b, err := ioutil.ReadFile(file)
+    if os.IsNotExist(err) {
+        return st, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    if err = json.Unmarshal(b, st); err != nil {
+        return nil, errors.New(fmt.Sprintf("sync state %s: %s", file, err.Error()))
+    }
+    return st, nil
+}
+
+func (st *syncState) save() error {
+    file, err := syncFile(st.Account)
+    if err != nil {
+        return err
+    }
+    if err = os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+        return err
+    }
+    b, err := json.Marshal(st)
+    if err != nil {
+        return err
+    }
+    // write aside and rename, so a crash never leaves half a file.
+    if err = ioutil.WriteFile(file + ".tmp", b, 0600); err != nil {
+        return err
+    }
+    return os.Rename(file + ".tmp", file)
+}
+
+// known tells whether the last sync had item, or an order older than it.
+func (st *syncState) known(item *ItemInfo) bool {
+    if st.Newest.IsZero() || item.Date.IsZero() {
+        return false
+    }
+    if item.Date.Before(st.Newest) {
+        return true
+    }
+    if item.Date.Equal(st.Newest) {
+        key := itemKey(item)
+        for _, k := range(st.Keys) {
+            if k == key {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// add moves the state past the new items.
+func (st *syncState) add(items []ItemInfo) {
+    for i := range(items) {
+        item := &items[i]
+        if item.Date.IsZero() || item.Date.Before(st.Newest) {
+            continue
+        }
+        if item.Date.After(st.Newest) {
+            st.Newest = item.Date
+            st.Keys = nil
+        }
+        st.Keys = append(st.Keys, itemKey(item))
+    }
+    st.Synced = time.Now()
+}
+
+// syncRange is from the day of the newest synced order, or sync_days ago
+// on the first sync, to today.
+func (st *syncState) syncRange() (startTime, endTime string, err error) {
+    today := time.Now().In(reportZone)
+    start := st.Newest.In(reportZone)
+    if st.Newest.IsZero() {
+        days, err := common.Conf.Int("taoke", "sync_days", 7)
+        if err != nil {
+            return "", "", err
+        }
+        start = today.AddDate(0, 0, -days)
+    }
+    return start.Format(CHUNK_LAYOUT), today.Format(CHUNK_LAYOUT), nil
+}
+
+// SyncTaoke fetches the orders of account newer than those of its last
+// sync. The report lists the newest orders first, so it stops at the
+// first page that reaches a synced one; the api and the export have no
+// such order and are fetched whole, dropping the synced orders. The state is saved only
+// when the sync worked, a failed one is simply done again.
+func SyncTaoke(ctx context.Context, account string) ([]ItemInfo, error) {
+    l := syncLock(account)
+    l.Lock()
+    defer l.Unlock()
+
+    ctx, release, err := common.AcquireAccount(ctx, "taoke", account)
+    if err != nil {
+        return nil, err
+    }
+    defer release()
+
+    st, err := loadSync(account)
+    if err != nil {
+        return nil, err
+    }
+    startTime, endTime, err := st.syncRange()
+    if err != nil {
+        return nil, err
+    }
+    log.Info("sync: %s, %s, %s", account, startTime, endTime)
+
+    items := make([]ItemInfo, 0)
+    collect := func(item ItemInfo) error {
+        if st.known(&item) {
+            return errSynced
+        }
+        items = append(items, item)
+        return nil
+    }
+
+    b, err := backend(account)
+    if err != nil {
+        return nil, err
+    }
+    if b != BACKEND_HTML {
+        err = getTaokeStream(ctx, account, startTime, endTime, func(item ItemInfo) error {
+            if err := collect(item); err != errSynced {
+                return err
+            }
+            return nil
+        }, nil)
+    } else {
+        days, e := chunkDays()
+        if e != nil {
+            return nil, e
+        }
+        // newest chunk first, like the pages.
+        list := chunks(startTime, endTime, days)
+        for i := len(list) - 1; i >= 0 && err == nil; i-- {
+            err = GetTaokeDetailStream(ctx, account, list[i].Start, list[i].End, collect)
+        }
+    }
+    if err != nil && err != errSynced {
+        return nil, err
+    }
+
+    items, dropped := dedupe(items)
+    logDuplicates(account, dropped)
+    st.add(items)
+    if err = st.save(); err != nil {
+        log.Error("sync state of %s not saved: %s", account, err.Error())
+        return nil, err
+    }
+    return items, nil
+}
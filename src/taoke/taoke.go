@@ -2,307 +2,338 @@ package taoke
 
 import (
     "fmt"
+    "net"
+    "sync"
+    "time"
+    "errors"
+    "context"
     "bytes"
+    "net/url"
     "common"
-    "errors"
-    "io/ioutil"
     "encoding/json"
-    "github.com/mahonia"
     log "code.google.com/p/log4go"
 )
 
-type ItemInfo struct {
-    Date string
-    Id string
-    Name string
-    ShopId string
-    ShopName string
-    Count string
-    Price string
-    State string
-    Transaction string
-    Commission string
-    Income string
+// isLoginPage also matches the captcha check alimama puts in front of
+// reports, a new login gets through it.
+func isLoginPage(body []byte) bool {
+    return bytes.Index(body, []byte("<title>阿里妈妈-阿里妈妈登录页面</title>")) != -1 ||
+        bytes.Index(body, []byte("TPL_checkcode")) != -1
 }
 
-func GetTaokeDetail(account, startTime, endTime string) (data []byte, err error) {
+// PAGE_SIZE_MAX is the most rows a report page has, whatever is asked.
+const PAGE_SIZE_MAX = 100
 
-    log.Info("request: %s, %s, %s", account, startTime, endTime)
+// pageQuery is what every page of one report request asks for.
+type pageQuery struct {
+    account string
+    report string
+    size int
+    startTime string
+    endTime string
+}
 
-    items := make([]ItemInfo, 0)
-    page := 1
-    for {
-        have := false
+// fetchPage fetches and parses one page of the report, numbering its
+// warnings with page.
+func fetchPage(ctx context.Context, q *pageQuery, page int) (*parsedPage, error) {
+    account := q.account
+    searchurl := fmt.Sprintf("%s?toPage=%d&perPageSize=%d&startTime=%s&endTime=%s", q.report, page, q.size, q.startTime, q.endTime)
 
-        searchurl := fmt.Sprintf("http://u.alimama.com/union/newreport/taobaokeDetail.htm?toPage=%d&perPageSize=20&startTime=%s&endTime=%s", page, startTime, endTime)
+    log.Error(searchurl)
 
+    resp, err := common.FetchCtx(ctx, account, common.Request{Method:"GET", URL:searchurl})
+    if err != nil {
+        return nil, err
+    }
 
-        log.Error(searchurl)
+    body := common.DecodeBody(resp.Body, resp.Header.Get("Content-Type"))
 
-        body, err := common.GetPage(account, searchurl)
-        if err != nil {
-            return nil, err
-        }
+    /* login */
 
-        i := bytes.Index(body, []byte("charset=GBK"))
-        if i != -1 {
-            d:=mahonia.NewDecoder("gbk")
-            r := d.NewReader(bytes.NewBuffer(body))
-            body, _ = ioutil.ReadAll(r)
-        }
+    if isLoginPage(body) {
+        return nil, common.ErrNeedLogin
+    }
 
-        /* login */
+    // an unknown layout logs its snippet, not the page.
+    p, err := parseReport(body)
+    if err != nil {
+        common.RecordLayout("taoke", account, "detail", common.LAYOUT_UNKNOWN)
+        log.Error("%s of %s", err.Error(), account)
+        return nil, err
+    }
+    common.RecordLayout("taoke", account, "detail", p.layout)
+    for i := range(p.warnings) {
+        w := &p.warnings[i]
+        w.Page = page
+        log.Warn("taoke detail page %d row %d of %s: %s %s", page, w.Row, account, w.Column, w.Reason)
+    }
+    return p, nil
+}
 
-        i = bytes.Index(body, []byte("<title>阿里妈妈-阿里妈妈登录页面</title>"))
-        if i != -1 {
-            return nil, errors.New("account need login.")
-        }
+// ErrPage is the error of one page of the report, once its retries are
+// used up.
+type ErrPage struct {
+    Page int
+    Err error
+}
 
-        /* when parse error, log page */
-        defer func() {
-            if data == nil {
-                log.Error(string(body))
-            }
-        }()
+func (e *ErrPage) Error() string {
+    return fmt.Sprintf("taoke detail page %d: %s", e.Page, e.Err.Error())
+}
 
-        i = bytes.Index(body, []byte("<table class=\"med-table med-list-s\">"))
-        if i == -1 {
-            return nil, errors.New("1parse taoke detail page failed")
-        }
+func (e *ErrPage) Unwrap() error {
+    return e.Err
+}
 
-        start := bytes.Index(body[i:], []byte("<tbody>"))
-        if start == -1 {
-            return nil, errors.New("2parse taoke detail page failed")
-        }
+// transient tells the page errors worth another try: a failing status
+// the site may get over, or no answer at all.
+func transient(err error) bool {
+    var upstream *common.ErrUpstreamStatus
+    if errors.As(err, &upstream) {
+        return upstream.Temporary()
+    }
+    var ne net.Error
+    var ue *url.Error
+    return errors.As(err, &ne) || errors.As(err, &ue)
+}
 
-        i = i + start + len("<tbody>")
+// fetchPageRetry is fetchPage tried again after a transient error, up to
+// page_retries times, waiting page_retry_delay doubled each time. This
+// is on top of the retries of each request, a page failing for longer
+// than those does not throw away the pages fetched before it.
+func fetchPageRetry(ctx context.Context, q *pageQuery, page int) (*parsedPage, error) {
+    retries, err := common.Conf.Int("taoke", "page_retries", 2)
+    if err != nil {
+        return nil, err
+    }
+    delay, err := common.Conf.Duration("taoke", "page_retry_delay", time.Second)
+    if err != nil {
+        return nil, err
+    }
 
-        end := bytes.Index(body[i:], []byte("</tbody>"))
-        if end == -1 {
-            return nil, errors.New("3parse taoke detail page failed")
+    for attempt := 0; ; attempt++ {
+        p, err := fetchPage(ctx, q, page)
+        if err == nil {
+            return p, nil
         }
-
-        /* error */
-        ei := bytes.Index(body[i:], []byte("<div class=\"med-tip\">")) 
-        if ei != -1 {
-            break
+        if ctx.Err() != nil || attempt >= retries || !transient(err) {
+            return nil, &ErrPage{page, err}
         }
 
-        trs := bytes.Split(bytes.TrimSpace(body[i:i+end]), []byte("<tr>"))
-
-        for _, tr := range(trs) {
-            if len(tr) == 0 {
-                continue
-            }
-
-            i = bytes.Index(tr, []byte("</tr>"))
-            if i == -1 {
-                return nil, errors.New("4parse taoke detail page failed")
-            }
-            tr = bytes.TrimSpace(tr[:i])
-
-            tds := bytes.Split(tr, []byte("<td"))
-
-            item := ItemInfo{}
-
-            for index, td := range(tds) {
-                if len(td) == 0 {
-                    continue
-                }
-                i = bytes.Index(td, []byte("</td>"))
-                if i == -1 {
-                    return nil, errors.New("5parse taoke detail page failed")
-                }
-                td = bytes.TrimSpace(td[:i])
-
-                switch index {
-                case 1:
-                    i = bytes.Index(td, []byte(">"))
-                    if i == -1 {
-                        return nil, errors.New("6parse taoke detail page failed")
-                    }
-
-                    item.Date = string(td[i+1:])
-
-                case 2:
-                    i = bytes.Index(td, []byte("id="))
-                    if i == -1 {
-                        return nil, errors.New("7parse taoke detail page failed")
-                    }
-
-                    td = td[i+3:]
-
-                    i = bytes.Index(td, []byte("\""))
-                    if i == -1 {
-                        return nil, errors.New("8parse taoke detail page failed")
-                    }
-
-                    //
-                    item.Id = string(td[:i])
-
-                    td = td[i+2:]
-
-                    i = bytes.Index(td, []byte("<"))
-                    if i == -1 {
-                        return nil, errors.New("8parse taoke detail page failed")
-                    }
-
-                    //
-                    item.Name = string(td[:i])
-
-                    td = td[i:]
-
-                    i = bytes.Index(td, []byte("oid="))
-                    if i == -1 {
-                        return nil, errors.New("8parse taoke detail page failed")
-                    }
-
-                    td = td[i+4:]
-
-                    i = bytes.Index(td, []byte("\""))
-                    if i == -1 {
-                        return nil, errors.New("8parse taoke detail page failed")
-                    }
-
-                    item.ShopId = string(td[:i])
-
-                    td = td[i:]
-
-                    i = bytes.Index(td, []byte(">"))
-                    if i == -1 {
-                        return nil, errors.New("8parse taoke detail page failed")
-                    }
-
-                    td = td[i+1:]
-
-                    i = bytes.Index(td, []byte("<"))
-                    if i == -1 {
-                        return nil, errors.New("8parse taoke detail page failed")
-                    }
-
-                    item.ShopName = string(td[:i])
-
-                case 3:
-                    i = bytes.Index(td, []byte("2\">"))
-                    if i == -1 {
-                        return nil, errors.New("9parse taoke detail page failed")
-                    }
-
-                    td = td[i+3:]
-
-                    i = bytes.Index(td, []byte("<"))
-                    if i == -1 {
-                        return nil, errors.New("10parse taoke detail page failed")
-                    }
-
-                    item.Count = string(td[:i])
-                case 4:
-                    i = bytes.Index(td, []byte("/i>"))
-                    if i == -1 {
-                        return nil, errors.New("11parse taoke detail page failed")
-                    }
-
-                    td = td[i+3:]
-
-                    i = bytes.Index(td, []byte("<"))
-                    if i == -1 {
-                        return nil, errors.New("12parse taoke detail page failed")
-                    }
-
-                    item.Price = string(td[:i])
-
-                case 5:
-                    i = bytes.Index(td, []byte("<span"))
-                    if i == -1 {
-                        log.Info(string(td))
-                        return nil, errors.New("13parse taoke detail page failed")
-                    }
-
-
-                    td = td[i:]
-
-                    i = bytes.Index(td, []byte(">"))
-                    if i == -1 {
-                        return nil, errors.New("14parse taoke detail page failed")
-                    }
+        wait := delay << uint(attempt)
+        log.Warn("taoke detail page %d of %s failed: %s, retry in %s", page, q.account, err.Error(), wait)
+        select {
+        case <-ctx.Done():
+            return nil, &ErrPage{page, err}
+        case <-time.After(wait):
+        }
+    }
+}
 
-                    td = td[i+1:]
+// pageWorkers is how many report pages of one request are fetched at
+// once; the pace of the account still spaces the requests.
+func pageWorkers() (int, error) {
+    n, err := common.Conf.Int("taoke", "page_workers", 4)
+    if err != nil {
+        return 0, err
+    }
+    if n < 1 {
+        return 0, errors.New(fmt.Sprintf("invalid page_workers %d of [taoke], expect at least 1", n))
+    }
+    return n, nil
+}
 
-                    i = bytes.Index(td, []byte("<"))
-                    if i == -1 {
-                        return nil, errors.New("15parse taoke detail page failed")
-                    }
+// pageLimits reads page_size, the rows asked per page, and max_pages,
+// beyond which a report is taken for a parser that missed its end.
+func pageLimits() (size, max int, err error) {
+    if size, err = common.Conf.Int("taoke", "page_size", PAGE_SIZE_MAX); err != nil {
+        return
+    }
+    if size < 1 || size > PAGE_SIZE_MAX {
+        return 0, 0, errors.New(fmt.Sprintf("invalid page_size %d of [taoke], expect 1 to %d", size, PAGE_SIZE_MAX))
+    }
+    if max, err = common.Conf.Int("taoke", "max_pages", 500); err != nil {
+        return
+    }
+    if max < 1 {
+        return 0, 0, errors.New(fmt.Sprintf("invalid max_pages %d of [taoke], expect at least 1", max))
+    }
+    return
+}
 
-                    item.State = string(td[:i])
+type pageResult struct {
+    page *parsedPage
+    err error
+}
 
-                case 6:
-                    continue
+// hooks get what a report has besides its items, a nil hooks or hook
+// nothing.
+type hooks struct {
+    totals func(*Totals)
+    warn func(common.RowWarning)
+}
 
-                case 7:
-                    i = bytes.Index(td, []byte("/i>"))
-                    if i == -1 {
-                        return nil, errors.New("16parse taoke detail page failed")
-                    }
+func (h *hooks) onTotals(t *Totals) {
+    if h != nil && h.totals != nil {
+        h.totals(t)
+    }
+}
 
-                    td = td[i+3:]
+func (h *hooks) onWarn(w common.RowWarning) {
+    if h != nil && h.warn != nil {
+        h.warn(w)
+    }
+}
 
-                    i = bytes.Index(td, []byte("<"))
-                    if i == -1 {
-                        return nil, errors.New("17parse taoke detail page failed")
-                    }
+// GetTaokeDetailStream fetches the report page by page, handing each item
+// to fn in report order. Pages ahead are fetched while fn gets the items
+// of earlier ones, so up to page_workers - 1 pages past the last one may
+// be requested. Rows that do not parse are left out, see detailStream
+// for their warnings. An error from fn stops the fetch, so does a report
+// of more than max_pages pages.
+func GetTaokeDetailStream(ctx context.Context, account, startTime, endTime string, fn func(ItemInfo) error) error {
+    return detailStream(ctx, account, startTime, endTime, fn, nil)
+}
 
-                    item.Transaction = string(td[:i])
-                case 8:
-                    i = bytes.Index(td, []byte("2\">"))
-                    if i == -1 {
-                        return nil, errors.New("18parse taoke detail page failed")
-                    }
+// detailStream is GetTaokeDetailStream also handing the summary row of
+// the report, when there is one, and the row warnings to h.
+func detailStream(ctx context.Context, account, startTime, endTime string, fn func(ItemInfo) error, h *hooks) error {
+    // the pages of a report are one scrape of the account.
+    ctx, release, err := common.AcquireAccount(ctx, "taoke", account)
+    if err != nil {
+        return err
+    }
+    defer release()
 
-                    td = td[i+3:]
+    log.Info("request: %s, %s, %s", account, startTime, endTime)
 
-                    i = bytes.Index(td, []byte("<"))
-                    if i == -1 {
-                        return nil, errors.New("19parse taoke detail page failed")
-                    }
+    workers, err := pageWorkers()
+    if err != nil {
+        return err
+    }
+    size, maxPages, err := pageLimits()
+    if err != nil {
+        return err
+    }
 
-                    item.Commission = string(td[:i])
-                case 9:
-                    continue
-                case 10:
-                    continue
-                case 11:
-                    i = bytes.Index(td, []byte("/i>"))
-                    if i == -1 {
-                        return nil, errors.New("20parse taoke detail page failed")
-                    }
-
-                    td = td[i+3:]
-
-                    i = bytes.Index(td, []byte("<"))
-                    if i == -1 {
-                        return nil, errors.New("21parse taoke detail page failed")
-                    }
-
-                    item.Income = string(td[:i])
-                }
-            }
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+
+    q := &pageQuery{account, reportURL(), size, startTime, endTime}
+    next := 1
+    gotTotals := false
+    var pending []chan pageResult
+    for page := 1; ; page++ {
+        // one page past max_pages tells whether there are more.
+        for len(pending) < workers && next <= maxPages + 1 {
+            ch := make(chan pageResult, 1)
+            go func(page int) {
+                p, err := fetchPageRetry(ctx, q, page)
+                ch <- pageResult{p, err}
+            }(next)
+            pending = append(pending, ch)
+            next++
+        }
 
-            have = true
+        r := <-pending[0]
+        pending = pending[1:]
+        if r.err != nil {
+            return r.err
+        }
 
-            items = append(items, item)
+        // every page repeats the summary of the whole range.
+        if r.page.totals != nil && !gotTotals {
+            h.onTotals(r.page.totals)
+            gotTotals = true
         }
 
-        if !have {
+        /* past the last page */
+        if r.page.rows == 0 {
             break
         }
+        if page > maxPages {
+            return errors.New(fmt.Sprintf("taoke report of %s from %s to %s goes on past max_pages %d, stopped; the parser may miss the last page, or raise max_pages of [taoke]", account, startTime, endTime, maxPages))
+        }
 
-        page++
+        for _, w := range(r.page.warnings) {
+            h.onWarn(w)
+        }
+        for _, item := range(r.page.items) {
+            if err = fn(item); err != nil {
+                return err
+            }
+        }
+        if err = ctx.Err(); err != nil {
+            return err
+        }
     }
 
-    data, err = json.Marshal(items)
+    return nil
+}
+
+// GetTaokeDetail is the report as a JSON array of the items filter keeps,
+// all when it is nil. A repeated order keeps its latest row, as Fetch of
+// the adapter does.
+func GetTaokeDetail(ctx context.Context, account, startTime, endTime string, filter *Filter) (data []byte, err error) {
+    items := make([]ItemInfo, 0)
+    err = getTaokeStream(ctx, account, startTime, endTime, func(item ItemInfo) error {
+        items = append(items, item)
+        return nil
+    }, nil)
     if err != nil {
         return nil, err
     }
+    items, dropped := dedupe(items)
+    logDuplicates(account, dropped)
+
+    kept := items[:0]
+    for _, item := range(items) {
+        if filter.Match(&item) {
+            kept = append(kept, item)
+        }
+    }
+
+    return json.Marshal(kept)
+}
+
+// AccountResult is the report of one account of GetAll: Data is the JSON
+// of GetTaokeDetail, unless Err stopped it.
+type AccountResult struct {
+    Data []byte
+    Err error
+}
+
+// detailRelogin is GetTaokeDetail with every item, logging account in
+// again once when its session expired.
+func detailRelogin(ctx context.Context, account, startTime, endTime string) (data []byte, err error) {
+    err = common.WithRelogin("taoke", account, func() error {
+        var e error
+        data, e = GetTaokeDetail(ctx, account, startTime, endTime, nil)
+        return e
+    })
+    return
+}
+
+// GetAll runs get for each of accounts, at most workers at once, nil get
+// being GetTaokeDetail, which logs an account whose session expired in
+// again and fetches it once more. The pace of each account still applies.
+func GetAll(ctx context.Context, accounts []string, startTime, endTime string, workers int, get common.AccountFetch) map[string]*AccountResult {
+    if get == nil {
+        get = detailRelogin
+    }
+    results := make(map[string]*AccountResult, len(accounts))
+    var lock sync.Mutex
+
+    common.EachAccount(accounts, workers, func(account string) {
+        r := &AccountResult{}
+        r.Data, r.Err = get(ctx, account, startTime, endTime)
+        if r.Err != nil {
+            log.Error("taoke %s: %s", account, r.Err.Error())
+        }
 
-    return data, nil
+        lock.Lock()
+        results[account] = r
+        lock.Unlock()
+    })
+    return results
 }
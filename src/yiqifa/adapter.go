@@ -0,0 +1,73 @@
+package yiqifa
+
+import (
+    "context"
+    "strconv"
+    "strings"
+    "common"
+)
+
+// The upstream addresses of yiqifa. The base_url and report_path options
+// of [yiqifa] replace them, eg. for a mock server.
+const BASE_URL = "http://www.yiqifa.com"
+const REPORT_PATH = "/earner/earnerExportCpsEffectOriList.do"
+
+func baseURL() string {
+    return strings.TrimSuffix(common.SiteURL("yiqifa", "base_url", BASE_URL), "/")
+}
+
+func reportURL() string {
+    return baseURL() + common.SiteURL("yiqifa", "report_path", REPORT_PATH)
+}
+
+// Items are the orders of a yiqifa export.
+type Items []CPSItem
+
+func (items Items) Len() int {
+    return len(items)
+}
+
+func (items Items) Table() (header []string, rows [][]string) {
+    header = []string{"OrderNo", "ProductNo", "Product", "Count", "Amount", "Commission", "EffectDate", "BalanceDate", "Status", "Campaign", "WebsiteId"}
+    rows = make([][]string, len(items))
+    for i, it := range(items) {
+        rows[i] = []string{it.OrderNo, it.ProductNo, it.Product, strconv.Itoa(it.Count), it.Amount.String(), it.Commission.String(), it.EffectDateString(), it.BalanceDateString(), it.Status, it.Campaign, it.WebsiteId}
+    }
+    return
+}
+
+type adapter struct{}
+
+func init() {
+    common.RegisterAdapter(adapter{})
+}
+
+func (adapter) Name() string {
+    return "yiqifa"
+}
+
+func (adapter) Login() error {
+    return common.Login("yiqifa", baseURL() + "/", baseURL() + "/")
+}
+
+func (adapter) Fetch(ctx context.Context, account, startTime, endTime string) (common.Rows, error) {
+    items := Items{}
+    err := GetCPSDetailStream(ctx, account, startTime, endTime, func(item CPSItem) error {
+        items = append(items, item)
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    return items, nil
+}
+
+func (adapter) Stream(ctx context.Context, account, startTime, endTime string, fn func(interface{}) error) error {
+    return GetCPSDetailStream(ctx, account, startTime, endTime, func(item CPSItem) error {
+        return fn(item)
+    })
+}
+
+func (adapter) HealthCheck(account string) (common.Health, error) {
+    return common.CheckAccount("yiqifa", account)
+}
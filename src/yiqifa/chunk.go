@@ -0,0 +1,58 @@
+package yiqifa
+
+import (
+    "context"
+    "common"
+    log "code.google.com/p/log4go"
+)
+
+// chunkDays is the longest range of days exported at once, 0 for no
+// limit. Exports of long ranges time out or come cut short.
+func chunkDays() (int, error) {
+    return common.ChunkDays("yiqifa", 31)
+}
+
+// GetCPSDetailStream fetches the export from startTime to endTime, in
+// ranges of chunk_days, and hands each order to fn. An order an earlier
+// range already had is not handed again; the rows of one order, one per
+// product, all are. An error from fn stops the parse.
+func GetCPSDetailStream(ctx context.Context, account, startTime, endTime string, fn func(CPSItem) error) error {
+    // the ranges are one scrape of the account.
+    ctx, release, err := common.AcquireAccount(ctx, "yiqifa", account)
+    if err != nil {
+        return err
+    }
+    defer release()
+
+    days, err := chunkDays()
+    if err != nil {
+        return err
+    }
+    list := common.DateChunks(startTime, endTime, days)
+    if len(list) == 1 {
+        return exportStream(ctx, account, startTime, endTime, fn)
+    }
+
+    log.Info("request: %s, %s, %s in %d chunks", account, startTime, endTime, len(list))
+
+    seen := make(map[string]bool)
+    for _, c := range(list) {
+        orders := make(map[string]bool)
+        err := exportStream(ctx, account, c.Start, c.End, func(item CPSItem) error {
+            if item.OrderNo != "" {
+                if seen[item.OrderNo] {
+                    return nil
+                }
+                orders[item.OrderNo] = true
+            }
+            return fn(item)
+        })
+        if err != nil {
+            return err
+        }
+        for no := range(orders) {
+            seen[no] = true
+        }
+    }
+    return nil
+}
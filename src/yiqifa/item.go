@@ -0,0 +1,166 @@
+package yiqifa
+
+import (
+    "fmt"
+    "time"
+    "strconv"
+    "strings"
+    "encoding/json"
+    "common"
+)
+
+// CPSItem is one order of the yiqifa export. Amount and Commission are
+// written as numbers, as exact as the export has them, and left out when
+// it has none.
+type CPSItem struct {
+    OrderNo string
+    ProductNo string
+    Product string
+    Count int
+    Amount json.Number `json:",omitempty"`
+    Commission json.Number `json:",omitempty"`
+    // EffectDate is when the order was placed, BalanceDate when yiqifa
+    // confirmed it, nil until then.
+    EffectDate time.Time
+    BalanceDate *time.Time `json:",omitempty"`
+    Status string
+    Campaign string
+    WebsiteId string
+    // Raw has every cell of the row by its header.
+    Raw map[string]string `json:",omitempty"`
+}
+
+// The fields of CPSItem, found by the text of the headers of the export,
+// which yiqifa reorders now and then. Keywords are tried in order, so the
+// specific ones come first: "确认时间" is no effect date, "网站佣金" is the
+// commission, not the website.
+var cpsColumns = []struct {
+    field string
+    headers []string
+    required bool
+}{
+    {"balance_date", []string{"确认时间", "结算时间", "确认日期", "结算日期"}, false},
+    {"effect_date", []string{"下单时间", "效果时间", "下单日期", "效果日期", "时间", "日期"}, true},
+    {"order_no", []string{"订单编号", "订单号"}, true},
+    {"product_no", []string{"商品编号", "商品编码", "商品ID"}, false},
+    {"count", []string{"商品数量", "数量"}, false},
+    {"commission", []string{"佣金"}, true},
+    {"amount", []string{"订单金额", "商品金额", "金额"}, false},
+    {"status", []string{"确认状态", "订单状态", "状态"}, false},
+    {"campaign", []string{"活动名称", "活动"}, false},
+    {"website_id", []string{"网站ID", "网站编号", "网站"}, false},
+    {"product", []string{"商品名称", "商品"}, false},
+}
+
+// mapColumns finds the column of each field from the header row. Columns
+// of no field are only kept in Raw; a header without a required field is
+// an ErrLayout.
+func mapColumns(header []string) (map[string]int, error) {
+    cols := make(map[string]int)
+    for i, h := range(header) {
+        h = strings.Join(strings.Fields(h), "")
+        for _, c := range(cpsColumns) {
+            if _, ok := cols[c.field]; ok {
+                continue
+            }
+            matched := false
+            for _, k := range(c.headers) {
+                if strings.Contains(h, k) {
+                    matched = true
+                    break
+                }
+            }
+            if matched {
+                cols[c.field] = i
+                break
+            }
+        }
+    }
+    var missing []string
+    for _, c := range(cpsColumns) {
+        if _, ok := cols[c.field]; c.required && !ok {
+            missing = append(missing, c.field)
+        }
+    }
+    if len(missing) > 0 {
+        return nil, &common.ErrLayout{Page:"yiqifa report", Snippet:fmt.Sprintf("no %s column in header %s", strings.Join(missing, ", "), strings.Join(header, "|"))}
+    }
+    return cols, nil
+}
+
+var exportZone = time.FixedZone("CST", 8 * 3600)
+
+var dateLayouts = []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+func parseDate(s string) (time.Time, bool) {
+    s = strings.TrimSpace(s)
+    for _, layout := range(dateLayouts) {
+        if t, err := time.ParseInLocation(layout, s, exportZone); err == nil {
+            return t, true
+        }
+    }
+    return time.Time{}, false
+}
+
+// parseNumber drops the thousands separators and the yuan sign of s, it
+// is empty when s is no number.
+func parseNumber(s string) json.Number {
+    s = strings.TrimSpace(strings.Replace(s, ",", "", -1))
+    s = strings.TrimSpace(strings.TrimLeft(s, "¥￥"))
+    if _, err := strconv.ParseFloat(s, 64); err != nil {
+        return ""
+    }
+    return json.Number(s)
+}
+
+// cpsItem reads a row of the export with the columns mapColumns found in
+// header.
+func cpsItem(cols map[string]int, header, row []string) CPSItem {
+    cell := func(field string) string {
+        if i, ok := cols[field]; ok && i < len(row) {
+            return strings.TrimSpace(row[i])
+        }
+        return ""
+    }
+
+    item := CPSItem{
+        OrderNo:cell("order_no"),
+        ProductNo:cell("product_no"),
+        Product:cell("product"),
+        Amount:parseNumber(cell("amount")),
+        Commission:parseNumber(cell("commission")),
+        Status:cell("status"),
+        Campaign:cell("campaign"),
+        WebsiteId:cell("website_id"),
+        Raw:make(map[string]string),
+    }
+    item.Count, _ = strconv.Atoi(cell("count"))
+    item.EffectDate, _ = parseDate(cell("effect_date"))
+    if t, ok := parseDate(cell("balance_date")); ok {
+        item.BalanceDate = &t
+    }
+    for i, h := range(header) {
+        if i < len(row) && h != "" {
+            item.Raw[h] = row[i]
+        }
+    }
+    return item
+}
+
+func formatDate(t *time.Time) string {
+    if t == nil || t.IsZero() {
+        return ""
+    }
+    return t.In(exportZone).Format(dateLayouts[0])
+}
+
+// EffectDateString is the order time as the export writes it.
+func (item *CPSItem) EffectDateString() string {
+    return formatDate(&item.EffectDate)
+}
+
+// BalanceDateString is the confirm time as the export writes it, empty
+// while the order is not confirmed.
+func (item *CPSItem) BalanceDateString() string {
+    return formatDate(item.BalanceDate)
+}
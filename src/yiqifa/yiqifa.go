@@ -3,67 +3,196 @@ package yiqifa
 import (
     "fmt"
     "errors"
+    "context"
     "common"
     "archive/zip"
+    "io"
     "bytes"
-    "io/ioutil"
+    "bufio"
+    "encoding/csv"
     "encoding/json"
-    "github.com/mahonia"
     log "code.google.com/p/log4go"
 )
 
-func GetCPSDetail(account, startTime, endTime string) (data []byte, err error) {
+// SNIPPET_SIZE is about how much of a page an ErrParse shows.
+const SNIPPET_SIZE = 400
+
+func init() {
+    common.RegisterLoginCheck("yiqifa", isLoginPage)
+}
+
+func isLoginPage(body []byte) bool {
+    return bytes.Index(common.DecodeBody(body, ""), []byte("会员登录")) != -1
+}
+
+// exportStream fetches the export of one range and hands each order to
+// fn. An error from fn stops the parse.
+func exportStream(ctx context.Context, account, startTime, endTime string, fn func(CPSItem) error) error {
     log.Info("request: %s, %s, %s", account, startTime, endTime)
 
-    searchurl := fmt.Sprintf("http://www.yiqifa.com/earner/earnerExportCpsEffectOriList.do?schStartDate=&schEndDate=&back=&effectDateOrderby=&balanceDateOrderby=&commissionOrderby=&orderNoOrderby=&productNoOrderby=&sysWebsiteCommisionOrderby=&pageNumber=1&pageSize=10&searchOption=orderNo&startDate=%s&endDate=%s&startConfirmDate=&endConfirmDate=&websiteId=&campaignType=&campaignName=&schCampaignId=0&searchOptionValue=&confirmStatus=&dataSourceType=&perSize=10&perSize2=10", startTime, endTime)
+    searchurl := fmt.Sprintf("%s?schStartDate=&schEndDate=&back=&effectDateOrderby=&balanceDateOrderby=&commissionOrderby=&orderNoOrderby=&productNoOrderby=&sysWebsiteCommisionOrderby=&pageNumber=1&pageSize=10&searchOption=orderNo&startDate=%s&endDate=%s&startConfirmDate=&endConfirmDate=&websiteId=&campaignType=&campaignName=&schCampaignId=0&searchOptionValue=&confirmStatus=&dataSourceType=&perSize=10&perSize2=10", reportURL(), startTime, endTime)
 
-    body, err := common.GetPage(account, searchurl)
+    resp, err := common.FetchCtx(ctx, account, common.Request{Method:"GET", URL:searchurl})
     if err != nil {
         log.Info(err)
-        return nil, err
+        return err
     }
+    body := resp.Body
 
     r, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
     if err != nil {
-
-        d:=mahonia.NewDecoder("gbk")
-        r := d.NewReader(bytes.NewBuffer(body))
-        body, _ = ioutil.ReadAll(r)
-
+        body = common.DecodeBody(body, resp.Header.Get("Content-Type"))
+        if !isHTML(body) {
+            // the export, unzipped.
+            return parseExport(bytes.NewReader(body), fn)
+        }
         if bytes.Index(body, []byte("会员登录")) != -1 {
-            return nil, errors.New("account need login.")
+            return common.ErrNeedLogin
         }
-
-        /* login failed */
-        log.Error(string(body))
-        return nil, errors.New("fetch failed.")
+        if err = sitePage(body); err != nil {
+            log.Error("%s of %s", err.Error(), account)
+            return err
+        }
+        return &common.ErrParse{Page:"yiqifa report", Expected:"a zip or csv export", Excerpt:common.Snippet(body, SNIPPET_SIZE, "<body")}
     }
 
-    for _, f := range r.File {
+    // the entries are decoded and read as they are inflated, the export is
+    // never held whole, only the zip of it.
+    for _, f := range(r.File) {
         rc, err := f.Open()
         if err != nil {
-            log.Info(err)
+            log.Error("open %s of the export of %s: %s", f.Name, account, err.Error())
+            return err
         }
+        err = parseExport(common.DecodeReader(rc, ""), fn)
+        rc.Close()
+        if err != nil {
+            return err
+        }
+    }
 
-        body, err = ioutil.ReadAll(rc)
+    return nil
+}
 
-        d:=mahonia.NewDecoder("gbk")
-        r := d.NewReader(bytes.NewBuffer(body))
-        body, _ = ioutil.ReadAll(r)
+// parseExport hands the orders of a decoded export file to fn, one row at
+// a time. The first row is the header, the last a summary, not an order.
+func parseExport(r io.Reader, fn func(CPSItem) error) error {
+    br := bufio.NewReader(r)
+    if bom, _ := br.Peek(3); bytes.Equal(bom, []byte("\xef\xbb\xbf")) {
+        br.Discard(3)
+    }
+    tail := &tailReader{r:br, line:1}
+    cr := csv.NewReader(tail)
+    cr.FieldsPerRecord = -1
 
-        rc.Close()
+    var header, held []string
+    var cols map[string]int
+    for {
+        row, err := cr.Read()
+        if err == io.EOF {
+            // held is the summary.
+            return nil
+        }
+        var pe *csv.ParseError
+        if errors.As(err, &pe) {
+            return &common.ErrParse{Page:"yiqifa report", Row:pe.Line, Column:pe.Column, Expected:"csv fields, " + pe.Err.Error(), Excerpt:common.Snippet(tail.lineAt(pe.Line), SNIPPET_SIZE)}
+        }
+        if err != nil {
+            return err
+        }
+        if header == nil {
+            header = row
+            continue
+        }
+        if held != nil {
+            // a file of a header and its summary has no columns to map.
+            if cols == nil {
+                if cols, err = mapColumns(header); err != nil {
+                    return err
+                }
+            }
+            if err = fn(cpsItem(cols, header, held)); err != nil {
+                return err
+            }
+        }
+        held = row
+    }
+}
+
+// TAIL_SIZE is how much of the export a tailReader keeps to show the line
+// the csv reader failed on.
+const TAIL_SIZE = 64 * 1024
+
+// tailReader keeps the last TAIL_SIZE bytes read from r, line is the
+// number of the first line of them.
+type tailReader struct {
+    r io.Reader
+    tail []byte
+    line int
+}
+
+func (t *tailReader) Read(p []byte) (int, error) {
+    n, err := t.r.Read(p)
+    t.tail = append(t.tail, p[:n]...)
+    if cut := len(t.tail) - TAIL_SIZE; cut > 0 {
+        t.line += bytes.Count(t.tail[:cut], []byte("\n"))
+        t.tail = append(t.tail[:0], t.tail[cut:]...)
+    }
+    return n, err
+}
+
+// lineAt is line n if it is still kept, nil when not.
+func (t *tailReader) lineAt(n int) []byte {
+    lines := bytes.Split(t.tail, []byte("\n"))
+    if i := n - t.line; n > 0 && i >= 0 && i < len(lines) {
+        return lines[i]
     }
+    return nil
+}
+
+// isHTML tells a page from a csv export by its first bytes.
+func isHTML(body []byte) bool {
+    head := body
+    if len(head) > 1024 {
+        head = head[:1024]
+    }
+    head = bytes.ToLower(bytes.TrimSpace(bytes.TrimPrefix(head, []byte("\xef\xbb\xbf"))))
+    return bytes.HasPrefix(head, []byte("<")) || bytes.Contains(head, []byte("<html"))
+}
+
+// siteWords are what the pages of yiqifa say when it has no export to
+// give, by the error they are.
+var siteWords = []struct {
+    err error
+    words []string
+}{
+    {common.ErrMaintenance, []string{"系统维护", "维护中", "升级维护", "暂停服务"}},
+    {common.ErrRateLimited, []string{"过于频繁", "访问频繁", "请求太多"}},
+    {common.ErrDenied, []string{"没有权限", "无权", "权限不足", "拒绝访问", "Access Denied"}},
+}
 
-    lines := bytes.Split(body, []byte("\n"))
-    lines = lines[:len(lines)-2]
-    items := make([][]string, len(lines))
-    for i, line := range(lines) {
-        cols := bytes.Split(line, []byte(","))
-        items[i] = make([]string, len(cols))
-        for j, col := range(cols) {
-            items[i][j] = string(col[1:len(col)-1])
+// sitePage is the ErrSitePage of a page in place of the export, nil when
+// it says nothing known.
+func sitePage(body []byte) error {
+    for _, s := range(siteWords) {
+        for _, w := range(s.words) {
+            if bytes.Contains(body, []byte(w)) {
+                return &common.ErrSitePage{Page:"yiqifa report", Err:s.err, Excerpt:common.Snippet(body, SNIPPET_SIZE, w)}
+            }
         }
     }
+    return nil
+}
+
+func GetCPSDetail(ctx context.Context, account, startTime, endTime string) (data []byte, err error) {
+    items := make([]CPSItem, 0)
+    err = GetCPSDetailStream(ctx, account, startTime, endTime, func(item CPSItem) error {
+        items = append(items, item)
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
 
     data, err = json.Marshal(items)
     if err != nil {